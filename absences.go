@@ -0,0 +1,257 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// The absence report lists the enabled users without any punch on the
+// workdays of a period: the days of their Workweek except the holidays
+// the admins enter. Days from today on are never absences, as the day
+// isn't over yet.
+
+// Holiday is a company holiday, keyed by its date as 2006-01-02.
+type Holiday struct {
+	Name string `datastore:",noindex"`
+}
+
+func holidayKey(c appengine.Context, date string) *datastore.Key {
+	return datastore.NewKey(c, "Holiday", date, 0, punchKey(c))
+}
+
+// findHolidays returns the holidays by date.
+func findHolidays(c appengine.Context) (map[string]string, error) {
+	var holidays []Holiday
+	keys, err := datastore.NewQuery("Holiday").Ancestor(punchKey(c)).GetAll(c, &holidays)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(keys))
+	for i, key := range keys {
+		names[key.StringID()] = holidays[i].Name
+	}
+	return names, nil
+}
+
+type HolidayJSON struct {
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+type HolidaysResponse struct {
+	Holidays []HolidayJSON `json:"holidays"`
+}
+
+type HolidayResponse struct {
+	Holiday HolidayJSON `json:"holiday"`
+}
+
+type HolidayRequest struct {
+	Date string `form:"date"`
+	Name string `form:"name"`
+}
+
+func apiAdminHolidaysHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method == "GET" {
+		var holidays []Holiday
+		keys, err := datastore.NewQuery("Holiday").Ancestor(punchKey(c)).Order("__key__").GetAll(c, &holidays)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the holidays from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		res := HolidaysResponse{Holidays: make([]HolidayJSON, 0, len(keys))}
+		for i, key := range keys {
+			res.Holidays = append(res.Holidays, HolidayJSON{Date: key.StringID(), Name: holidays[i].Name})
+		}
+		return res, nil
+	} else if r.Method != "PUT" && r.Method != "POST" && r.Method != "DELETE" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	var req HolidayRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	if _, err := time.Parse("2006-01-02", req.Date); err != nil {
+		return nil, formValueError(err, "date", `Failed to parse the "%s" parameter as a date (YYYY-MM-DD)`)
+	}
+	key := holidayKey(c, req.Date)
+	if r.Method == "DELETE" {
+		if err := datastore.Delete(c, key); err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to delete the holiday from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return HolidayResponse{Holiday: HolidayJSON{Date: req.Date, Name: req.Name}}, nil
+	}
+	if _, err := datastore.Put(c, key, &Holiday{Name: req.Name}); err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to put the holiday to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return HolidayResponse{Holiday: HolidayJSON{Date: req.Date, Name: req.Name}}, nil
+}
+
+type AbsenceReportRequest struct {
+	From string `form:"from"`
+	To   string `form:"to"`
+}
+
+type AbsenceJSON struct {
+	Puncher string   `json:"puncher"`
+	Name    string   `json:"name"`
+	Dates   []string `json:"dates"`
+}
+
+type AbsenceReportResponse struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Workdays is the number of workdays of the organization's workweek
+	// up to yesterday.
+	Workdays int           `json:"workdays"`
+	Absences []AbsenceJSON `json:"absences"`
+}
+
+// table has a row per absence.
+func (res *AbsenceReportResponse) table() [][]string {
+	rows := [][]string{{"date", "email", "name"}}
+	for _, a := range res.Absences {
+		for _, date := range a.Dates {
+			rows = append(rows, []string{date, a.Puncher, a.Name})
+		}
+	}
+	return rows
+}
+
+// buildAbsenceReport reports the dates from and to of req, both
+// inclusive, in the location of now. The users are in name order.
+func buildAbsenceReport(c appengine.Context, req *AbsenceReportRequest, now time.Time) (*AbsenceReportResponse, *appError) {
+	from, to, appErr := statsRange(req.From, req.To, now)
+	if appErr != nil {
+		return nil, appErr
+	}
+	res := &AbsenceReportResponse{
+		From:     from.Format("2006-01-02"),
+		To:       to.Format("2006-01-02"),
+		Absences: []AbsenceJSON{},
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if !to.Before(today) {
+		to = today.AddDate(0, 0, -1)
+	}
+
+	holidays, err := findHolidays(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the holidays from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	ww, err := findWorkweeks(c)
+	if err != nil {
+		return nil, workweekError(err)
+	}
+	var days []time.Time
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+		if ww.org.isWorkday(day, holidays) {
+			res.Workdays++
+		}
+	}
+	if len(days) == 0 {
+		return res, nil
+	}
+
+	enabled := true
+	_, users, err := findUsers(c, userQuery{Enabled: &enabled})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	_, punches, err := findPunches(c, punchQuery{From: from, To: to.AddDate(0, 0, 1), Fields: sessionFields})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	punched := make(map[string]bool)
+	for _, p := range punches {
+		punched[p.Puncher+" "+p.Time.In(now.Location()).Format("2006-01-02")] = true
+	}
+	for _, u := range users {
+		a := AbsenceJSON{Puncher: u.Email, Name: u.Name}
+		week := ww.of(u.Email)
+		for _, day := range days {
+			date := day.Format("2006-01-02")
+			if week.isWorkday(day, holidays) && !punched[u.Email+" "+date] {
+				a.Dates = append(a.Dates, date)
+			}
+		}
+		if len(a.Dates) > 0 {
+			res.Absences = append(res.Absences, a)
+		}
+	}
+	return res, nil
+}
+
+func apiAdminAbsenceReportHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	var req AbsenceReportRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	return buildAbsenceReport(c, &req, requestViewer(r).Now())
+}
+
+// adminAbsenceReportHandler shows the absence report of a period, or with
+// format=csv downloads it with a row per absence.
+func adminAbsenceReportHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	var req AbsenceReportRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return appErr
+	}
+	report, appErr := buildAbsenceReport(c, &req, requestViewer(r).Now())
+	if appErr != nil {
+		return appErr
+	}
+
+	if r.FormValue("format") == "csv" {
+		name := "timecard-absences-" + report.From + "-" + report.To
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		if err := writeTable(w, "csv", report); err != nil {
+			c.Errorf("failed to write the absence report: %v", err)
+		}
+		return nil
+	}
+
+	query := url.Values{"from": {report.From}, "to": {report.To}, "format": {"csv"}}
+	data := map[string]interface{}{
+		"Report": report,
+		"CSVURL": "/admin/reports/absences?" + query.Encode(),
+	}
+	return renderTemplate(c, w, r, absenceReportTemplate, data)
+}
+
+var absenceReportTemplate = parsePage("absence_report")
@@ -0,0 +1,110 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// Admins of the App Engine project are always admins of the app. Other
+// users are admins when their User entity has the Admin flag, which an
+// admin sets on the users page. The first project admin to visit the app
+// gets a User entity with the flag, so that the app, and each tenant, has
+// an admin from the start.
+//
+// app.yaml only requires a login for the admin paths, and appHandler and
+// apiHandler check that the user is an admin.
+
+var adminPathPattern = regexp.MustCompile(`^/(api/(v[0-9]+/)?)?admin/`)
+
+// adminBootstrapped has the namespaces in which this instance has seen
+// an app admin, so that later requests don't look for one again.
+var adminBootstrapped = struct {
+	sync.Mutex
+	done map[string]bool
+}{done: make(map[string]bool)}
+
+// isAdmin reports whether the current user may use the admin pages.
+func isAdmin(c appengine.Context) (bool, error) {
+	if user.IsAdmin(c) {
+		return true, nil
+	}
+	_, u, err := findUserByEmail(c, user.Current(c).Email)
+	if err != nil || u == nil {
+		return false, err
+	}
+	return u.Admin && u.Enabled, nil
+}
+
+// checkAdmin fails requests for the admin paths from users who aren't
+// admins.
+func checkAdmin(c appengine.Context, r *http.Request) *appError {
+	if !adminPathPattern.MatchString(r.URL.Path) {
+		return nil
+	}
+	ok, err := isAdmin(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if !ok {
+		err := errors.New("Only admins can use this page")
+		return &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusForbidden,
+		}
+	}
+	return nil
+}
+
+// bootstrapAdmin makes the current user, a project admin, an app admin
+// if the app has none yet. Failures are only logged since project admins
+// are admins anyway.
+func bootstrapAdmin(c appengine.Context) {
+	adminBootstrapped.Lock()
+	defer adminBootstrapped.Unlock()
+	ns := contextNamespace(c)
+	if adminBootstrapped.done[ns] || !user.IsAdmin(c) {
+		return
+	}
+	email := user.Current(c).Email
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		q := datastore.NewQuery("User").Ancestor(punchKey(tc)).Filter("Admin =", true).KeysOnly().Limit(1)
+		keys, err := q.GetAll(tc, nil)
+		if err != nil || len(keys) > 0 {
+			return err
+		}
+		key, u, err := findUserByEmail(tc, email)
+		if err != nil {
+			return err
+		}
+		if u == nil {
+			key = datastore.NewIncompleteKey(tc, "User", punchKey(tc))
+			u = &User{Email: email, Name: strings.SplitN(email, "@", 2)[0]}
+		}
+		u.Admin, u.Enabled = true, true
+		u.Version++
+		u.Updated = time.Now()
+		_, err = datastore.Put(tc, key, u)
+		if err == nil {
+			c.Infof("made %s the first admin", email)
+		}
+		return err
+	}, nil)
+	if err != nil {
+		c.Errorf("failed to bootstrap the first admin: %v", err)
+		return
+	}
+	adminBootstrapped.done[ns] = true
+}
@@ -0,0 +1,237 @@
+package timecard
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"appengine"
+)
+
+// The anomaly report flags the punches of a period that are worth a
+// look, whether they are mistakes or abuse: sessions longer than the
+// MaxSessionHours of the org settings, arrivals without a leave, arrivals
+// far from the usual arrival time of the puncher, and punches at the
+// same time of day to the second as another of the puncher's.
+
+const (
+	anomalyLongSession     = "long_session"
+	anomalyMissingLeave    = "missing_leave"
+	anomalyUnusualArrival  = "unusual_arrival"
+	anomalyRepeatedTime    = "repeated_time"
+	anomalyHistoryDays     = 90
+	minUsualArrivalSamples = 10
+	// An arrival is unusual when it is further from the mean arrival time
+	// than unusualArrivalDeviations standard deviations and than
+	// minUnusualArrivalOffset.
+	unusualArrivalDeviations = 3
+	minUnusualArrivalOffset  = 2 * time.Hour
+)
+
+type AnomalyReportRequest struct {
+	From string `form:"from"`
+	To   string `form:"to"`
+}
+
+type AnomalyJSON struct {
+	// Type is long_session, missing_leave, unusual_arrival or
+	// repeated_time.
+	Type    string    `json:"type"`
+	Puncher string    `json:"puncher"`
+	Name    string    `json:"name"`
+	PunchID int64     `json:"punch_id"`
+	Time    time.Time `json:"time"`
+	// Minutes is the length of a long session.
+	Minutes int `json:"minutes,omitempty"`
+	// Usual is the mean arrival time of the puncher, as 15:04, for an
+	// unusual arrival.
+	Usual string `json:"usual,omitempty"`
+	// Count is the number of punches at the same time of day, for a
+	// repeated time.
+	Count int `json:"count,omitempty"`
+}
+
+type AnomalyReportResponse struct {
+	From            string        `json:"from"`
+	To              string        `json:"to"`
+	MaxSessionHours int           `json:"max_session_hours"`
+	Anomalies       []AnomalyJSON `json:"anomalies"`
+}
+
+// table has a row per anomaly.
+func (res *AnomalyReportResponse) table() [][]string {
+	rows := [][]string{{"time", "type", "email", "name", "punch_id", "minutes", "usual", "count"}}
+	for _, a := range res.Anomalies {
+		rows = append(rows, []string{
+			a.Time.Format(time.RFC3339), a.Type, a.Puncher, a.Name, strconv.FormatInt(a.PunchID, 10),
+			strconv.Itoa(a.Minutes), a.Usual, strconv.Itoa(a.Count),
+		})
+	}
+	return rows
+}
+
+type anomaliesByTime []AnomalyJSON
+
+func (a anomaliesByTime) Len() int           { return len(a) }
+func (a anomaliesByTime) Less(i, j int) bool { return a[i].Time.Before(a[j].Time) }
+func (a anomaliesByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// buildAnomalyReport reports the anomalies of the punches from and to of
+// req, both inclusive, in the location of now, in time order. The usual
+// arrival time of a puncher is from their arrivals of the
+// anomalyHistoryDays before the period and of the period itself.
+func buildAnomalyReport(c appengine.Context, req *AnomalyReportRequest, now time.Time) (*AnomalyReportResponse, *appError) {
+	from, to, appErr := statsRange(req.From, req.To, now)
+	if appErr != nil {
+		return nil, appErr
+	}
+	settings, err := getOrgSettings(c)
+	if err != nil {
+		return nil, orgSettingsError(err)
+	}
+	res := &AnomalyReportResponse{
+		From:            from.Format("2006-01-02"),
+		To:              to.Format("2006-01-02"),
+		MaxSessionHours: settings.MaxSessionHours,
+		Anomalies:       []AnomalyJSON{},
+	}
+	end := to.AddDate(0, 0, 1)
+	keys, punches, err := findPunches(c, punchQuery{From: from.AddDate(0, 0, -anomalyHistoryDays), To: end})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	names, err := userNames(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	add := func(a AnomalyJSON, i int) {
+		a.Puncher = punches[i].Puncher
+		a.Name = names[a.Puncher]
+		a.PunchID = keys[i].IntID()
+		a.Time = punches[i].Time
+		res.Anomalies = append(res.Anomalies, a)
+	}
+	inPeriod := func(i int) bool {
+		return !punches[i].Time.Before(from)
+	}
+
+	// The punches are in time order, so the arrivals are paired with
+	// their leaves like pairSessions does.
+	maxSession := time.Duration(settings.MaxSessionHours) * time.Hour
+	open := make(map[string]int)
+	arrivals := make(map[string][]int)
+	repeated := make(map[string][]int)
+	for i, p := range punches {
+		arrival, isOpen := open[p.Puncher]
+		switch p.Type {
+		case "arrival":
+			if isOpen && inPeriod(arrival) {
+				add(AnomalyJSON{Type: anomalyMissingLeave}, arrival)
+			}
+			open[p.Puncher] = i
+			arrivals[p.Puncher] = append(arrivals[p.Puncher], i)
+		case "leave":
+			if isOpen {
+				if d := p.Time.Sub(punches[arrival].Time); d > maxSession && inPeriod(arrival) {
+					add(AnomalyJSON{Type: anomalyLongSession, Minutes: int(d / time.Minute)}, arrival)
+				}
+				delete(open, p.Puncher)
+			}
+		}
+		// Punches recorded by admins are often typed in at round times.
+		if inPeriod(i) && p.RecordedBy == "" {
+			k := p.Puncher + " " + p.Type + " " + p.Time.In(now.Location()).Format("15:04:05")
+			repeated[k] = append(repeated[k], i)
+		}
+	}
+	for _, arrival := range open {
+		if inPeriod(arrival) && now.Sub(punches[arrival].Time) > maxSession {
+			add(AnomalyJSON{Type: anomalyMissingLeave}, arrival)
+		}
+	}
+	for _, same := range repeated {
+		if len(same) < 2 {
+			continue
+		}
+		for _, i := range same {
+			add(AnomalyJSON{Type: anomalyRepeatedTime, Count: len(same)}, i)
+		}
+	}
+
+	for _, indexes := range arrivals {
+		if len(indexes) < minUsualArrivalSamples {
+			continue
+		}
+		minutes := make([]float64, len(indexes))
+		var sum float64
+		for j, i := range indexes {
+			t := punches[i].Time.In(now.Location())
+			minutes[j] = float64(t.Hour()*60 + t.Minute())
+			sum += minutes[j]
+		}
+		mean := sum / float64(len(minutes))
+		var squares float64
+		for _, m := range minutes {
+			squares += (m - mean) * (m - mean)
+		}
+		limit := math.Max(unusualArrivalDeviations*math.Sqrt(squares/float64(len(minutes))), minUnusualArrivalOffset.Minutes())
+		usual := time.Date(2000, 1, 1, 0, int(mean+0.5), 0, 0, time.UTC).Format("15:04")
+		for j, i := range indexes {
+			if inPeriod(i) && math.Abs(minutes[j]-mean) > limit {
+				add(AnomalyJSON{Type: anomalyUnusualArrival, Usual: usual}, i)
+			}
+		}
+	}
+	sort.Stable(anomaliesByTime(res.Anomalies))
+	return res, nil
+}
+
+func apiAdminAnomalyReportHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	var req AnomalyReportRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	return buildAnomalyReport(c, &req, requestViewer(r).Now())
+}
+
+// adminAnomalyReportHandler shows the anomaly report of a period, or with
+// format=csv downloads it.
+func adminAnomalyReportHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	var req AnomalyReportRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return appErr
+	}
+	report, appErr := buildAnomalyReport(c, &req, requestViewer(r).Now())
+	if appErr != nil {
+		return appErr
+	}
+
+	if r.FormValue("format") == "csv" {
+		name := "timecard-anomalies-" + report.From + "-" + report.To
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		if err := writeTable(w, "csv", report); err != nil {
+			c.Errorf("failed to write the anomaly report: %v", err)
+		}
+		return nil
+	}
+
+	query := url.Values{"from": {report.From}, "to": {report.To}, "format": {"csv"}}
+	data := map[string]interface{}{
+		"Report": report,
+		"CSVURL": "/admin/reports/anomalies?" + query.Encode(),
+	}
+	return renderTemplate(c, w, r, anomalyReportTemplate, data)
+}
+
+var anomalyReportTemplate = parsePage("anomaly_report")
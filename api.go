@@ -0,0 +1,467 @@
+package timecard
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+type apiHandler func(appengine.Context, http.ResponseWriter, *http.Request) (jsonData interface{}, error *appError)
+
+func (fn apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	l := startRequestLog(c, w, r)
+	defer l.finish()
+	u := user.Current(c)
+	if u == nil {
+		err := errors.New("login needed")
+		handleAPIError(c, l, r, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusUnauthorized,
+		})
+		return
+	}
+	c, appErr := tenantContext(c, r)
+	if appErr != nil {
+		handleAPIError(appengine.NewContext(r), l, r, appErr)
+		return
+	}
+	if appErr := checkSignIn(c); appErr != nil {
+		handleAPIError(c, l, r, appErr)
+		return
+	}
+	bootstrapAdmin(c)
+	if appErr := checkAdmin(c, r); appErr != nil {
+		handleAPIError(c, l, r, appErr)
+		return
+	}
+	defer loadRequestSettings(c, r, u.Email)()
+	format, explicit, appErr := apiResponseFormat(r)
+	if appErr != nil {
+		handleAPIError(c, l, r, appErr)
+		return
+	}
+
+	jsonData, appErr := fn(c, l, r)
+	if appErr != nil {
+		handleAPIError(c, l, r, appErr)
+		return
+	}
+	writeAPIResponse(c, l, r, jsonData, format, explicit)
+}
+
+// apiResponseFormat returns the format of the response to r, which is
+// negotiated for GET requests. Other requests are answered in JSON.
+func apiResponseFormat(r *http.Request) (format string, explicit bool, appErr *appError) {
+	if r.Method != "GET" {
+		return "json", false, nil
+	}
+	return responseFormat(r)
+}
+
+// writeAPIResponse sends jsonData in format, or in JSON if it isn't a
+// table and the format was only asked for by the Accept header. w must
+// come from startRequestLog.
+//
+// GET responses carry the hash of their body as a strong ETag, and are
+// answered with 304 Not Modified when it is one of the If-None-Match
+// header, so that polling clients don't download the same body again.
+// There is no Last-Modified since corrections and the trash change
+// responses without moving any punch time.
+func writeAPIResponse(c appengine.Context, w *requestLogger, r *http.Request, jsonData interface{}, format string, explicit bool) {
+	t, ok := jsonData.(tabular)
+	if ok {
+		w.Header().Set("Vary", "Accept")
+	}
+	if format != "json" && !ok && explicit {
+		handleAPIError(c, w, r, &appError{
+			Error:   fmt.Errorf("%T isn't a table", jsonData),
+			Message: `The "format" parameter must be json for this endpoint`,
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	b := &bufferedResponse{ResponseWriter: w}
+	var err error
+	if format != "json" && ok {
+		err = writeTable(b, format, t)
+	} else {
+		err = writeJsonResponse(b, jsonData)
+	}
+	if err != nil {
+		w.fail(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == "GET" {
+		sum := sha256.Sum256(b.body.Bytes())
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+		// Responses are of the signed-in user, and revalidated every time.
+		w.Header().Set("Cache-Control", "private, no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if _, err := b.body.WriteTo(w); err != nil {
+		w.fail(err)
+	}
+}
+
+// bufferedResponse keeps the body written to it, so that it can be
+// hashed before it is sent.
+type bufferedResponse struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// etagMatches tells if the If-None-Match header lists etag, comparing
+// weakly as RFC 7232 asks.
+func etagMatches(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// apiNotFoundHandler answers API paths that no route is registered for.
+func apiNotFoundHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	err := errors.New("No such API endpoint")
+	return nil, &appError{
+		Error:   fmt.Errorf("no API route for %s", r.URL.Path),
+		Message: err.Error(),
+		Code:    http.StatusNotFound,
+	}
+}
+
+// handleAPIError sends e in the JSON error envelope. w must come from
+// startRequestLog.
+func handleAPIError(c appengine.Context, w http.ResponseWriter, r *http.Request, e *appError) {
+	if l, ok := w.(*requestLogger); ok {
+		l.fail(e.Error)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Code)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error: ErrorJSON{Code: e.Code, Message: e.localMessage(r), RequestID: responseRequestID(w)},
+	})
+}
+
+func writeJsonResponse(w http.ResponseWriter, jsonData interface{}) error {
+	w.Header().Add("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(jsonData)
+}
+
+// apiVersion is a group of API routes served under /api/<name>.
+// Each incompatible change to the response shapes gets a new version
+// so that existing clients keep working against the old one.
+type apiVersion struct {
+	name   string
+	routes []apiRoute
+}
+
+type apiRoute struct {
+	pattern    string
+	handler    apiHandler
+	operations []apiOperation
+	deprecated bool
+}
+
+// apiOperation describes one method of a route for the OpenAPI
+// document. Request and Response are zero values of the typed structs
+// the handler decodes and returns.
+type apiOperation struct {
+	Method   string
+	Summary  string
+	Request  interface{}
+	Response interface{}
+}
+
+var apiV1 = &apiVersion{name: "v1"}
+
+func (v *apiVersion) prefix() string {
+	return "/api/" + v.name
+}
+
+func (v *apiVersion) handle(pattern string, h apiHandler, ops ...apiOperation) {
+	v.routes = append(v.routes, apiRoute{pattern: pattern, handler: h, operations: ops})
+	http.Handle(v.prefix()+pattern, h)
+}
+
+// handleDeprecated registers the unversioned legacy path for a route
+// already registered in v. Responses carry a Deprecation header and a
+// Link to the versioned successor so clients can migrate.
+func (v *apiVersion) handleDeprecated(pattern string) {
+	for i := range v.routes {
+		if v.routes[i].pattern == pattern {
+			v.routes[i].deprecated = true
+			h := v.routes[i].handler
+			successor := v.prefix() + pattern
+			http.Handle("/api"+pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Deprecation", "true")
+				w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+				h.ServeHTTP(w, r)
+			}))
+			return
+		}
+	}
+	panic("timecard: no " + v.name + " API route for " + pattern)
+}
+
+// decodeForm fills the fields of the struct pointed to by dst from the
+// form values named by their `form` tags. Fields whose value is absent
+// keep their current value, so callers set defaults before decoding.
+func decodeForm(r *http.Request, dst interface{}) *appError {
+	rv := reflect.ValueOf(dst).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		name := rt.Field(i).Tag.Get("form")
+		if name == "" {
+			continue
+		}
+		strValue := r.FormValue(name)
+		if strValue == "" {
+			continue
+		}
+		f := rv.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(strValue)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(strValue)
+			if err != nil {
+				return formValueError(err, name, `Failed to parse the "%s" parameter as a boolean value`)
+			}
+			f.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(strValue, 10, 64)
+			if err != nil {
+				return formValueError(err, name, `Failed to parse the "%s" parameter as an integer`)
+			}
+			f.SetInt(n)
+		default:
+			panic("timecard: unsupported form field type " + f.Type().String())
+		}
+	}
+	return nil
+}
+
+// formValueError reports an invalid parameter. message is a format
+// taking the parameter name.
+func formValueError(err error, name, message string) *appError {
+	return &appError{
+		Error:   err,
+		Message: message,
+		Args:    []interface{}{name},
+		Code:    http.StatusBadRequest,
+	}
+}
+
+// Request and response shapes of the v1 API. Field names are part of the API
+// contract; change them only in a new API version.
+
+type ErrorJSON struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+type ErrorResponse struct {
+	Error ErrorJSON `json:"error"`
+}
+
+type CreateUserRequest struct {
+	Email   string `form:"email"`
+	Name    string `form:"name"`
+	Team    string `form:"team"`
+	Enabled bool   `form:"enabled"`
+	Admin   bool   `form:"admin"`
+	// Mode "import" creates or updates the users of a CSV "file"
+	// instead. See userimport.go.
+	Mode string `form:"mode"`
+	// DryRun only reports what an import would do.
+	DryRun bool `form:"dry_run"`
+}
+
+type ListUsersRequest struct {
+	// Q matches the start of the name or the email, ignoring case.
+	Q       string `form:"q"`
+	Sort    string `form:"sort"`
+	Enabled string `form:"enabled"`
+	Cursor  string `form:"cursor"`
+	Limit   int    `form:"limit"`
+}
+
+type UpdateUserRequest struct {
+	ID      int64  `form:"id"`
+	Version int64  `form:"version"`
+	Name    string `form:"name"`
+	Team    string `form:"team"`
+	Enabled bool   `form:"enabled"`
+	Admin   bool   `form:"admin"`
+}
+
+type UserJSON struct {
+	ID       int64         `json:"id"`
+	Email    string        `json:"email"`
+	Name     string        `json:"name"`
+	Team     string        `json:"team"`
+	Enabled  bool          `json:"enabled"`
+	Admin    bool          `json:"admin"`
+	PayRates []PayRateJSON `json:"pay_rates"`
+	Version  int64         `json:"version"`
+	Updated  time.Time     `json:"updated"`
+}
+
+func newUserJSON(key *datastore.Key, u *User) UserJSON {
+	return UserJSON{
+		ID:       key.IntID(),
+		Email:    u.Email,
+		Name:     u.Name,
+		Team:     u.Team,
+		Enabled:  u.Enabled,
+		Admin:    u.Admin,
+		PayRates: newPayRatesJSON(u.PayRates),
+		Version:  u.Version,
+		Updated:  u.Updated,
+	}
+}
+
+type UsersResponse struct {
+	Users      []UserJSON `json:"users"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+	// Total is the number of users on all pages.
+	Total int `json:"total"`
+}
+
+type UserResponse struct {
+	User UserJSON `json:"user"`
+}
+
+type PunchJSON struct {
+	ID        int64      `json:"id"`
+	Puncher   string     `json:"puncher"`
+	Type      string     `json:"type"`
+	Time      time.Time  `json:"time"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+	// RecordedBy is set when an admin recorded the punch for the
+	// puncher.
+	RecordedBy string `json:"recorded_by,omitempty"`
+	Project    int64  `json:"project,omitempty"`
+	Note       string `json:"note,omitempty"`
+	Revision   int64  `json:"revision"`
+	// Source is web, api, import or auto, and empty for the punches made
+	// before it was recorded.
+	Source    string `json:"source,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+}
+
+func newPunchJSON(key *datastore.Key, p *Punch) PunchJSON {
+	j := PunchJSON{
+		ID:         key.IntID(),
+		Puncher:    p.Puncher,
+		Type:       p.Type,
+		Time:       p.Time,
+		RecordedBy: p.RecordedBy,
+		Project:    p.Project,
+		Note:       p.Note,
+		Revision:   p.Revision,
+		Source:     p.Source,
+		UserAgent:  p.UserAgent,
+		ClientIP:   p.ClientIP,
+	}
+	if p.Deleted() {
+		deletedAt := p.DeletedAt
+		j.DeletedAt = &deletedAt
+		j.DeletedBy = p.DeletedBy
+	}
+	return j
+}
+
+type SessionJSON struct {
+	Puncher       string     `json:"puncher"`
+	Arrival       time.Time  `json:"arrival"`
+	Leave         *time.Time `json:"leave,omitempty"`
+	Open          bool       `json:"open"`
+	WorkedMinutes int        `json:"worked_minutes"`
+	// BreakMinutes is the break deducted from the worked minutes.
+	BreakMinutes int `json:"break_minutes"`
+	// MissingLeave is set when the arrival was followed by another
+	// arrival instead of a leave. Such a session has no worked minutes.
+	MissingLeave bool `json:"missing_leave,omitempty"`
+}
+
+func newSessionJSON(s *WorkSession, now time.Time) SessionJSON {
+	j := SessionJSON{
+		Puncher:       s.Puncher,
+		Arrival:       s.Arrival,
+		Open:          s.Open(),
+		WorkedMinutes: int(s.Duration(now) / time.Minute),
+		BreakMinutes:  int(s.BreakDeducted() / time.Minute),
+		MissingLeave:  s.MissingLeave,
+	}
+	if !s.Leave.IsZero() {
+		leave := s.Leave
+		j.Leave = &leave
+	}
+	return j
+}
+
+type SummaryJSON struct {
+	Puncher       string `json:"puncher"`
+	Date          string `json:"date"`
+	WorkedMinutes int    `json:"worked_minutes"`
+}
+
+func newSummaryJSON(s *DailySummary) SummaryJSON {
+	return SummaryJSON{
+		Puncher:       s.Puncher,
+		Date:          s.Date,
+		WorkedMinutes: int(s.Worked / time.Minute),
+	}
+}
+
+// parseTimeParam parses a date (2006-01-02, midnight in loc) or an RFC
+// 3339 timestamp given in parameter name. An empty value gives the zero
+// time.
+func parseTimeParam(name, value string, loc *time.Location) (time.Time, *appError) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, formValueError(err, name, `Failed to parse the "%s" parameter as a date or an RFC 3339 time`)
+	}
+	return t, nil
+}
@@ -0,0 +1,406 @@
+package timecard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// Personal API tokens let scripts and the command line client in
+// cmd/timecard act as the user who created them, on the client API under
+// /client/v1, which is served without the Google sign-in. Like SCIM
+// tokens they are keyed by their hash in the default namespace, with the
+// namespace of the tenant they belong to, and the secret is only shown
+// when a token is created.
+
+const (
+	clientAPIPrefix = "/client/v1"
+	maxAPITokens    = 10
+	// apiTokenUseInterval is how stale LastUsed may get, so that a token
+	// used by a script in a loop isn't written on every request.
+	apiTokenUseInterval = time.Hour
+)
+
+type APIToken struct {
+	Namespace string
+	Email     string
+	// UserID is the ID of the User entity of Email, so that the token
+	// doesn't pass to a user invited again with the same email. Tokens
+	// created before it was recorded are bound on their first use.
+	UserID   int64  `datastore:",noindex"`
+	Name     string `datastore:",noindex"`
+	Created  time.Time
+	LastUsed time.Time `datastore:",noindex"`
+}
+
+func apiTokenKey(c appengine.Context, secret string) *datastore.Key {
+	sum := sha256.Sum256([]byte(secret))
+	return datastore.NewKey(c, "APIToken", hex.EncodeToString(sum[:]), 0, nil)
+}
+
+type APITokenJSON struct {
+	// ID is the hash of the token, which is enough to revoke it but not
+	// to use it.
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+func newAPITokenJSON(key *datastore.Key, t *APIToken) APITokenJSON {
+	res := APITokenJSON{ID: key.StringID(), Name: t.Name, Created: t.Created}
+	if !t.LastUsed.IsZero() {
+		lastUsed := t.LastUsed
+		res.LastUsed = &lastUsed
+	}
+	return res
+}
+
+type APITokensResponse struct {
+	Tokens []APITokenJSON `json:"tokens"`
+}
+
+type CreateAPITokenRequest struct {
+	// Name tells the tokens apart, like the machine or the script using
+	// it.
+	Name string `form:"name"`
+}
+
+type RevokeAPITokenRequest struct {
+	ID string `form:"id"`
+}
+
+type APITokenResponse struct {
+	Token APITokenJSON `json:"token"`
+	// Secret is only sent when the token is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+// findAPITokens returns the tokens of email in the tenant of c, oldest
+// first. dc must be in the default namespace.
+func findAPITokens(c, dc appengine.Context, email string) ([]*datastore.Key, []APIToken, error) {
+	var tokens []APIToken
+	keys, err := datastore.NewQuery("APIToken").
+		Filter("Namespace =", contextNamespace(c)).
+		Filter("Email =", email).
+		Order("Created").
+		GetAll(dc, &tokens)
+	return keys, tokens, err
+}
+
+func listAPITokens(c, dc appengine.Context, email string) (*APITokensResponse, *appError) {
+	keys, tokens, err := findAPITokens(c, dc, email)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the API tokens from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	res := &APITokensResponse{Tokens: make([]APITokenJSON, len(tokens))}
+	for i := range tokens {
+		res.Tokens[i] = newAPITokenJSON(keys[i], &tokens[i])
+	}
+	return res, nil
+}
+
+func createAPIToken(c, dc appengine.Context, email string, req *CreateAPITokenRequest) (*APITokenResponse, *appError) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, &appError{
+			Error:   errors.New("empty API token name"),
+			Message: `The "name" parameter is required`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	keys, _, err := findAPITokens(c, dc, email)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the API tokens from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if len(keys) >= maxAPITokens {
+		return nil, &appError{
+			Error:   fmt.Errorf("%s has %d API tokens", email, len(keys)),
+			Message: "You can have at most %d API tokens. Revoke one to create another",
+			Args:    []interface{}{maxAPITokens},
+			Code:    http.StatusConflict,
+		}
+	}
+	userKey, u, err := findUserByEmail(c, email)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if u == nil || !u.Enabled {
+		return nil, &appError{
+			Error:   fmt.Errorf("%s is not an enabled user", email),
+			Message: "Only enabled users can create API tokens",
+			Code:    http.StatusForbidden,
+		}
+	}
+	secret := randomHex(32)
+	t := APIToken{Namespace: contextNamespace(c), Email: email, UserID: userKey.IntID(), Name: name, Created: time.Now()}
+	key, err := datastore.Put(dc, apiTokenKey(dc, secret), &t)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to put the API token to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	c.Infof("%s created the API token %q", email, name)
+	return &APITokenResponse{Token: newAPITokenJSON(key, &t), Secret: secret}, nil
+}
+
+func revokeAPIToken(c, dc appengine.Context, email string, req *RevokeAPITokenRequest) (*APITokenResponse, *appError) {
+	notFound := &appError{
+		Error:   errors.New("no API token " + req.ID + " of " + email),
+		Message: "No such API token",
+		Code:    http.StatusNotFound,
+	}
+	if req.ID == "" {
+		return nil, notFound
+	}
+	key := datastore.NewKey(dc, "APIToken", req.ID, 0, nil)
+	var t APIToken
+	err := datastore.Get(dc, key, &t)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, notFound
+	} else if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the API tokens from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if t.Email != email || t.Namespace != contextNamespace(c) {
+		return nil, notFound
+	}
+	if err := datastore.Delete(dc, key); err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to delete the API token from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	c.Infof("%s revoked the API token %q", email, t.Name)
+	return &APITokenResponse{Token: newAPITokenJSON(key, &t)}, nil
+}
+
+// apiMyTokensHandler lists, creates and revokes the API tokens of the
+// current user.
+func apiMyTokensHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	// Tokens are kept in the default namespace.
+	dc := appengine.NewContext(r)
+	email := user.Current(c).Email
+	switch r.Method {
+	case "GET":
+		return listAPITokens(c, dc, email)
+
+	case "POST":
+		var req CreateAPITokenRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		return createAPIToken(c, dc, email, &req)
+
+	case "DELETE":
+		var req RevokeAPITokenRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		return revokeAPIToken(c, dc, email, &req)
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// myTokensHandler is the page of the API tokens. A created token is
+// shown on the page answering the POST, since it can't be shown again.
+func myTokensHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	dc := appengine.NewContext(r)
+	email := user.Current(c).Email
+	var created *APITokenResponse
+	if r.Method == "POST" {
+		if r.FormValue("id") != "" {
+			var req RevokeAPITokenRequest
+			if appErr := decodeForm(r, &req); appErr != nil {
+				return appErr
+			}
+			if _, appErr := revokeAPIToken(c, dc, email, &req); appErr != nil {
+				return appErr
+			}
+			redirect(w, "/my/tokens")
+			return nil
+		}
+		var req CreateAPITokenRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return appErr
+		}
+		var appErr *appError
+		if created, appErr = createAPIToken(c, dc, email, &req); appErr != nil {
+			return appErr
+		}
+	}
+	res, appErr := listAPITokens(c, dc, email)
+	if appErr != nil {
+		return appErr
+	}
+	data := map[string]interface{}{
+		"Tokens":  res.Tokens,
+		"Created": created,
+		"BaseURL": "https://" + r.Host,
+	}
+	return renderTemplate(c, w, r, tokensTemplate, data)
+}
+
+var tokensTemplate = parsePage("tokens")
+
+// clientHandler serves a route of the client API for the user of the
+// bearer token, whose email it is given, in the tenant of the token.
+type clientHandler func(c appengine.Context, w http.ResponseWriter, r *http.Request, email string) (jsonData interface{}, error *appError)
+
+func (fn clientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	l := startRequestLog(c, w, r)
+	defer l.finish()
+	tc, email, appErr := clientContext(c, r)
+	if appErr != nil {
+		if appErr.Code == http.StatusUnauthorized {
+			l.Header().Set("WWW-Authenticate", `Bearer realm="timecard"`)
+		}
+		handleAPIError(c, l, r, appErr)
+		return
+	}
+	l.user = email
+	defer loadRequestSettings(tc, r, email)()
+	format, explicit, appErr := apiResponseFormat(r)
+	if appErr != nil {
+		handleAPIError(tc, l, r, appErr)
+		return
+	}
+
+	jsonData, appErr := fn(tc, l, r, email)
+	if appErr != nil {
+		handleAPIError(tc, l, r, appErr)
+		return
+	}
+	writeAPIResponse(tc, l, r, jsonData, format, explicit)
+}
+
+// clientContext returns c in the namespace of the bearer token of r, and
+// the email of its user. The token stops working when its user is
+// disabled or deleted, even if invited again, or is outside the sign-in
+// policy.
+func clientContext(c appengine.Context, r *http.Request) (appengine.Context, string, *appError) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		err := errors.New("A bearer token is required")
+		return nil, "", &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusUnauthorized,
+		}
+	}
+	invalid := &appError{
+		Error:   errors.New("unknown API token"),
+		Message: "The bearer token is invalid or has been revoked",
+		Code:    http.StatusUnauthorized,
+	}
+	key := apiTokenKey(c, strings.TrimPrefix(auth, "Bearer "))
+	var t APIToken
+	err := datastore.Get(c, key, &t)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, "", invalid
+	} else if err != nil {
+		return nil, "", &appError{
+			Error:   err,
+			Message: "Failed to fetch the API tokens from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	tc := c
+	if t.Namespace != "" {
+		if tc, err = appengine.Namespace(c, t.Namespace); err != nil {
+			return nil, "", &appError{
+				Error:   err,
+				Message: "Failed to fetch the tenants from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+	}
+	userKey, u, err := findUserByEmail(tc, t.Email)
+	if err != nil {
+		return nil, "", &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	policy, err := getSignInPolicy(tc)
+	if err != nil {
+		return nil, "", &appError{
+			Error:   err,
+			Message: "Failed to fetch the sign-in policy from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if u == nil || !u.Enabled || !policy.allows(t.Email) || (t.UserID != 0 && t.UserID != userKey.IntID()) {
+		invalid.Error = fmt.Errorf("the API token of %s is no longer allowed", t.Email)
+		return nil, "", invalid
+	}
+
+	if now := time.Now(); now.Sub(t.LastUsed) > apiTokenUseInterval || t.UserID == 0 {
+		t.LastUsed = now
+		t.UserID = userKey.IntID()
+		if _, err := datastore.Put(c, key, &t); err != nil {
+			c.Warningf("failed to record the use of an API token: %v", err)
+		}
+	}
+	return tc, t.Email, nil
+}
+
+func clientStatusHandler(c appengine.Context, w http.ResponseWriter, r *http.Request, email string) (interface{}, *appError) {
+	return findStatus(c, email)
+}
+
+func clientPunchesHandler(c appengine.Context, w http.ResponseWriter, r *http.Request, email string) (interface{}, *appError) {
+	if r.Method != "POST" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return createMyPunch(c, r, email, punchSourceAPI)
+}
+
+func clientStatsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request, email string) (interface{}, *appError) {
+	var req StatsRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	return findStats(c, requestViewer(r).Now(), email, req.From, req.To)
+}
@@ -1,12 +1,11 @@
 package timecard
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"appengine"
@@ -15,9 +14,20 @@ import (
 )
 
 type User struct {
-	Email   string
-	Name    string
+	Email string
+	Name  string
+	// Team is the name of the team the user is on, or empty.
+	Team    string
 	Enabled bool
+	// Admin lets the user use the admin pages. See admin.go.
+	Admin bool
+	// PayRates is the history of the user's hourly rate, ordered by
+	// date. See payroll.go.
+	PayRates []PayRate
+	// Version is incremented by every update, which must name the
+	// version it was made from so that concurrent edits are detected.
+	Version int64
+	Updated time.Time
 }
 
 func userKey(c appengine.Context) *datastore.Key {
@@ -28,6 +38,65 @@ type Punch struct {
 	Puncher string
 	Type    string
 	Time    time.Time
+	// DeletedAt is set when an admin moves the punch to the trash, from
+	// where it can be restored.
+	DeletedAt time.Time
+	DeletedBy string
+	// RecordedBy is the admin who recorded or last corrected the punch
+	// for the puncher, autoLeaveRecorder for a leave punched at the auto
+	// leave hour, or empty when the puncher punched themselves.
+	RecordedBy string
+	// Project is the ID of the Project the session started by an arrival
+	// is spent on, or 0.
+	Project int64
+	// Note is a remark kept with the punch, like one imported from the
+	// system it was migrated from.
+	Note string `datastore:",noindex"`
+	// Revision is the number of the latest PunchEvent of the punch.
+	Revision int64 `datastore:",noindex"`
+	// Source is how the punch was made, one of the punchSource values,
+	// and UserAgent and ClientIP those of the request that made it, if
+	// any. They are kept to investigate disputed punches, and stay as
+	// they were when the punch is corrected.
+	Source    string `datastore:",noindex"`
+	UserAgent string `datastore:",noindex"`
+	ClientIP  string `datastore:",noindex"`
+}
+
+const (
+	// punchSourceWeb is a punch made by a signed-in browser, from a page
+	// or its script.
+	punchSourceWeb = "web"
+	// punchSourceAPI is a punch made with an API token.
+	punchSourceAPI    = "api"
+	punchSourceImport = "import"
+	// punchSourceAuto is a leave punched at the auto leave hour.
+	punchSourceAuto = "auto"
+
+	maxUserAgentLength = 500
+)
+
+func (p *Punch) Deleted() bool {
+	return !p.DeletedAt.IsZero()
+}
+
+// setClient records that the punch is made by r from source.
+func (p *Punch) setClient(r *http.Request, source string) {
+	p.Source = source
+	p.UserAgent = r.Header.Get("User-Agent")
+	if len(p.UserAgent) > maxUserAgentLength {
+		p.UserAgent = p.UserAgent[:maxUserAgentLength]
+	}
+	// App Engine sets RemoteAddr to the address of the client.
+	p.ClientIP = r.RemoteAddr
+}
+
+// recorder returns who recorded the punch.
+func (p *Punch) recorder() string {
+	if p.RecordedBy != "" {
+		return p.RecordedBy
+	}
+	return p.Puncher
 }
 
 func punchKey(c appengine.Context) *datastore.Key {
@@ -39,64 +108,79 @@ func punchKey(c appengine.Context) *datastore.Key {
 type appError struct {
 	Error   error
 	Message string
-	Code    int
+	// Args format Message after it has been translated.
+	Args []interface{}
+	Code int
+}
+
+func (e *appError) localMessage(r *http.Request) string {
+	return requestLocale(r).T(e.Message, e.Args...)
 }
 
 type appHandler func(appengine.Context, http.ResponseWriter, *http.Request) *appError
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
+	l := startRequestLog(c, w, r)
+	defer l.finish()
 	u := user.Current(c)
 	if u == nil {
 		url, err := user.LoginURL(c, r.URL.String())
 		if err != nil {
-			c.Errorf("%v", err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			l.fail(err)
+			http.Error(l, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		redirect(w, url)
+		redirect(l, url)
 		return
 	}
-
-	if e := fn(c, w, r); e != nil {
-		handleAppError(c, w, e)
+	c, e := tenantContext(c, r)
+	if e != nil {
+		handleAppError(appengine.NewContext(r), l, r, e)
+		return
 	}
-}
+	if e := checkSignIn(c); e != nil {
+		handleSignInError(c, l, r, e)
+		return
+	}
+	bootstrapAdmin(c)
+	if e := checkAdmin(c, r); e != nil {
+		handleAppError(c, l, r, e)
+		return
+	}
+	defer loadRequestSettings(c, r, u.Email)()
 
-func handleAppError(c appengine.Context, w http.ResponseWriter, e *appError) {
-	c.Errorf("%v", e.Error)
-	http.Error(w, e.Message, e.Code)
+	if e := fn(c, l, r); e != nil {
+		handleAppError(c, l, r, e)
+	}
 }
 
-type apiHandler func(appengine.Context, http.ResponseWriter, *http.Request) (jsonData interface{}, error *appError)
-
-func (fn apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	u := user.Current(c)
-	if u == nil {
-		err := errors.New("login needed")
-		c.Errorf("%v", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// handleAppError sends e as an error page to browsers and as text to
+// other clients. w must come from startRequestLog.
+func handleAppError(c appengine.Context, w http.ResponseWriter, r *http.Request, e *appError) {
+	if l, ok := w.(*requestLogger); ok {
+		l.fail(e.Error)
+	}
+	message := e.localMessage(r)
+	requestID := responseRequestID(w)
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, message+"\n"+requestLocale(r).T("Request ID: %s", requestID), e.Code)
 		return
 	}
 
-	jsonData, appErr := fn(c, w, r)
-	if appErr != nil {
-		handleAppError(c, w, appErr)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(e.Code)
+	data := map[string]interface{}{
+		"Status":    fmt.Sprintf("%d %s", e.Code, http.StatusText(e.Code)),
+		"Message":   message,
+		"RequestID": requestID,
 	}
-
-	err := writeJsonResponse(w, jsonData)
-	if err != nil {
-		c.Errorf("%v", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if appErr := renderTemplate(c, w, r, errorTemplate, data); appErr != nil {
+		c.Errorf("failed to render the error page: %v", appErr.Error)
 	}
 }
 
-func writeJsonResponse(w http.ResponseWriter, jsonData interface{}) error {
-	w.Header().Add("Content-Type", "application/json")
-	encoder := json.NewEncoder(w)
-	return encoder.Encode(jsonData)
-}
+var errorTemplate = parsePage("error")
 
 func redirect(w http.ResponseWriter, url string) {
 	w.Header().Set("Location", url)
@@ -107,68 +191,281 @@ func init() {
 	http.Handle("/", appHandler(rootHandler))
 	http.Handle("/my/arrivals", appHandler(myArrivalsHandler))
 	http.Handle("/my/leaves", appHandler(myLeavesHandler))
-
-	http.Handle("/api/admin/users", apiHandler(apiAdminUsersHandler))
+	http.Handle("/my/calendar", appHandler(myCalendarHandler))
+	http.Handle("/my/timesheet", appHandler(myTimesheetHandler))
+	http.Handle("/my/history", appHandler(myHistoryHandler))
+	http.Handle("/my/punch", appHandler(myPunchHandler))
+	http.Handle("/my/locale", appHandler(myLocaleHandler))
+	http.Handle("/my/export", appHandler(myExportHandler))
+	http.Handle("/my/notifications", appHandler(myNotificationsHandler))
+	http.Handle("/my/tokens", appHandler(myTokensHandler))
+	http.Handle("/my/settings", appHandler(mySettingsHandler))
+	http.Handle("/admin/dashboard", appHandler(adminDashboardHandler))
+	http.Handle("/admin/live", appHandler(adminLiveHandler))
+	http.Handle("/admin/live/events", appHandler(adminLiveEventsHandler))
+	http.Handle("/admin/trash", appHandler(adminTrashHandler))
+	http.Handle("/admin/punch", appHandler(adminPunchHandler))
+	http.Handle("/admin/invoice", appHandler(adminInvoiceHandler))
+	http.Handle("/admin/reports/projects", appHandler(adminProjectReportHandler))
+	http.Handle("/admin/payroll", appHandler(adminPayrollHandler))
+	http.Handle("/admin/reports/absences", appHandler(adminAbsenceReportHandler))
+	http.Handle("/admin/reports/anomalies", appHandler(adminAnomalyReportHandler))
+	http.Handle("/admin/timesheets", appHandler(adminTimesheetsHandler))
+	http.Handle("/admin/settings", appHandler(adminSettingsHandler))
+	http.Handle("/admin/jobs", appHandler(adminJobsHandler))
+	http.Handle("/admin/jobs/download", appHandler(adminJobDownloadHandler))
+	http.Handle(acceptInvitePath, appHandler(acceptInvitationHandler))
+	http.Handle(tenantSwitchPath, appHandler(adminTenantHandler))
+	http.Handle(debugPprofPath, appHandler(debugPprofHandler))
+
+	apiV1.handle("/admin/users", apiAdminUsersHandler,
+		apiOperation{Method: "GET", Summary: "List a page of users, optionally searched, filtered and sorted", Request: ListUsersRequest{}, Response: UsersResponse{}},
+		apiOperation{Method: "POST", Summary: "Create a user, or with mode=import create and update the users of a CSV file, responding with an ImportUsersResponse", Request: CreateUserRequest{}, Response: UserResponse{}},
+		apiOperation{Method: "PUT", Summary: "Update a user, failing with 409 if it has changed since the given version", Request: UpdateUserRequest{}, Response: UserResponse{}},
+	)
+	apiV1.handleDeprecated("/admin/users")
+	apiV1.handle("/admin/users/pay-rates", apiAdminPayRatesHandler,
+		apiOperation{Method: "PUT", Summary: "Set the hourly rate of a user from a date on, failing with 409 if the user has changed since the given version", Request: PayRateRequest{}, Response: UserResponse{}},
+		apiOperation{Method: "DELETE", Summary: "Remove the hourly rate of a user from a date, failing with 409 if the user has changed since the given version", Request: PayRateRequest{}, Response: UserResponse{}},
+	)
+	apiV1.handle("/admin/dashboard", apiAdminDashboardHandler,
+		apiOperation{Method: "GET", Summary: "Get who is in today with their first arrival, last punch and time worked so far", Request: DashboardRequest{}, Response: DashboardResponse{}},
+	)
+	apiV1.handle("/admin/invitations", apiAdminInvitationsHandler,
+		apiOperation{Method: "GET", Summary: "List the latest invitations", Response: InvitationsResponse{}},
+		apiOperation{Method: "POST", Summary: "Invite a new employee by email", Request: CreateInvitationRequest{}, Response: InvitationResponse{}},
+		apiOperation{Method: "DELETE", Summary: "Revoke an invitation", Request: InvitationTokenRequest{}, Response: InvitationResponse{}},
+	)
+	apiV1.handle("/admin/user-deletions", apiAdminUserDeletionsHandler,
+		apiOperation{Method: "GET", Summary: "Get the progress or the final report of a user deletion", Request: GetUserDeletionRequest{}, Response: UserDeletionResponse{}},
+		apiOperation{Method: "POST", Summary: "Delete a user and delete or anonymize their punches in the background", Request: DeleteUserRequest{}, Response: UserDeletionResponse{}},
+	)
+	apiV1.handle("/admin/punches", apiAdminPunchesHandler,
+		apiOperation{Method: "POST", Summary: "Record a punch for an employee", Request: RecordPunchRequest{}, Response: PunchResponse{}},
+		apiOperation{Method: "PUT", Summary: "Correct the type or time of a punch", Request: CorrectPunchRequest{}, Response: PunchResponse{}},
+		apiOperation{Method: "DELETE", Summary: "Move a punch to the trash", Request: PunchIDRequest{}, Response: PunchResponse{}},
+	)
+	apiV1.handle("/admin/punches/restore", apiAdminPunchesRestoreHandler,
+		apiOperation{Method: "POST", Summary: "Restore a punch from the trash", Request: PunchIDRequest{}, Response: PunchResponse{}},
+	)
+	apiV1.handle("/admin/punches/import", apiAdminPunchImportsHandler,
+		apiOperation{Method: "POST", Summary: "Import historical punches from a CSV file in the background, or report its invalid rows", Request: ImportPunchesRequest{}, Response: PunchImportResponse{}},
+		apiOperation{Method: "GET", Summary: "Get the progress of a punch import", Request: GetPunchImportRequest{}, Response: PunchImportResponse{}},
+	)
+	apiV1.handle("/admin/punches/history", apiAdminPunchHistoryHandler,
+		apiOperation{Method: "GET", Summary: "Get every change of a punch and verify its history", Request: PunchIDRequest{}, Response: PunchHistoryResponse{}},
+	)
+	apiV1.handle("/admin/tenants", apiAdminTenantsHandler,
+		apiOperation{Method: "GET", Summary: "List the tenants (project admins only)", Response: TenantsResponse{}},
+		apiOperation{Method: "PUT", Summary: "Create or update a tenant and the login domains it serves (project admins only)", Request: PutTenantRequest{}, Response: TenantResponse{}},
+	)
+	apiV1.handle("/admin/settings", apiAdminSettingsHandler,
+		apiOperation{Method: "GET", Summary: "Get the org settings: company name, time zone, currency, rounding, overnight mode, break deductions, auto leave hour, allowed domains and retention", Response: OrgSettingsResponse{}},
+		apiOperation{Method: "PUT", Summary: "Change the org settings; settings not given keep their value", Request: UpdateOrgSettingsRequest{}, Response: OrgSettingsResponse{}},
+	)
+	apiV1.handle("/admin/sign-in-policy", apiAdminSignInPolicyHandler,
+		apiOperation{Method: "GET", Summary: "Get the email domains allowed to sign in", Response: SignInPolicyResponse{}},
+		apiOperation{Method: "PUT", Summary: "Set the email domains allowed to sign in, or none to allow every account", Request: UpdateSignInPolicyRequest{}, Response: SignInPolicyResponse{}},
+	)
+	apiV1.handle("/admin/theme", apiAdminThemeHandler,
+		apiOperation{Method: "GET", Summary: "Get the theme", Response: ThemeResponse{}},
+		apiOperation{Method: "PUT", Summary: "Update the theme", Request: UpdateThemeRequest{}, Response: ThemeResponse{}},
+	)
+	apiV1.handle("/admin/retention", apiAdminRetentionHandler,
+		apiOperation{Method: "GET", Summary: "Get the retention policy", Response: RetentionPolicyResponse{}},
+		apiOperation{Method: "PUT", Summary: "Update the retention policy", Request: UpdateRetentionPolicyRequest{}, Response: RetentionPolicyResponse{}},
+	)
+	apiV1.handle("/admin/overnight-policy", apiAdminOvernightPolicyHandler,
+		apiOperation{Method: "GET", Summary: "Get which day sessions crossing midnight count for", Response: OvernightPolicyResponse{}},
+		apiOperation{Method: "PUT", Summary: "Count sessions crossing midnight for their start day or split them at midnight", Request: UpdateOvernightPolicyRequest{}, Response: OvernightPolicyResponse{}},
+	)
+	apiV1.handle("/admin/workweek", apiAdminWorkweekHandler,
+		apiOperation{Method: "GET", Summary: "Get the workdays and the expected minutes per workday of the organization", Response: WorkweekResponse{}},
+		apiOperation{Method: "PUT", Summary: "Set the workdays and the expected minutes per workday of the organization", Request: UpdateWorkweekRequest{}, Response: WorkweekResponse{}},
+	)
+	apiV1.handle("/admin/users/workweek", apiAdminUserWorkweekHandler,
+		apiOperation{Method: "GET", Summary: "Get the workweek of a user", Request: UserWorkweekRequest{}, Response: WorkweekResponse{}},
+		apiOperation{Method: "PUT", Summary: "Give a user a workweek of their own", Request: UserWorkweekRequest{}, Response: WorkweekResponse{}},
+		apiOperation{Method: "DELETE", Summary: "Put a user back on the organization's workweek", Request: UserWorkweekRequest{}, Response: WorkweekResponse{}},
+	)
+	apiV1.handle("/admin/restore", apiAdminRestoreHandler,
+		apiOperation{Method: "POST", Summary: "Restore a backup, or with dry_run report what restoring it would change", Request: RestoreRequest{}, Response: RestoreResponse{}},
+	)
+	apiV1.handle("/admin/integrations", apiAdminIntegrationsHandler,
+		apiOperation{Method: "GET", Summary: "Get the integration settings", Response: IntegrationsResponse{}},
+		apiOperation{Method: "PUT", Summary: "Update the integration settings", Request: UpdateIntegrationsRequest{}, Response: IntegrationsResponse{}},
+	)
+	apiV1.handle("/admin/bigquery/backfill", apiAdminBigQueryBackfillHandler,
+		apiOperation{Method: "POST", Summary: "Send all existing punches to BigQuery in the background", Response: BigQueryBackfillResponse{}},
+	)
+	apiV1.handle("/admin/scim/token", apiAdminSCIMTokenHandler,
+		apiOperation{Method: "GET", Summary: "Get when the SCIM token was created, and the SCIM base URL", Response: SCIMTokenResponse{}},
+		apiOperation{Method: "POST", Summary: "Create a SCIM token, replacing the old one; the secret is only returned here", Response: SCIMTokenResponse{}},
+		apiOperation{Method: "DELETE", Summary: "Revoke the SCIM token", Response: SCIMTokenResponse{}},
+	)
+	apiV1.handle("/admin/directory/sync", apiAdminDirectorySyncHandler,
+		apiOperation{Method: "POST", Summary: "Sync the users with the Google Workspace directory in the background", Response: DirectorySyncResponse{}},
+	)
+	apiV1.handle("/admin/webhooks", apiAdminWebhooksHandler,
+		apiOperation{Method: "GET", Summary: "List the Google Chat and Microsoft Teams webhooks of the teams", Response: WebhooksResponse{}},
+		apiOperation{Method: "PUT", Summary: "Create a webhook, or update the one with the ID", Request: PutWebhookRequest{}, Response: WebhookResponse{}},
+		apiOperation{Method: "DELETE", Summary: "Delete a webhook", Request: WebhookIDRequest{}, Response: WebhookResponse{}},
+	)
+	apiV1.handle("/admin/clients", apiAdminClientsHandler,
+		apiOperation{Method: "GET", Summary: "List the clients", Response: ClientsResponse{}},
+		apiOperation{Method: "PUT", Summary: "Create a client, or update the one with the ID", Request: PutClientRequest{}, Response: ClientResponse{}},
+	)
+	apiV1.handle("/admin/projects", apiAdminProjectsHandler,
+		apiOperation{Method: "GET", Summary: "List the projects", Response: ProjectsResponse{}},
+		apiOperation{Method: "PUT", Summary: "Create a project, or update the one with the ID", Request: PutProjectRequest{}, Response: ProjectResponse{}},
+	)
+	apiV1.handle("/admin/invoice", apiAdminInvoiceHandler,
+		apiOperation{Method: "GET", Summary: "Invoice a client for the billable sessions of a period", Request: InvoiceRequest{}, Response: InvoiceResponse{}},
+	)
+	apiV1.handle("/admin/reports/projects", apiAdminProjectReportHandler,
+		apiOperation{Method: "GET", Summary: "Worked minutes per client, project and puncher of a period", Request: ProjectReportRequest{}, Response: ProjectReportResponse{}},
+	)
+	apiV1.handle("/admin/payroll", apiAdminPayrollHandler,
+		apiOperation{Method: "GET", Summary: "Regular and overtime hours and gross pay of everyone for a month", Request: PayrollRequest{}, Response: PayrollResponse{}},
+	)
+	apiV1.handle("/admin/payroll/format", apiAdminPayrollExportFormatHandler,
+		apiOperation{Method: "GET", Summary: "Get the CSV layout of the payroll export", Response: PayrollExportFormatResponse{}},
+		apiOperation{Method: "PUT", Summary: "Set the columns, date format and rounding of the payroll export", Request: UpdatePayrollExportFormatRequest{}, Response: PayrollExportFormatResponse{}},
+		apiOperation{Method: "DELETE", Summary: "Go back to the default payroll export layout", Response: PayrollExportFormatResponse{}},
+	)
+	apiV1.handle("/admin/holidays", apiAdminHolidaysHandler,
+		apiOperation{Method: "GET", Summary: "List the company holidays", Response: HolidaysResponse{}},
+		apiOperation{Method: "PUT", Summary: "Make a date a holiday", Request: HolidayRequest{}, Response: HolidayResponse{}},
+		apiOperation{Method: "DELETE", Summary: "Make a date a workday again", Request: HolidayRequest{}, Response: HolidayResponse{}},
+	)
+	apiV1.handle("/admin/reports/absences", apiAdminAbsenceReportHandler,
+		apiOperation{Method: "GET", Summary: "Enabled users without any punch on workdays of a period", Request: AbsenceReportRequest{}, Response: AbsenceReportResponse{}},
+	)
+	apiV1.handle("/admin/jobs", apiAdminJobsHandler,
+		apiOperation{Method: "GET", Summary: "A job, or the latest jobs", Request: GetJobRequest{}, Response: JobsResponse{}},
+		apiOperation{Method: "POST", Summary: "Start an export of the punches on the task queue", Request: StartJobRequest{}, Response: JobResponse{}},
+	)
+	apiV1.handle("/admin/reports/anomalies", apiAdminAnomalyReportHandler,
+		apiOperation{Method: "GET", Summary: "Long sessions, missing leaves, unusual arrivals and repeated punch times of a period", Request: AnomalyReportRequest{}, Response: AnomalyReportResponse{}},
+	)
+	apiV1.handle("/admin/sheets/export", apiAdminSheetsExportHandler,
+		apiOperation{Method: "POST", Summary: "Append everyone's hour totals of a period to the Google Sheet", Request: SheetsExportRequest{}, Response: SheetsExportResponse{}},
+	)
+	apiV1.handle("/admin/stats", apiAdminStatsHandler,
+		apiOperation{Method: "GET", Summary: "Worked minutes per day and week of everyone or one puncher", Request: AdminStatsRequest{}, Response: StatsResponse{}},
+	)
+	apiV1.handle("/my/stats", apiMyStatsHandler,
+		apiOperation{Method: "GET", Summary: "My worked minutes per day and week", Request: StatsRequest{}, Response: StatsResponse{}},
+	)
+	apiV1.handle("/my/status", apiMyStatusHandler,
+		apiOperation{Method: "GET", Summary: "Whether I am clocked in, and since when", Response: StatusResponse{}},
+	)
+	apiV1.handle("/my/settings", apiMySettingsHandler,
+		apiOperation{Method: "GET", Summary: "Get my time zone, language, email and default project settings", Response: UserSettingsResponse{}},
+		apiOperation{Method: "PUT", Summary: "Change my settings; settings not given keep their value", Request: UpdateUserSettingsRequest{}, Response: UserSettingsResponse{}},
+	)
+	apiV1.handle("/my/tokens", apiMyTokensHandler,
+		apiOperation{Method: "GET", Summary: "List my API tokens", Response: APITokensResponse{}},
+		apiOperation{Method: "POST", Summary: "Create an API token for the client API; the secret is only returned here", Request: CreateAPITokenRequest{}, Response: APITokenResponse{}},
+		apiOperation{Method: "DELETE", Summary: "Revoke one of my API tokens", Request: RevokeAPITokenRequest{}, Response: APITokenResponse{}},
+	)
+	apiV1.handle("/my/notifications", apiMyNotificationsHandler,
+		apiOperation{Method: "GET", Summary: "List my latest notifications and count the unread ones", Request: ListNotificationsRequest{}, Response: NotificationsResponse{}},
+	)
+	apiV1.handle("/my/notification-preferences", apiMyNotificationPreferencesHandler,
+		apiOperation{Method: "GET", Summary: "Get which notifications I get emailed", Response: NotificationPreferencesResponse{}},
+		apiOperation{Method: "PUT", Summary: "Choose which notifications I get emailed", Request: UpdateNotificationPreferencesRequest{}, Response: NotificationPreferencesResponse{}},
+	)
+	apiV1.handle("/my/notifications/read", apiMyNotificationsReadHandler,
+		apiOperation{Method: "POST", Summary: "Mark one or all of my notifications read", Request: MarkNotificationsReadRequest{}, Response: NotificationsResponse{}},
+	)
+	apiV1.handle("/my/punches/history", apiMyPunchHistoryHandler,
+		apiOperation{Method: "GET", Summary: "Get every change of one of my punches: who made it, when and what it changed", Request: PunchIDRequest{}, Response: PunchHistoryResponse{}},
+	)
+	apiV1.handle("/my/punches", apiMyPunchesHandler,
+		apiOperation{Method: "GET", Summary: "List my punches, newest first", Request: ListPunchesRequest{}, Response: PunchesResponse{}},
+		apiOperation{Method: "POST", Summary: "Record a punch, at most once per idempotency key", Request: CreatePunchRequest{}, Response: PunchResponse{}},
+	)
+
+	http.Handle(deletionTaskPath, taskHandler(userDeletionTaskHandler))
+	http.Handle(punchImportTaskPath, taskHandler(punchImportTaskHandler))
+	http.Handle(purgeTaskPath, taskHandler(purgeTaskHandler))
+	http.Handle(jobTaskPath, taskHandler(jobTaskHandler))
+	http.Handle(autoLeaveTaskPath, taskHandler(autoLeaveTaskHandler))
+	http.Handle(backupTaskPath, taskHandler(backupTaskHandler))
+	http.Handle(bigQueryInsertPath, taskHandler(bigQueryInsertTaskHandler))
+	http.Handle(bigQueryBackfillPath, taskHandler(bigQueryBackfillTaskHandler))
+	http.Handle(directorySyncPath, taskHandler(directorySyncTaskHandler))
+	http.Handle(webhookLatePath, taskHandler(webhookLateTaskHandler))
+	http.Handle(webhookDailyPath, taskHandler(webhookDailyTaskHandler))
+
+	http.Handle(scimUsersPath, scimHandler(scimUsersHandler))
+	http.Handle(scimUsersPath+"/", scimHandler(scimUsersHandler))
+
+	http.Handle(clientAPIPrefix+"/status", clientHandler(clientStatusHandler))
+	http.Handle(clientAPIPrefix+"/punches", clientHandler(clientPunchesHandler))
+	http.Handle(clientAPIPrefix+"/stats", clientHandler(clientStatsHandler))
+
+	http.Handle("/api/", apiHandler(apiNotFoundHandler))
+	http.Handle("/api/openapi.json", apiHandler(apiOpenAPIHandler))
+	http.Handle("/api/graphql", apiHandler(apiGraphQLHandler))
 }
 
+// rootHandler serves exactly "/", and the 404 page for every path that
+// no other handler is registered for.
 func rootHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
-	u := user.Current(c)
-	q := datastore.NewQuery("Punch").Ancestor(punchKey(c)).Order("Time").Limit(10)
-	punches := make([]Punch, 0, 10)
-	if _, err := q.GetAll(c, &punches); err != nil {
+	if r.URL.Path != "/" {
+		err := errors.New("Page not found")
 		return &appError{
-			Error:   err,
-			Message: "Failed to fetch punches data from the datastore",
-			Code:    http.StatusInternalServerError,
+			Error:   fmt.Errorf("no handler for %s", r.URL.Path),
+			Message: err.Error(),
+			Code:    http.StatusNotFound,
 		}
 	}
-	data := map[string]interface{}{
-		"User":    u,
-		"Punches": punches,
+	u := user.Current(c)
+	settings, err := getOrgSettings(c)
+	if err != nil {
+		return orgSettingsError(err)
 	}
-	if err := rootTemplate.Execute(w, data); err != nil {
+	_, punches, err := findPunches(c, punchQuery{Puncher: u.Email, Newest: true, Limit: settings.RecentPunches})
+	if err != nil {
 		return &appError{
 			Error:   err,
-			Message: "Failed to execute the root template",
+			Message: "Failed to fetch punches data from the datastore",
 			Code:    http.StatusInternalServerError,
 		}
 	}
-	return nil
-}
-
-func formatDateTime(t time.Time) string {
-	return t.Format("2006-01-02 15:04")
+	status, appErr := findStatus(c, u.Email)
+	if appErr != nil {
+		return appErr
+	}
+	// The arrival form lets the puncher pick what they work on.
+	open, appErr := findOpenProjects(c)
+	if appErr != nil {
+		return appErr
+	}
+	data := map[string]interface{}{
+		"User":           u,
+		"Status":         status,
+		"Punches":        punches,
+		"Projects":       open,
+		"DefaultProject": defaultPunchProject(c, r),
+		// The punch forms send this with their type appended, so that
+		// submitting a form twice stores one punch.
+		"IdempotencyKey": randomHex(16),
+	}
+	return renderTemplate(c, w, r, rootTemplate, data)
 }
 
-var templateFuncs = template.FuncMap{
-	"formatDateTime": formatDateTime,
-}
+// templateFuncs are the functions templates are parsed with.
+// renderTemplate replaces them with ones for the viewer.
+var templateFuncs = (&viewer{Locale: defaultLocale, Location: time.UTC}).funcs()
 
-var rootTemplate = template.Must(template.New("root").Funcs(templateFuncs).Parse(`
-<html>
-  <head>
-    <title>Timecard</title>
-  </head>
-  <body>
-    <div>Hello, {{.User}}!</div>
-    <ul>
-    {{range .Punches}}
-      <li>{{.Type}} {{formatDateTime .Time}}</li>
-    {{end}}
-    </ul>
-    <form action="/my/arrivals" method="post">
-      <input type="submit" value="Arrive">
-    </form>
-    <form action="/my/leaves" method="post">
-      <input type="submit" value="Leave">
-    </form>
-  </body>
-</html>
-`))
+var rootTemplate = parsePage("root")
 
 func myArrivalsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
 	if r.Method == "POST" {
-		err := createPunch(c, "arrival")
+		err := createPunch(c, r, "arrival")
 		if err != nil {
 			return err
 		}
@@ -179,7 +476,7 @@ func myArrivalsHandler(c appengine.Context, w http.ResponseWriter, r *http.Reque
 
 func myLeavesHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
 	if r.Method == "POST" {
-		err := createPunch(c, "leave")
+		err := createPunch(c, r, "leave")
 		if err != nil {
 			return err
 		}
@@ -188,30 +485,88 @@ func myLeavesHandler(c appengine.Context, w http.ResponseWriter, r *http.Request
 	return nil
 }
 
-func createPunch(c appengine.Context, punchType string) *appError {
+// createPunch stores a punch of the current user. With an idempotency
+// key in the "idempotency_key" form value or the Idempotency-Key header,
+// a repeated request stores nothing.
+func createPunch(c appengine.Context, r *http.Request, punchType string) *appError {
 	u := user.Current(c)
 	p := Punch{
 		Puncher: u.Email,
 		Type:    punchType,
 		Time:    time.Now(),
 	}
-	key := datastore.NewIncompleteKey(c, "Punch", punchKey(c))
-	_, err := datastore.Put(c, key, &p)
-	if err != nil {
-		return &appError{
-			Error:   err,
-			Message: "Failed to put a punch data to the datastore",
-			Code:    http.StatusInternalServerError,
+	p.setClient(r, punchSourceWeb)
+	if v := r.FormValue("project"); v != "" && punchType == "arrival" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return formValueError(err, "project", `Failed to parse the "%s" parameter as an integer`)
 		}
+		if appErr := checkPunchProject(c, id); appErr != nil {
+			return appErr
+		}
+		p.Project = id
+	}
+	idempotencyKey := r.FormValue("idempotency_key")
+	if idempotencyKey == "" {
+		idempotencyKey = r.Header.Get("Idempotency-Key")
+	}
+	if appErr := checkIdempotencyKey(idempotencyKey); appErr != nil {
+		return appErr
+	}
+
+	key, _, created, err := putPunchOnce(c, &p, idempotencyKey)
+	if err != nil {
+		return punchWriteError(err)
+	}
+	if created {
+		punchCreated(c, newPunchJSON(key, &p))
 	}
 	return nil
 }
 
+// punchCreated tells the live dashboard, the integrations and the
+// webhooks about a new punch.
+func punchCreated(c appengine.Context, p PunchJSON) {
+	publishPunchEvent(c, p)
+	streamPunch(c, p, "create")
+	queueLateArrival(c, p)
+}
+
+const (
+	defaultUsersLimit = 100
+	maxUsersLimit     = 500
+)
+
 func apiAdminUsersHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
 	if r.Method == "GET" {
-		q := datastore.NewQuery("User").Ancestor(punchKey(c)).Order("Name")
-		var users []User
-		if _, err := q.GetAll(c, &users); err != nil {
+		var req ListUsersRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		uq := userQuery{Prefix: req.Q, Sort: req.Sort, Cursor: req.Cursor, Limit: req.Limit}
+		if uq.Limit <= 0 {
+			uq.Limit = defaultUsersLimit
+		} else if uq.Limit > maxUsersLimit {
+			uq.Limit = maxUsersLimit
+		}
+		if !validUserSort(req.Sort) {
+			return nil, &appError{
+				Error:   errors.New("invalid user sort: " + req.Sort),
+				Message: `The "sort" parameter must be name, email or updated, optionally prefixed with "-"`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		if req.Enabled != "" {
+			enabled, err := strconv.ParseBool(req.Enabled)
+			if err != nil {
+				return nil, formValueError(err, "enabled", `Failed to parse the "%s" parameter as a boolean value`)
+			}
+			uq.Enabled = &enabled
+		}
+		keys, users, next, total, err := findUserPage(c, uq)
+		if err == errBadUserCursor {
+			return nil, formValueError(err, "cursor", `The "%s" parameter is invalid or no longer matches a user`)
+		} else if err != nil {
 			return nil, &appError{
 				Error:   err,
 				Message: "Failed to fetch users data from the datastore",
@@ -219,33 +574,40 @@ func apiAdminUsersHandler(c appengine.Context, w http.ResponseWriter, r *http.Re
 			}
 		}
 
-		var jsonUsers []interface{}
-		for _, user := range users {
-			jsonUsers = append(jsonUsers, map[string]interface{}{
-				"email":   user.Email,
-				"name":    user.Name,
-				"enabled": user.Enabled,
-			})
+		jsonUsers := make([]UserJSON, 0, len(users))
+		for i := range users {
+			jsonUsers = append(jsonUsers, newUserJSON(keys[i], &users[i]))
 		}
 
-		return map[string]interface{}{
-			"users": jsonUsers,
-		}, nil
+		return UsersResponse{Users: jsonUsers, NextCursor: next, Total: total}, nil
 
 	} else if r.Method == "POST" {
-		enabled, appErr := getFormBoolValue(r, "enabled", true)
-		if appErr != nil {
+		req := CreateUserRequest{Enabled: true}
+		if appErr := decodeForm(r, &req); appErr != nil {
 			return nil, appErr
 		}
+		if req.Mode == "import" {
+			return importUsers(c, r, req.DryRun)
+		} else if req.Mode != "" {
+			return nil, &appError{
+				Error:   errors.New("invalid user mode: " + req.Mode),
+				Message: `The "mode" parameter must be "import" or empty`,
+				Code:    http.StatusBadRequest,
+			}
+		}
 
-		c.Debugf("formvalues. email=%s, name=%s", r.FormValue("email"), r.FormValue("name"))
+		c.Debugf("formvalues. email=%s, name=%s", req.Email, req.Name)
 		u := User{
-			Email:   r.FormValue("email"),
-			Name:    r.FormValue("name"),
-			Enabled: enabled,
+			Email:   req.Email,
+			Name:    req.Name,
+			Team:    req.Team,
+			Enabled: req.Enabled,
+			Admin:   req.Admin,
+			Version: 1,
+			Updated: time.Now(),
 		}
 		key := datastore.NewIncompleteKey(c, "User", punchKey(c))
-		_, err := datastore.Put(c, key, &u)
+		key, err := datastore.Put(c, key, &u)
 		if err != nil {
 			return nil, &appError{
 				Error:   err,
@@ -254,13 +616,10 @@ func apiAdminUsersHandler(c appengine.Context, w http.ResponseWriter, r *http.Re
 			}
 		}
 
-		return map[string]interface{}{
-			"user": map[string]interface{}{
-				"email":   r.FormValue("email"),
-				"name":    u.Name,
-				"enabled": u.Enabled,
-			},
-		}, nil
+		notifyAccount(c, u.Email, notificationAccountCreated)
+		return UserResponse{User: newUserJSON(key, &u)}, nil
+	} else if r.Method == "PUT" {
+		return updateUser(c, r)
 	} else {
 		err := errors.New("Unsupported http method")
 		return nil, &appError{
@@ -271,19 +630,68 @@ func apiAdminUsersHandler(c appengine.Context, w http.ResponseWriter, r *http.Re
 	}
 }
 
-func getFormBoolValue(r *http.Request, name string, defaultValue bool) (bool, *appError) {
-	boolValue := defaultValue
-	strValue := r.FormValue(name)
-	if strValue != "" {
-		var err error
-		boolValue, err = strconv.ParseBool(strValue)
-		if err != nil {
-			return false, &appError{
-				Error:   err,
-				Message: fmt.Sprintf(`Failed to parse the "%s" parameter as a boolean value`, name),
-				Code:    http.StatusBadRequest,
-			}
+// updateUser applies an UpdateUserRequest unless the user has been
+// updated since the version the request was made from.
+func updateUser(c appengine.Context, r *http.Request) (interface{}, *appError) {
+	var req UpdateUserRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	if r.FormValue("version") == "" {
+		return nil, &appError{
+			Error:   errors.New("missing version"),
+			Message: `The "version" parameter is required`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	key := datastore.NewKey(c, "User", "", req.ID, punchKey(c))
+	var u User
+	conflict, disabled := false, false
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := datastore.Get(tc, key, &u); err != nil {
+			return err
 		}
+		if u.Version != req.Version {
+			conflict = true
+			return nil
+		}
+		wasEnabled := u.Enabled
+		// Fields that aren't given keep their stored value.
+		upd := UpdateUserRequest{Name: u.Name, Team: u.Team, Enabled: u.Enabled, Admin: u.Admin}
+		decodeForm(r, &upd)
+		u.Name = upd.Name
+		u.Team = upd.Team
+		u.Enabled = upd.Enabled
+		u.Admin = upd.Admin
+		u.Version++
+		u.Updated = time.Now()
+		disabled = wasEnabled && !u.Enabled
+		_, err := datastore.Put(tc, key, &u)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, &appError{
+			Error:   err,
+			Message: "No such user",
+			Code:    http.StatusNotFound,
+		}
+	} else if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to put a user data to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if conflict {
+		return nil, &appError{
+			Error:   fmt.Errorf("user %d is at version %d, not %d", req.ID, u.Version, req.Version),
+			Message: "The user has been changed by someone else. Reload and try again",
+			Code:    http.StatusConflict,
+		}
+	}
+	if disabled {
+		notifyAccount(c, u.Email, notificationAccountDisabled)
 	}
-	return boolValue, nil
+	return UserResponse{User: newUserJSON(key, &u)}, nil
 }
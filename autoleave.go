@@ -0,0 +1,85 @@
+package timecard
+
+import (
+	"net/http"
+	"time"
+
+	"appengine"
+)
+
+// Sessions forgotten open are closed at the auto leave hour of the org
+// settings, in their time zone, so that they don't run into the next day
+// and swallow its arrival. The leave is recorded by autoLeaveRecorder and
+// the puncher is notified, since they may have worked past the hour.
+
+const (
+	autoLeaveTaskPath = "/tasks/auto-leave"
+	autoLeaveRecorder = "auto-leave"
+)
+
+// autoLeaveTime returns the first auto leave hour after arrival, in the
+// location of arrival.
+func autoLeaveTime(arrival time.Time, hour int) time.Time {
+	t := time.Date(arrival.Year(), arrival.Month(), arrival.Day(), hour, 0, 0, 0, arrival.Location())
+	if !t.After(arrival) {
+		t = time.Date(arrival.Year(), arrival.Month(), arrival.Day()+1, hour, 0, 0, 0, arrival.Location())
+	}
+	return t
+}
+
+// autoLeaveTaskHandler punches the leaves of the sessions still open at
+// their auto leave hour. It is run hourly by cron, so the leaves are
+// punched within an hour of it. The punch of each session is stored once
+// even if the task is retried.
+func autoLeaveTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	settings, err := getOrgSettings(c)
+	if err != nil {
+		return orgSettingsError(err)
+	}
+	if settings.AutoLeaveHour == 0 {
+		return nil
+	}
+	now := time.Now()
+	_, punches, err := findPunches(c, punchQuery{From: now.Add(-maxSessionLength), To: now, Fields: sessionFields})
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	loc := settings.location()
+	for _, s := range pairSessions(punches) {
+		if !s.Open() {
+			continue
+		}
+		leave := autoLeaveTime(s.Arrival.In(loc), settings.AutoLeaveHour)
+		if leave.After(now) {
+			continue
+		}
+		p := Punch{
+			Puncher:    s.Puncher,
+			Type:       "leave",
+			Time:       leave,
+			RecordedBy: autoLeaveRecorder,
+			Source:     punchSourceAuto,
+		}
+		key, stored, created, err := putPunchOnce(c, &p, autoLeaveRecorder+" "+s.Arrival.Format(time.RFC3339Nano))
+		if err != nil {
+			return punchWriteError(err)
+		}
+		if created {
+			c.Infof("punched the leave of %s at %v", p.Puncher, p.Time)
+			punchCreated(c, newPunchJSON(key, stored))
+			notify(c, p.Puncher, &Notification{
+				Type:      notificationPunchAutoLeave,
+				Message:   "You were punched out automatically at %s",
+				Args:      []string{leave.Format("2006-01-02 15:04 MST")},
+				Link:      "/my/history",
+				PunchTime: leave,
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,579 @@
+package timecard
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/file"
+)
+
+// Backups are ZIP archives in the app's default Cloud Storage bucket
+// holding every User, Punch, PunchEvent and IdempotencyKey, the clients
+// and projects punches refer to, the holidays and workweeks, the
+// webhooks, the settings of the organization and of each user, and the
+// integrations without their keys, as JSON files. Entity IDs are kept so
+// that a backup can be restored over the same entities. punches.csv is
+// there for reading in a spreadsheet and is not used for restoring.
+//
+// A backup is a job. Its steps read the files in batches into the job's
+// chunks, and the last one streams the archive from the chunks to Cloud
+// Storage and deletes them. The entities are read over several requests,
+// so a backup taken while punches are made isn't a snapshot of a single
+// moment.
+
+const (
+	backupTaskPath     = "/tasks/backup"
+	backupObjectPrefix = "backups/"
+	// backupVersion 2 added the org settings, clients, projects,
+	// holidays and workweeks, and 3 the webhooks, the payroll export
+	// format, the user settings and the integrations.
+	backupVersion = 3
+
+	storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+type BackupJSON struct {
+	Version         int                        `json:"version"`
+	Created         time.Time                  `json:"created"`
+	Users           []UserJSON                 `json:"users"`
+	Punches         []PunchJSON                `json:"punches"`
+	PunchEvents     []BackupPunchEventJSON     `json:"punch_events"`
+	IdempotencyKeys []BackupIdempotencyKeyJSON `json:"idempotency_keys"`
+	Theme           ThemeJSON                  `json:"theme"`
+	// RetentionPolicy is only restored from version 1 backups. Later
+	// ones restore the retention with the OrgSettings.
+	RetentionPolicy RetentionPolicyJSON `json:"retention_policy"`
+	OrgSettings     OrgSettingsJSON     `json:"org_settings"`
+	Clients         []ClientJSON        `json:"clients"`
+	Projects        []ProjectJSON       `json:"projects"`
+	Holidays        []HolidayJSON       `json:"holidays"`
+	// Workweeks are the organization's workweek, if it has been set, and
+	// those of the users, which have an email.
+	Workweeks []WorkweekJSON `json:"workweeks"`
+	Webhooks  []WebhookJSON  `json:"webhooks"`
+	// PayrollExportFormat is nil when the default format is used.
+	PayrollExportFormat *PayrollExportFormatJSON `json:"payroll_export_format"`
+	UserSettings        []BackupUserSettingsJSON `json:"user_settings"`
+	// Integrations tell whether the service account keys are set but
+	// leave them out, so restoring keeps the stored ones.
+	Integrations IntegrationsJSON `json:"integrations"`
+}
+
+type BackupManifestJSON struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type BackupPunchEventJSON struct {
+	PunchID int64 `json:"punch_id"`
+	PunchEventJSON
+}
+
+type BackupUserSettingsJSON struct {
+	Email string `json:"email"`
+	UserSettingsJSON
+	Updated time.Time `json:"updated"`
+}
+
+// BackupIdempotencyKeyJSON holds the whole key name, which includes the
+// puncher's email.
+type BackupIdempotencyKeyJSON struct {
+	Name    string    `json:"name"`
+	PunchID int64     `json:"punch_id"`
+	Created time.Time `json:"created"`
+}
+
+// backupFile is a file of a backup archive.
+type backupFile struct {
+	name string
+	// list is whether the file is a JSON array, whose items the chunks
+	// hold separated by commas.
+	list bool
+	// read returns the next chunk of the file from cursor, which is
+	// empty for the first one, with the number of entities in it and the
+	// cursor of the chunk after it, or "" for the last one.
+	read func(c appengine.Context, cursor string) (data []byte, n int, next string, err error)
+}
+
+// backupFiles are read in order, and written to the archive in the same
+// order after the manifest.
+var backupFiles = []backupFile{
+	{"users.json", true, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		var users []User
+		keys, next, err := readBackupBatch(c, datastore.NewQuery("User").Ancestor(punchKey(c)), cursor, &users)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		items := make([]UserJSON, 0, len(users))
+		for i := range users {
+			items = append(items, newUserJSON(keys[i], &users[i]))
+		}
+		data, err := backupListChunk(items)
+		return data, len(items), next, err
+	}},
+	{"punches.json", true, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		keys, punches, next, err := findPunchPage(c, punchQuery{Limit: jobBatchSize, Cursor: cursor, IncludeDeleted: true})
+		if err != nil {
+			return nil, 0, "", err
+		}
+		items := make([]PunchJSON, 0, len(punches))
+		for i := range punches {
+			items = append(items, newPunchJSON(keys[i], &punches[i]))
+		}
+		data, err := backupListChunk(items)
+		return data, len(items), next, err
+	}},
+	{"punch_events.json", true, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		var events []PunchEvent
+		keys, next, err := readBackupBatch(c, datastore.NewQuery("PunchEvent").Ancestor(punchKey(c)), cursor, &events)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		items := make([]BackupPunchEventJSON, 0, len(events))
+		for i := range events {
+			items = append(items, BackupPunchEventJSON{
+				PunchID:        keys[i].Parent().IntID(),
+				PunchEventJSON: newPunchEventJSON(keys[i], &events[i]),
+			})
+		}
+		data, err := backupListChunk(items)
+		return data, len(items), next, err
+	}},
+	{"idempotency_keys.json", true, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		var recs []IdempotencyKey
+		keys, next, err := readBackupBatch(c, datastore.NewQuery("IdempotencyKey").Ancestor(punchKey(c)), cursor, &recs)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		items := make([]BackupIdempotencyKeyJSON, 0, len(recs))
+		for i, rec := range recs {
+			items = append(items, BackupIdempotencyKeyJSON{
+				Name:    keys[i].StringID(),
+				PunchID: rec.Punch.IntID(),
+				Created: rec.Created,
+			})
+		}
+		data, err := backupListChunk(items)
+		return data, len(items), next, err
+	}},
+	{"theme.json", false, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		theme, err := getTheme(c)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		data, err := json.Marshal(newThemeResponse(theme).Theme)
+		return data, 1, "", err
+	}},
+	{"retention_policy.json", false, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		policy, err := getRetentionPolicy(c)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		data, err := json.Marshal(newRetentionPolicyResponse(policy).RetentionPolicy)
+		return data, 1, "", err
+	}},
+	{"org_settings.json", false, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		settings, err := getOrgSettings(c)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		data, err := json.Marshal(newOrgSettingsResponse(settings).Settings)
+		return data, 1, "", err
+	}},
+	// There are few clients, projects, holidays, workweeks and webhooks,
+	// so each is read at once.
+	{"clients.json", true, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		keys, clients, err := findClients(c)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		items := make([]ClientJSON, 0, len(clients))
+		for i := range clients {
+			items = append(items, newClientJSON(keys[i], &clients[i]))
+		}
+		data, err := backupListChunk(items)
+		return data, len(items), "", err
+	}},
+	{"projects.json", true, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		keys, projects, err := findProjects(c)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		items := make([]ProjectJSON, 0, len(projects))
+		for i := range projects {
+			items = append(items, newProjectJSON(keys[i], &projects[i]))
+		}
+		data, err := backupListChunk(items)
+		return data, len(items), "", err
+	}},
+	{"holidays.json", true, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		var holidays []Holiday
+		keys, err := datastore.NewQuery("Holiday").Ancestor(punchKey(c)).GetAll(c, &holidays)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		items := make([]HolidayJSON, 0, len(holidays))
+		for i := range holidays {
+			items = append(items, HolidayJSON{Date: keys[i].StringID(), Name: holidays[i].Name})
+		}
+		data, err := backupListChunk(items)
+		return data, len(items), "", err
+	}},
+	{"workweeks.json", true, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		items := []WorkweekJSON{}
+		org, err := getWorkweek(c, workweekKey(c))
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if org != nil {
+			items = append(items, newWorkweekResponse("", org, false).Workweek)
+		}
+		var weeks []Workweek
+		keys, err := datastore.NewQuery("UserWorkweek").Ancestor(punchKey(c)).GetAll(c, &weeks)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		for i := range weeks {
+			items = append(items, newWorkweekResponse(keys[i].StringID(), &weeks[i], false).Workweek)
+		}
+		data, err := backupListChunk(items)
+		return data, len(items), "", err
+	}},
+	{"webhooks.json", true, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		keys, hooks, err := findWebhooks(c)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		items := make([]WebhookJSON, 0, len(hooks))
+		for i := range hooks {
+			items = append(items, newWebhookJSON(keys[i], &hooks[i]))
+		}
+		data, err := backupListChunk(items)
+		return data, len(items), "", err
+	}},
+	{"payroll_export_format.json", false, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		var format PayrollExportFormat
+		err := datastore.Get(c, payrollExportFormatKey(c), &format)
+		if err == datastore.ErrNoSuchEntity {
+			return []byte("null"), 0, "", nil
+		} else if err != nil {
+			return nil, 0, "", err
+		}
+		data, err := json.Marshal(newPayrollExportFormatResponse(&format).Format)
+		return data, 1, "", err
+	}},
+	{"user_settings.json", true, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		var settings []UserSettings
+		keys, next, err := readBackupBatch(c, datastore.NewQuery("UserSettings").Ancestor(punchKey(c)), cursor, &settings)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		items := make([]BackupUserSettingsJSON, 0, len(settings))
+		for i := range settings {
+			items = append(items, BackupUserSettingsJSON{
+				Email:            keys[i].StringID(),
+				UserSettingsJSON: newUserSettingsResponse(&settings[i]).Settings,
+				Updated:          settings[i].Updated,
+			})
+		}
+		data, err := backupListChunk(items)
+		return data, len(items), next, err
+	}},
+	{"integrations.json", false, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		in, err := getIntegrations(c)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		data, err := json.Marshal(newIntegrationsResponse(in).Integrations)
+		return data, 1, "", err
+	}},
+	// punches.csv reads the punches again rather than parsing them back
+	// from the chunks of punches.json.
+	{"punches.csv", false, func(c appengine.Context, cursor string) ([]byte, int, string, error) {
+		keys, punches, next, err := findPunchPage(c, punchQuery{Limit: jobBatchSize, Cursor: cursor, IncludeDeleted: true})
+		if err != nil {
+			return nil, 0, "", err
+		}
+		var buf bytes.Buffer
+		cw := csv.NewWriter(&buf)
+		if cursor == "" {
+			cw.Write([]string{"id", "puncher", "type", "time"})
+		}
+		for i, p := range punches {
+			cw.Write([]string{strconv.FormatInt(keys[i].IntID(), 10), p.Puncher, p.Type, p.Time.Format(time.RFC3339)})
+		}
+		cw.Flush()
+		return buf.Bytes(), 0, next, cw.Error()
+	}},
+}
+
+// readBackupBatch reads up to jobBatchSize entities of q from cursor into
+// dst, a pointer to a slice, and returns their keys and the cursor after
+// them, or "" when there are no more.
+func readBackupBatch(c appengine.Context, q *datastore.Query, cursor string, dst interface{}) ([]*datastore.Key, string, error) {
+	if cursor != "" {
+		dc, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(dc)
+	}
+	sv := reflect.ValueOf(dst).Elem()
+	var keys []*datastore.Key
+	t := q.Limit(jobBatchSize).Run(c)
+	for {
+		ev := reflect.New(sv.Type().Elem())
+		key, err := t.Next(ev.Interface())
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, key)
+		sv.Set(reflect.Append(sv, ev.Elem()))
+	}
+	if len(keys) < jobBatchSize {
+		return keys, "", nil
+	}
+	dc, err := t.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, dc.String(), nil
+}
+
+// backupListChunk encodes items, a non-nil slice, as a chunk of a list
+// file.
+func backupListChunk(items interface{}) ([]byte, error) {
+	b, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	return b[1 : len(b)-1], nil
+}
+
+func backupFileIndex(name string) int {
+	for i := range backupFiles {
+		if backupFiles[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// The Cursor of a backup job is the name of the file being read and the
+// cursor in it separated by a space, then backupUploadCursor and
+// backupCleanupCursor for the last two steps.
+const (
+	backupUploadCursor  = "upload"
+	backupCleanupCursor = "cleanup"
+)
+
+// backupStep reads the next chunk of the file being read into the chunk
+// of the step. After the last file it uploads the archive, and then
+// deletes the chunks.
+func backupStep(c appengine.Context, key *datastore.Key, job *Job, params url.Values) (bool, error) {
+	switch job.Cursor {
+	case backupUploadCursor:
+		created, err := time.Parse(time.RFC3339Nano, params.Get("created"))
+		if err != nil {
+			return false, err
+		}
+		if err := uploadBackup(c, key, job, created); err != nil {
+			return false, err
+		}
+		job.Cursor = backupCleanupCursor
+		return true, nil
+	case backupCleanupCursor:
+		return false, deleteJobChunks(c, key)
+	}
+
+	name, cursor := backupFiles[0].name, ""
+	if job.Cursor != "" {
+		name = job.Cursor
+		if i := strings.Index(job.Cursor, " "); i >= 0 {
+			name, cursor = job.Cursor[:i], job.Cursor[i+1:]
+		}
+	}
+	i := backupFileIndex(name)
+	if i < 0 {
+		return false, errors.New("unknown backup file: " + name)
+	}
+	data, n, next, err := backupFiles[i].read(c, cursor)
+	if err != nil {
+		return false, err
+	}
+	chunk := &JobChunk{Name: name, Data: data}
+	if _, err := datastore.Put(c, jobChunkKey(c, key, job.Steps+1), chunk); err != nil {
+		return false, err
+	}
+	job.Processed += n
+	if next != "" {
+		job.Cursor = name + " " + next
+	} else if i+1 < len(backupFiles) {
+		job.Cursor = backupFiles[i+1].name
+	} else {
+		job.Cursor = backupUploadCursor
+	}
+	return true, nil
+}
+
+// uploadBackup streams the archive of the backup job from its chunks to
+// Cloud Storage.
+func uploadBackup(c appengine.Context, key *datastore.Key, job *Job, created time.Time) error {
+	bucket, err := file.DefaultBucketName(c)
+	if err != nil {
+		return err
+	}
+	name := backupObjectPrefix + "timecard-" + created.UTC().Format("20060102-150405") + ".zip"
+	if ns := contextNamespace(c); ns != "" {
+		name = backupObjectPrefix + ns + "/timecard-" + created.UTC().Format("20060102-150405") + ".zip"
+	}
+
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := writeBackupArchive(c, key, created, pw)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	err = putStorageObject(c, bucket, name, "application/zip", pr)
+	// Unblock the writer if the upload stopped reading.
+	pr.CloseWithError(errors.New("the upload has ended"))
+	if werr := <-written; err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	c.Infof("backed up %d entities to gs://%s/%s", job.Processed, bucket, name)
+	return nil
+}
+
+// deleteJobChunks deletes the chunks of the job.
+func deleteJobChunks(c appengine.Context, key *datastore.Key) error {
+	keys, err := datastore.NewQuery("JobChunk").Ancestor(key).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += jobBatchSize {
+		end := start + jobBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := datastore.DeleteMulti(c, keys[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBackupArchive writes the archive of the backup job to w, reading
+// its chunks one at a time. The chunks of each file follow each other,
+// in the order of backupFiles.
+func writeBackupArchive(c appengine.Context, key *datastore.Key, created time.Time, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	if err := writeZipJSON(zw, "manifest.json", created, BackupManifestJSON{Version: backupVersion, Created: created}); err != nil {
+		return err
+	}
+	var f *backupFile
+	var fw io.Writer
+	empty := true
+	end := func() error {
+		if f != nil && f.list {
+			_, err := io.WriteString(fw, "]")
+			return err
+		}
+		return nil
+	}
+	for t := datastore.NewQuery("JobChunk").Ancestor(key).Order("__key__").Run(c); ; {
+		var chunk JobChunk
+		if _, err := t.Next(&chunk); err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		if f == nil || chunk.Name != f.name {
+			if err := end(); err != nil {
+				return err
+			}
+			i := backupFileIndex(chunk.Name)
+			if i < 0 {
+				return errors.New("unknown backup file: " + chunk.Name)
+			}
+			f = &backupFiles[i]
+			fh := &zip.FileHeader{Name: f.name, Method: zip.Deflate}
+			fh.SetModTime(created)
+			var err error
+			if fw, err = zw.CreateHeader(fh); err != nil {
+				return err
+			}
+			if f.list {
+				if _, err := io.WriteString(fw, "["); err != nil {
+					return err
+				}
+			}
+			empty = true
+		}
+		if len(chunk.Data) == 0 {
+			continue
+		}
+		if f.list && !empty {
+			if _, err := io.WriteString(fw, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := fw.Write(chunk.Data); err != nil {
+			return err
+		}
+		empty = false
+	}
+	if err := end(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func putStorageObject(c appengine.Context, bucket, name, contentType string, body io.Reader) error {
+	client, err := googleClient(c, storageScope)
+	if err != nil {
+		return err
+	}
+	u := "https://www.googleapis.com/upload/storage/v1/b/" + url.QueryEscape(bucket) +
+		"/o?uploadType=media&name=" + url.QueryEscape(name)
+	resp, err := client.Post(u, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return googleAPIError("cloud storage", resp)
+	}
+	return nil
+}
+
+// backupTaskHandler starts a backup job, whose archive is named after
+// the current time. It is run daily by cron.
+func backupTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	params := url.Values{"created": {time.Now().Format(time.RFC3339Nano)}}
+	if _, _, err := startJob(c, jobKindBackup, params, "cron"); err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to create a backup",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return nil
+}
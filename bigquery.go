@@ -0,0 +1,220 @@
+package timecard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"appengine"
+	"appengine/taskqueue"
+)
+
+// Punch events are streamed to the configured BigQuery table on the
+// "bigquery" queue, so that a BigQuery outage delays the rows instead of
+// failing punches. The table needs this schema:
+//
+//	id:INTEGER, puncher:STRING, type:STRING, time:TIMESTAMP,
+//	event:STRING, recorded:TIMESTAMP
+//
+// Rows carry an insert ID so that retried tasks don't duplicate them.
+
+const (
+	bigQueryScope        = "https://www.googleapis.com/auth/bigquery.insertdata"
+	bigQueryQueue        = "bigquery"
+	bigQueryInsertPath   = "/tasks/bigquery/insert"
+	bigQueryBackfillPath = "/tasks/bigquery/backfill"
+	bigQueryBatchSize    = 500
+)
+
+type bigQueryRow struct {
+	ID       int64     `json:"id"`
+	Puncher  string    `json:"puncher"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Recorded time.Time `json:"recorded"`
+}
+
+func newBigQueryRow(p PunchJSON, event string, recorded time.Time) bigQueryRow {
+	return bigQueryRow{
+		ID:       p.ID,
+		Puncher:  p.Puncher,
+		Type:     p.Type,
+		Time:     p.Time,
+		Event:    event,
+		Recorded: recorded,
+	}
+}
+
+func (in *Integrations) bigQueryEnabled() bool {
+	return in.BigQueryDataset != "" && in.BigQueryTable != ""
+}
+
+// streamPunch queues an event about p for BigQuery. Failures are only
+// logged since the punch itself has been stored.
+func streamPunch(c appengine.Context, p PunchJSON, event string) {
+	in, err := getIntegrations(c)
+	if err != nil {
+		c.Errorf("failed to get the integrations: %v", err)
+		return
+	}
+	if !in.bigQueryEnabled() {
+		return
+	}
+	b, err := json.Marshal(newBigQueryRow(p, event, time.Now()))
+	if err == nil {
+		err = addTask(c, taskqueue.NewPOSTTask(bigQueryInsertPath, url.Values{"row": {string(b)}}), bigQueryQueue)
+	}
+	if err != nil {
+		c.Errorf("failed to queue a punch for BigQuery: %v", err)
+	}
+}
+
+func insertBigQueryRows(c appengine.Context, in *Integrations, rows []bigQueryRow) error {
+	type insertRow struct {
+		InsertID string      `json:"insertId"`
+		JSON     bigQueryRow `json:"json"`
+	}
+	req := struct {
+		Rows []insertRow `json:"rows"`
+	}{}
+	for _, row := range rows {
+		req.Rows = append(req.Rows, insertRow{
+			InsertID: fmt.Sprintf("%d-%s-%d", row.ID, row.Event, row.Recorded.UnixNano()),
+			JSON:     row,
+		})
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	project := in.BigQueryProject
+	if project == "" {
+		project = appengine.AppID(c)
+	}
+	client, err := googleClient(c, bigQueryScope)
+	if err != nil {
+		return err
+	}
+	u := "https://www.googleapis.com/bigquery/v2/projects/" + url.QueryEscape(project) +
+		"/datasets/" + in.BigQueryDataset + "/tables/" + in.BigQueryTable + "/insertAll"
+	resp, err := client.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return googleAPIError("bigquery", resp)
+	}
+	var res struct {
+		InsertErrors []json.RawMessage `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if len(res.InsertErrors) > 0 {
+		return fmt.Errorf("bigquery: %d rows rejected, first: %s", len(res.InsertErrors), res.InsertErrors[0])
+	}
+	return nil
+}
+
+func bigQueryError(err error) *appError {
+	return &appError{
+		Error:   err,
+		Message: "Failed to send punches to BigQuery",
+		Code:    http.StatusInternalServerError,
+	}
+}
+
+func bigQueryInsertTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	var row bigQueryRow
+	if err := json.Unmarshal([]byte(r.FormValue("row")), &row); err != nil {
+		return formValueError(err, "row", `Failed to parse the "%s" parameter as a JSON object`)
+	}
+	in, err := getIntegrations(c)
+	if err != nil {
+		return bigQueryError(err)
+	}
+	if !in.bigQueryEnabled() {
+		return nil
+	}
+	if err := insertBigQueryRows(c, in, []bigQueryRow{row}); err != nil {
+		return bigQueryError(err)
+	}
+	return nil
+}
+
+// bigQueryBackfillTaskHandler sends one batch of existing punches, oldest
+// first, and enqueues itself with the cursor for the next batch.
+func bigQueryBackfillTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	in, err := getIntegrations(c)
+	if err != nil {
+		return bigQueryError(err)
+	}
+	if !in.bigQueryEnabled() {
+		return nil
+	}
+	keys, punches, next, err := findPunchPage(c, punchQuery{Limit: bigQueryBatchSize, Cursor: r.FormValue("cursor")})
+	if err != nil {
+		return bigQueryError(err)
+	}
+	if len(punches) == 0 {
+		return nil
+	}
+	// The recorded time of a backfilled row is that of the punch, so that
+	// running the backfill again gives the same insert IDs.
+	rows := make([]bigQueryRow, 0, len(punches))
+	for i := range punches {
+		rows = append(rows, newBigQueryRow(newPunchJSON(keys[i], &punches[i]), "backfill", punches[i].Time))
+	}
+	if err := insertBigQueryRows(c, in, rows); err != nil {
+		return bigQueryError(err)
+	}
+	if next != "" {
+		t := taskqueue.NewPOSTTask(bigQueryBackfillPath, url.Values{"cursor": {next}})
+		if err := addTask(c, t, bigQueryQueue); err != nil {
+			return bigQueryError(err)
+		}
+	}
+	return nil
+}
+
+type BigQueryBackfillResponse struct {
+	Queued bool `json:"queued"`
+}
+
+func apiAdminBigQueryBackfillHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method != "POST" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	in, err := getIntegrations(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the integrations from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if !in.bigQueryEnabled() {
+		err := errors.New("BigQuery is not configured")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if err := addTask(c, taskqueue.NewPOSTTask(bigQueryBackfillPath, nil), bigQueryQueue); err != nil {
+		return nil, bigQueryError(err)
+	}
+	return BigQueryBackfillResponse{Queued: true}, nil
+}
@@ -0,0 +1,121 @@
+package timecard
+
+import (
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/user"
+)
+
+type calendarDay struct {
+	Date    time.Time
+	InMonth bool
+	// Workday is whether the day is a workday of the workweek, and
+	// Holiday the name of the holiday on it, if any.
+	Workday bool
+	Holiday string
+	Worked  time.Duration
+}
+
+type calendarMonth struct {
+	Month time.Time
+	Weeks [][]calendarDay
+	Total time.Duration
+}
+
+// parseMonth parses a month given as 2006-01. An empty value gives the
+// current month.
+func parseMonth(value string, now time.Time) (time.Time, *appError) {
+	if value == "" {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()), nil
+	}
+	t, err := time.ParseInLocation("2006-01", value, now.Location())
+	if err != nil {
+		return time.Time{}, formValueError(err, "month", `Failed to parse the "%s" parameter as a month (YYYY-MM)`)
+	}
+	return t, nil
+}
+
+// buildCalendarMonth lays out the weeks (Sunday first) covering month
+// with the worked time of each day from the daily summaries, marking the
+// workdays of w and the holidays.
+func buildCalendarMonth(month time.Time, summaries []DailySummary, w *Workweek, holidays map[string]string) *calendarMonth {
+	worked := make(map[string]time.Duration)
+	for _, s := range summaries {
+		worked[s.Date] += s.Worked
+	}
+
+	cal := &calendarMonth{Month: month}
+	next := month.AddDate(0, 1, 0)
+	day := month.AddDate(0, 0, -int(month.Weekday()))
+	for day.Before(next) {
+		week := make([]calendarDay, 7)
+		for i := range week {
+			d := calendarDay{
+				Date:    day,
+				InMonth: day.Month() == month.Month(),
+				Workday: w.isWorkday(day, holidays),
+				Holiday: holidays[day.Format("2006-01-02")],
+			}
+			if d.InMonth {
+				d.Worked = worked[day.Format("2006-01-02")]
+				cal.Total += d.Worked
+			}
+			week[i] = d
+			day = day.AddDate(0, 0, 1)
+		}
+		cal.Weeks = append(cal.Weeks, week)
+	}
+	return cal
+}
+
+func myCalendarHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	now := requestViewer(r).Now()
+	month, appErr := parseMonth(r.FormValue("month"), now)
+	if appErr != nil {
+		return appErr
+	}
+
+	email := user.Current(c).Email
+	end := month.AddDate(0, 1, 0)
+	sessions, err := findSessions(c, punchQuery{
+		Puncher: email,
+		From:    month,
+		To:      end,
+		Fields:  sessionFields,
+	})
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	policy, err := getOvernightPolicy(c)
+	if err != nil {
+		return overnightPolicyError(err)
+	}
+	ww, err := findWorkweeks(c)
+	if err != nil {
+		return workweekError(err)
+	}
+	holidays, err := findHolidays(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the holidays from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	summaries := summarizeDays(sessions, month, end, policy.split(), now)
+	data := map[string]interface{}{
+		"Calendar": buildCalendarMonth(month, summaries, ww.of(email), holidays),
+		"Prev":     month.AddDate(0, -1, 0).Format("2006-01"),
+		"Next":     month.AddDate(0, 1, 0).Format("2006-01"),
+	}
+	return renderTemplate(c, w, r, calendarTemplate, data)
+}
+
+var calendarTemplate = parsePage("calendar")
@@ -0,0 +1,382 @@
+// Command timecard punches and reads reports on a timecard server from
+// the terminal, authenticating with an API token created on the server's
+// /my/tokens page.
+//
+// Usage:
+//
+//	timecard [-url URL] [-token TOKEN] [-timezone ZONE] <command> [flags]
+//
+// The commands are:
+//
+//	in [-project ID] [-force]   clock in
+//	out [-force]                clock out
+//	status [-json]              show whether you are clocked in
+//	report [-week | -month] [-date YYYY-MM-DD] [-json]
+//	                            show the time worked per day of a week or
+//	                            a month
+//
+// The server URL and the token default to the TIMECARD_URL and
+// TIMECARD_TOKEN environment variables, and the time zone, which days
+// are grouped in, to TZ or the system time zone.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The shapes of the client API responses, as served under /client/v1.
+
+type punchJSON struct {
+	ID      int64     `json:"id"`
+	Puncher string    `json:"puncher"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Project int64     `json:"project,omitempty"`
+}
+
+type statusResponse struct {
+	Puncher   string     `json:"puncher"`
+	In        bool       `json:"in"`
+	Since     *time.Time `json:"since,omitempty"`
+	LastPunch *punchJSON `json:"last_punch,omitempty"`
+}
+
+type punchResponse struct {
+	Punch punchJSON `json:"punch"`
+}
+
+type statsSeriesJSON struct {
+	Labels   []string `json:"labels"`
+	Minutes  []int    `json:"minutes"`
+	Expected []int    `json:"expected"`
+}
+
+type statsResponse struct {
+	From           string          `json:"from"`
+	To             string          `json:"to"`
+	Days           statsSeriesJSON `json:"days"`
+	Weeks          statsSeriesJSON `json:"weeks"`
+	BalanceMinutes int             `json:"balance_minutes"`
+}
+
+type errorResponse struct {
+	Error struct {
+		Code      int    `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+	} `json:"error"`
+}
+
+type client struct {
+	baseURL  string
+	token    string
+	timezone string
+	location *time.Location
+	http     *http.Client
+}
+
+// do sends a request to the client API and decodes the JSON response into
+// res. Errors of the server are returned with their message.
+func (c *client) do(method, path string, form url.Values, res interface{}) error {
+	u := strings.TrimRight(c.baseURL, "/") + "/client/v1" + path
+	var body io.Reader
+	if method == "GET" && len(form) > 0 {
+		u += "?" + form.Encode()
+	} else if len(form) > 0 {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.timezone != "" {
+		// The server renders and groups days in the zone of this cookie.
+		req.AddCookie(&http.Cookie{Name: "timezone", Value: c.timezone})
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e errorResponse
+		if err := json.Unmarshal(b, &e); err == nil && e.Error.Message != "" {
+			return fmt.Errorf("%s (%d, request %s)", e.Error.Message, e.Error.Code, e.Error.RequestID)
+		}
+		return fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	}
+	return json.Unmarshal(b, res)
+}
+
+func (c *client) status() (*statusResponse, error) {
+	var res statusResponse
+	if err := c.do("GET", "/status", nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (c *client) punch(punchType, project string) (*punchResponse, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"type":            {punchType},
+		"time":            {time.Now().Format(time.RFC3339)},
+		"idempotency_key": {hex.EncodeToString(key)},
+	}
+	if project != "" {
+		form.Set("project", project)
+	}
+	var res punchResponse
+	if err := c.do("POST", "/punches", form, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (c *client) stats(from, to time.Time) (*statsResponse, error) {
+	form := url.Values{"from": {from.Format("2006-01-02")}, "to": {to.Format("2006-01-02")}}
+	var res statsResponse
+	if err := c.do("GET", "/stats", form, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (c *client) formatTime(t time.Time) string {
+	t = t.In(c.location)
+	now := time.Now().In(c.location)
+	if t.Year() == now.Year() && t.YearDay() == now.YearDay() {
+		return t.Format("15:04")
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+func formatMinutes(m int) string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s%d:%02d", sign, m/60, m%60)
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", b)
+	return nil
+}
+
+func statusCommand(c *client, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	fs.Parse(args)
+	s, err := c.status()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(s)
+	}
+	switch {
+	case s.In:
+		fmt.Printf("IN since %s\n", c.formatTime(*s.Since))
+	case s.Since != nil:
+		fmt.Printf("OUT since %s\n", c.formatTime(*s.Since))
+	default:
+		fmt.Println("OUT")
+	}
+	return nil
+}
+
+// punchCommand clocks in or out. Since punching in twice is most likely
+// a mistake, it refuses to unless forced.
+func punchCommand(c *client, punchType string, args []string) error {
+	fs := flag.NewFlagSet(map[string]string{"arrival": "in", "leave": "out"}[punchType], flag.ExitOnError)
+	project := ""
+	if punchType == "arrival" {
+		fs.StringVar(&project, "project", "", "the ID of the project to work on")
+	}
+	force := fs.Bool("force", false, "punch even if already clocked "+fs.Name())
+	fs.Parse(args)
+	if !*force {
+		s, err := c.status()
+		if err != nil {
+			return err
+		}
+		if s.In == (punchType == "arrival") && s.Since != nil {
+			return fmt.Errorf("already clocked %s since %s; use -force to punch anyway", fs.Name(), c.formatTime(*s.Since))
+		} else if s.Since == nil && punchType == "leave" {
+			return errors.New("not clocked in; use -force to punch anyway")
+		}
+	}
+	res, err := c.punch(punchType, project)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Clocked %s at %s\n", fs.Name(), c.formatTime(res.Punch.Time))
+	return nil
+}
+
+func reportCommand(c *client, args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	week := fs.Bool("week", false, "report the week from Monday (the default)")
+	month := fs.Bool("month", false, "report the month")
+	date := fs.String("date", "", "a day of the week or month to report, as YYYY-MM-DD; defaults to today")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+	if *week && *month {
+		return errors.New("-week and -month can't be used together")
+	}
+
+	now := time.Now().In(c.location)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, c.location)
+	if *date != "" {
+		t, err := time.ParseInLocation("2006-01-02", *date, c.location)
+		if err != nil {
+			return fmt.Errorf("failed to parse -date as YYYY-MM-DD: %v", err)
+		}
+		day = t
+	}
+	var from, to time.Time
+	if *month {
+		from = time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, c.location)
+		to = from.AddDate(0, 1, -1)
+	} else {
+		from = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		to = from.AddDate(0, 0, 6)
+	}
+	s, err := c.stats(from, to)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(s)
+	}
+
+	if *month {
+		fmt.Printf("%s\n\n", from.Format("2006-01"))
+	} else {
+		fmt.Printf("Week of %s\n\n", from.Format("2006-01-02"))
+	}
+	fmt.Printf("%-15s %8s %8s\n", "Date", "Worked", "Expected")
+	var worked, expected int
+	for i, label := range s.Days.Labels {
+		d, err := time.Parse("2006-01-02", label)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-15s %8s %8s\n", d.Format("Mon 2006-01-02"), formatMinutes(s.Days.Minutes[i]), formatMinutes(s.Days.Expected[i]))
+		worked += s.Days.Minutes[i]
+		expected += s.Days.Expected[i]
+	}
+	fmt.Printf("%-15s %8s %8s\n", "Total", formatMinutes(worked), formatMinutes(expected))
+	fmt.Printf("\nBalance until today: %s\n", formatMinutes(s.BalanceMinutes))
+	return nil
+}
+
+// localTimezone returns the IANA name of the system time zone, which the
+// server needs rather than the offsets of time.Local.
+func localTimezone() string {
+	if tz := os.Getenv("TZ"); tz != "" {
+		return strings.TrimPrefix(tz, ":")
+	}
+	if link, err := os.Readlink("/etc/localtime"); err == nil {
+		if i := strings.Index(link, "zoneinfo/"); i >= 0 {
+			return link[i+len("zoneinfo/"):]
+		}
+	}
+	return ""
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: timecard [flags] <command> [command flags]
+
+Commands:
+  in       clock in
+  out      clock out
+  status   show whether you are clocked in
+  report   show the time worked per day of a week (-week) or a month (-month)
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	baseURL := flag.String("url", os.Getenv("TIMECARD_URL"), "the URL of the timecard server, like https://timecard.example.com")
+	token := flag.String("token", os.Getenv("TIMECARD_TOKEN"), "the API token created on the server's /my/tokens page")
+	timezone := flag.String("timezone", localTimezone(), "the time zone days are grouped in, like Asia/Tokyo")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if *baseURL == "" || *token == "" {
+		fmt.Fprintln(os.Stderr, "timecard: set the server with -url or TIMECARD_URL, and the token with -token or TIMECARD_TOKEN")
+		os.Exit(2)
+	}
+
+	c := &client{
+		baseURL:  *baseURL,
+		token:    *token,
+		timezone: *timezone,
+		location: time.Local,
+		http:     &http.Client{Timeout: 30 * time.Second},
+	}
+	if *timezone != "" {
+		loc, err := time.LoadLocation(*timezone)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "timecard: unknown time zone %s: %v\n", *timezone, err)
+			os.Exit(2)
+		}
+		c.location = loc
+	}
+
+	args := flag.Args()
+	var err error
+	switch args[0] {
+	case "in":
+		err = punchCommand(c, "arrival", args[1:])
+	case "out":
+		err = punchCommand(c, "leave", args[1:])
+	case "status":
+		err = statusCommand(c, args[1:])
+	case "report":
+		err = reportCommand(c, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "timecard: unknown command %s\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "timecard: %v\n", err)
+		os.Exit(1)
+	}
+}
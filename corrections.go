@@ -0,0 +1,166 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// Admins record punches for employees who couldn't punch, and correct
+// the type and time of punches. Either way the admin is stored as the
+// punch's RecordedBy and is the actor of the change in its history.
+
+type RecordPunchRequest struct {
+	Puncher string `form:"puncher"`
+	Type    string `form:"type"`
+	// Time defaults to now.
+	Time           string `form:"time"`
+	IdempotencyKey string `form:"idempotency_key"`
+	// Project is only kept on arrivals.
+	Project int64 `form:"project"`
+}
+
+type CorrectPunchRequest struct {
+	ID int64 `form:"id"`
+	// Type and Time keep their stored value when they aren't given.
+	Type string `form:"type"`
+	Time string `form:"time"`
+}
+
+// parseAdminPunch validates the type and the time of a punch made by an
+// admin. Unlike the punches of the puncher, it may be any time up to now.
+func parseAdminPunch(p *Punch, punchType, punchTime string) *appError {
+	if punchType != "arrival" && punchType != "leave" {
+		return &appError{
+			Error:   errors.New("invalid punch type: " + punchType),
+			Message: `The "type" parameter must be "arrival" or "leave"`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	p.Type = punchType
+	if punchTime == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, punchTime)
+	if err != nil {
+		return formValueError(err, "time", `Failed to parse the "%s" parameter as an RFC 3339 time`)
+	}
+	if t.After(time.Now().Add(maxPunchClockSkew)) {
+		return &appError{
+			Error:   fmt.Errorf("punch time in the future: %v", t),
+			Message: "The punch time can't be in the future",
+			Code:    http.StatusBadRequest,
+		}
+	}
+	p.Time = t
+	return nil
+}
+
+func recordPunchFor(c appengine.Context, r *http.Request) (interface{}, *appError) {
+	req := RecordPunchRequest{IdempotencyKey: r.Header.Get("Idempotency-Key")}
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	if appErr := checkIdempotencyKey(req.IdempotencyKey); appErr != nil {
+		return nil, appErr
+	}
+	_, u, err := findUserByEmail(c, req.Puncher)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if u == nil {
+		return nil, &appError{
+			Error:   errors.New("no user for puncher " + req.Puncher),
+			Message: `The "puncher" parameter must be the email of a user`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	p := Punch{Puncher: u.Email, Time: time.Now()}
+	p.setClient(r, punchSourceWeb)
+	if appErr := parseAdminPunch(&p, req.Type, req.Time); appErr != nil {
+		return nil, appErr
+	}
+	if p.Type == "arrival" {
+		if appErr := checkPunchProject(c, req.Project); appErr != nil {
+			return nil, appErr
+		}
+		p.Project = req.Project
+	}
+	if actor := user.Current(c).Email; actor != p.Puncher {
+		p.RecordedBy = actor
+	}
+	key, stored, created, err := putPunchOnce(c, &p, req.IdempotencyKey)
+	if err != nil {
+		return nil, punchWriteError(err)
+	}
+	res := PunchResponse{Punch: newPunchJSON(key, stored)}
+	if created {
+		c.Infof("%s recorded the %s of %s at %v", p.RecordedBy, p.Type, p.Puncher, p.Time)
+		punchCreated(c, res.Punch)
+		notifyPunchChanged(c, &p, p.recorder(), notificationPunchRecorded)
+	}
+	return res, nil
+}
+
+func correctPunch(c appengine.Context, r *http.Request) (interface{}, *appError) {
+	var req CorrectPunchRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	actor := user.Current(c).Email
+	key := datastore.NewKey(c, "Punch", "", req.ID, punchKey(c))
+	var p Punch
+	var appErr *appError
+	changed := false
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := datastore.Get(tc, key, &p); err != nil {
+			return err
+		}
+		if !p.DeletedAt.IsZero() {
+			return errPunchInTrash
+		}
+		punchType := req.Type
+		if punchType == "" {
+			punchType = p.Type
+		}
+		prevType, prevTime := p.Type, p.Time
+		if appErr = parseAdminPunch(&p, punchType, req.Time); appErr != nil {
+			return nil
+		}
+		// A correction to the same type and time leaves the punch and
+		// its history as they are.
+		if changed = p.Type != prevType || !p.Time.Equal(prevTime); !changed {
+			return nil
+		}
+		p.RecordedBy = actor
+		if err := recordPunchEvent(tc, key, &p, punchEventEdited, actor); err != nil {
+			return err
+		}
+		_, err := datastore.Put(tc, key, &p)
+		return err
+	}, punchTransactionOptions)
+	if err != nil {
+		return nil, punchChangeError(err)
+	}
+	if appErr != nil {
+		return nil, appErr
+	}
+	res := PunchResponse{Punch: newPunchJSON(key, &p)}
+	if !changed {
+		return res, nil
+	}
+	c.Infof("%s corrected punch %d of %s to the %s at %v", actor, req.ID, p.Puncher, p.Type, p.Time)
+	streamPunch(c, res.Punch, "edit")
+	notifyPunchChanged(c, &p, actor, notificationPunchCorrected)
+	return res, nil
+}
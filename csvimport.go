@@ -0,0 +1,89 @@
+package timecard
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// Admins import punches and users from CSV files with a header row naming
+// the columns, which may come in any order. Every row is validated before
+// anything is stored, and the invalid rows are reported by number.
+
+// CSVRowErrorJSON reports an invalid row of an uploaded CSV file.
+type CSVRowErrorJSON struct {
+	// Row is the number of the row in the file, the header being row 1.
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+func newCSVRowError(r *http.Request, row int, msg string, args ...interface{}) CSVRowErrorJSON {
+	return CSVRowErrorJSON{Row: row, Message: requestLocale(r).T(msg, args...)}
+}
+
+// csvUpload opens the CSV "file" of a multipart request.
+func csvUpload(r *http.Request) (multipart.File, *appError) {
+	f, _, err := r.FormFile("file")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return nil, &appError{
+			Error:   err,
+			Message: `A CSV "file" is required`,
+			Code:    http.StatusBadRequest,
+		}
+	} else if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to read the CSV file",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return f, nil
+}
+
+// csvColumns are the indexes of the columns of a CSV file by their lower
+// cased names.
+type csvColumns map[string]int
+
+// readCSVHeader reads the header row of a file, which must have the
+// required columns. message tells which columns the file has.
+func readCSVHeader(cr *csv.Reader, required []string, message string) (csvColumns, *appError) {
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil && err != io.EOF {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to parse the CSV file",
+			Code:    http.StatusBadRequest,
+		}
+	}
+	columns := make(csvColumns)
+	for i, name := range header {
+		// Spreadsheets may start the file with a byte order mark.
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		columns[name] = i
+	}
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return nil, &appError{
+				Error:   errors.New("missing column " + name),
+				Message: message,
+				Code:    http.StatusBadRequest,
+			}
+		}
+	}
+	return columns, nil
+}
+
+// get returns the trimmed value of the column name of record, or empty if
+// there is no such column.
+func (columns csvColumns) get(record []string, name string) string {
+	i, ok := columns[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
@@ -0,0 +1,189 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+)
+
+// The dashboard answers who is in today: for each enabled user their
+// first arrival, their last punch, whether they are in now and the time
+// worked today so far. Sessions started before midnight count from
+// midnight.
+
+type DashboardRequest struct {
+	// Sort is a key of dashboardSorts. Rows are sorted by team by
+	// default.
+	Sort string `form:"sort"`
+}
+
+type DashboardRowJSON struct {
+	Puncher       string     `json:"puncher"`
+	Name          string     `json:"name"`
+	Team          string     `json:"team"`
+	In            bool       `json:"in"`
+	FirstArrival  *time.Time `json:"first_arrival,omitempty"`
+	LastPunch     *time.Time `json:"last_punch,omitempty"`
+	LastPunchType string     `json:"last_punch_type,omitempty"`
+	WorkedMinutes int        `json:"worked_minutes"`
+}
+
+type DashboardResponse struct {
+	Date string `json:"date"`
+	// In is the number of users in now.
+	In   int                `json:"in"`
+	Rows []DashboardRowJSON `json:"rows"`
+}
+
+// table has a row per user.
+func (res *DashboardResponse) table() [][]string {
+	rows := [][]string{{"email", "name", "team", "in", "first_arrival", "last_punch", "last_punch_type", "worked_minutes"}}
+	for _, row := range res.Rows {
+		first, last := "", ""
+		if row.FirstArrival != nil {
+			first = row.FirstArrival.Format(time.RFC3339)
+		}
+		if row.LastPunch != nil {
+			last = row.LastPunch.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{row.Puncher, row.Name, row.Team, strconv.FormatBool(row.In), first, last,
+			row.LastPunchType, strconv.Itoa(row.WorkedMinutes)})
+	}
+	return rows
+}
+
+// dashboardSorts order the rows, each falling back on the name.
+var dashboardSorts = map[string]func(a, b *DashboardRowJSON) bool{
+	"team": func(a, b *DashboardRowJSON) bool { return a.Team < b.Team },
+	"name": func(a, b *DashboardRowJSON) bool { return false },
+	// Users who are in come first.
+	"status": func(a, b *DashboardRowJSON) bool { return a.In && !b.In },
+	// Users who haven't arrived come last.
+	"arrival": func(a, b *DashboardRowJSON) bool {
+		if a.FirstArrival == nil || b.FirstArrival == nil {
+			return b.FirstArrival == nil && a.FirstArrival != nil
+		}
+		return a.FirstArrival.Before(*b.FirstArrival)
+	},
+}
+
+type dashboardRowsBy struct {
+	rows []DashboardRowJSON
+	less func(a, b *DashboardRowJSON) bool
+}
+
+func (d dashboardRowsBy) Len() int      { return len(d.rows) }
+func (d dashboardRowsBy) Swap(i, j int) { d.rows[i], d.rows[j] = d.rows[j], d.rows[i] }
+func (d dashboardRowsBy) Less(i, j int) bool {
+	a, b := &d.rows[i], &d.rows[j]
+	if d.less(a, b) {
+		return true
+	} else if d.less(b, a) {
+		return false
+	}
+	return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+}
+
+func buildDashboard(c appengine.Context, req *DashboardRequest, now time.Time) (*DashboardResponse, *appError) {
+	if req.Sort == "" {
+		req.Sort = "team"
+	}
+	less, ok := dashboardSorts[req.Sort]
+	if !ok {
+		return nil, &appError{
+			Error:   errors.New("invalid dashboard sort: " + req.Sort),
+			Message: `The "sort" parameter must be team, name, status or arrival`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	enabled := true
+	_, users, err := findUsers(c, userQuery{Enabled: &enabled})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	today := startOfDay(now)
+	sessions, err := findSessions(c, punchQuery{From: today, To: today.AddDate(0, 0, 1), Fields: sessionFields})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	rows := make(map[string]*DashboardRowJSON, len(users))
+	res := &DashboardResponse{Date: today.Format("2006-01-02"), Rows: make([]DashboardRowJSON, len(users))}
+	for i, u := range users {
+		res.Rows[i] = DashboardRowJSON{Puncher: u.Email, Name: u.Name, Team: u.Team}
+		rows[u.Email] = &res.Rows[i]
+	}
+	worked := make(map[string]time.Duration)
+	for i := range sessions {
+		s := &sessions[i]
+		row, ok := rows[s.Puncher]
+		if !ok || s.Arrival.After(now) {
+			continue
+		}
+		if row.FirstArrival == nil || s.Arrival.Before(*row.FirstArrival) {
+			arrival := s.Arrival
+			row.FirstArrival = &arrival
+		}
+		last, lastType := s.Arrival, "arrival"
+		if !s.Open() && !s.MissingLeave && !s.Leave.After(now) {
+			last, lastType = s.Leave, "leave"
+		}
+		if row.LastPunch == nil || !last.Before(*row.LastPunch) {
+			row.LastPunch, row.LastPunchType = &last, lastType
+			row.In = lastType == "arrival"
+		}
+		start, end := s.Arrival, s.Leave
+		if start.Before(today) {
+			start = today
+		}
+		if s.Open() || end.After(now) {
+			end = now
+		}
+		if end.After(start) {
+			worked[s.Puncher] += end.Sub(start)
+		}
+	}
+	for i := range res.Rows {
+		res.Rows[i].WorkedMinutes = int(worked[res.Rows[i].Puncher] / time.Minute)
+		if res.Rows[i].In {
+			res.In++
+		}
+	}
+	sort.Stable(dashboardRowsBy{res.Rows, less})
+	return res, nil
+}
+
+func apiAdminDashboardHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	var req DashboardRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	return buildDashboard(c, &req, requestViewer(r).Now())
+}
+
+func adminDashboardHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	var req DashboardRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return appErr
+	}
+	dashboard, appErr := buildDashboard(c, &req, requestViewer(r).Now())
+	if appErr != nil {
+		return appErr
+	}
+	return renderTemplate(c, w, r, dashboardTemplate, map[string]interface{}{"Dashboard": dashboard})
+}
+
+var dashboardTemplate = parsePage("dashboard")
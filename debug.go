@@ -0,0 +1,102 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/user"
+)
+
+// The profiles of the instance serving the request are at
+// /debug/pprof/, in the format `go tool pprof` reads. They are served
+// with runtime/pprof instead of net/http/pprof, whose handlers register
+// themselves on the default mux without any access control.
+
+const (
+	debugPprofPath    = "/debug/pprof/"
+	defaultCPUSeconds = 30
+	maxCPUSeconds     = 50 // below the 60s request deadline
+)
+
+var pprofIndexTemplate = template.Must(template.New("pprof").Parse(`<!DOCTYPE html>
+<title>Profiles</title>
+<ul>
+<li><a href="profile?seconds=30">profile</a> (CPU, 30 seconds)</li>
+{{range .}}<li><a href="{{.Name}}?debug=1">{{.Name}}</a> ({{.Count}})</li>
+{{end}}</ul>
+`))
+
+func debugPprofHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	if !user.IsAdmin(c) {
+		err := errors.New("Only admins can see profiles")
+		return &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusForbidden,
+		}
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, debugPprofPath)
+	switch name {
+	case "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := pprofIndexTemplate.Execute(w, pprof.Profiles()); err != nil {
+			c.Errorf("failed to write the profile index: %v", err)
+		}
+		return nil
+	case "profile":
+		seconds := defaultCPUSeconds
+		if s := r.FormValue("seconds"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > maxCPUSeconds {
+				return &appError{
+					Error:   fmt.Errorf("invalid seconds: %q", s),
+					Message: `The "%s" parameter must be from 1 to %d`,
+					Args:    []interface{}{"seconds", maxCPUSeconds},
+					Code:    http.StatusBadRequest,
+				}
+			}
+			seconds = n
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+		if err := pprof.StartCPUProfile(w); err != nil {
+			return &appError{
+				Error:   err,
+				Message: "Failed to start the CPU profile",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+		pprof.StopCPUProfile()
+		return nil
+	}
+
+	p := pprof.Lookup(name)
+	if p == nil {
+		err := errors.New("No such profile")
+		return &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusNotFound,
+		}
+	}
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	}
+	if err := p.WriteTo(w, debug); err != nil {
+		c.Errorf("failed to write the %s profile: %v", name, err)
+	}
+	return nil
+}
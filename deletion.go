@@ -0,0 +1,409 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+	"appengine/user"
+)
+
+// A UserDeletion removes a departed employee in batches on the task
+// queue. In "delete" mode their punches and punch events are deleted; in
+// "anonymize" mode their email is replaced by an alias in their punches
+// and punch events so that aggregate history is kept, and the user agent
+// and IP address of their punches are cleared. Where they recorded,
+// deleted or changed the punches of others, their email is replaced by
+// the alias, or cleared in "delete" mode. Either way their User entity,
+// settings, notifications, idempotency keys, invitations and API tokens
+// are deleted.
+// The entity doubles as the confirmation report.
+type UserDeletion struct {
+	Email       string
+	Mode        string
+	Alias       string
+	RequestedBy string
+	Requested   time.Time
+	Status      string // "running" or "done"
+	Completed   time.Time
+
+	PunchesDeleted         int
+	PunchesAnonymized      int
+	IdempotencyKeysDeleted int
+	UserDeleted            bool
+}
+
+const (
+	deletionModeDelete    = "delete"
+	deletionModeAnonymize = "anonymize"
+
+	deletionBatchSize = 200
+	deletionTaskPath  = "/tasks/user-deletion"
+)
+
+type DeleteUserRequest struct {
+	Email string `form:"email"`
+	Mode  string `form:"mode"`
+}
+
+type UserDeletionJSON struct {
+	ID                     int64      `json:"id"`
+	Email                  string     `json:"email"`
+	Mode                   string     `json:"mode"`
+	Alias                  string     `json:"alias,omitempty"`
+	RequestedBy            string     `json:"requested_by"`
+	Requested              time.Time  `json:"requested"`
+	Status                 string     `json:"status"`
+	Completed              *time.Time `json:"completed,omitempty"`
+	PunchesDeleted         int        `json:"punches_deleted"`
+	PunchesAnonymized      int        `json:"punches_anonymized"`
+	IdempotencyKeysDeleted int        `json:"idempotency_keys_deleted"`
+	UserDeleted            bool       `json:"user_deleted"`
+}
+
+type UserDeletionResponse struct {
+	Deletion UserDeletionJSON `json:"deletion"`
+}
+
+type GetUserDeletionRequest struct {
+	ID int64 `form:"id"`
+}
+
+func newUserDeletionResponse(key *datastore.Key, d *UserDeletion) UserDeletionResponse {
+	j := UserDeletionJSON{
+		ID:                     key.IntID(),
+		Email:                  d.Email,
+		Mode:                   d.Mode,
+		Alias:                  d.Alias,
+		RequestedBy:            d.RequestedBy,
+		Requested:              d.Requested,
+		Status:                 d.Status,
+		PunchesDeleted:         d.PunchesDeleted,
+		PunchesAnonymized:      d.PunchesAnonymized,
+		IdempotencyKeysDeleted: d.IdempotencyKeysDeleted,
+		UserDeleted:            d.UserDeleted,
+	}
+	if !d.Completed.IsZero() {
+		completed := d.Completed
+		j.Completed = &completed
+	}
+	return UserDeletionResponse{Deletion: j}
+}
+
+func enqueueUserDeletion(c appengine.Context, key *datastore.Key) error {
+	t := taskqueue.NewPOSTTask(deletionTaskPath, url.Values{
+		"id": {strconv.FormatInt(key.IntID(), 10)},
+	})
+	return addTask(c, t, "")
+}
+
+func apiAdminUserDeletionsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method == "GET" {
+		var req GetUserDeletionRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		key := datastore.NewKey(c, "UserDeletion", "", req.ID, nil)
+		var d UserDeletion
+		if err := datastore.Get(c, key, &d); err == datastore.ErrNoSuchEntity {
+			return nil, &appError{
+				Error:   err,
+				Message: "No such user deletion",
+				Code:    http.StatusNotFound,
+			}
+		} else if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the user deletion from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newUserDeletionResponse(key, &d), nil
+	} else if r.Method == "POST" {
+		var req DeleteUserRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		if req.Email == "" {
+			return nil, &appError{
+				Error:   errors.New("missing email"),
+				Message: `The "email" parameter is required`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		if req.Mode != deletionModeDelete && req.Mode != deletionModeAnonymize {
+			return nil, &appError{
+				Error:   errors.New("invalid deletion mode: " + req.Mode),
+				Message: `The "mode" parameter must be "delete" or "anonymize"`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+
+		d := UserDeletion{
+			Email:       req.Email,
+			Mode:        req.Mode,
+			RequestedBy: user.Current(c).Email,
+			Requested:   time.Now(),
+			Status:      "running",
+		}
+		key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "UserDeletion", nil), &d)
+		if err == nil && d.Mode == deletionModeAnonymize {
+			d.Alias = fmt.Sprintf("anonymized-%d", key.IntID())
+			_, err = datastore.Put(c, key, &d)
+		}
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the user deletion to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		if err := enqueueUserDeletion(c, key); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to start the user deletion",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newUserDeletionResponse(key, &d), nil
+	} else {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// userDeletionTaskHandler processes one batch of punches of a deletion
+// and enqueues itself again until none are left. Then it deletes the
+// idempotency keys and the User entity, and completes the report.
+func userDeletionTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return formValueError(err, "id", `Failed to parse the "%s" parameter as an integer`)
+	}
+	key := datastore.NewKey(c, "UserDeletion", "", id, nil)
+	var d UserDeletion
+	if err := datastore.Get(c, key, &d); err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the user deletion from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if d.Status == "done" {
+		return nil
+	}
+
+	more, err := processUserDeletionBatch(c, &d)
+	if err == nil {
+		if !more {
+			d.Status = "done"
+			d.Completed = time.Now()
+			c.Infof("user deletion %d of %s completed: %d punches deleted, %d anonymized, %d idempotency keys deleted, user deleted: %v",
+				id, d.Email, d.PunchesDeleted, d.PunchesAnonymized, d.IdempotencyKeysDeleted, d.UserDeleted)
+		}
+		_, err = datastore.Put(c, key, &d)
+	}
+	if err == nil && more {
+		err = enqueueUserDeletion(c, key)
+	}
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to process the user deletion",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return nil
+}
+
+// processUserDeletionBatch handles up to deletionBatchSize punches of
+// d.Email and reports whether there may be more. Punches that have been
+// handled no longer match the query, so no cursor is needed.
+func processUserDeletionBatch(c appengine.Context, d *UserDeletion) (more bool, err error) {
+	q := datastore.NewQuery("Punch").Ancestor(punchKey(c)).Filter("Puncher =", d.Email).Limit(deletionBatchSize)
+	if d.Mode == deletionModeDelete {
+		keys, err := q.KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return false, err
+		}
+		if len(keys) > 0 {
+			if err := datastore.DeleteMulti(c, keys); err != nil {
+				return false, err
+			}
+			d.PunchesDeleted += len(keys)
+			return true, nil
+		}
+		q = datastore.NewQuery("PunchEvent").Ancestor(punchKey(c)).Filter("Puncher =", d.Email).Limit(deletionBatchSize)
+		keys, err = q.KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return false, err
+		}
+		if len(keys) > 0 {
+			return true, datastore.DeleteMulti(c, keys)
+		}
+	} else {
+		var punches []Punch
+		keys, err := q.GetAll(c, &punches)
+		if err != nil {
+			return false, err
+		}
+		if len(keys) > 0 {
+			for i := range punches {
+				anonymizePunch(&punches[i], d.Email, d.Alias)
+				punches[i].UserAgent = ""
+				punches[i].ClientIP = ""
+				if err := anonymizePunchEvents(c, keys[i], d.Email, d.Alias); err != nil {
+					return false, err
+				}
+			}
+			if _, err := datastore.PutMulti(c, keys, punches); err != nil {
+				return false, err
+			}
+			d.PunchesAnonymized += len(keys)
+			return true, nil
+		}
+	}
+
+	more, err = anonymizePunchesOfOthers(c, d)
+	if more || err != nil {
+		return more, err
+	}
+
+	nkeys, err := notificationsQuery(c, d.Email, false).KeysOnly().Limit(deletionBatchSize).GetAll(c, nil)
+	if err != nil {
+		return false, err
+	}
+	if len(nkeys) > 0 {
+		return true, datastore.DeleteMulti(c, nkeys)
+	}
+	err = datastore.DeleteMulti(c, []*datastore.Key{userSettingsKey(c, d.Email), notificationPreferencesKey(c, d.Email), userWorkweekKey(c, d.Email)})
+	if err != nil {
+		return false, err
+	}
+
+	q, _ = idempotencyKeysQuery(c, d.Email)
+	ikeys, err := q.KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return false, err
+	}
+	if err := datastore.DeleteMulti(c, ikeys); err != nil {
+		return false, err
+	}
+	d.IdempotencyKeysDeleted += len(ikeys)
+
+	q = datastore.NewQuery("Invitation").Ancestor(punchKey(c)).Filter("Email =", d.Email)
+	invKeys, err := q.KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return false, err
+	}
+	if err := datastore.DeleteMulti(c, invKeys); err != nil {
+		return false, err
+	}
+
+	// API tokens are kept in the default namespace.
+	dc, err := appengine.Namespace(c, "")
+	if err != nil {
+		return false, err
+	}
+	tokenKeys, _, err := findAPITokens(c, dc, d.Email)
+	if err != nil {
+		return false, err
+	}
+	if err := datastore.DeleteMulti(dc, tokenKeys); err != nil {
+		return false, err
+	}
+
+	userKey, u, err := findUserByEmail(c, d.Email)
+	if err != nil {
+		return false, err
+	}
+	if u != nil {
+		if err := datastore.Delete(c, userKey); err != nil {
+			return false, err
+		}
+		d.UserDeleted = true
+	}
+	return false, nil
+}
+
+// anonymizePunch replaces email with alias in the fields of p naming a
+// user.
+func anonymizePunch(p *Punch, email, alias string) {
+	if p.Puncher == email {
+		p.Puncher = alias
+	}
+	if p.RecordedBy == email {
+		p.RecordedBy = alias
+	}
+	if p.DeletedBy == email {
+		p.DeletedBy = alias
+	}
+}
+
+// anonymizePunchesOfOthers replaces d.Email with d.Alias in up to
+// deletionBatchSize punches of other users that d.Email recorded,
+// deleted or changed, and in their histories. It reports whether there
+// may be more.
+func anonymizePunchesOfOthers(c appengine.Context, d *UserDeletion) (more bool, err error) {
+	var keys []*datastore.Key
+	for _, filter := range []string{"RecordedBy =", "DeletedBy ="} {
+		q := datastore.NewQuery("Punch").Ancestor(punchKey(c)).Filter(filter, d.Email).KeysOnly().Limit(deletionBatchSize)
+		if keys, err = q.GetAll(c, nil); err != nil || len(keys) > 0 {
+			break
+		}
+	}
+	if err == nil && len(keys) == 0 {
+		q := datastore.NewQuery("PunchEvent").Ancestor(punchKey(c)).Filter("Actor =", d.Email).KeysOnly().Limit(deletionBatchSize)
+		var eventKeys []*datastore.Key
+		eventKeys, err = q.GetAll(c, nil)
+		seen := make(map[int64]bool)
+		for _, k := range eventKeys {
+			if !seen[k.Parent().IntID()] {
+				seen[k.Parent().IntID()] = true
+				keys = append(keys, k.Parent())
+			}
+		}
+	}
+	if err != nil || len(keys) == 0 {
+		return false, err
+	}
+
+	punches := make([]Punch, len(keys))
+	err = datastore.GetMulti(c, keys, punches)
+	if me, ok := err.(appengine.MultiError); ok {
+		// The history of a punch purged from the trash may be left.
+		var found []*datastore.Key
+		var foundPunches []Punch
+		for i, e := range me {
+			if e == nil {
+				found = append(found, keys[i])
+				foundPunches = append(foundPunches, punches[i])
+			} else if e != datastore.ErrNoSuchEntity {
+				return false, e
+			} else if err := anonymizePunchEvents(c, keys[i], d.Email, d.Alias); err != nil {
+				return false, err
+			}
+		}
+		keys, punches = found, foundPunches
+	} else if err != nil {
+		return false, err
+	}
+	for i := range punches {
+		anonymizePunch(&punches[i], d.Email, d.Alias)
+		if err := anonymizePunchEvents(c, keys[i], d.Email, d.Alias); err != nil {
+			return false, err
+		}
+	}
+	_, err = datastore.PutMulti(c, keys, punches)
+	return true, err
+}
@@ -0,0 +1,207 @@
+package timecard
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+// The directory sync makes the users match the Google Workspace
+// directory: active directory users without a User entity get an enabled
+// one, and Users of the directory's domains whom the directory no longer
+// lists, or lists as suspended, are disabled. Users are never enabled or
+// deleted by the sync, so that admins can still disable people the
+// directory lists, and users of other domains are left alone. It runs
+// daily by cron and on demand.
+
+const (
+	directoryScope    = "https://www.googleapis.com/auth/admin.directory.user.readonly"
+	directorySyncPath = "/tasks/directory-sync"
+)
+
+func (in *Integrations) directoryEnabled() bool {
+	return in.DirectoryCredentials != "" && in.DirectoryAdminEmail != ""
+}
+
+type directoryUser struct {
+	PrimaryEmail string `json:"primaryEmail"`
+	Name         struct {
+		FullName string `json:"fullName"`
+	} `json:"name"`
+	Suspended bool `json:"suspended"`
+	Archived  bool `json:"archived"`
+}
+
+// listDirectoryUsers returns every user of the directory.
+func listDirectoryUsers(c appengine.Context, in *Integrations) ([]directoryUser, error) {
+	client, err := serviceAccountClient(c, in.DirectoryCredentials, directoryScope, in.DirectoryAdminEmail)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{"maxResults": {"500"}, "projection": {"basic"}}
+	if in.DirectoryDomain != "" {
+		params.Set("domain", in.DirectoryDomain)
+	} else {
+		params.Set("customer", "my_customer")
+	}
+
+	var users []directoryUser
+	for {
+		resp, err := client.Get("https://admin.googleapis.com/admin/directory/v1/users?" + params.Encode())
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Users         []directoryUser `json:"users"`
+			NextPageToken string          `json:"nextPageToken"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = googleAPIError("directory", resp)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, page.Users...)
+		if page.NextPageToken == "" {
+			return users, nil
+		}
+		params.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// syncDirectory applies the directory users to the Users and returns how
+// many were created and disabled.
+func syncDirectory(c appengine.Context, dirUsers []directoryUser) (created, disabled int, err error) {
+	keys, users, err := findUsers(c, userQuery{})
+	if err != nil {
+		return 0, 0, err
+	}
+	existing := make(map[string]bool, len(users))
+	for _, u := range users {
+		existing[strings.ToLower(u.Email)] = true
+	}
+
+	active := make(map[string]bool, len(dirUsers))
+	domains := make(map[string]bool)
+	now := time.Now()
+	for _, du := range dirUsers {
+		email := strings.ToLower(du.PrimaryEmail)
+		domains[emailDomain(email)] = true
+		if du.Suspended || du.Archived {
+			continue
+		}
+		active[email] = true
+		if existing[email] {
+			continue
+		}
+		u := User{Email: du.PrimaryEmail, Name: du.Name.FullName, Enabled: true, Version: 1, Updated: now}
+		if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "User", punchKey(c)), &u); err != nil {
+			return created, disabled, err
+		}
+		created++
+		notifyAccount(c, u.Email, notificationAccountCreated)
+	}
+
+	for i, u := range users {
+		email := strings.ToLower(u.Email)
+		if !u.Enabled || active[email] || !domains[emailDomain(email)] {
+			continue
+		}
+		// Disable in a transaction so that a concurrent edit on the users
+		// page isn't lost.
+		err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+			var cur User
+			if err := datastore.Get(tc, keys[i], &cur); err != nil {
+				return err
+			}
+			cur.Enabled = false
+			cur.Version++
+			cur.Updated = now
+			_, err := datastore.Put(tc, keys[i], &cur)
+			return err
+		}, nil)
+		if err != nil {
+			return created, disabled, err
+		}
+		disabled++
+		notifyAccount(c, u.Email, notificationAccountDisabled)
+	}
+	return created, disabled, nil
+}
+
+func directorySyncTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	in, err := getIntegrations(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the integrations from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if !in.directoryEnabled() {
+		return nil
+	}
+	dirUsers, err := listDirectoryUsers(c, in)
+	if err == nil {
+		var created, disabled int
+		created, disabled, err = syncDirectory(c, dirUsers)
+		c.Infof("directory sync: %d directory users, %d users created, %d disabled", len(dirUsers), created, disabled)
+	}
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to sync the users with the directory",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return nil
+}
+
+type DirectorySyncResponse struct {
+	Queued bool `json:"queued"`
+}
+
+func apiAdminDirectorySyncHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method != "POST" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	in, err := getIntegrations(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the integrations from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if !in.directoryEnabled() {
+		err := errors.New("The directory sync is not configured")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if err := addTask(c, taskqueue.NewPOSTTask(directorySyncPath, nil), ""); err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to sync the users with the directory",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return DirectorySyncResponse{Queued: true}, nil
+}
@@ -0,0 +1,134 @@
+package timecard
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/user"
+)
+
+// The personal data export holds everything stored about the calling
+// user, for data access requests.
+
+type ExportJSON struct {
+	Email           string               `json:"email"`
+	ExportedAt      time.Time            `json:"exported_at"`
+	User            *UserJSON            `json:"user"`
+	Punches         []PunchJSON          `json:"punches"`
+	Sessions        []SessionJSON        `json:"sessions"`
+	IdempotencyKeys []IdempotencyKeyJSON `json:"idempotency_keys"`
+}
+
+type IdempotencyKeyJSON struct {
+	Key     string    `json:"key"`
+	PunchID int64     `json:"punch_id"`
+	Created time.Time `json:"created"`
+}
+
+func buildExport(c appengine.Context, email string, now time.Time) (*ExportJSON, error) {
+	export := &ExportJSON{
+		Email:           email,
+		ExportedAt:      now,
+		Punches:         []PunchJSON{},
+		Sessions:        []SessionJSON{},
+		IdempotencyKeys: []IdempotencyKeyJSON{},
+	}
+
+	key, u, err := findUserByEmail(c, email)
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		j := newUserJSON(key, u)
+		export.User = &j
+	}
+
+	keys, punches, err := findPunches(c, punchQuery{Puncher: email, IncludeDeleted: true})
+	if err != nil {
+		return nil, err
+	}
+	for i := range punches {
+		export.Punches = append(export.Punches, newPunchJSON(keys[i], &punches[i]))
+	}
+	for _, s := range pairSessions(punches) {
+		export.Sessions = append(export.Sessions, newSessionJSON(&s, now))
+	}
+
+	q, prefix := idempotencyKeysQuery(c, email)
+	var recs []IdempotencyKey
+	ikeys, err := q.GetAll(c, &recs)
+	if err != nil {
+		return nil, err
+	}
+	for i, rec := range recs {
+		export.IdempotencyKeys = append(export.IdempotencyKeys, IdempotencyKeyJSON{
+			Key:     strings.TrimPrefix(ikeys[i].StringID(), prefix),
+			PunchID: rec.Punch.IntID(),
+			Created: rec.Created,
+		})
+	}
+	return export, nil
+}
+
+// myExportHandler sends the export as a ZIP archive with one JSON file
+// per kind of data, or as a single JSON document with format=json.
+func myExportHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	email := user.Current(c).Email
+	now := time.Now()
+	export, err := buildExport(c, email, now)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to export your data",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	name := "timecard-export-" + now.Format("20060102")
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(export); err != nil {
+			c.Errorf("failed to write the export: %v", err)
+		}
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+	zw := zip.NewWriter(w)
+	for _, f := range []struct {
+		name string
+		data interface{}
+	}{
+		{"user.json", export.User},
+		{"punches.json", export.Punches},
+		{"sessions.json", export.Sessions},
+		{"idempotency_keys.json", export.IdempotencyKeys},
+	} {
+		if err := writeZipJSON(zw, name+"/"+f.name, now, f.data); err != nil {
+			c.Errorf("failed to write the export: %v", err)
+			return nil
+		}
+	}
+	if err := zw.Close(); err != nil {
+		c.Errorf("failed to write the export: %v", err)
+	}
+	return nil
+}
+
+// writeZipJSON adds a file named name holding data as JSON to zw.
+func writeZipJSON(zw *zip.Writer, name string, modified time.Time, data interface{}) error {
+	fh := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	fh.SetModTime(modified)
+	fw, err := zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(fw).Encode(data)
+}
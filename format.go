@@ -0,0 +1,131 @@
+package timecard
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// viewer is the locale and time zone a page is rendered for.
+type viewer struct {
+	Locale   locale
+	Location *time.Location
+}
+
+const timezoneCookieName = "timezone"
+
+// requestViewer returns the viewer of r. The time zone is the one of the
+// user's settings, or else the IANA name the browser reports, stored in a
+// cookie by the root page.
+func requestViewer(r *http.Request) *viewer {
+	v := &viewer{Locale: requestLocale(r), Location: time.UTC}
+	if s := requestUserSettings(r); s != nil && s.Timezone != "" {
+		if loc, err := time.LoadLocation(s.Timezone); err == nil {
+			v.Location = loc
+			return v
+		}
+	}
+	if cookie, err := r.Cookie(timezoneCookieName); err == nil {
+		if loc, err := time.LoadLocation(cookie.Value); err == nil {
+			v.Location = loc
+		}
+	}
+	return v
+}
+
+// Now returns the current time in the viewer's time zone. Passing it to
+// the session summaries makes them group by the viewer's dates.
+func (v *viewer) Now() time.Time {
+	return time.Now().In(v.Location)
+}
+
+func (v *viewer) funcs() template.FuncMap {
+	return template.FuncMap{
+		"T":              v.Locale.T,
+		"formatDateTime": v.formatDateTime,
+		"formatTime":     v.formatTime,
+		"formatWeekday":  v.formatWeekday,
+		"formatDuration": v.formatDuration,
+		"formatMinutes":  v.formatMinutes,
+		"formatRelative": v.formatRelative,
+		"formatChange":   v.formatChange,
+		// Bound to the current theme by renderTemplate.
+		"theme": func() *Theme { return &defaultTheme },
+	}
+}
+
+func (v *viewer) formatDateTime(t time.Time) string {
+	return t.In(v.Location).Format("2006-01-02 15:04")
+}
+
+func (v *viewer) formatTime(t time.Time) string {
+	return t.In(v.Location).Format("15:04")
+}
+
+// formatWeekday returns the short name of the day of the week of t.
+func (v *viewer) formatWeekday(t time.Time) string {
+	return v.Locale.T(t.In(v.Location).Weekday().String()[:3])
+}
+
+// formatDuration formats d as hours and minutes, like "7h 45m".
+func (v *viewer) formatDuration(d time.Duration) string {
+	m := int(d / time.Minute)
+	h, m := m/60, m%60
+	switch {
+	case h > 0 && m > 0:
+		return v.Locale.T("%dh %dm", h, m)
+	case h > 0:
+		return v.Locale.T("%dh", h)
+	}
+	return v.Locale.T("%dm", m)
+}
+
+// formatMinutes formats m minutes like formatDuration.
+func (v *viewer) formatMinutes(m int) string {
+	return v.formatDuration(time.Duration(m) * time.Minute)
+}
+
+// formatChange formats the value of a field of a PunchChangeJSON. Unset
+// values are shown as "-".
+func (v *viewer) formatChange(field, value string) string {
+	if value == "" {
+		return "-"
+	}
+	switch field {
+	case "type":
+		return v.Locale.T(value)
+	case "time", "deleted":
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return v.formatDateTime(t)
+		}
+	}
+	return value
+}
+
+// formatRelative formats t relative to now, like "2 hours ago".
+func (v *viewer) formatRelative(t time.Time) string {
+	d := time.Now().Sub(t)
+	if d < 0 {
+		d = -d
+	}
+	var n int
+	var unit string
+	switch {
+	case d < time.Minute:
+		return v.Locale.T("just now")
+	case d < time.Hour:
+		n, unit = int(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		n, unit = int(d/time.Hour), "hour"
+	default:
+		n, unit = int(d/(24*time.Hour)), "day"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	if t.After(time.Now()) {
+		return v.Locale.T(fmt.Sprintf("in %%d %s", unit), n)
+	}
+	return v.Locale.T(fmt.Sprintf("%%d %s ago", unit), n)
+}
@@ -0,0 +1,136 @@
+package timecard
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"appengine"
+	"appengine/urlfetch"
+)
+
+// googleClient returns an HTTP client authorized for Google APIs with
+// scopes as the app's service account.
+func googleClient(c appengine.Context, scopes ...string) (*http.Client, error) {
+	token, _, err := appengine.AccessToken(c, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	return bearerClient(c, token), nil
+}
+
+// bearerClient returns an HTTP client sending the OAuth 2.0 access token.
+func bearerClient(c appengine.Context, token string) *http.Client {
+	return &http.Client{Transport: &bearerTransport{
+		token: token,
+		base:  &urlfetch.Transport{Context: c, Deadline: time.Minute},
+	}}
+}
+
+type bearerTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(r)
+}
+
+// googleAPIError makes an error of an unsuccessful response from api.
+func googleAPIError(api string, resp *http.Response) error {
+	b, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("%s: %s: %s", api, resp.Status, b)
+}
+
+// A serviceAccountKey is the JSON key file of a service account.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func parseServiceAccountKey(data string) (*serviceAccountKey, *rsa.PrivateKey, error) {
+	var key serviceAccountKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return nil, nil, err
+	}
+	if key.ClientEmail == "" || key.TokenURI == "" {
+		return nil, nil, errors.New("client_email or token_uri is missing")
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, nil, errors.New("private_key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("private_key is not an RSA key")
+	}
+	return &key, rsaKey, nil
+}
+
+// serviceAccountClient returns an HTTP client authorized with scope as
+// the service account of the JSON key file data, using the OAuth 2.0
+// JWT bearer flow. A non-empty subject is the user the service account
+// acts as through domain-wide delegation.
+func serviceAccountClient(c appengine.Context, data, scope, subject string) (*http.Client, error) {
+	key, rsaKey, err := parseServiceAccountKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := base64.RawURLEncoding
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claimSet := map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": scope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	if subject != "" {
+		claimSet["sub"] = subject
+	}
+	claims, _ := json.Marshal(claimSet)
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := urlfetch.Client(c).PostForm(key.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, googleAPIError("oauth2", resp)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	return bearerClient(c, token.AccessToken), nil
+}
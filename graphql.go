@@ -0,0 +1,878 @@
+package timecard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/user"
+)
+
+// This file implements the subset of GraphQL the dashboard needs: query
+// operations with arguments, variables, aliases and __typename. Fragments,
+// directives, mutations and introspection are not supported.
+//
+// Object types are the JSON structs of the REST API with the "JSON"
+// suffix dropped (UserJSON is User). Their scalar fields are the json
+// fields of the struct; fields taking arguments are listed in gqlFields.
+// The users and punches lists take a required first argument, up to
+// gqlMaxFirst. Dates in arguments and of summaries are in the time zone
+// of the org settings.
+
+// gqlMaxFirst is the most items a users or punches list returns.
+const gqlMaxFirst = 500
+
+type gqlRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type gqlResponse struct {
+	Data   interface{} `json:"data"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+type gqlError struct {
+	Message string `json:"message"`
+}
+
+type gqlSelection struct {
+	Alias      string
+	Name       string
+	Args       map[string]interface{}
+	Selections []*gqlSelection
+}
+
+type gqlVariable string
+
+type gqlField struct {
+	Resolve func(c appengine.Context, source interface{}, args gqlArgs) (interface{}, error)
+}
+
+var gqlFields map[string]map[string]*gqlField
+
+func init() {
+	gqlFields = map[string]map[string]*gqlField{
+		"Query": {
+			"users":     {Resolve: gqlResolveUsers},
+			"punches":   {Resolve: gqlResolvePunches},
+			"sessions":  {Resolve: gqlResolveSessions},
+			"summaries": {Resolve: gqlResolveSummaries},
+		},
+		"User": {
+			"punches":   {Resolve: gqlResolveUserField(gqlResolvePunches)},
+			"sessions":  {Resolve: gqlResolveUserField(gqlResolveSessions)},
+			"summaries": {Resolve: gqlResolveUserField(gqlResolveSummaries)},
+		},
+	}
+}
+
+func apiGraphQLHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	var req gqlRequest
+	switch r.Method {
+	case "GET":
+		req.Query = r.FormValue("query")
+		if v := r.FormValue("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return nil, formValueError(err, "variables", `Failed to parse the "%s" parameter as a JSON object`)
+			}
+		}
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to read the request body",
+				Code:    http.StatusBadRequest,
+			}
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql") {
+			req.Query = string(body)
+		} else if err := json.Unmarshal(body, &req); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to parse the request body as JSON",
+				Code:    http.StatusBadRequest,
+			}
+		}
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	data, err := executeGraphQL(c, req)
+	if err != nil {
+		return gqlResponse{Errors: []gqlError{{Message: err.Error()}}}, nil
+	}
+	return gqlResponse{Data: data}, nil
+}
+
+func executeGraphQL(c appengine.Context, req gqlRequest) (interface{}, error) {
+	p := &gqlParser{src: req.Query}
+	sels, defaults, err := p.parseDocument()
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]interface{})
+	for k, v := range defaults {
+		vars[k] = v
+	}
+	for k, v := range req.Variables {
+		vars[k] = v
+	}
+	e := &gqlExecutor{c: c, vars: vars, now: time.Now()}
+	return e.resolveObject("Query", nil, sels)
+}
+
+// gqlObject is a result object that keeps its fields in selection order.
+type gqlObject []gqlObjectField
+
+type gqlObjectField struct {
+	Key   string
+	Value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(f.Key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type gqlExecutor struct {
+	c    appengine.Context
+	vars map[string]interface{}
+	now  time.Time
+}
+
+func gqlTypeName(t reflect.Type) string {
+	return strings.TrimSuffix(t.Name(), "JSON")
+}
+
+func (e *gqlExecutor) resolveObject(typeName string, source interface{}, sels []*gqlSelection) (gqlObject, error) {
+	var obj gqlObject
+	for _, sel := range sels {
+		key := sel.Alias
+		if key == "" {
+			key = sel.Name
+		}
+		if sel.Name == "__typename" {
+			obj = append(obj, gqlObjectField{key, typeName})
+			continue
+		}
+
+		var v interface{}
+		if f, ok := gqlFields[typeName][sel.Name]; ok {
+			args, err := e.args(sel.Args)
+			if err != nil {
+				return nil, err
+			}
+			v, err = f.Resolve(e.c, source, args)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", typeName, sel.Name, err)
+			}
+		} else if fv, ok := structField(source, sel.Name); ok {
+			if len(sel.Args) > 0 {
+				return nil, fmt.Errorf("%s.%s takes no arguments", typeName, sel.Name)
+			}
+			v = fv
+		} else {
+			return nil, fmt.Errorf("unknown field %s.%s", typeName, sel.Name)
+		}
+
+		completed, err := e.complete(typeName+"."+sel.Name, v, sel.Selections)
+		if err != nil {
+			return nil, err
+		}
+		obj = append(obj, gqlObjectField{key, completed})
+	}
+	return obj, nil
+}
+
+func (e *gqlExecutor) complete(field string, v interface{}, sels []*gqlSelection) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil, nil
+	}
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		rv = rv.Elem()
+	}
+	switch {
+	case rv.Kind() == reflect.Slice:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			item, err := e.complete(field, rv.Index(i).Interface(), sels)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = item
+		}
+		return list, nil
+	case rv.Kind() == reflect.Struct && rv.Type() != timeType:
+		if len(sels) == 0 {
+			return nil, fmt.Errorf("field %s of type %s must have a selection of subfields", field, gqlTypeName(rv.Type()))
+		}
+		return e.resolveObject(gqlTypeName(rv.Type()), rv.Interface(), sels)
+	}
+	if len(sels) > 0 {
+		return nil, fmt.Errorf("field %s is a scalar and cannot have subfields", field)
+	}
+	return v, nil
+}
+
+// structField returns the field of source whose json name is name.
+func structField(source interface{}, name string) (interface{}, bool) {
+	rv := reflect.ValueOf(source)
+	if !rv.IsValid() || rv.Kind() != reflect.Struct {
+		return nil, false
+	}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		if n, _ := jsonFieldName(rt.Field(i)); n == name {
+			return rv.Field(i).Interface(), true
+		}
+	}
+	return nil, false
+}
+
+func (e *gqlExecutor) args(raw map[string]interface{}) (gqlArgs, error) {
+	args := make(gqlArgs)
+	for k, v := range raw {
+		resolved, err := e.value(v)
+		if err != nil {
+			return nil, err
+		}
+		args[k] = resolved
+	}
+	return args, nil
+}
+
+func (e *gqlExecutor) value(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case gqlVariable:
+		val, ok := e.vars[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s is not defined", v)
+		}
+		return val, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, err := e.value(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = resolved
+		}
+		return list, nil
+	}
+	return v, nil
+}
+
+// gqlArgs holds resolved field arguments. Numbers are float64 as in
+// decoded JSON variables.
+type gqlArgs map[string]interface{}
+
+func (a gqlArgs) String(name string) (string, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument %s must be a String", name)
+}
+
+func (a gqlArgs) Int(name string) (int, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %s must be an Int", name)
+}
+
+func (a gqlArgs) Bool(name string) (*bool, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		return &v, nil
+	}
+	return nil, fmt.Errorf("argument %s must be a Boolean", name)
+}
+
+// First returns the required first argument, the number of items a list
+// returns.
+func (a gqlArgs) First() (int, error) {
+	n, err := a.Int("first")
+	if _, ok := a["first"]; err != nil || !ok || n < 1 || n > gqlMaxFirst {
+		return 0, fmt.Errorf("argument first must be an Int from 1 to %d", gqlMaxFirst)
+	}
+	return n, nil
+}
+
+// Time returns a time argument, where a date is the midnight starting it
+// in loc.
+func (a gqlArgs) Time(name string, loc *time.Location) (time.Time, error) {
+	s, err := a.String(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, appErr := parseTimeParam(name, s, loc)
+	if appErr != nil {
+		return time.Time{}, fmt.Errorf(appErr.Message, appErr.Args...)
+	}
+	return t, nil
+}
+
+// gqlPuncher returns the puncher the caller may query. Admins may query
+// anyone; other users only themselves.
+func gqlPuncher(c appengine.Context, requested string) (string, error) {
+	if admin, err := isAdmin(c); err != nil {
+		return "", err
+	} else if admin {
+		return requested, nil
+	}
+	self := user.Current(c).Email
+	if requested != "" && requested != self {
+		return "", errors.New("not allowed to query other users")
+	}
+	return self, nil
+}
+
+// gqlLocation returns the time zone of the org settings, which days are
+// in, as for the payroll.
+func gqlLocation(c appengine.Context) (*time.Location, error) {
+	settings, err := getOrgSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	return settings.location(), nil
+}
+
+func gqlPunchQuery(c appengine.Context, args gqlArgs) (punchQuery, error) {
+	var pq punchQuery
+	var err error
+	if pq.Puncher, err = args.String("puncher"); err != nil {
+		return pq, err
+	}
+	if pq.Puncher, err = gqlPuncher(c, pq.Puncher); err != nil {
+		return pq, err
+	}
+	loc, err := gqlLocation(c)
+	if err != nil {
+		return pq, err
+	}
+	if pq.From, err = args.Time("from", loc); err != nil {
+		return pq, err
+	}
+	if pq.To, err = args.Time("to", loc); err != nil {
+		return pq, err
+	}
+	return pq, nil
+}
+
+func gqlResolveUsers(c appengine.Context, source interface{}, args gqlArgs) (interface{}, error) {
+	email, err := args.String("email")
+	if err != nil {
+		return nil, err
+	}
+	if email, err = gqlPuncher(c, email); err != nil {
+		return nil, err
+	}
+	enabled, err := args.Bool("enabled")
+	if err != nil {
+		return nil, err
+	}
+	first, err := args.First()
+	if err != nil {
+		return nil, err
+	}
+	keys, users, err := findUsers(c, userQuery{Enabled: enabled})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]UserJSON, 0, first)
+	for i := 0; i < len(users) && len(result) < first; i++ {
+		if email != "" && users[i].Email != email {
+			continue
+		}
+		result = append(result, newUserJSON(keys[i], &users[i]))
+	}
+	return result, nil
+}
+
+func gqlResolvePunches(c appengine.Context, source interface{}, args gqlArgs) (interface{}, error) {
+	pq, err := gqlPunchQuery(c, args)
+	if err != nil {
+		return nil, err
+	}
+	if pq.Type, err = args.String("type"); err != nil {
+		return nil, err
+	}
+	if pq.Limit, err = args.First(); err != nil {
+		return nil, err
+	}
+	keys, punches, err := findPunches(c, pq)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]PunchJSON, len(punches))
+	for i := range punches {
+		result[i] = newPunchJSON(keys[i], &punches[i])
+	}
+	return result, nil
+}
+
+func gqlSessions(c appengine.Context, args gqlArgs) ([]WorkSession, error) {
+	pq, err := gqlPunchQuery(c, args)
+	if err != nil {
+		return nil, err
+	}
+	pq.Fields = sessionFields
+	return findSessions(c, pq)
+}
+
+func gqlResolveSessions(c appengine.Context, source interface{}, args gqlArgs) (interface{}, error) {
+	sessions, err := gqlSessions(c, args)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	result := make([]SessionJSON, len(sessions))
+	for i := range sessions {
+		result[i] = newSessionJSON(&sessions[i], now)
+	}
+	return result, nil
+}
+
+func gqlResolveSummaries(c appengine.Context, source interface{}, args gqlArgs) (interface{}, error) {
+	pq, err := gqlPunchQuery(c, args)
+	if err != nil {
+		return nil, err
+	}
+	pq.Fields = sessionFields
+	sessions, err := findSessions(c, pq)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := getOvernightPolicy(c)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := gqlLocation(c)
+	if err != nil {
+		return nil, err
+	}
+	// The summaries are of the dates the range touches in the time zone
+	// of the org settings.
+	from, end := pq.From, pq.To
+	if !from.IsZero() {
+		from = startOfDay(from.In(loc))
+	}
+	summaries := summarizeDays(sessions, from, end, policy.split(), time.Now().In(loc))
+	result := make([]SummaryJSON, len(summaries))
+	for i := range summaries {
+		result[i] = newSummaryJSON(&summaries[i])
+	}
+	return result, nil
+}
+
+// gqlResolveUserField resolves a User field by the root resolver with
+// the puncher argument set to the user.
+func gqlResolveUserField(resolve func(appengine.Context, interface{}, gqlArgs) (interface{}, error)) func(appengine.Context, interface{}, gqlArgs) (interface{}, error) {
+	return func(c appengine.Context, source interface{}, args gqlArgs) (interface{}, error) {
+		if _, ok := args["puncher"]; ok {
+			return nil, errors.New("unknown argument puncher")
+		}
+		args["puncher"] = source.(UserJSON).Email
+		return resolve(c, source, args)
+	}
+}
+
+// gqlParser is a recursive descent parser for GraphQL query documents.
+type gqlParser struct {
+	src  string
+	pos  int
+	kind byte // 'n' name, 'i' int, 'f' float, 's' string, 'p' punctuator, 0 end
+	text string
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *gqlParser) next() error {
+	for p.pos < len(p.src) {
+		ch := p.src[p.pos]
+		if ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == ',' {
+			p.pos++
+		} else if ch == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else {
+			break
+		}
+	}
+	if p.pos >= len(p.src) {
+		p.kind, p.text = 0, ""
+		return nil
+	}
+	start := p.pos
+	ch := p.src[p.pos]
+	switch {
+	case isNameStart(ch):
+		for p.pos < len(p.src) && (isNameStart(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.kind = 'n'
+	case ch == '-' || isDigit(ch):
+		p.pos++
+		p.kind = 'i'
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			if c == '.' || c == 'e' || c == 'E' || ((c == '+' || c == '-') && p.kind == 'f') {
+				p.kind = 'f'
+			} else if !isDigit(c) {
+				break
+			}
+			p.pos++
+		}
+	case ch == '"':
+		s, err := p.scanString()
+		if err != nil {
+			return err
+		}
+		p.kind, p.text = 's', s
+		return nil
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.kind = 'p'
+	case strings.IndexByte("!$():=@[]{}|", ch) >= 0:
+		p.pos++
+		p.kind = 'p'
+	default:
+		return p.errorf("unexpected character %q", ch)
+	}
+	p.text = p.src[start:p.pos]
+	return nil
+}
+
+func (p *gqlParser) scanString() (string, error) {
+	var buf bytes.Buffer
+	p.pos++
+	for p.pos < len(p.src) {
+		ch := p.src[p.pos]
+		switch ch {
+		case '"':
+			p.pos++
+			return buf.String(), nil
+		case '\n':
+			return "", p.errorf("unterminated string")
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				return "", p.errorf("unterminated string")
+			}
+			esc := p.src[p.pos+1]
+			p.pos += 2
+			switch esc {
+			case '"', '\\', '/':
+				buf.WriteByte(esc)
+			case 'b':
+				buf.WriteByte('\b')
+			case 'f':
+				buf.WriteByte('\f')
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			case 't':
+				buf.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				var r rune
+				if _, err := fmt.Sscanf(p.src[p.pos:p.pos+4], "%04x", &r); err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				buf.WriteRune(r)
+				p.pos += 4
+			default:
+				return "", p.errorf("invalid escape \\%c", esc)
+			}
+		default:
+			buf.WriteByte(ch)
+			p.pos++
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func isNameStart(ch byte) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z')
+}
+
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+func (p *gqlParser) isPunct(s string) bool {
+	return p.kind == 'p' && p.text == s
+}
+
+func (p *gqlParser) expectPunct(s string) error {
+	if !p.isPunct(s) {
+		return p.errorf("expected %q, found %q", s, p.text)
+	}
+	return p.next()
+}
+
+func (p *gqlParser) expectName() (string, error) {
+	if p.kind != 'n' {
+		return "", p.errorf("expected a name, found %q", p.text)
+	}
+	name := p.text
+	return name, p.next()
+}
+
+// parseDocument parses a document holding a single query operation and
+// returns its selections and variable defaults.
+func (p *gqlParser) parseDocument() ([]*gqlSelection, map[string]interface{}, error) {
+	if err := p.next(); err != nil {
+		return nil, nil, err
+	}
+	defaults := make(map[string]interface{})
+	if p.kind == 'n' {
+		switch p.text {
+		case "query":
+		case "mutation", "subscription", "fragment":
+			return nil, nil, fmt.Errorf("%s is not supported", p.text)
+		default:
+			return nil, nil, p.errorf("unexpected %q", p.text)
+		}
+		if err := p.next(); err != nil {
+			return nil, nil, err
+		}
+		if p.kind == 'n' {
+			if err := p.next(); err != nil {
+				return nil, nil, err
+			}
+		}
+		if p.isPunct("(") {
+			if err := p.parseVariableDefinitions(defaults); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	sels, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.kind != 0 {
+		return nil, nil, errors.New("only a single operation per document is supported")
+	}
+	return sels, defaults, nil
+}
+
+func (p *gqlParser) parseVariableDefinitions(defaults map[string]interface{}) error {
+	if err := p.expectPunct("("); err != nil {
+		return err
+	}
+	for !p.isPunct(")") {
+		if err := p.expectPunct("$"); err != nil {
+			return err
+		}
+		name, err := p.expectName()
+		if err != nil {
+			return err
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if p.isPunct("=") {
+			if err := p.next(); err != nil {
+				return err
+			}
+			v, err := p.parseValue()
+			if err != nil {
+				return err
+			}
+			defaults[name] = v
+		}
+	}
+	return p.next()
+}
+
+// skipType skips a type reference. Argument values are checked when the
+// resolvers read them instead.
+func (p *gqlParser) skipType() error {
+	if p.isPunct("[") {
+		if err := p.next(); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.expectName(); err != nil {
+		return err
+	}
+	if p.isPunct("!") {
+		return p.next()
+	}
+	return nil
+}
+
+func (p *gqlParser) parseSelectionSet() ([]*gqlSelection, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for !p.isPunct("}") {
+		if p.isPunct("...") {
+			return nil, errors.New("fragments are not supported")
+		}
+		sel, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	return sels, p.next()
+}
+
+func (p *gqlParser) parseField() (*gqlSelection, error) {
+	name, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	sel := &gqlSelection{Name: name}
+	if p.isPunct(":") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		sel.Alias = name
+		if sel.Name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		sel.Args = make(map[string]interface{})
+		for !p.isPunct(")") {
+			argName, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(":"); err != nil {
+				return nil, err
+			}
+			if sel.Args[argName], err = p.parseValue(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("@") {
+		return nil, errors.New("directives are not supported")
+	}
+	if p.isPunct("{") {
+		if sel.Selections, err = p.parseSelectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) parseValue() (interface{}, error) {
+	kind, text := p.kind, p.text
+	switch {
+	case kind == 'p' && text == "$":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.expectName()
+		return gqlVariable(name), err
+	case kind == 'p' && text == "[":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for !p.isPunct("]") {
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.next()
+	case kind == 'i' || kind == 'f':
+		var f float64
+		if _, err := fmt.Sscan(text, &f); err != nil {
+			return nil, p.errorf("invalid number %q", text)
+		}
+		return f, p.next()
+	case kind == 's':
+		return text, p.next()
+	case kind == 'n':
+		var v interface{}
+		switch text {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			// Enum values are passed to resolvers as strings.
+			v = text
+		}
+		return v, p.next()
+	}
+	return nil, p.errorf("unexpected %q", text)
+}
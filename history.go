@@ -0,0 +1,269 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/user"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+type ListPunchesRequest struct {
+	From   string `form:"from"`
+	To     string `form:"to"`
+	Type   string `form:"type"`
+	Cursor string `form:"cursor"`
+	Limit  int    `form:"limit"`
+}
+
+type CreatePunchRequest struct {
+	Type           string `form:"type"`
+	Time           string `form:"time"`
+	IdempotencyKey string `form:"idempotency_key"`
+	// Project is only kept on arrivals.
+	Project int64 `form:"project"`
+}
+
+type PunchResponse struct {
+	Punch PunchJSON `json:"punch"`
+}
+
+type PunchesResponse struct {
+	Punches    []PunchJSON `json:"punches"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// table has a row per punch. The cursor of the next page is only in the
+// JSON.
+func (res PunchesResponse) table() [][]string {
+	rows := [][]string{{"id", "puncher", "type", "time", "project", "note"}}
+	for _, p := range res.Punches {
+		project := ""
+		if p.Project != 0 {
+			project = strconv.FormatInt(p.Project, 10)
+		}
+		rows = append(rows, []string{strconv.FormatInt(p.ID, 10), p.Puncher, p.Type, p.Time.Format(time.RFC3339), project, p.Note})
+	}
+	return rows
+}
+
+// myPunchQuery builds the query for the caller's own punches, newest
+// first. A date given as "to" includes that whole day.
+func myPunchQuery(c appengine.Context, req *ListPunchesRequest, loc *time.Location) (punchQuery, *appError) {
+	pq := punchQuery{
+		Puncher: user.Current(c).Email,
+		Newest:  true,
+		Cursor:  req.Cursor,
+		Limit:   req.Limit,
+	}
+	if pq.Limit <= 0 {
+		pq.Limit = defaultHistoryLimit
+	} else if pq.Limit > maxHistoryLimit {
+		pq.Limit = maxHistoryLimit
+	}
+	switch req.Type {
+	case "", "arrival", "leave":
+		pq.Type = req.Type
+	default:
+		return pq, &appError{
+			Error:   errors.New("invalid punch type: " + req.Type),
+			Message: `The "type" parameter must be "arrival" or "leave"`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	var appErr *appError
+	if pq.From, appErr = parseTimeParam("from", req.From, loc); appErr != nil {
+		return pq, appErr
+	}
+	if pq.To, appErr = parseTimeParam("to", req.To, loc); appErr != nil {
+		return pq, appErr
+	}
+	if len(req.To) == len("2006-01-02") {
+		pq.To = pq.To.AddDate(0, 0, 1)
+	}
+	return pq, nil
+}
+
+func findMyPunchPage(c appengine.Context, r *http.Request) (*ListPunchesRequest, *PunchesResponse, *appError) {
+	var req ListPunchesRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, nil, appErr
+	}
+	pq, appErr := myPunchQuery(c, &req, requestViewer(r).Location)
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+	keys, punches, next, err := findPunchPage(c, pq)
+	if err != nil {
+		return nil, nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	res := &PunchesResponse{
+		Punches:    make([]PunchJSON, len(punches)),
+		NextCursor: next,
+	}
+	for i := range punches {
+		res.Punches[i] = newPunchJSON(keys[i], &punches[i])
+	}
+	return &req, res, nil
+}
+
+// Punches queued by an offline client are accepted with the time they
+// were made, up to maxPunchAge ago.
+const (
+	maxPunchAge       = 7 * 24 * time.Hour
+	maxPunchClockSkew = 5 * time.Minute
+)
+
+func apiMyPunchesHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method == "GET" {
+		_, res, appErr := findMyPunchPage(c, r)
+		if appErr != nil {
+			return nil, appErr
+		}
+		return res, nil
+	} else if r.Method == "POST" {
+		return createMyPunch(c, r, user.Current(c).Email, punchSourceWeb)
+	} else {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// createMyPunch stores a punch of puncher from the CreatePunchRequest of
+// r, made from source.
+func createMyPunch(c appengine.Context, r *http.Request, puncher, source string) (interface{}, *appError) {
+	req := CreatePunchRequest{IdempotencyKey: r.Header.Get("Idempotency-Key")}
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	if req.Type != "arrival" && req.Type != "leave" {
+		return nil, &appError{
+			Error:   errors.New("invalid punch type: " + req.Type),
+			Message: `The "type" parameter must be "arrival" or "leave"`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if req.IdempotencyKey == "" {
+		return nil, &appError{
+			Error:   errors.New("missing idempotency key"),
+			Message: `The "idempotency_key" parameter or the Idempotency-Key header is required`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if appErr := checkIdempotencyKey(req.IdempotencyKey); appErr != nil {
+		return nil, appErr
+	}
+
+	now := time.Now()
+	p := Punch{
+		Puncher: puncher,
+		Type:    req.Type,
+		Time:    now,
+	}
+	p.setClient(r, source)
+	if req.Time != "" {
+		t, err := time.Parse(time.RFC3339, req.Time)
+		if err != nil {
+			return nil, formValueError(err, "time", `Failed to parse the "%s" parameter as an RFC 3339 time`)
+		}
+		if t.After(now.Add(maxPunchClockSkew)) || t.Before(now.Add(-maxPunchAge)) {
+			return nil, &appError{
+				Error:   fmt.Errorf("punch time out of range: %v", t),
+				Message: "The punch time must be within the last %d days",
+				Args:    []interface{}{int(maxPunchAge / (24 * time.Hour))},
+				Code:    http.StatusBadRequest,
+			}
+		}
+		p.Time = t
+	}
+	if req.Type == "arrival" {
+		if _, ok := r.Form["project"]; !ok {
+			req.Project = defaultPunchProject(c, r)
+		}
+		if appErr := checkPunchProject(c, req.Project); appErr != nil {
+			return nil, appErr
+		}
+		p.Project = req.Project
+	}
+
+	key, stored, created, err := putPunchOnce(c, &p, req.IdempotencyKey)
+	if err != nil {
+		return nil, punchWriteError(err)
+	}
+	res := PunchResponse{Punch: newPunchJSON(key, stored)}
+	if created {
+		punchCreated(c, res.Punch)
+	}
+	return res, nil
+}
+
+// The history page keeps the start cursors of the pages before the
+// current one in the "back" parameter, since datastore cursors only
+// move forward.
+const historyTrailSep = "."
+
+func myHistoryHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	req, res, appErr := findMyPunchPage(c, r)
+	if appErr != nil {
+		return appErr
+	}
+
+	var trail []string
+	if back := r.FormValue("back"); back != "" {
+		trail = strings.Split(back, historyTrailSep)
+	}
+	historyURL := func(cursor string, trail []string) template.URL {
+		v := url.Values{}
+		for name, value := range map[string]string{
+			"from":   req.From,
+			"to":     req.To,
+			"type":   req.Type,
+			"cursor": cursor,
+			"back":   strings.Join(trail, historyTrailSep),
+		} {
+			if value != "" {
+				v.Set(name, value)
+			}
+		}
+		return template.URL("/my/history?" + v.Encode())
+	}
+
+	data := map[string]interface{}{
+		"Request": req,
+		"Punches": res.Punches,
+	}
+	if req.Cursor != "" {
+		// An empty entry stands for the first page.
+		if len(trail) > 0 {
+			data["PrevURL"] = historyURL(trail[len(trail)-1], trail[:len(trail)-1])
+		} else {
+			data["PrevURL"] = historyURL("", nil)
+		}
+	}
+	if res.NextCursor != "" {
+		data["NextURL"] = historyURL(res.NextCursor, append(trail[:len(trail):len(trail)], req.Cursor))
+	}
+	return renderTemplate(c, w, r, historyTemplate, data)
+}
+
+var historyTemplate = parsePage("history")
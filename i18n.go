@@ -0,0 +1,540 @@
+package timecard
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/user"
+)
+
+// Messages are looked up by their English text, which is also used when
+// a translation is missing. Messages taking arguments are fmt formats.
+
+type locale string
+
+const (
+	localeEnglish  locale = "en"
+	localeJapanese locale = "ja"
+
+	defaultLocale = localeEnglish
+)
+
+var locales = []locale{localeEnglish, localeJapanese}
+
+var catalogs = map[locale]map[string]string{
+	localeJapanese: {
+		// Pages
+		"Timecard":                    "タイムカード",
+		"Timecard - %s":               "タイムカード - %s",
+		"Hello, %v!":                  "こんにちは、%vさん",
+		"Arrive":                      "出勤",
+		"Leave":                       "退勤",
+		"arrival":                     "出勤",
+		"leave":                       "退勤",
+		"Language":                    "言語",
+		"Back":                        "戻る",
+		"Sun":                         "日",
+		"Mon":                         "月",
+		"Tue":                         "火",
+		"Wed":                         "水",
+		"Thu":                         "木",
+		"Fri":                         "金",
+		"Sat":                         "土",
+		"Total: %s":                   "合計: %s",
+		"Week of %s":                  "%s の週",
+		"Date":                        "日付",
+		"Arrival":                     "出勤",
+		"Breaks":                      "休憩",
+		"Total":                       "合計",
+		"(in)":                        "(勤務中)",
+		"Week total":                  "週合計",
+		"History":                     "履歴",
+		"From:":                       "開始日:",
+		"To:":                         "終了日:",
+		"All":                         "すべて",
+		"Filter":                      "絞り込み",
+		"No punches":                  "打刻はありません",
+		"Previous":                    "前へ",
+		"Next":                        "次へ",
+		"Who's in":                    "出勤中のメンバー",
+		"since %s":                    "%s から",
+		"Timecard - History":          "タイムカード - 履歴",
+		"Punches waiting to be sent:": "送信待ちの打刻:",
+		"Download my data":            "自分のデータをダウンロード",
+		"Timecard - Error":            "タイムカード - エラー",
+		"Back to the timecard":        "タイムカードに戻る",
+		"Trash":                       "ゴミ箱",
+		"Puncher":                     "打刻者",
+		"Type":                        "種別",
+		"Time":                        "時刻",
+		"Deleted":                     "削除",
+		"Restore":                     "復元",
+		"The trash is empty":          "ゴミ箱は空です",
+		"Request ID: %s":              "リクエスト ID: %s",
+		"%dh %dm":                     "%d時間%d分",
+		"%dh":                         "%d時間",
+		"%dm":                         "%d分",
+		"just now":                    "たった今",
+		"%d minute ago":               "%d 分前",
+		"%d minutes ago":              "%d 分前",
+		"%d hour ago":                 "%d 時間前",
+		"%d hours ago":                "%d 時間前",
+		"%d day ago":                  "%d 日前",
+		"%d days ago":                 "%d 日前",
+		"in %d minute":                "%d 分後",
+		"in %d minutes":               "%d 分後",
+		"in %d hour":                  "%d 時間後",
+		"in %d hours":                 "%d 時間後",
+		"in %d day":                   "%d 日後",
+		"in %d days":                  "%d 日後",
+
+		// Errors
+		"login needed":         "ログインが必要です",
+		"Page not found":       "ページが見つかりません",
+		"No such API endpoint": "該当する API はありません",
+		"No such user":         "該当するユーザーはありません",
+		"The user has been changed by someone else. Reload and try again":                   "ユーザーは他の人によって変更されました。再読み込みしてからやり直してください",
+		`The "version" parameter is required`:                                               `パラメータ "version" が必要です`,
+		"Too many punches at once. Try again":                                               "打刻が集中しています。もう一度お試しください",
+		"No such punch":                                                                     "該当する打刻はありません",
+		"Unsupported http method":                                                           "サポートされていない HTTP メソッドです",
+		"Failed to execute the %s template":                                                 "%s テンプレートの表示に失敗しました",
+		"Failed to fetch punches data from the datastore":                                   "打刻データの取得に失敗しました",
+		"Failed to put a punch data to the datastore":                                       "打刻データの保存に失敗しました",
+		"Failed to fetch users data from the datastore":                                     "ユーザーデータの取得に失敗しました",
+		"Failed to put a user data to the datastore":                                        "ユーザーデータの保存に失敗しました",
+		"Failed to export your data":                                                        "データのエクスポートに失敗しました",
+		"Failed to fetch the theme from the datastore":                                      "テーマの取得に失敗しました",
+		"Failed to put the theme to the datastore":                                          "テーマの保存に失敗しました",
+		`The "%s" parameter must be a color like #336699`:                                   `パラメータ "%s" には #336699 のような色を指定してください`,
+		`The "%s" parameter must be an http or https URL`:                                   `パラメータ "%s" には http または https の URL を指定してください`,
+		"Failed to read the request body":                                                   "リクエスト本文の読み込みに失敗しました",
+		"Failed to parse the request body as JSON":                                          "リクエスト本文を JSON として解釈できません",
+		"Failed to read the live event sequence":                                            "ライブイベントの連番の取得に失敗しました",
+		"Failed to read live events":                                                        "ライブイベントの取得に失敗しました",
+		"Failed to encode a live event":                                                     "ライブイベントのエンコードに失敗しました",
+		"The range must be from 1 to %d days":                                               "期間は 1 日から %d 日の範囲で指定してください",
+		`The "idempotency_key" parameter or the Idempotency-Key header is required`:         `パラメータ "idempotency_key" または Idempotency-Key ヘッダーが必要です`,
+		"The punch time must be within the last %d days":                                    "打刻時刻は過去 %d 日以内で指定してください",
+		`Failed to parse the "%s" parameter as an RFC 3339 time`:                            `パラメータ "%s" を RFC 3339 形式の時刻として解釈できません`,
+		`The "type" parameter must be "arrival" or "leave"`:                                 `パラメータ "type" には "arrival" または "leave" を指定してください`,
+		`Failed to parse the "%s" parameter as a boolean value`:                             `パラメータ "%s" を真偽値として解釈できません`,
+		`Failed to parse the "%s" parameter as an integer`:                                  `パラメータ "%s" を整数として解釈できません`,
+		`Failed to parse the "%s" parameter as a date or an RFC 3339 time`:                  `パラメータ "%s" を日付または RFC 3339 形式の時刻として解釈できません`,
+		`Failed to parse the "%s" parameter as a month (YYYY-MM)`:                           `パラメータ "%s" を年月 (YYYY-MM) として解釈できません`,
+		`Failed to parse the "%s" parameter as a date (YYYY-MM-DD)`:                         `パラメータ "%s" を日付 (YYYY-MM-DD) として解釈できません`,
+		"No such user deletion":                                                             "該当するユーザー削除はありません",
+		"Failed to fetch the user deletion from the datastore":                              "ユーザー削除の取得に失敗しました",
+		"Failed to put the user deletion to the datastore":                                  "ユーザー削除の保存に失敗しました",
+		"Failed to start the user deletion":                                                 "ユーザー削除の開始に失敗しました",
+		"Failed to process the user deletion":                                               "ユーザー削除の処理に失敗しました",
+		"not a task queue or cron request":                                                  "タスクキューまたは cron からのリクエストではありません",
+		`The "email" parameter is required`:                                                 `パラメータ "email" が必要です`,
+		`The "mode" parameter must be "delete" or "anonymize"`:                              `パラメータ "mode" には "delete" または "anonymize" を指定してください`,
+		"Failed to fetch the retention policy from the datastore":                           "保存期間の設定の取得に失敗しました",
+		"Failed to put the retention policy to the datastore":                               "保存期間の設定の保存に失敗しました",
+		"Failed to purge expired data":                                                      "期限切れデータの削除に失敗しました",
+		"Failed to create a backup":                                                         "バックアップの作成に失敗しました",
+		"The backup is invalid: %s":                                                         "バックアップが不正です: %s",
+		`The "object" parameter or an "archive" file is required`:                           `パラメータ "object" または "archive" ファイルが必要です`,
+		"Failed to read the backup":                                                         "バックアップの読み込みに失敗しました",
+		"Failed to restore the backup":                                                      "バックアップの復元に失敗しました",
+		"Failed to fetch the integrations from the datastore":                               "連携設定の取得に失敗しました",
+		"Failed to put the integrations to the datastore":                                   "連携設定の保存に失敗しました",
+		`The "%s" parameter may only contain letters, digits and underscores`:               `パラメータ "%s" には英数字とアンダースコアのみ使えます`,
+		"Failed to send punches to BigQuery":                                                "BigQuery への打刻の送信に失敗しました",
+		"BigQuery is not configured":                                                        "BigQuery が設定されていません",
+		`The "%s" parameter must be a service account JSON key`:                             `パラメータ "%s" にはサービスアカウントの JSON キーを指定してください`,
+		"Google Sheets is not configured":                                                   "Google スプレッドシートが設定されていません",
+		"Failed to export to Google Sheets":                                                 "Google スプレッドシートへのエクスポートに失敗しました",
+		"Only admins can see profiles":                                                      "プロファイルは管理者のみ参照できます",
+		"No such profile":                                                                   "該当するプロファイルはありません",
+		"Failed to start the CPU profile":                                                   "CPU プロファイルの開始に失敗しました",
+		`The "%s" parameter must be from 1 to %d`:                                           `パラメータ "%s" には 1 から %d までを指定してください`,
+		`Failed to parse the "%s" parameter as a JSON object`:                               `パラメータ "%s" を JSON オブジェクトとして解釈できません`,
+		`The "sort" parameter must be name, email or updated, optionally prefixed with "-"`: `パラメータ "sort" には name、email、updated のいずれか (降順は先頭に "-") を指定してください`,
+		`The "%s" parameter is invalid or no longer matches a user`:                         `パラメータ "%s" が不正か、該当するユーザーがもういません`,
+		"Only admins can use this page":                                                     "このページは管理者のみ利用できます",
+		"You are invited to the timecard":                                                   "タイムカードに招待されました",
+		"%s invited you to the timecard. Open this link and sign in as %s to start punching:\n\n%s\n\nThe link expires on %s.": "%s さんがあなたをタイムカードに招待しました。次のリンクを開き、%s としてログインすると打刻を始められます:\n\n%s\n\nリンクの有効期限は %s です。",
+		"Failed to fetch the invitations from the datastore":                                                                   "招待の取得に失敗しました",
+		"Failed to put the invitation to the datastore":                                                                        "招待の保存に失敗しました",
+		`The "email" parameter must be an email address`:                                                                       `パラメータ "email" にはメールアドレスを指定してください`,
+		"No such invitation": "該当する招待はありません",
+		"This invitation is for %s. Sign in with that account to accept it": "この招待は %s 宛てです。そのアカウントでログインしてから承諾してください",
+		"The invitation has expired. Ask your admin for a new one":          "招待の有効期限が切れています。管理者に新しい招待を依頼してください",
+		"Invitation":                    "招待",
+		"%s invited you as %s.":         "%s さんがあなたを %s として招待しました。",
+		"Accept the invitation":         "招待を承諾する",
+		"You have joined the timecard.": "タイムカードに参加済みです。",
+		"Failed to fetch the sign-in policy from the datastore":                                             "ログイン制限の取得に失敗しました",
+		"Failed to put the sign-in policy to the datastore":                                                 "ログイン制限の保存に失敗しました",
+		"The account %s can't use this timecard. Sign in with your work account, or contact your admin":     "アカウント %s ではこのタイムカードを利用できません。業務用のアカウントでログインするか、管理者に問い合わせてください",
+		`The "allowed_domains" parameter must list domains like example.co.jp`:                              `パラメータ "allowed_domains" には example.co.jp のようなドメインを指定してください`,
+		"The allowed domains must include your own domain, %s":                                              "許可するドメインにはご自身のドメイン %s を含めてください",
+		"Accounts of %s aren't allowed to sign in":                                                          "%s のアカウントはログインを許可されていません",
+		"Failed to fetch the tenants from the datastore":                                                    "テナントの取得に失敗しました",
+		"Failed to put the tenant to the datastore":                                                         "テナントの保存に失敗しました",
+		"Only project admins can manage tenants":                                                            "テナントを管理できるのはプロジェクトの管理者のみです",
+		`The "namespace" parameter may only contain letters, digits, ".", "-" and "_", up to %d characters`: `パラメータ "namespace" には英数字と "."、"-"、"_" のみ、%d 文字まで使えます`,
+		`The "domains" parameter must list domains like example.co.jp`:                                      `パラメータ "domains" には example.co.jp のようなドメインを指定してください`,
+		"Tenant":         "テナント",
+		"Default tenant": "既定のテナント",
+		"Switch":         "切り替え",
+		"Failed to sync the users with the directory":                     "ディレクトリとのユーザーの同期に失敗しました",
+		"The directory sync is not configured":                            "ディレクトリの同期が設定されていません",
+		"Sign in with another account":                                    "別のアカウントでログイン",
+		"Not allowed":                                                     "利用できません",
+		"A bearer token is required":                                      "ベアラートークンが必要です",
+		"The bearer token is invalid or has been revoked":                 "ベアラートークンが無効か、無効化されています",
+		"Failed to fetch the SCIM token from the datastore":               "SCIM トークンの取得に失敗しました",
+		"Failed to put the SCIM token to the datastore":                   "SCIM トークンの保存に失敗しました",
+		"The email of a user can't be changed":                            "ユーザーのメールアドレスは変更できません",
+		`The "filter" parameter only supports userName eq "..."`:          `パラメータ "filter" には userName eq "..." のみ指定できます`,
+		"The userName must be an email address":                           "userName にはメールアドレスを指定してください",
+		"A user with the email %s already exists":                         "メールアドレス %s のユーザーは既に存在します",
+		"The active attribute must be a boolean":                          "active 属性には真偽値を指定してください",
+		"The punch time can't be in the future":                           "打刻の時刻を未来にすることはできません",
+		`The "puncher" parameter must be the email of a user`:             `パラメータ "puncher" にはユーザーのメールアドレスを指定してください`,
+		"recorded by %s":                                                  "%s が記録",
+		"Notifications":                                                   "お知らせ",
+		"No notifications":                                                "お知らせはありません",
+		"Mark all read":                                                   "すべて既読にする",
+		"Mark read":                                                       "既読にする",
+		"Punch: %s":                                                       "打刻: %s",
+		"%s recorded a punch for you":                                     "%s があなたの打刻を記録しました",
+		"%s corrected one of your punches":                                "%s があなたの打刻を修正しました",
+		"%s moved one of your punches to the trash":                       "%s があなたの打刻をゴミ箱に移動しました",
+		"%s restored one of your punches from the trash":                  "%s があなたの打刻をゴミ箱から復元しました",
+		"Failed to fetch the notifications from the datastore":            "お知らせの取得に失敗しました",
+		"Failed to put the notifications to the datastore":                "お知らせの保存に失敗しました",
+		"No such notification":                                            "お知らせが見つかりません",
+		"Emails":                                                          "メール",
+		"Email me about my account":                                       "アカウントについてメールで知らせる",
+		"Email me when others change my punches":                          "他の人が打刻を変更したらメールで知らせる",
+		"Save":                                                            "保存",
+		"Your timecard account has been created":                          "タイムカードのアカウントが作成されました",
+		"Your timecard account has been disabled":                         "タイムカードのアカウントが無効になりました",
+		"You can turn these emails off at %s":                             "このメールは %s で停止できます",
+		"Timecard: %s":                                                    "タイムカード: %s",
+		"Failed to fetch the notification preferences from the datastore": "通知の設定の取得に失敗しました",
+		"Failed to put the notification preferences to the datastore":     "通知の設定の保存に失敗しました",
+		"Late arrival":                                                    "遅刻",
+		"Employee":                                                        "従業員",
+		"Arrived":                                                         "出勤",
+		"Expected by":                                                     "出勤予定",
+		"Missing punches on %s":                                           "%s の打刻漏れ",
+		"Didn't punch out":                                                "退勤の打刻なし",
+		"Failed to fetch the webhooks from the datastore":                 "Webhook の取得に失敗しました",
+		"Failed to put the webhook to the datastore":                      "Webhook の保存に失敗しました",
+		"No such webhook":                                                 "Webhook が見つかりません",
+		`The "kind" parameter must be "google_chat" or "teams"`:           `パラメータ "kind" には "google_chat" または "teams" を指定してください`,
+		`The "url" parameter must be an https URL`:                        `パラメータ "url" には https の URL を指定してください`,
+		`The "%s" parameter must be a time of day like 09:30`:             `パラメータ "%s" には 09:30 のような時刻を指定してください`,
+		`The "%s" parameter must be a time zone like Asia/Tokyo`:          `パラメータ "%s" には Asia/Tokyo のようなタイムゾーンを指定してください`,
+		"No such client":                                                  "そのクライアントはありません",
+		"No such project":                                                 "そのプロジェクトはありません",
+		"Failed to fetch the clients from the datastore":                  "データストアからクライアントの取得に失敗しました",
+		"Failed to fetch the projects from the datastore":                 "データストアからプロジェクトの取得に失敗しました",
+		"Failed to put the client to the datastore":                       "データストアへのクライアントの保存に失敗しました",
+		"Failed to put the project to the datastore":                      "データストアへのプロジェクトの保存に失敗しました",
+		`The "project" parameter must be the ID of a project that isn't archived`: `パラメータ "project" にはアーカイブされていないプロジェクトの ID を指定してください`,
+		`The "name" parameter is required`:                                        `パラメータ "name" が必要です`,
+		`The "client" parameter is required`:                                      `パラメータ "client" が必要です`,
+		`The "%s" parameter must be from 0 to 100`:                                `パラメータ "%s" には 0 から 100 までを指定してください`,
+		`The "%s" parameter can't be negative`:                                    `パラメータ "%s" には負の値を指定できません`,
+		"Invoice":                                                                 "請求書",
+		"Create invoice":                                                          "請求書を作成",
+		"Period: %s - %s":                                                         "期間: %s - %s",
+		"Project":                                                                 "プロジェクト",
+		"Hours":                                                                   "時間",
+		"Rate":                                                                    "単価",
+		"Amount":                                                                  "金額",
+		"No billable sessions":                                                    "請求対象の勤務はありません",
+		"Subtotal":                                                                "小計",
+		"Tax (%d%%)":                                                              "税 (%d%%)",
+		"No project":                                                              "プロジェクトなし",
+		"Projects report":                                                         "プロジェクト別レポート",
+		"Everyone":                                                                "全員",
+		"Show":                                                                    "表示",
+		"Client":                                                                  "クライアント",
+		"No client":                                                               "クライアントなし",
+		"No sessions":                                                             "勤務はありません",
+		"Download CSV":                                                            "CSV をダウンロード",
+		"Payroll":                                                                 "給与計算",
+		"Period":                                                                  "期間",
+		"Regular":                                                                 "所定内",
+		"Overtime":                                                                "時間外",
+		"Gross pay":                                                               "総支給額",
+		"No rate":                                                                 "単価未設定",
+		`Unknown field "%s" in the "fields" parameter`:                  `パラメータ "fields" の項目 "%s" は不明です`,
+		`The "headers" parameter must have a header for each field`:     `パラメータ "headers" には項目ごとに見出しを指定してください`,
+		`The "%s" parameter must have YYYY, MM or DD`:                   `パラメータ "%s" には YYYY、MM、DD のいずれかを含めてください`,
+		`The "round_mode" parameter must be "nearest", "down" or "up"`:  `パラメータ "round_mode" には "nearest"、"down"、"up" のいずれかを指定してください`,
+		`The "%s" parameter must be from 0 to %d`:                       `パラメータ "%s" には 0 から %d までを指定してください`,
+		"Failed to fetch the payroll export format from the datastore":  "データストアから給与データの出力形式の取得に失敗しました",
+		"Failed to put the payroll export format to the datastore":      "データストアへの給与データの出力形式の保存に失敗しました",
+		"Failed to delete the payroll export format from the datastore": "データストアからの給与データの出力形式の削除に失敗しました",
+		"Failed to fetch the holidays from the datastore":               "データストアから休日の取得に失敗しました",
+		"Failed to put the holiday to the datastore":                    "データストアへの休日の保存に失敗しました",
+		"Failed to delete the holiday from the datastore":               "データストアからの休日の削除に失敗しました",
+		"Absences":             "欠勤",
+		"%d workdays":          "勤務日 %d 日",
+		"Days without punches": "打刻のない日",
+		"No absences":          "欠勤はありません",
+		"Failed to fetch the overnight policy from the datastore":        "データストアから日付をまたぐ勤務の設定の取得に失敗しました",
+		"Failed to put the overnight policy to the datastore":            "データストアへの日付をまたぐ勤務の設定の保存に失敗しました",
+		`The "%s" parameter must be "start_day" or "split"`:              `パラメータ "%s" には "start_day" または "split" を指定してください`,
+		"Failed to fetch the workweek from the datastore":                "データストアから勤務日の設定の取得に失敗しました",
+		"Failed to put the workweek to the datastore":                    "データストアへの勤務日の設定の保存に失敗しました",
+		"Failed to delete the workweek from the datastore":               "データストアからの勤務日の設定の削除に失敗しました",
+		`The "workdays" parameter must be days like mon,tue,wed,thu,fri`: `パラメータ "workdays" には mon,tue,wed,thu,fri のように曜日を指定してください`,
+		"Expected":                     "所定",
+		"Failed to parse the CSV file": "CSVファイルを解析できませんでした",
+		"The CSV file must have a header row with the columns email, type, timestamp and optionally note":        "CSVファイルには email, type, timestamp と任意で note の列からなるヘッダー行が必要です",
+		"The CSV file can have at most %d rows":                                                                  "CSVファイルの行数は最大 %d 行です",
+		"Failed to parse the row as CSV":                                                                         "行をCSVとして解析できませんでした",
+		"The \"email\" column must be the email of a user":                                                       "列 \"email\" にはユーザーのメールアドレスを指定してください",
+		"The \"type\" column must be \"arrival\" or \"leave\"":                                                   "列 \"type\" には \"arrival\" または \"leave\" を指定してください",
+		"Failed to parse the \"timestamp\" column as an RFC 3339 time":                                           "\"timestamp\" 列を RFC 3339 の時刻として解析できませんでした",
+		"No such punch import":                                                                                   "そのインポートはありません",
+		"Failed to fetch the punch import from the datastore":                                                    "インポートをデータストアから取得できませんでした",
+		"A CSV \"file\" is required":                                                                             "CSVの \"file\" が必要です",
+		"Failed to read the CSV file":                                                                            "CSVファイルを読み込めませんでした",
+		"Failed to put the punch import to the datastore":                                                        "インポートをデータストアに保存できませんでした",
+		"Failed to start the punch import":                                                                       "インポートを開始できませんでした",
+		"Failed to process the punch import":                                                                     "インポートを処理できませんでした",
+		"The \"mode\" parameter must be \"import\" or empty":                                                     "パラメータ \"mode\" には \"import\" または空を指定してください",
+		"The CSV file must have a header row with the columns email, name and optionally team, role and enabled": "CSVファイルには email, name と任意で team, role, enabled の列からなるヘッダー行が必要です",
+		"The \"email\" column must be an email address":                                                          "列 \"email\" にはメールアドレスを指定してください",
+		"The email is already in row %d":                                                                         "このメールアドレスは %d 行目にもあります",
+		"The \"role\" column must be \"admin\", \"employee\" or empty":                                           "列 \"role\" には \"admin\"、\"employee\" または空を指定してください",
+		"The \"enabled\" column must be true, false or empty":                                                    "列 \"enabled\" には true、false または空を指定してください",
+		"Timesheets":     "タイムシート",
+		"Week":           "週",
+		"Month":          "月",
+		"No users":       "ユーザーがいません",
+		"Download Excel": "Excel をダウンロード",
+		"The \"period\" parameter must be \"week\" or \"month\"": "パラメータ \"period\" には \"week\" または \"month\" を指定してください",
+		"Timesheet":                 "タイムシート",
+		"Employee signature":        "本人署名",
+		"Approver signature":        "承認者署名",
+		"Printed %s":                "%s 印刷",
+		"Download the month as PDF": "月の PDF をダウンロード",
+		"Download PDF":              "PDF をダウンロード",
+		"Dashboard":                 "ダッシュボード",
+		"%d in now":                 "現在 %d 人が出勤中",
+		"Team":                      "チーム",
+		"Name":                      "名前",
+		"Status":                    "状態",
+		"First arrival":             "最初の出勤",
+		"Last punch":                "最後の打刻",
+		"In":                        "出勤中",
+		"Out":                       "退勤済み",
+		"Not yet":                   "未出勤",
+		"The \"sort\" parameter must be team, name, status or arrival": "パラメータ \"sort\" には team、name、status、arrival のいずれかを指定してください",
+		"You are IN since %s": "%s から出勤中です",
+		"You are OUT":         "退勤中です",
+		"API tokens":          "APIトークン",
+		"Scripts and the timecard command punch and read your reports as you with an API token.": "スクリプトや timecard コマンドは、APIトークンを使ってあなたとして打刻したりレポートを読んだりします。",
+		"Copy the token %s now. It won't be shown again.":                                        "トークン %s を今コピーしてください。二度と表示されません。",
+		"Created":        "作成日時",
+		"Last used":      "最終使用",
+		"Never":          "未使用",
+		"Revoke":         "無効にする",
+		"No API tokens":  "APIトークンはありません",
+		"Create a token": "トークンを作成",
+		"Failed to fetch the API tokens from the datastore":                "データストアからのAPIトークンの取得に失敗しました",
+		"Failed to put the API token to the datastore":                     "データストアへのAPIトークンの保存に失敗しました",
+		"Failed to delete the API token from the datastore":                "データストアからのAPIトークンの削除に失敗しました",
+		"You can have at most %d API tokens. Revoke one to create another": "APIトークンは %d 個までです。作成するには既存のトークンを無効にしてください",
+		"No such API token":                                     "そのAPIトークンはありません",
+		"Only enabled users can create API tokens":              "APIトークンを作成できるのは有効なユーザーだけです",
+		`The "format" parameter must be json, csv or text`:      `パラメータ "format" には json、csv、text のいずれかを指定してください`,
+		`The "format" parameter must be json for this endpoint`: `このエンドポイントではパラメータ "format" には json を指定してください`,
+		"Settings":  "設定",
+		"Time zone": "タイムゾーン",
+		"Leave empty to use the time zone of your browser.": "空にするとブラウザのタイムゾーンを使います。",
+		"Automatic":       "自動",
+		"Default project": "既定のプロジェクト",
+		"Failed to put the settings to the datastore":     "設定をデータストアに保存できませんでした",
+		"Failed to fetch the settings from the datastore": "設定をデータストアから取得できませんでした",
+		`The "locale" parameter must be en, ja or empty`:  `パラメータ "locale" には en、ja または空を指定してください`,
+		"Organization settings":                           "組織の設定",
+		"Company name":                                    "会社名",
+		"Currency of new clients":                         "新しい取引先の通貨",
+		"Round the worked time of each session to":        "各勤務の労働時間の丸め単位（分）",
+		"nearest":                          "四捨五入",
+		"down":                             "切り捨て",
+		"up":                               "切り上げ",
+		"Count sessions crossing midnight": "日付をまたぐ勤務の労働時間",
+		"for the day they started on":      "すべて開始日に計上",
+		"split at midnight":                "午前0時で分けて計上",
+		"Punch out sessions still open at": "退勤し忘れた勤務を自動で退勤させる時刻",
+		"An hour from 1 to 24, or 0 to leave them open.":      "1 から 24 までの時、または 0 で自動退勤しません。",
+		"Allowed email domains":                               "許可するメールドメイン",
+		"Leave empty to let every account sign in.":           "空にするとすべてのアカウントがサインインできます。",
+		"Keep punches for":                                    "打刻の保存日数",
+		"Days, or 0 to keep them forever.":                    "日数、または 0 で無期限に保存します。",
+		"Failed to fetch the org settings from the datastore": "組織の設定をデータストアから取得できませんでした",
+		"Failed to put the org settings to the datastore":     "組織の設定をデータストアに保存できませんでした",
+		`The "%s" parameter must be a currency code like JPY`: `パラメータ "%s" には JPY のような通貨コードを指定してください`,
+		"You were punched out automatically at %s":            "%s に自動で退勤しました",
+		"Punch":                          "打刻",
+		"Recorded by":                    "記録者",
+		"Note":                           "メモ",
+		"Source":                         "打刻元",
+		"Unknown":                        "不明",
+		"IP address":                     "IP アドレス",
+		"User agent":                     "ユーザーエージェント",
+		"The history is broken: %s":      "履歴が壊れています: %s",
+		"Revision":                       "版",
+		"Change":                         "変更",
+		"By":                             "変更者",
+		"At":                             "日時",
+		"Anomalies":                      "異常",
+		"Anomaly":                        "異常",
+		"Session of %s":                  "%s の勤務",
+		"No leave":                       "退勤の打刻がありません",
+		"Arrival far from the usual %s":  "いつもの %s から離れた出勤",
+		"Same time of day as %d punches": "%d 件の打刻と同じ時刻",
+		"No anomalies":                   "異常はありません",
+		"Report sessions longer than":    "次より長い勤務を報告する",
+		"Hours, in the anomaly report.":  "時間。異常のレポートに使われます。",
+		"Punches on the top page":        "トップページに表示する打刻の数",
+		"See full history":               "すべての履歴を見る",
+		"Jobs":                           "ジョブ",
+		"Job":                            "ジョブ",
+		"Export punches":                 "打刻をエクスポート",
+		"Requested":                      "依頼",
+		"Processed":                      "処理済み",
+		"Updated":                        "更新",
+		"No jobs":                        "ジョブはありません",
+		"With no dates, every punch is exported. The end date is not included.": "日付を指定しない場合はすべての打刻をエクスポートします。終了日は含まれません。",
+		"punch_export": "打刻のエクスポート",
+		"purge":        "期限切れデータの削除",
+		"backup":       "バックアップ",
+		"queued":       "待機中",
+		"running":      "実行中",
+		"done":         "完了",
+		"failed":       "失敗",
+		"No such job":  "ジョブが見つかりません",
+		"Failed to fetch the jobs from the datastore":                             "ジョブの取得に失敗しました",
+		"Failed to put the job to the datastore":                                  "ジョブの保存に失敗しました",
+		"Failed to run the job":                                                   "ジョブの実行に失敗しました",
+		"Failed to start the job":                                                 "ジョブの開始に失敗しました",
+		`The "kind" parameter must be "punch_export"`:                             `パラメータ "kind" には "punch_export" を指定してください`,
+		"The job has no output to download":                                       "このジョブにはダウンロードできる出力がありません",
+		"Break deductions":                                                        "休憩の控除",
+		"Minutes worked without a break, and the minutes deducted for the break.": "休憩なしで勤務した分数と、休憩として控除する分数です。",
+		`The "break_rules" parameter must list rules like 360:45, with increasing minutes from 1 to 1440`: `パラメータ "break_rules" には 360:45 のような規則を、1 から 1440 までの増加する分数で指定してください`,
+		`The "%s" parameter must list at most %d rules`:                                                   `パラメータ "%s" に指定できる規則は %d 個までです`,
+		"Changed":     "変更",
+		"puncher":     "打刻者",
+		"type":        "種別",
+		"time":        "時刻",
+		"deleted":     "削除",
+		"recorded_by": "記録者",
+		"Failed to fetch the punch history from the datastore":              "打刻の履歴の取得に失敗しました",
+		"The punch is in the trash":                                         "この打刻はゴミ箱にあります",
+		"The punch is not in the trash":                                     "この打刻はゴミ箱にありません",
+		"The idempotency key must be at most %d printable ASCII characters": "冪等キーは %d 文字以内の印字可能な ASCII 文字で指定してください",
+	},
+}
+
+// T returns the translation of msg formatted with args.
+func (l locale) T(msg string, args ...interface{}) string {
+	if s, ok := catalogs[l][msg]; ok {
+		msg = s
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+func parseLocale(s string) (locale, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if i := strings.IndexAny(s, "-_"); i >= 0 {
+		s = s[:i]
+	}
+	for _, l := range locales {
+		if string(l) == s {
+			return l, true
+		}
+	}
+	return "", false
+}
+
+const localeCookieName = "locale"
+
+// requestLocale returns the locale of the user's settings, or the one
+// they chose on the language switcher, or else the best match of the
+// Accept-Language header.
+func requestLocale(r *http.Request) locale {
+	if s := requestUserSettings(r); s != nil {
+		if l, ok := parseLocale(s.Locale); ok {
+			return l
+		}
+	}
+	if cookie, err := r.Cookie(localeCookieName); err == nil {
+		if l, ok := parseLocale(cookie.Value); ok {
+			return l
+		}
+	}
+	return acceptLanguageLocale(r.Header.Get("Accept-Language"))
+}
+
+func acceptLanguageLocale(header string) locale {
+	best, bestQ := defaultLocale, 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		l, ok := parseLocale(fields[0])
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = l, q
+		}
+	}
+	return best
+}
+
+// myLocaleHandler sets the language chosen on the language switcher,
+// which is also saved in the user's settings.
+func myLocaleHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method == "POST" {
+		if l, ok := parseLocale(r.FormValue("locale")); ok {
+			email := user.Current(c).Email
+			s, err := getUserSettings(c, email)
+			if err != nil {
+				return userSettingsError(err)
+			}
+			s.Locale = string(l)
+			if appErr := putUserSettings(c, email, s); appErr != nil {
+				return appErr
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:    localeCookieName,
+				Value:   string(l),
+				Path:    "/",
+				Expires: time.Now().AddDate(1, 0, 0),
+			})
+		}
+		redirect(w, "/")
+	}
+	return nil
+}
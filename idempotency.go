@@ -0,0 +1,119 @@
+package timecard
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// IdempotencyKey remembers the punch created for a client-generated key
+// so that a retried request returns that punch instead of creating a
+// second one. It is keyed by the user's email and the client's key, and
+// lives in the punches' entity group so both are written atomically.
+type IdempotencyKey struct {
+	Punch   *datastore.Key
+	Created time.Time
+}
+
+func idempotencyKeyKey(c appengine.Context, email, key string) *datastore.Key {
+	return datastore.NewKey(c, "IdempotencyKey", email+"\n"+key, 0, punchKey(c))
+}
+
+// maxIdempotencyKeyLength is the length in bytes of the longest key a
+// client may send.
+const maxIdempotencyKeyLength = 255
+
+// checkIdempotencyKey rejects a client's key that is too long or has
+// anything but printable ASCII, like the newline that separates the email
+// from the key in the key name.
+func checkIdempotencyKey(key string) *appError {
+	bad := len(key) > maxIdempotencyKeyLength
+	for i := 0; i < len(key) && !bad; i++ {
+		bad = key[i] < 0x20 || key[i] > 0x7e
+	}
+	if bad {
+		return &appError{
+			Error:   fmt.Errorf("invalid idempotency key %q", key),
+			Message: "The idempotency key must be at most %d printable ASCII characters",
+			Args:    []interface{}{maxIdempotencyKeyLength},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+// punchTransactionOptions retry transactions on the punches' entity
+// group more than the default, since every punch of everyone is written
+// to it.
+var punchTransactionOptions = &datastore.TransactionOptions{Attempts: 5}
+
+// putPunchOnce stores p unless a punch has already been stored for the
+// same puncher and idempotencyKey, in which case that punch is returned
+// and created is false. An empty idempotencyKey always stores p. The
+// punch is written in a transaction so that all the entities kept with
+// it stay consistent under concurrent punches.
+func putPunchOnce(c appengine.Context, p *Punch, idempotencyKey string) (key *datastore.Key, stored *Punch, created bool, err error) {
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if idempotencyKey == "" {
+			key, err = insertPunch(tc, p, p.recorder())
+			stored, created = p, true
+			return err
+		}
+
+		ik := idempotencyKeyKey(tc, p.Puncher, idempotencyKey)
+		var rec IdempotencyKey
+		err := datastore.Get(tc, ik, &rec)
+		if err == nil {
+			var existing Punch
+			if err := datastore.Get(tc, rec.Punch, &existing); err != nil {
+				return err
+			}
+			key, stored, created = rec.Punch, &existing, false
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		key, err = insertPunch(tc, p, p.recorder())
+		if err != nil {
+			return err
+		}
+		rec = IdempotencyKey{Punch: key, Created: time.Now()}
+		if _, err := datastore.Put(tc, ik, &rec); err != nil {
+			return err
+		}
+		stored, created = p, true
+		return nil
+	}, punchTransactionOptions)
+	return
+}
+
+// punchWriteError reports a failure of putPunchOnce. Running out of
+// transaction attempts is temporary, so the client is told to retry.
+func punchWriteError(err error) *appError {
+	if err == datastore.ErrConcurrentTransaction {
+		return &appError{
+			Error:   err,
+			Message: "Too many punches at once. Try again",
+			Code:    http.StatusServiceUnavailable,
+		}
+	}
+	return &appError{
+		Error:   err,
+		Message: "Failed to put a punch data to the datastore",
+		Code:    http.StatusInternalServerError,
+	}
+}
+
+// idempotencyKeysQuery returns a query for the idempotency keys of email.
+// The client's key is the part of a key's StringID after prefix.
+func idempotencyKeysQuery(c appengine.Context, email string) (q *datastore.Query, prefix string) {
+	prefix = email + "\n"
+	q = datastore.NewQuery("IdempotencyKey").Ancestor(punchKey(c)).
+		Filter("__key__ >=", datastore.NewKey(c, "IdempotencyKey", prefix, 0, punchKey(c))).
+		Filter("__key__ <", datastore.NewKey(c, "IdempotencyKey", prefix+"\xff", 0, punchKey(c)))
+	return q, prefix
+}
@@ -0,0 +1,177 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Integrations configures the external services punches are sent to.
+// There is a single Integrations entity, edited by admins; an
+// integration is off until it is configured.
+type Integrations struct {
+	// BigQueryProject defaults to the app's own project.
+	BigQueryProject string
+	BigQueryDataset string
+	BigQueryTable   string
+
+	// SheetsSpreadsheetID is the spreadsheet hour totals are exported
+	// to. SheetsCredentials is the JSON key of the service account to
+	// write it as, or empty to use the app's own service account.
+	SheetsSpreadsheetID string
+	SheetsCredentials   string `datastore:",noindex"`
+
+	// DirectoryAdminEmail is the Workspace admin whom the service account
+	// of DirectoryCredentials acts as, through domain-wide delegation, to
+	// read the users of DirectoryDomain, or of the whole account when it
+	// is empty.
+	DirectoryAdminEmail  string
+	DirectoryDomain      string
+	DirectoryCredentials string `datastore:",noindex"`
+}
+
+func integrationsKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Integrations", "default_integrations", 0, nil)
+}
+
+func getIntegrations(c appengine.Context) (*Integrations, error) {
+	var in Integrations
+	err := datastore.Get(c, integrationsKey(c), &in)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return &in, nil
+}
+
+type IntegrationsJSON struct {
+	BigQueryProject string `json:"bigquery_project"`
+	BigQueryDataset string `json:"bigquery_dataset"`
+	BigQueryTable   string `json:"bigquery_table"`
+
+	SheetsSpreadsheetID string `json:"sheets_spreadsheet_id"`
+	// The credentials themselves are never sent back.
+	SheetsCredentialsSet bool `json:"sheets_credentials_set"`
+
+	DirectoryAdminEmail     string `json:"directory_admin_email"`
+	DirectoryDomain         string `json:"directory_domain"`
+	DirectoryCredentialsSet bool   `json:"directory_credentials_set"`
+}
+
+type IntegrationsResponse struct {
+	Integrations IntegrationsJSON `json:"integrations"`
+}
+
+type UpdateIntegrationsRequest struct {
+	BigQueryProject string `form:"bigquery_project"`
+	BigQueryDataset string `form:"bigquery_dataset"`
+	BigQueryTable   string `form:"bigquery_table"`
+
+	SheetsSpreadsheetID string `form:"sheets_spreadsheet_id"`
+	// SheetsCredentials replaces the stored key when given; "-" removes
+	// it.
+	SheetsCredentials string `form:"sheets_credentials"`
+
+	DirectoryAdminEmail string `form:"directory_admin_email"`
+	DirectoryDomain     string `form:"directory_domain"`
+	// DirectoryCredentials is replaced and removed like
+	// SheetsCredentials.
+	DirectoryCredentials string `form:"directory_credentials"`
+}
+
+func newIntegrationsResponse(in *Integrations) IntegrationsResponse {
+	return IntegrationsResponse{Integrations: IntegrationsJSON{
+		BigQueryProject: in.BigQueryProject,
+		BigQueryDataset: in.BigQueryDataset,
+		BigQueryTable:   in.BigQueryTable,
+
+		SheetsSpreadsheetID:  in.SheetsSpreadsheetID,
+		SheetsCredentialsSet: in.SheetsCredentials != "",
+
+		DirectoryAdminEmail:     in.DirectoryAdminEmail,
+		DirectoryDomain:         in.DirectoryDomain,
+		DirectoryCredentialsSet: in.DirectoryCredentials != "",
+	}}
+}
+
+var bigQueryNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+func apiAdminIntegrationsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	in, err := getIntegrations(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the integrations from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if r.Method == "GET" {
+		return newIntegrationsResponse(in), nil
+	} else if r.Method == "PUT" || r.Method == "POST" {
+		req := UpdateIntegrationsRequest{
+			BigQueryProject: in.BigQueryProject,
+			BigQueryDataset: in.BigQueryDataset,
+			BigQueryTable:   in.BigQueryTable,
+
+			SheetsSpreadsheetID: in.SheetsSpreadsheetID,
+			SheetsCredentials:   in.SheetsCredentials,
+
+			DirectoryAdminEmail:  in.DirectoryAdminEmail,
+			DirectoryDomain:      in.DirectoryDomain,
+			DirectoryCredentials: in.DirectoryCredentials,
+		}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		for name, value := range map[string]*string{
+			"sheets_credentials":    &req.SheetsCredentials,
+			"directory_credentials": &req.DirectoryCredentials,
+		} {
+			if *value == "-" {
+				*value = ""
+			} else if *value != "" {
+				if _, _, err := parseServiceAccountKey(*value); err != nil {
+					return nil, formValueError(err, name, `The "%s" parameter must be a service account JSON key`)
+				}
+			}
+		}
+		for name, value := range map[string]string{
+			"bigquery_dataset": req.BigQueryDataset,
+			"bigquery_table":   req.BigQueryTable,
+		} {
+			if !bigQueryNamePattern.MatchString(value) {
+				return nil, formValueError(errors.New("invalid BigQuery name: "+value), name, `The "%s" parameter may only contain letters, digits and underscores`)
+			}
+		}
+
+		in = &Integrations{
+			BigQueryProject: req.BigQueryProject,
+			BigQueryDataset: req.BigQueryDataset,
+			BigQueryTable:   req.BigQueryTable,
+
+			SheetsSpreadsheetID: req.SheetsSpreadsheetID,
+			SheetsCredentials:   req.SheetsCredentials,
+
+			DirectoryAdminEmail:  req.DirectoryAdminEmail,
+			DirectoryDomain:      req.DirectoryDomain,
+			DirectoryCredentials: req.DirectoryCredentials,
+		}
+		if _, err := datastore.Put(c, integrationsKey(c), in); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the integrations to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newIntegrationsResponse(in), nil
+	} else {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
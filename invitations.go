@@ -0,0 +1,310 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+	"appengine/user"
+)
+
+// An admin invites a new employee by email. The invitee gets a link with
+// the invitation's token, which is its key name, and accepting it while
+// signed in with the invited account creates their enabled User entity.
+
+const (
+	invitationExpiry    = 14 * 24 * time.Hour
+	invitationsPageSize = 100
+	acceptInvitePath    = "/invitations/accept"
+)
+
+type Invitation struct {
+	Email     string
+	Name      string
+	InvitedBy string
+	Created   time.Time
+	Expires   time.Time
+	// Accepted is zero until the invitee accepts.
+	Accepted time.Time
+}
+
+func invitationKey(c appengine.Context, token string) *datastore.Key {
+	return datastore.NewKey(c, "Invitation", token, 0, punchKey(c))
+}
+
+type CreateInvitationRequest struct {
+	Email string `form:"email"`
+	Name  string `form:"name"`
+}
+
+type InvitationTokenRequest struct {
+	Token string `form:"token"`
+}
+
+type InvitationJSON struct {
+	Token     string     `json:"token"`
+	URL       string     `json:"url"`
+	Email     string     `json:"email"`
+	Name      string     `json:"name"`
+	InvitedBy string     `json:"invited_by"`
+	Created   time.Time  `json:"created"`
+	Expires   time.Time  `json:"expires"`
+	Accepted  *time.Time `json:"accepted,omitempty"`
+}
+
+func newInvitationJSON(r *http.Request, key *datastore.Key, inv *Invitation) InvitationJSON {
+	j := InvitationJSON{
+		Token:     key.StringID(),
+		URL:       invitationURL(r, key.StringID()),
+		Email:     inv.Email,
+		Name:      inv.Name,
+		InvitedBy: inv.InvitedBy,
+		Created:   inv.Created,
+		Expires:   inv.Expires,
+	}
+	if !inv.Accepted.IsZero() {
+		accepted := inv.Accepted
+		j.Accepted = &accepted
+	}
+	return j
+}
+
+type InvitationResponse struct {
+	Invitation InvitationJSON `json:"invitation"`
+	// EmailSent is false when the invitation email couldn't be sent, in
+	// which case the admin has to pass on the URL.
+	EmailSent bool `json:"email_sent"`
+}
+
+type InvitationsResponse struct {
+	Invitations []InvitationJSON `json:"invitations"`
+}
+
+func invitationURL(r *http.Request, token string) string {
+	return "https://" + r.Host + acceptInvitePath + "?token=" + token
+}
+
+func sendInvitationMail(c appengine.Context, r *http.Request, inv *Invitation, url string) error {
+	l := requestLocale(r)
+	return mail.Send(c, &mail.Message{
+		Sender:  noreplySender(c),
+		ReplyTo: inv.InvitedBy,
+		To:      []string{inv.Email},
+		Subject: l.T("You are invited to the timecard"),
+		Body:    l.T("%s invited you to the timecard. Open this link and sign in as %s to start punching:\n\n%s\n\nThe link expires on %s.", inv.InvitedBy, inv.Email, url, inv.Expires.Format("2006-01-02")),
+	})
+}
+
+func apiAdminInvitationsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	switch r.Method {
+	case "GET":
+		q := datastore.NewQuery("Invitation").Ancestor(punchKey(c)).Order("-Created").Limit(invitationsPageSize)
+		var invs []Invitation
+		keys, err := q.GetAll(c, &invs)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the invitations from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		res := InvitationsResponse{Invitations: make([]InvitationJSON, 0, len(invs))}
+		for i := range invs {
+			res.Invitations = append(res.Invitations, newInvitationJSON(r, keys[i], &invs[i]))
+		}
+		return res, nil
+
+	case "POST":
+		var req CreateInvitationRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if !strings.Contains(req.Email, "@") {
+			return nil, &appError{
+				Error:   errors.New("invalid invitation email: " + req.Email),
+				Message: `The "email" parameter must be an email address`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		policy, err := getSignInPolicy(c)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the sign-in policy from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		if !policy.allows(req.Email) {
+			return nil, &appError{
+				Error:   errors.New("invitation outside the allowed domains: " + req.Email),
+				Message: "Accounts of %s aren't allowed to sign in",
+				Args:    []interface{}{emailDomain(req.Email)},
+				Code:    http.StatusBadRequest,
+			}
+		}
+		now := time.Now()
+		inv := Invitation{
+			Email:     req.Email,
+			Name:      req.Name,
+			InvitedBy: user.Current(c).Email,
+			Created:   now,
+			Expires:   now.Add(invitationExpiry),
+		}
+		key, err := datastore.Put(c, invitationKey(c, randomHex(16)), &inv)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the invitation to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		res := InvitationResponse{Invitation: newInvitationJSON(r, key, &inv)}
+		if err := sendInvitationMail(c, r, &inv, res.Invitation.URL); err != nil {
+			c.Errorf("failed to send the invitation to %s: %v", inv.Email, err)
+		} else {
+			res.EmailSent = true
+		}
+		return res, nil
+
+	case "DELETE":
+		var req InvitationTokenRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		key := invitationKey(c, req.Token)
+		var inv Invitation
+		err := datastore.Get(c, key, &inv)
+		if err == nil {
+			err = datastore.Delete(c, key)
+		}
+		if err == datastore.ErrNoSuchEntity {
+			return nil, &appError{
+				Error:   err,
+				Message: "No such invitation",
+				Code:    http.StatusNotFound,
+			}
+		} else if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the invitation to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return InvitationResponse{Invitation: newInvitationJSON(r, key, &inv)}, nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// getInvitation returns the invitation with token if the current user
+// may accept it.
+func getInvitation(c appengine.Context, token string, inv *Invitation) *appError {
+	err := datastore.ErrNoSuchEntity
+	if token != "" {
+		err = datastore.Get(c, invitationKey(c, token), inv)
+	}
+	if err == datastore.ErrNoSuchEntity {
+		return &appError{
+			Error:   fmt.Errorf("no invitation %q", token),
+			Message: "No such invitation",
+			Code:    http.StatusNotFound,
+		}
+	} else if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the invitations from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if email := user.Current(c).Email; !strings.EqualFold(email, inv.Email) {
+		return &appError{
+			Error:   fmt.Errorf("%s tried to accept the invitation of %s", email, inv.Email),
+			Message: "This invitation is for %s. Sign in with that account to accept it",
+			Args:    []interface{}{inv.Email},
+			Code:    http.StatusForbidden,
+		}
+	}
+	if inv.Accepted.IsZero() && time.Now().After(inv.Expires) {
+		return &appError{
+			Error:   fmt.Errorf("invitation of %s expired on %v", inv.Email, inv.Expires),
+			Message: "The invitation has expired. Ask your admin for a new one",
+			Code:    http.StatusGone,
+		}
+	}
+	return nil
+}
+
+// acceptInvitation creates or enables the User entity of the invitee. An
+// invitation that has been accepted is accepted again without changes.
+func acceptInvitation(c appengine.Context, token string) *appError {
+	var appErr *appError
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var inv Invitation
+		if appErr = getInvitation(tc, token, &inv); appErr != nil || !inv.Accepted.IsZero() {
+			return nil
+		}
+		now := time.Now()
+		key, u, err := findUserByEmail(tc, inv.Email)
+		if err != nil {
+			return err
+		}
+		if u == nil {
+			key = datastore.NewIncompleteKey(tc, "User", punchKey(tc))
+			u = &User{Email: inv.Email, Name: inv.Name}
+		}
+		u.Enabled = true
+		u.Version++
+		u.Updated = now
+		if _, err := datastore.Put(tc, key, u); err != nil {
+			return err
+		}
+		inv.Accepted = now
+		_, err = datastore.Put(tc, invitationKey(tc, token), &inv)
+		return err
+	}, nil)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to put a user data to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return appErr
+}
+
+// acceptInvitationHandler shows the invitation with the token, and
+// accepts it when posted.
+func acceptInvitationHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	token := r.FormValue("token")
+	if r.Method == "POST" {
+		if appErr := acceptInvitation(c, token); appErr != nil {
+			return appErr
+		}
+		redirect(w, "/")
+		return nil
+	}
+
+	var inv Invitation
+	if appErr := getInvitation(c, token, &inv); appErr != nil {
+		return appErr
+	}
+	data := map[string]interface{}{
+		"Token":      token,
+		"Invitation": inv,
+	}
+	return renderTemplate(c, w, r, invitationTemplate, data)
+}
+
+var invitationTemplate = parsePage("invitation")
@@ -0,0 +1,181 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"appengine"
+)
+
+// An invoice bills a client for the closed sessions of its billable
+// projects that started in a period, with a line per day and project.
+// Invoices are computed on request rather than stored, so a punch fixed
+// later changes the invoice of its period.
+
+type InvoiceRequest struct {
+	Client int64  `form:"client"`
+	From   string `form:"from"`
+	To     string `form:"to"`
+}
+
+type InvoiceLineJSON struct {
+	Date       string `json:"date"`
+	ProjectID  int64  `json:"project_id"`
+	Project    string `json:"project"`
+	Minutes    int    `json:"minutes"`
+	HourlyRate int64  `json:"hourly_rate"`
+	Amount     int64  `json:"amount"`
+}
+
+type InvoiceJSON struct {
+	Client     ClientJSON        `json:"client"`
+	From       string            `json:"from"`
+	To         string            `json:"to"`
+	Currency   string            `json:"currency"`
+	Lines      []InvoiceLineJSON `json:"lines"`
+	Minutes    int               `json:"minutes"`
+	Subtotal   int64             `json:"subtotal"`
+	TaxPercent int               `json:"tax_percent"`
+	Tax        int64             `json:"tax"`
+	Total      int64             `json:"total"`
+}
+
+type InvoiceResponse struct {
+	Invoice InvoiceJSON `json:"invoice"`
+}
+
+type invoiceLines []InvoiceLineJSON
+
+func (l invoiceLines) Len() int      { return len(l) }
+func (l invoiceLines) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l invoiceLines) Less(i, j int) bool {
+	if l[i].Date != l[j].Date {
+		return l[i].Date < l[j].Date
+	}
+	return l[i].Project < l[j].Project
+}
+
+// roundedDiv divides rounding halves up.
+func roundedDiv(a, b int64) int64 {
+	return (a + b/2) / b
+}
+
+// buildInvoice bills the client with id for the dates from and to, both
+// inclusive, in the location of now.
+func buildInvoice(c appengine.Context, id int64, fromValue, toValue string, now time.Time) (*InvoiceJSON, *appError) {
+	from, to, appErr := statsRange(fromValue, toValue, now)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if id == 0 {
+		return nil, &appError{
+			Error:   errors.New("missing client"),
+			Message: `The "client" parameter is required`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	var cl Client
+	key, appErr := getForUpdate(c, "Client", id, &cl)
+	if appErr != nil {
+		return nil, appErr
+	}
+	projectKeys, projects, err := findProjects(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the projects from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	billable := make(map[int64]*Project)
+	for i := range projects {
+		if projects[i].ClientID == id && projects[i].Billable {
+			billable[projectKeys[i].IntID()] = &projects[i]
+		}
+	}
+	sessions, appErr := findProjectSessions(c, "", from, to.AddDate(0, 0, 1))
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	worked := make(map[InvoiceLineJSON]time.Duration)
+	for _, s := range sessions {
+		if _, ok := billable[s.Project]; !ok || s.Open() {
+			continue
+		}
+		line := InvoiceLineJSON{Date: s.Arrival.In(now.Location()).Format("2006-01-02"), ProjectID: s.Project}
+		worked[line] += s.Duration(now)
+	}
+
+	inv := &InvoiceJSON{
+		Client:     newClientJSON(key, &cl),
+		From:       from.Format("2006-01-02"),
+		To:         to.Format("2006-01-02"),
+		Currency:   cl.Currency,
+		Lines:      make([]InvoiceLineJSON, 0, len(worked)),
+		TaxPercent: cl.TaxPercent,
+	}
+	for line, d := range worked {
+		p := billable[line.ProjectID]
+		line.Project = p.Name
+		line.Minutes = int(d / time.Minute)
+		line.HourlyRate = p.HourlyRate
+		line.Amount = roundedDiv(int64(line.Minutes)*p.HourlyRate, 60)
+		inv.Lines = append(inv.Lines, line)
+		inv.Minutes += line.Minutes
+		inv.Subtotal += line.Amount
+	}
+	sort.Sort(invoiceLines(inv.Lines))
+	inv.Tax = roundedDiv(inv.Subtotal*int64(cl.TaxPercent), 100)
+	inv.Total = inv.Subtotal + inv.Tax
+	return inv, nil
+}
+
+func apiAdminInvoiceHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	var req InvoiceRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	inv, appErr := buildInvoice(c, req.Client, req.From, req.To, requestViewer(r).Now())
+	if appErr != nil {
+		return nil, appErr
+	}
+	return InvoiceResponse{Invoice: *inv}, nil
+}
+
+// adminInvoiceHandler shows a printable invoice of the chosen client and
+// period.
+func adminInvoiceHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	var req InvoiceRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return appErr
+	}
+	keys, clients, err := findClients(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the clients from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	choices := make([]ClientJSON, len(clients))
+	for i := range clients {
+		choices[i] = newClientJSON(keys[i], &clients[i])
+	}
+	data := map[string]interface{}{
+		"Request": req,
+		"Clients": choices,
+	}
+	if req.Client != 0 {
+		inv, appErr := buildInvoice(c, req.Client, req.From, req.To, requestViewer(r).Now())
+		if appErr != nil {
+			return appErr
+		}
+		data["Invoice"] = inv
+	}
+	return renderTemplate(c, w, r, invoiceTemplate, data)
+}
+
+var invoiceTemplate = parsePage("invoice")
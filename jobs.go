@@ -0,0 +1,532 @@
+package timecard
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+	"appengine/user"
+)
+
+// A Job is work too large for a request, like exporting every punch, run
+// in steps on the task queue. Each task runs one step from where the
+// previous one left off and stores the progress in the Job, so that the
+// admins can follow it on the jobs page. A step that keeps failing fails
+// the job after jobMaxRetries tries.
+type Job struct {
+	// Kind is one of the jobKind values.
+	Kind string
+	// Params are those of the kind, URL encoded.
+	Params      string `datastore:",noindex"`
+	RequestedBy string
+	Requested   time.Time
+	Status      string // "queued", "running", "done" or "failed"
+	// Cursor is where the next step starts, as the kind understands it.
+	Cursor string `datastore:",noindex"`
+	// Steps is the number of steps done, and Processed the number of
+	// entities they handled.
+	Steps     int    `datastore:",noindex"`
+	Processed int    `datastore:",noindex"`
+	Error     string `datastore:",noindex"`
+	Updated   time.Time
+	Completed time.Time
+}
+
+// JobChunk is the output of a step of an export or backup job, keyed by
+// the step number from 1 under the job. Downloading the export
+// concatenates them.
+type JobChunk struct {
+	// Name is the file of a backup the chunk is part of.
+	Name string `datastore:",noindex"`
+	Data []byte `datastore:",noindex"`
+}
+
+const (
+	// jobKindPunchExport writes the punches from and to the times in
+	// its params, or all of them, as CSV.
+	jobKindPunchExport = "punch_export"
+	// jobKindPurge deletes the data older than the cutoff in its params,
+	// for the retention policy.
+	jobKindPurge = "purge"
+	// jobKindBackup writes a backup to Cloud Storage, created at the
+	// time in its params.
+	jobKindBackup = "backup"
+
+	jobStatusQueued  = "queued"
+	jobStatusRunning = "running"
+	jobStatusDone    = "done"
+	jobStatusFailed  = "failed"
+
+	jobTaskPath   = "/tasks/job"
+	jobBatchSize  = 500
+	jobMaxRetries = 5
+	jobListLimit  = 50
+)
+
+// jobStep runs a step of job, which has the key and params given,
+// updating its Cursor and Processed, and reports whether there are more
+// steps. Running a step again from the same job must give the same
+// result, since the task queue retries tasks.
+type jobStep func(c appengine.Context, key *datastore.Key, job *Job, params url.Values) (more bool, err error)
+
+// jobStepOf returns the step of kind, or nil for an unknown kind.
+func jobStepOf(kind string) jobStep {
+	switch kind {
+	case jobKindPunchExport:
+		return punchExportStep
+	case jobKindPurge:
+		return purgeStep
+	case jobKindBackup:
+		return backupStep
+	}
+	return nil
+}
+
+func jobKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Job", "", id, punchKey(c))
+}
+
+func jobChunkKey(c appengine.Context, job *datastore.Key, step int) *datastore.Key {
+	return datastore.NewKey(c, "JobChunk", "", int64(step), job)
+}
+
+// enqueueJob adds the task running the step of the job numbered step,
+// from 0. A task whose step has already been run is dropped, so that a
+// task added twice doesn't run a step twice.
+func enqueueJob(c appengine.Context, key *datastore.Key, step int) error {
+	t := taskqueue.NewPOSTTask(jobTaskPath, url.Values{
+		"id":   {strconv.FormatInt(key.IntID(), 10)},
+		"step": {strconv.Itoa(step)},
+	})
+	return addTask(c, t, "")
+}
+
+// startJob stores a job of kind and enqueues its first step.
+func startJob(c appengine.Context, kind string, params url.Values, requestedBy string) (*datastore.Key, *Job, error) {
+	now := time.Now()
+	job := &Job{
+		Kind:        kind,
+		Params:      params.Encode(),
+		RequestedBy: requestedBy,
+		Requested:   now,
+		Status:      jobStatusQueued,
+		Updated:     now,
+	}
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Job", punchKey(c)), job)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := enqueueJob(c, key, 0); err != nil {
+		return nil, nil, err
+	}
+	return key, job, nil
+}
+
+func getJob(c appengine.Context, id int64) (*datastore.Key, *Job, *appError) {
+	key := jobKey(c, id)
+	var job Job
+	if err := datastore.Get(c, key, &job); err == datastore.ErrNoSuchEntity {
+		return nil, nil, &appError{
+			Error:   err,
+			Message: "No such job",
+			Code:    http.StatusNotFound,
+		}
+	} else if err != nil {
+		return nil, nil, jobError(err)
+	}
+	return key, &job, nil
+}
+
+func jobError(err error) *appError {
+	return &appError{
+		Error:   err,
+		Message: "Failed to fetch the jobs from the datastore",
+		Code:    http.StatusInternalServerError,
+	}
+}
+
+// jobTaskHandler runs a step of a job and enqueues the next one.
+func jobTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return formValueError(err, "id", `Failed to parse the "%s" parameter as an integer`)
+	}
+	step, err := strconv.Atoi(r.FormValue("step"))
+	if err != nil {
+		return formValueError(err, "step", `Failed to parse the "%s" parameter as an integer`)
+	}
+	key, job, appErr := getJob(c, id)
+	if appErr != nil {
+		return appErr
+	}
+	if job.Status == jobStatusDone || job.Status == jobStatusFailed || step != job.Steps {
+		c.Infof("skipping step %d of job %d, which has run %d steps and is %s", step, id, job.Steps, job.Status)
+		return nil
+	}
+
+	run := jobStepOf(job.Kind)
+	params, err := url.ParseQuery(job.Params)
+	if run == nil {
+		err = errors.New("unknown job kind: " + job.Kind)
+	}
+	more := false
+	if err == nil {
+		more, err = run(c, key, job, params)
+	}
+	now := time.Now()
+	if err != nil {
+		// The header counts the tries before this one.
+		retries, _ := strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount"))
+		if retries+1 < jobMaxRetries {
+			return &appError{
+				Error:   err,
+				Message: "Failed to run the job",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		c.Errorf("job %d failed at step %d: %v", id, step, err)
+		job.Status = jobStatusFailed
+		job.Error = err.Error()
+		job.Completed = now
+	} else {
+		job.Steps++
+		job.Status = jobStatusRunning
+		if !more {
+			job.Status = jobStatusDone
+			job.Completed = now
+			c.Infof("job %d (%s) completed in %d steps, %d processed", id, job.Kind, job.Steps, job.Processed)
+		}
+	}
+	job.Updated = now
+	if _, err := datastore.Put(c, key, job); err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to put the job to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if job.Status == jobStatusRunning {
+		if err := enqueueJob(c, key, job.Steps); err != nil {
+			return &appError{
+				Error:   err,
+				Message: "Failed to run the job",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+	}
+	return nil
+}
+
+// punchExportColumns are those of the punch export. The first step
+// writes them as the header.
+var punchExportColumns = []string{"id", "puncher", "type", "time", "project", "recorded_by", "note", "deleted_at"}
+
+// punchExportStep writes the next jobBatchSize punches, oldest first, to
+// the chunk of the step.
+func punchExportStep(c appengine.Context, key *datastore.Key, job *Job, params url.Values) (bool, error) {
+	var pq punchQuery
+	for name, t := range map[string]*time.Time{"from": &pq.From, "to": &pq.To} {
+		if v := params.Get(name); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return false, err
+			}
+		}
+	}
+	pq.Limit = jobBatchSize
+	pq.Cursor = job.Cursor
+	pq.IncludeDeleted = true
+	keys, punches, next, err := findPunchPage(c, pq)
+	if err != nil {
+		return false, err
+	}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	if job.Steps == 0 {
+		cw.Write(punchExportColumns)
+	}
+	for i, p := range punches {
+		deleted := ""
+		if !p.DeletedAt.IsZero() {
+			deleted = p.DeletedAt.Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			strconv.FormatInt(keys[i].IntID(), 10), p.Puncher, p.Type, p.Time.Format(time.RFC3339),
+			strconv.FormatInt(p.Project, 10), p.RecordedBy, p.Note, deleted,
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return false, err
+	}
+	if _, err := datastore.Put(c, jobChunkKey(c, key, job.Steps+1), &JobChunk{Data: buf.Bytes()}); err != nil {
+		return false, err
+	}
+	job.Cursor = next
+	job.Processed += len(punches)
+	return next != "", nil
+}
+
+// purgeKinds are purged in order, each until none older than the cutoff
+// are left. The Cursor of a purge job is the kind being purged. The
+// events of the punches are purged with them.
+var purgeKinds = []struct {
+	kind  string
+	purge func(c appengine.Context, cutoff time.Time) (int, bool, error)
+}{
+	{"Punch", purgePunchesBefore},
+	{"IdempotencyKey", func(c appengine.Context, cutoff time.Time) (int, bool, error) {
+		return purgeBefore(c, "IdempotencyKey", "Created <", cutoff)
+	}},
+}
+
+// purgeStep deletes up to purgeBatchesPerTask batches of the kind being
+// purged. Deleted entities no longer match, so running it again is safe.
+func purgeStep(c appengine.Context, key *datastore.Key, job *Job, params url.Values) (bool, error) {
+	cutoff, err := time.Parse(time.RFC3339Nano, params.Get("cutoff"))
+	if err != nil {
+		return false, err
+	}
+	i := 0
+	for i < len(purgeKinds) && job.Cursor != "" && purgeKinds[i].kind != job.Cursor {
+		i++
+	}
+	if i == len(purgeKinds) {
+		// A job started before the events were purged with their
+		// punches may stop at the kind it was purging.
+		if job.Cursor == "PunchEvent" {
+			i = 1
+		} else {
+			return false, errors.New("unknown purge kind: " + job.Cursor)
+		}
+	}
+	n, more, err := purgeKinds[i].purge(c, cutoff)
+	if err != nil {
+		return false, err
+	}
+	c.Infof("purged %d %s entities older than %v", n, purgeKinds[i].kind, cutoff)
+	job.Processed += n
+	if more {
+		job.Cursor = purgeKinds[i].kind
+		return true, nil
+	}
+	if i+1 == len(purgeKinds) {
+		return false, nil
+	}
+	job.Cursor = purgeKinds[i+1].kind
+	return true, nil
+}
+
+type JobJSON struct {
+	ID          int64      `json:"id"`
+	Kind        string     `json:"kind"`
+	RequestedBy string     `json:"requested_by"`
+	Requested   time.Time  `json:"requested"`
+	Status      string     `json:"status"`
+	Steps       int        `json:"steps"`
+	Processed   int        `json:"processed"`
+	Error       string     `json:"error,omitempty"`
+	Updated     time.Time  `json:"updated"`
+	Completed   *time.Time `json:"completed,omitempty"`
+	// DownloadURL is that of the output of a finished export.
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+type JobResponse struct {
+	Job JobJSON `json:"job"`
+}
+
+type JobsResponse struct {
+	Jobs []JobJSON `json:"jobs"`
+}
+
+type GetJobRequest struct {
+	// ID is that of a job, or 0 to list the latest jobs.
+	ID int64 `form:"id"`
+}
+
+type StartJobRequest struct {
+	// Kind is punch_export.
+	Kind string `form:"kind"`
+	// From and To limit the punches exported, as a date or an RFC 3339
+	// time. To is exclusive.
+	From string `form:"from"`
+	To   string `form:"to"`
+}
+
+func newJobJSON(key *datastore.Key, job *Job) JobJSON {
+	j := JobJSON{
+		ID:          key.IntID(),
+		Kind:        job.Kind,
+		RequestedBy: job.RequestedBy,
+		Requested:   job.Requested,
+		Status:      job.Status,
+		Steps:       job.Steps,
+		Processed:   job.Processed,
+		Error:       job.Error,
+		Updated:     job.Updated,
+	}
+	if !job.Completed.IsZero() {
+		completed := job.Completed
+		j.Completed = &completed
+	}
+	if job.Kind == jobKindPunchExport && job.Status == jobStatusDone {
+		j.DownloadURL = fmt.Sprintf("/admin/jobs/download?id=%d", key.IntID())
+	}
+	return j
+}
+
+// findJobs returns the latest jobListLimit jobs, newest first.
+func findJobs(c appengine.Context) ([]JobJSON, *appError) {
+	var jobs []Job
+	keys, err := datastore.NewQuery("Job").Ancestor(punchKey(c)).Order("-Requested").Limit(jobListLimit).GetAll(c, &jobs)
+	if err != nil {
+		return nil, jobError(err)
+	}
+	res := make([]JobJSON, 0, len(keys))
+	for i, key := range keys {
+		res = append(res, newJobJSON(key, &jobs[i]))
+	}
+	return res, nil
+}
+
+// startExportJob checks req and starts the job it asks for. Only exports
+// are started by the admins; purges and backups are started by cron.
+func startExportJob(c appengine.Context, req *StartJobRequest, loc *time.Location) (*datastore.Key, *Job, *appError) {
+	if req.Kind != jobKindPunchExport {
+		return nil, nil, &appError{
+			Error:   errors.New("invalid job kind: " + req.Kind),
+			Message: `The "kind" parameter must be "punch_export"`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	params := make(url.Values)
+	for name, value := range map[string]string{"from": req.From, "to": req.To} {
+		t, appErr := parseTimeParam(name, value, loc)
+		if appErr != nil {
+			return nil, nil, appErr
+		}
+		if !t.IsZero() {
+			params.Set(name, t.Format(time.RFC3339))
+		}
+	}
+	key, job, err := startJob(c, req.Kind, params, user.Current(c).Email)
+	if err != nil {
+		return nil, nil, &appError{
+			Error:   err,
+			Message: "Failed to start the job",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return key, job, nil
+}
+
+func apiAdminJobsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	switch r.Method {
+	case "GET":
+		var req GetJobRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		if req.ID == 0 {
+			jobs, appErr := findJobs(c)
+			if appErr != nil {
+				return nil, appErr
+			}
+			return JobsResponse{Jobs: jobs}, nil
+		}
+		key, job, appErr := getJob(c, req.ID)
+		if appErr != nil {
+			return nil, appErr
+		}
+		return JobResponse{Job: newJobJSON(key, job)}, nil
+
+	case "POST":
+		var req StartJobRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		key, job, appErr := startExportJob(c, &req, requestViewer(r).Location)
+		if appErr != nil {
+			return nil, appErr
+		}
+		return JobResponse{Job: newJobJSON(key, job)}, nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// adminJobsHandler lists the latest jobs, and starts a punch export on
+// POST.
+func adminJobsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method == "POST" {
+		req := StartJobRequest{
+			Kind: jobKindPunchExport,
+			From: r.FormValue("from"),
+			To:   r.FormValue("to"),
+		}
+		if _, _, appErr := startExportJob(c, &req, requestViewer(r).Location); appErr != nil {
+			return appErr
+		}
+		redirect(w, "/admin/jobs")
+		return nil
+	}
+
+	jobs, appErr := findJobs(c)
+	if appErr != nil {
+		return appErr
+	}
+	return renderTemplate(c, w, r, jobsTemplate, map[string]interface{}{"Jobs": jobs})
+}
+
+// adminJobDownloadHandler sends the output of a finished export.
+func adminJobDownloadHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	var req GetJobRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return appErr
+	}
+	key, job, appErr := getJob(c, req.ID)
+	if appErr != nil {
+		return appErr
+	}
+	if job.Kind != jobKindPunchExport || job.Status != jobStatusDone {
+		err := errors.New("The job has no output to download")
+		return &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="timecard-punches-%d.csv"`, req.ID))
+	for t := datastore.NewQuery("JobChunk").Ancestor(key).Order("__key__").Run(c); ; {
+		var chunk JobChunk
+		if _, err := t.Next(&chunk); err == datastore.Done {
+			break
+		} else if err != nil {
+			// The response has begun, so it can only be cut short.
+			c.Errorf("failed to fetch the output of job %d: %v", req.ID, err)
+			break
+		}
+		w.Write(chunk.Data)
+	}
+	return nil
+}
+
+var jobsTemplate = parsePage("jobs")
@@ -0,0 +1,179 @@
+package timecard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// Punch events for the live dashboard are kept in memcache under
+// sequential keys. The event stream is served as server-sent events, but
+// since App Engine buffers responses each request only sends the events
+// the client hasn't seen yet and tells it when to reconnect. Reconnects
+// only touch memcache; the datastore is queried once per client to send
+// the initial state, and again whenever events have been evicted.
+
+const (
+	liveSeqKey          = "live_punch_seq"
+	liveEventExpiration = 10 * time.Minute
+	liveRetry           = 2 * time.Second
+	// maxLiveEventGap is the most events read from memcache for a
+	// client that is behind. A client further behind, or one sending a
+	// bogus Last-Event-ID, gets the current state instead.
+	maxLiveEventGap = 100
+)
+
+func liveEventKey(id uint64) string {
+	return "live_punch_event_" + strconv.FormatUint(id, 10)
+}
+
+type LiveStateJSON struct {
+	In []LivePresenceJSON `json:"in"`
+}
+
+type LivePresenceJSON struct {
+	Puncher string    `json:"puncher"`
+	Since   time.Time `json:"since"`
+}
+
+// publishPunchEvent makes p visible to the live dashboard. Failures are
+// only logged since the punch itself has been stored.
+func publishPunchEvent(c appengine.Context, p PunchJSON) {
+	id, err := memcache.Increment(c, liveSeqKey, 1, 0)
+	if err != nil {
+		c.Errorf("failed to allocate a live event id: %v", err)
+		return
+	}
+	err = memcache.JSON.Set(c, &memcache.Item{
+		Key:        liveEventKey(id),
+		Object:     p,
+		Expiration: liveEventExpiration,
+	})
+	if err != nil {
+		c.Errorf("failed to publish a live punch event: %v", err)
+	}
+}
+
+func currentLiveSeq(c appengine.Context) (uint64, error) {
+	item, err := memcache.Get(c, liveSeqKey)
+	if err == memcache.ErrCacheMiss {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(item.Value), 10, 64)
+}
+
+// whosIn returns the open sessions of everyone who arrived in the last
+// day and hasn't left yet.
+func whosIn(c appengine.Context, now time.Time) ([]WorkSession, error) {
+	_, punches, err := findPunches(c, punchQuery{From: now.Add(-24 * time.Hour), Fields: sessionFields})
+	if err != nil {
+		return nil, err
+	}
+	var in []WorkSession
+	for _, s := range pairSessions(punches) {
+		if s.Open() {
+			in = append(in, s)
+		}
+	}
+	return in, nil
+}
+
+func adminLiveEventsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	seq, err := currentLiveSeq(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to read the live event sequence",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	var lastID uint64
+	hasLastID := false
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		lastID, err = strconv.ParseUint(s, 10, 64)
+		hasLastID = err == nil
+	}
+
+	var events []PunchJSON
+	sendState := !hasLastID || lastID > seq || seq-lastID > maxLiveEventGap
+	if !sendState && lastID < seq {
+		keys := make([]string, 0, seq-lastID)
+		for id := lastID + 1; id <= seq; id++ {
+			keys = append(keys, liveEventKey(id))
+		}
+		items, err := memcache.GetMulti(c, keys)
+		if err != nil {
+			return &appError{
+				Error:   err,
+				Message: "Failed to read live events",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		for _, k := range keys {
+			item, ok := items[k]
+			if !ok {
+				sendState = true
+				break
+			}
+			var p PunchJSON
+			if err := json.Unmarshal(item.Value, &p); err != nil {
+				sendState = true
+				break
+			}
+			events = append(events, p)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "retry: %d\n\n", liveRetry/time.Millisecond)
+
+	if sendState {
+		in, err := whosIn(c, time.Now())
+		if err != nil {
+			return &appError{
+				Error:   err,
+				Message: "Failed to fetch punches data from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		state := LiveStateJSON{In: make([]LivePresenceJSON, 0, len(in))}
+		for _, s := range in {
+			state.In = append(state.In, LivePresenceJSON{Puncher: s.Puncher, Since: s.Arrival})
+		}
+		return writeServerSentEvent(w, seq, "state", state)
+	}
+	for i, p := range events {
+		if appErr := writeServerSentEvent(w, lastID+uint64(i)+1, "punch", p); appErr != nil {
+			return appErr
+		}
+	}
+	return nil
+}
+
+func writeServerSentEvent(w http.ResponseWriter, id uint64, event string, data interface{}) *appError {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to encode a live event",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, b)
+	return nil
+}
+
+func adminLiveHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	return renderTemplate(c, w, r, liveTemplate, nil)
+}
+
+var liveTemplate = parsePage("live")
@@ -0,0 +1,152 @@
+package timecard
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"appengine"
+	"appengine/user"
+)
+
+// Every request served by appHandler, apiHandler, taskHandler,
+// scimHandler and clientHandler is logged as one JSON entry when it finishes. The request
+// ID in the entry is also sent in the X-Request-Id header and in error
+// responses, so that users can quote it when reporting a problem.
+// Entries of failed requests are logged as errors and warnings, and so
+// are those of requests slower than the threshold, which is 1s unless
+// the SLOW_REQUEST_THRESHOLD environment variable sets another duration.
+// Tasks and cron jobs are expected to take longer.
+
+const (
+	requestIDHeader      = "X-Request-Id"
+	slowRequestThreshold = time.Second
+	slowTaskThreshold    = time.Minute
+	slowRequestEnv       = "SLOW_REQUEST_THRESHOLD"
+)
+
+type requestLogEntry struct {
+	RequestID string `json:"request_id"`
+	TraceID   string `json:"trace_id,omitempty"`
+	User      string `json:"user,omitempty"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Status    int    `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Slow      bool   `json:"slow,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// requestLogger is the ResponseWriter handlers write to, recording what
+// goes into the log entry.
+type requestLogger struct {
+	http.ResponseWriter
+	c      appengine.Context
+	r      *http.Request
+	start  time.Time
+	id     string
+	status int
+	err    error
+	span   *span
+	// user is the user of a request without a Google sign-in, like one
+	// authenticated by an API token.
+	user string
+	// slow is the latency above which the request is logged as a
+	// warning.
+	slow time.Duration
+}
+
+func startRequestLog(c appengine.Context, w http.ResponseWriter, r *http.Request) *requestLogger {
+	id := appengine.RequestID(c)
+	if id == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return &requestLogger{ResponseWriter: w, c: c, r: r, start: time.Now(), id: id, span: startTrace(r), slow: requestThreshold()}
+}
+
+// requestThreshold returns the latency of a slow request.
+func requestThreshold() time.Duration {
+	if v := os.Getenv(slowRequestEnv); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return slowRequestThreshold
+}
+
+func (l *requestLogger) WriteHeader(code int) {
+	if l.status == 0 {
+		l.status = code
+	}
+	l.ResponseWriter.WriteHeader(code)
+}
+
+func (l *requestLogger) Write(b []byte) (int, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	return l.ResponseWriter.Write(b)
+}
+
+// fail records err for the log entry.
+func (l *requestLogger) fail(err error) {
+	l.err = err
+}
+
+// finish logs the entry of the request. It must be deferred by the
+// handler, so that a request that panics is logged as failed before the
+// panic goes on to App Engine.
+func (l *requestLogger) finish() {
+	latency := time.Since(l.start)
+	entry := requestLogEntry{
+		RequestID: l.id,
+		Method:    l.r.Method,
+		Path:      l.r.URL.Path,
+		Status:    l.status,
+		LatencyMS: int64(latency / time.Millisecond),
+		Slow:      latency > l.slow,
+	}
+	p := recover()
+	if p != nil {
+		entry.Status = http.StatusInternalServerError
+		l.err = fmt.Errorf("panic: %v", p)
+	} else if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	if l.user != "" {
+		entry.User = l.user
+	} else if u := user.Current(l.c); u != nil {
+		entry.User = u.Email
+	}
+	if l.err != nil {
+		entry.Error = l.err.Error()
+	}
+	if l.span != nil {
+		entry.TraceID = l.span.trace.id
+	}
+	b, _ := json.Marshal(entry)
+	switch {
+	case entry.Status >= 500:
+		l.c.Errorf("%s", b)
+	case entry.Status >= 400, entry.Slow:
+		l.c.Warningf("%s", b)
+	default:
+		l.c.Infof("%s", b)
+	}
+	finishTrace(l.c, l.r, l.span, entry.Status, l.err)
+	if p != nil {
+		panic(p)
+	}
+}
+
+// responseRequestID returns the request ID set on w by startRequestLog.
+func responseRequestID(w http.ResponseWriter) string {
+	return w.Header().Get(requestIDHeader)
+}
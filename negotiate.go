@@ -0,0 +1,113 @@
+package timecard
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// The list responses of the punch and report endpoints are tables, which
+// the API also serves as CSV for spreadsheets and as aligned plain text
+// for shell scripts. The "format" parameter (json, csv or text) picks the
+// format, or else the Accept header. JSON is the default, the format of
+// errors, and the only format of the responses that aren't tables.
+
+// tabular is a response that is also a table. The first row of table is
+// the header.
+type tabular interface {
+	table() [][]string
+}
+
+// responseFormats are the formats by their media types, in order of
+// preference.
+var responseFormats = []struct {
+	name, mediaType string
+}{
+	{"json", "application/json"},
+	{"csv", "text/csv"},
+	{"text", "text/plain"},
+}
+
+// responseFormat returns the format of the response to r, from the
+// "format" parameter or else the best match of the Accept header.
+// explicit is true when the format was named by the parameter.
+func responseFormat(r *http.Request) (format string, explicit bool, appErr *appError) {
+	if format := r.FormValue("format"); format != "" {
+		for _, f := range responseFormats {
+			if f.name == format {
+				return format, true, nil
+			}
+		}
+		return "", false, &appError{
+			Error:   errors.New("invalid response format: " + format),
+			Message: `The "format" parameter must be json, csv or text`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return "json", false, nil
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		for _, f := range responseFormats {
+			if q > bestQ && mediaTypeMatches(mediaType, f.mediaType) {
+				best, bestQ = f.name, q
+				break
+			}
+		}
+	}
+	if best == "" {
+		// Clients that only accept other types got JSON before there were
+		// other formats, and still do.
+		best = "json"
+	}
+	return best, false, nil
+}
+
+// mediaTypeMatches tells if the media range of an Accept header, like
+// text/* or */*, includes mediaType.
+func mediaTypeMatches(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	return strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*"))
+}
+
+// writeTable writes the table of t as CSV or as plain text with aligned
+// columns.
+func writeTable(w http.ResponseWriter, format string, t tabular) error {
+	rows := t.table()
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.WriteAll(rows)
+		return cw.Error()
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, row := range rows {
+		// Tabs and newlines in values would break the columns.
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(cell)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
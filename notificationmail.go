@@ -0,0 +1,116 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+	"appengine/user"
+)
+
+// Every notification is also emailed to its recipient, who can turn off
+// the emails about their account and those about their punches in their
+// UserSettings. The emails are in the language of the settings, or the
+// default one, since the browser of the recipient isn't known outside
+// their own requests.
+
+// NotificationPreferences is where the email preferences were kept
+// before UserSettings. It is only read, by getUserSettings.
+type NotificationPreferences struct {
+	// The zero value sends every email.
+	AccountEmailsOff bool
+	PunchEmailsOff   bool
+}
+
+func notificationPreferencesKey(c appengine.Context, email string) *datastore.Key {
+	return datastore.NewKey(c, "NotificationPreferences", email, 0, punchKey(c))
+}
+
+func noreplySender(c appengine.Context) string {
+	return fmt.Sprintf("noreply@%s.appspotmail.com", appengine.AppID(c))
+}
+
+func sendNotificationMail(c appengine.Context, recipient string, n *Notification, l locale) error {
+	base := "https://" + appengine.DefaultVersionHostname(c)
+	message := n.text(l)
+	body := message + "\n"
+	if n.Link != "" {
+		body += "\n" + base + n.Link + "\n"
+	}
+	body += "\n" + l.T("You can turn these emails off at %s", base+"/my/notifications") + "\n"
+	return mail.Send(c, &mail.Message{
+		Sender:  noreplySender(c),
+		To:      []string{recipient},
+		Subject: l.T("Timecard: %s", message),
+		Body:    body,
+	})
+}
+
+type NotificationPreferencesJSON struct {
+	AccountEmails bool `json:"account_emails"`
+	PunchEmails   bool `json:"punch_emails"`
+}
+
+type NotificationPreferencesResponse struct {
+	Preferences NotificationPreferencesJSON `json:"preferences"`
+}
+
+type UpdateNotificationPreferencesRequest struct {
+	AccountEmails bool `form:"account_emails"`
+	PunchEmails   bool `form:"punch_emails"`
+}
+
+func newNotificationPreferencesResponse(s *UserSettings) NotificationPreferencesResponse {
+	return NotificationPreferencesResponse{Preferences: NotificationPreferencesJSON{
+		AccountEmails: !s.AccountEmailsOff,
+		PunchEmails:   !s.PunchEmailsOff,
+	}}
+}
+
+// putNotificationPreferences changes the email preferences in the
+// settings of the current user.
+func putNotificationPreferences(c appengine.Context, req *UpdateNotificationPreferencesRequest) (*UserSettings, *appError) {
+	email := user.Current(c).Email
+	s, err := getUserSettings(c, email)
+	if err != nil {
+		return nil, userSettingsError(err)
+	}
+	s.AccountEmailsOff, s.PunchEmailsOff = !req.AccountEmails, !req.PunchEmails
+	if appErr := putUserSettings(c, email, s); appErr != nil {
+		return nil, appErr
+	}
+	return s, nil
+}
+
+func apiMyNotificationPreferencesHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	s, err := getUserSettings(c, user.Current(c).Email)
+	if err != nil {
+		return nil, userSettingsError(err)
+	}
+	if r.Method == "GET" {
+		return newNotificationPreferencesResponse(s), nil
+	} else if r.Method == "PUT" || r.Method == "POST" {
+		req := UpdateNotificationPreferencesRequest{
+			AccountEmails: !s.AccountEmailsOff,
+			PunchEmails:   !s.PunchEmailsOff,
+		}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		s, appErr := putNotificationPreferences(c, &req)
+		if appErr != nil {
+			return nil, appErr
+		}
+		return newNotificationPreferencesResponse(s), nil
+	} else {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
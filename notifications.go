@@ -0,0 +1,315 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// Notifications tell users about changes others made to their account
+// or data, such as an admin correcting one of their punches. They are
+// shown on /my/notifications, and the header of every page links there
+// with the number of unread ones. They are also emailed; see
+// notificationmail.go.
+type Notification struct {
+	Recipient string
+	Type      string
+	// Message is a catalog key, translated for the recipient when shown
+	// and formatted with Args.
+	Message string   `datastore:",noindex"`
+	Args    []string `datastore:",noindex"`
+	Link    string   `datastore:",noindex"`
+	// PunchTime is the time of the punch the notification is about, if
+	// any.
+	PunchTime time.Time `datastore:",noindex"`
+	Created   time.Time
+	Unread    bool
+}
+
+const (
+	notificationAccountCreated  = "account_created"
+	notificationAccountDisabled = "account_disabled"
+	notificationPunchRecorded   = "punch_recorded"
+	notificationPunchCorrected  = "punch_corrected"
+	notificationPunchDeleted    = "punch_deleted"
+	notificationPunchRestored   = "punch_restored"
+	notificationPunchAutoLeave  = "punch_auto_leave"
+
+	defaultNotificationsLimit = 20
+	maxNotificationsLimit     = 100
+	// maxMarkedNotifications limits the notifications marked read by one
+	// request, the most a datastore batch can put.
+	maxMarkedNotifications = 500
+)
+
+// notify adds a notification for recipient and emails it unless they
+// have turned the emails off. Failures are only logged, since the change
+// the notification is about has been made.
+func notify(c appengine.Context, recipient string, n *Notification) {
+	n.Recipient = recipient
+	n.Created = time.Now()
+	n.Unread = true
+	if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Notification", punchKey(c)), n); err != nil {
+		c.Errorf("failed to notify %s of %s: %v", recipient, n.Type, err)
+	}
+
+	s, err := getUserSettings(c, recipient)
+	if err != nil {
+		c.Errorf("failed to get the settings of %s: %v", recipient, err)
+		return
+	}
+	if !s.emails(n.Type) {
+		return
+	}
+	if err := sendNotificationMail(c, recipient, n, s.locale()); err != nil {
+		c.Errorf("failed to email %s of %s: %v", recipient, n.Type, err)
+	}
+}
+
+// text returns the message of n in l.
+func (n *Notification) text(l locale) string {
+	args := make([]interface{}, len(n.Args))
+	for i, a := range n.Args {
+		args[i] = a
+	}
+	return l.T(n.Message, args...)
+}
+
+// notifyPunchChanged tells the puncher that actor has changed their
+// punch, unless they changed it themselves.
+func notifyPunchChanged(c appengine.Context, p *Punch, actor, notificationType string) {
+	if actor == p.Puncher {
+		return
+	}
+	messages := map[string]string{
+		notificationPunchRecorded:  "%s recorded a punch for you",
+		notificationPunchCorrected: "%s corrected one of your punches",
+		notificationPunchDeleted:   "%s moved one of your punches to the trash",
+		notificationPunchRestored:  "%s restored one of your punches from the trash",
+	}
+	notify(c, p.Puncher, &Notification{
+		Type:      notificationType,
+		Message:   messages[notificationType],
+		Args:      []string{actor},
+		Link:      "/my/history",
+		PunchTime: p.Time,
+	})
+}
+
+// notifyAccount tells the owner of the account email that it has been
+// created or disabled.
+func notifyAccount(c appengine.Context, email, notificationType string) {
+	messages := map[string]string{
+		notificationAccountCreated:  "Your timecard account has been created",
+		notificationAccountDisabled: "Your timecard account has been disabled",
+	}
+	n := Notification{Type: notificationType, Message: messages[notificationType]}
+	if notificationType == notificationAccountCreated {
+		n.Link = "/"
+	}
+	notify(c, email, &n)
+}
+
+func notificationKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Notification", "", id, punchKey(c))
+}
+
+func notificationsQuery(c appengine.Context, email string, unreadOnly bool) *datastore.Query {
+	q := datastore.NewQuery("Notification").Ancestor(punchKey(c)).Filter("Recipient =", email)
+	if unreadOnly {
+		q = q.Filter("Unread =", true)
+	}
+	return q
+}
+
+type ListNotificationsRequest struct {
+	Unread bool `form:"unread"`
+	// Limit may be 0 to only get the unread count.
+	Limit int `form:"limit"`
+}
+
+type MarkNotificationsReadRequest struct {
+	ID  int64 `form:"id"`
+	All bool  `form:"all"`
+}
+
+type NotificationJSON struct {
+	ID        int64      `json:"id"`
+	Type      string     `json:"type"`
+	Message   string     `json:"message"`
+	Link      string     `json:"link,omitempty"`
+	PunchTime *time.Time `json:"punch_time,omitempty"`
+	Created   time.Time  `json:"created"`
+	Read      bool       `json:"read"`
+}
+
+func newNotificationJSON(r *http.Request, key *datastore.Key, n *Notification) NotificationJSON {
+	j := NotificationJSON{
+		ID:      key.IntID(),
+		Type:    n.Type,
+		Message: n.text(requestLocale(r)),
+		Link:    n.Link,
+		Created: n.Created,
+		Read:    !n.Unread,
+	}
+	if !n.PunchTime.IsZero() {
+		punchTime := n.PunchTime
+		j.PunchTime = &punchTime
+	}
+	return j
+}
+
+type NotificationsResponse struct {
+	Notifications []NotificationJSON `json:"notifications"`
+	Unread        int                `json:"unread"`
+}
+
+// findNotifications returns the latest notifications of the current
+// user, up to limit, and how many are unread.
+func findNotifications(c appengine.Context, r *http.Request, unreadOnly bool, limit int) (*NotificationsResponse, *appError) {
+	email := user.Current(c).Email
+	res := &NotificationsResponse{Notifications: []NotificationJSON{}}
+	var err error
+	if limit > 0 {
+		var ns []Notification
+		var keys []*datastore.Key
+		keys, err = notificationsQuery(c, email, unreadOnly).Order("-Created").Limit(limit).GetAll(c, &ns)
+		for i := range ns {
+			res.Notifications = append(res.Notifications, newNotificationJSON(r, keys[i], &ns[i]))
+		}
+	}
+	if err == nil {
+		res.Unread, err = notificationsQuery(c, email, true).KeysOnly().Count(c)
+	}
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the notifications from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return res, nil
+}
+
+// markNotificationsRead marks the notification with id, or every
+// notification when all is set, of the current user read.
+func markNotificationsRead(c appengine.Context, id int64, all bool) *appError {
+	email := user.Current(c).Email
+	var keys []*datastore.Key
+	var ns []Notification
+	var err error
+	if all {
+		keys, err = notificationsQuery(c, email, true).Limit(maxMarkedNotifications).GetAll(c, &ns)
+	} else {
+		var n Notification
+		key := notificationKey(c, id)
+		if err = datastore.Get(c, key, &n); err == datastore.ErrNoSuchEntity || (err == nil && n.Recipient != email) {
+			return &appError{
+				Error:   errors.New("no notification of the user"),
+				Message: "No such notification",
+				Code:    http.StatusNotFound,
+			}
+		}
+		keys, ns = []*datastore.Key{key}, []Notification{n}
+	}
+	if err == nil {
+		for i := range ns {
+			ns[i].Unread = false
+		}
+		_, err = datastore.PutMulti(c, keys, ns)
+	}
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to put the notifications to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return nil
+}
+
+func apiMyNotificationsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method != "GET" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	req := ListNotificationsRequest{Limit: defaultNotificationsLimit}
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	if req.Limit < 0 {
+		req.Limit = 0
+	} else if req.Limit > maxNotificationsLimit {
+		req.Limit = maxNotificationsLimit
+	}
+	return findNotifications(c, r, req.Unread, req.Limit)
+}
+
+func apiMyNotificationsReadHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method != "POST" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	var req MarkNotificationsReadRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	if appErr := markNotificationsRead(c, req.ID, req.All); appErr != nil {
+		return nil, appErr
+	}
+	return findNotifications(c, r, false, 0)
+}
+
+// myNotificationsHandler shows the latest notifications and the email
+// preferences. It marks the posted notification, or all of them, read,
+// or saves the posted preferences, whose unchecked boxes aren't sent.
+func myNotificationsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method == "POST" {
+		var appErr *appError
+		if r.FormValue("preferences") != "" {
+			_, appErr = putNotificationPreferences(c, &UpdateNotificationPreferencesRequest{
+				AccountEmails: r.FormValue("account_emails") != "",
+				PunchEmails:   r.FormValue("punch_emails") != "",
+			})
+		} else {
+			var req MarkNotificationsReadRequest
+			if appErr = decodeForm(r, &req); appErr == nil {
+				appErr = markNotificationsRead(c, req.ID, req.All)
+			}
+		}
+		if appErr != nil {
+			return appErr
+		}
+		redirect(w, "/my/notifications")
+		return nil
+	}
+
+	res, appErr := findNotifications(c, r, false, maxNotificationsLimit)
+	if appErr != nil {
+		return appErr
+	}
+	s, err := getUserSettings(c, user.Current(c).Email)
+	if err != nil {
+		return userSettingsError(err)
+	}
+	data := map[string]interface{}{
+		"Notifications": res.Notifications,
+		"Unread":        res.Unread,
+		"Preferences":   newNotificationPreferencesResponse(s).Preferences,
+	}
+	return renderTemplate(c, w, r, notificationsTemplate, data)
+}
+
+var notificationsTemplate = parsePage("notifications")
@@ -0,0 +1,239 @@
+package timecard
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"appengine"
+)
+
+// The OpenAPI 3 document is generated from the registered API routes and
+// the typed request/response structs, so it cannot drift from the
+// handlers.
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*openAPISchema `json:"schemas"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty"`
+	OperationID string                      `json:"operationId"`
+	Deprecated  bool                        `json:"deprecated,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name   string         `json:"name"`
+	In     string         `json:"in"`
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Content map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref        string                    `json:"$ref,omitempty"`
+	Type       string                    `json:"type,omitempty"`
+	Format     string                    `json:"format,omitempty"`
+	Items      *openAPISchema            `json:"items,omitempty"`
+	Properties map[string]*openAPISchema `json:"properties,omitempty"`
+	Required   []string                  `json:"required,omitempty"`
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	tabularType = reflect.TypeOf((*tabular)(nil)).Elem()
+)
+
+func newOpenAPIDocument(versions ...*apiVersion) *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    openAPIInfo{Title: "Timecard API"},
+		Paths:   make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{
+			Schemas: make(map[string]*openAPISchema),
+		},
+	}
+	for _, v := range versions {
+		doc.Info.Version = v.name
+		for _, route := range v.routes {
+			doc.addRoute(v.prefix()+route.pattern, route, false)
+			if route.deprecated {
+				doc.addRoute("/api"+route.pattern, route, true)
+			}
+		}
+	}
+	return doc
+}
+
+func (doc *openAPIDocument) addRoute(path string, route apiRoute, deprecated bool) {
+	ops := make(map[string]*openAPIOperation)
+	for _, o := range route.operations {
+		op := &openAPIOperation{
+			Summary:     o.Summary,
+			OperationID: operationID(o.Method, path),
+			Deprecated:  deprecated,
+			Responses: map[string]*openAPIResponse{
+				"default": doc.jsonResponse("Error", ErrorResponse{}),
+			},
+		}
+		if o.Response != nil {
+			op.Responses["200"] = doc.jsonResponse("OK", o.Response)
+			// Tables are also served as CSV and plain text. See negotiate.go.
+			if o.Method == "GET" && reflect.PtrTo(reflect.TypeOf(o.Response)).Implements(tabularType) {
+				for _, f := range responseFormats[1:] {
+					op.Responses["200"].Content[f.mediaType] = openAPIMediaType{Schema: &openAPISchema{Type: "string"}}
+				}
+				op.Parameters = append(op.Parameters, openAPIParameter{Name: "format", In: "query", Schema: &openAPISchema{Type: "string"}})
+			}
+		}
+		if o.Request != nil {
+			if o.Method == "GET" {
+				op.Parameters = append(doc.queryParameters(reflect.TypeOf(o.Request)), op.Parameters...)
+			} else {
+				op.RequestBody = &openAPIRequestBody{
+					Content: map[string]openAPIMediaType{
+						"application/x-www-form-urlencoded": {Schema: doc.formSchema(reflect.TypeOf(o.Request))},
+					},
+				}
+			}
+		}
+		ops[strings.ToLower(o.Method)] = op
+	}
+	doc.Paths[path] = ops
+}
+
+// operationID turns "GET /api/v1/admin/users" into "getApiV1AdminUsers".
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '.' || r == '_' }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func (doc *openAPIDocument) jsonResponse(description string, v interface{}) *openAPIResponse {
+	return &openAPIResponse{
+		Description: description,
+		Content: map[string]openAPIMediaType{
+			"application/json": {Schema: doc.schemaFor(reflect.TypeOf(v))},
+		},
+	}
+}
+
+func (doc *openAPIDocument) queryParameters(t reflect.Type) []openAPIParameter {
+	var params []openAPIParameter
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name := f.Tag.Get("form"); name != "" {
+			params = append(params, openAPIParameter{Name: name, In: "query", Schema: doc.schemaFor(f.Type)})
+		}
+	}
+	return params
+}
+
+func (doc *openAPIDocument) formSchema(t reflect.Type) *openAPISchema {
+	s := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name := f.Tag.Get("form"); name != "" {
+			s.Properties[name] = doc.schemaFor(f.Type)
+		}
+	}
+	return s
+}
+
+// schemaFor returns the schema of t. Named struct types are added to the
+// components and referenced by name.
+func (doc *openAPIDocument) schemaFor(t reflect.Type) *openAPISchema {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.String:
+		return &openAPISchema{Type: "string"}
+	case t.Kind() == reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return &openAPISchema{Type: "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return &openAPISchema{Type: "array", Items: doc.schemaFor(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return &openAPISchema{Type: "object"}
+	case t.Kind() == reflect.Struct:
+		ref := &openAPISchema{Ref: "#/components/schemas/" + t.Name()}
+		if _, ok := doc.Components.Schemas[t.Name()]; ok {
+			return ref
+		}
+		s := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+		doc.Components.Schemas[t.Name()] = s
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, omitempty := jsonFieldName(f)
+			if name == "" {
+				continue
+			}
+			s.Properties[name] = doc.schemaFor(f.Type)
+			if !omitempty {
+				s.Required = append(s.Required, name)
+			}
+		}
+		return ref
+	}
+	return &openAPISchema{}
+}
+
+func jsonFieldName(f reflect.StructField) (name string, omitempty bool) {
+	if f.PkgPath != "" {
+		return "", false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	if name == "" {
+		name = f.Name
+	}
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitempty = true
+		}
+	}
+	return name, omitempty
+}
+
+func apiOpenAPIHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	return newOpenAPIDocument(apiV1), nil
+}
@@ -0,0 +1,662 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/user"
+)
+
+// OrgSettings is the configuration of the whole organization. There is a
+// single OrgSettings entity, edited by admins. It took over the company
+// name of the Theme, the allowed domains of the SignInPolicy, the punch
+// days of the RetentionPolicy and the mode of the OvernightPolicy, which
+// are read from those entities until it is first saved with them, and
+// the admin APIs of those still edit it.
+type OrgSettings struct {
+	CompanyName string `datastore:",noindex"`
+	// Timezone is the IANA time zone the automatic leaves and new
+	// webhooks are in.
+	Timezone string `datastore:",noindex"`
+	// Currency is the currency of new clients.
+	Currency string `datastore:",noindex"`
+	// The worked time of each session is rounded to a multiple of
+	// RoundMinutes, to the nearest one or down or up as RoundMode says.
+	RoundMinutes int    `datastore:",noindex"`
+	RoundMode    string `datastore:",noindex"`
+	// AutoLeaveHour is the hour, from 1 to 24, at which sessions still
+	// open are closed by a leave punch, or 0 to leave them open.
+	AutoLeaveHour int `datastore:",noindex"`
+	// MaxSessionHours is the length beyond which the anomaly report flags
+	// a session.
+	MaxSessionHours int `datastore:",noindex"`
+	// RecentPunches is the number of punches listed on the top page.
+	RecentPunches int `datastore:",noindex"`
+	// OvernightMode says which day the time of a session crossing
+	// midnight counts for, as the OvernightPolicy does. It is empty in
+	// settings saved before it existed.
+	OvernightMode string `datastore:",noindex"`
+	// BreakRules are the breaks deducted from long sessions, in the order
+	// of their AfterMinutes.
+	BreakRules []BreakRule `datastore:",noindex"`
+	// AllowedDomains are the email domains that may sign in, or empty to
+	// let every account in.
+	AllowedDomains []string `datastore:",noindex"`
+	// RetentionDays is the number of days punches are kept, or 0 to keep
+	// them forever.
+	RetentionDays int `datastore:",noindex"`
+	Updated       time.Time
+}
+
+var defaultOrgSettings = OrgSettings{
+	Timezone:        "Asia/Tokyo",
+	Currency:        defaultCurrency,
+	RoundMinutes:    1,
+	RoundMode:       "nearest",
+	MaxSessionHours: 12,
+	RecentPunches:   10,
+}
+
+const (
+	orgSettingsCacheKey = "org_settings"
+	maxAutoLeaveHour    = 24
+	maxRecentPunches    = 100
+)
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// BreakRule deducts a break from the sessions longer than AfterMinutes,
+// for the breaks a labor policy mandates even when they aren't punched.
+// A break punched as a leave and an arrival splits a session in two, so
+// it is only deducted from a session worked without one.
+type BreakRule struct {
+	AfterMinutes  int `json:"after_minutes"`
+	DeductMinutes int `json:"deduct_minutes"`
+}
+
+const maxBreakRules = 5
+
+func orgSettingsKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "OrgSettings", "default_org_settings", 0, nil)
+}
+
+// getOrgSettings is cached in memcache since the allowed domains are
+// checked on every request.
+func getOrgSettings(c appengine.Context) (*OrgSettings, error) {
+	var s OrgSettings
+	if _, err := memcache.Gob.Get(c, orgSettingsCacheKey, &s); err == nil {
+		return &s, nil
+	} else if err != memcache.ErrCacheMiss {
+		c.Warningf("failed to get the org settings from memcache: %v", err)
+	}
+
+	s, err := loadOrgSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := memcache.Gob.Set(c, &memcache.Item{Key: orgSettingsCacheKey, Object: s}); err != nil {
+		c.Warningf("failed to set the org settings to memcache: %v", err)
+	}
+	return &s, nil
+}
+
+// loadOrgSettings reads the settings from the datastore, bypassing the
+// cache.
+func loadOrgSettings(c appengine.Context) (OrgSettings, error) {
+	// Settings added since the entity was saved keep their default.
+	s := defaultOrgSettings
+	err := datastore.Get(c, orgSettingsKey(c), &s)
+	if err == datastore.ErrNoSuchEntity {
+		s, err = legacyOrgSettings(c)
+	} else if err == nil && s.OvernightMode == "" {
+		s.OvernightMode, err = legacyOvernightMode(c)
+	}
+	return s, err
+}
+
+// legacyOrgSettings returns the default settings with the values kept in
+// the entities OrgSettings took over.
+func legacyOrgSettings(c appengine.Context) (OrgSettings, error) {
+	s := defaultOrgSettings
+	var theme Theme
+	var policy SignInPolicy
+	var retention RetentionPolicy
+	for _, e := range []struct {
+		key *datastore.Key
+		dst interface{}
+	}{
+		{themeKey(c), &theme},
+		{signInPolicyKey(c), &policy},
+		{retentionPolicyKey(c), &retention},
+	} {
+		if err := datastore.Get(c, e.key, e.dst); err != nil && err != datastore.ErrNoSuchEntity {
+			return s, err
+		}
+	}
+	s.CompanyName = theme.CompanyName
+	s.AllowedDomains = policy.AllowedDomains
+	s.RetentionDays = retention.PunchDays
+	mode, err := legacyOvernightMode(c)
+	s.OvernightMode = mode
+	return s, err
+}
+
+// orgSettingsTransactionOptions allow the entities the settings took
+// over, which are read until the settings are first saved, in the
+// transactions changing them.
+var orgSettingsTransactionOptions = &datastore.TransactionOptions{XG: true}
+
+// changeOrgSettings applies change to the settings read from the
+// datastore and puts them back in a transaction, so that admins changing
+// different settings at once don't undo each other's changes. change may
+// be called more than once, and an error from it changes nothing. The
+// cached settings are dropped once the transaction commits.
+func changeOrgSettings(c appengine.Context, change func(s *OrgSettings) error) (*OrgSettings, error) {
+	var s OrgSettings
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var err error
+		if s, err = loadOrgSettings(tc); err != nil {
+			return err
+		}
+		if err := change(&s); err != nil {
+			return err
+		}
+		s.Updated = time.Now()
+		_, err = datastore.Put(tc, orgSettingsKey(tc), &s)
+		return err
+	}, orgSettingsTransactionOptions)
+	if err != nil {
+		return nil, err
+	}
+	uncacheOrgSettings(c)
+	return &s, nil
+}
+
+// putOrgSettings replaces all the settings with s, as a restore does.
+func putOrgSettings(c appengine.Context, s *OrgSettings) error {
+	s.Updated = time.Now()
+	if _, err := datastore.Put(c, orgSettingsKey(c), s); err != nil {
+		return err
+	}
+	uncacheOrgSettings(c)
+	return nil
+}
+
+// uncacheOrgSettings drops the cached settings after they were stored. A
+// failure is only logged since the settings are stored by then.
+func uncacheOrgSettings(c appengine.Context) {
+	if err := memcache.Delete(c, orgSettingsCacheKey); err != nil && err != memcache.ErrCacheMiss {
+		c.Warningf("failed to delete the org settings from memcache: %v", err)
+	}
+}
+
+// orgSettingsError is the error of failing to get the settings.
+func orgSettingsError(err error) *appError {
+	return &appError{
+		Error:   err,
+		Message: "Failed to fetch the org settings from the datastore",
+		Code:    http.StatusInternalServerError,
+	}
+}
+
+func orgSettingsPutError(err error) *appError {
+	return &appError{
+		Error:   err,
+		Message: "Failed to put the org settings to the datastore",
+		Code:    http.StatusInternalServerError,
+	}
+}
+
+// location returns the time zone of the organization.
+func (s *OrgSettings) location() *time.Location {
+	if loc, err := time.LoadLocation(s.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// roundWorked rounds the worked time of a session.
+func (s *OrgSettings) roundWorked(d time.Duration) time.Duration {
+	return time.Duration(roundMinutes(int(d/time.Minute), s.RoundMinutes, s.RoundMode)) * time.Minute
+}
+
+// breakDeduction returns the break the rules deduct from a session of
+// worked time: that of the last rule it is longer than.
+func (s *OrgSettings) breakDeduction(worked time.Duration) time.Duration {
+	var d time.Duration
+	for _, rule := range s.BreakRules {
+		if worked > time.Duration(rule.AfterMinutes)*time.Minute {
+			d = time.Duration(rule.DeductMinutes) * time.Minute
+		}
+	}
+	return d
+}
+
+// parseBreakRules parses a list of rules like 360:45, the minutes after
+// which a break is deducted and the minutes deducted, separated by commas
+// or spaces.
+func parseBreakRules(value string) ([]BreakRule, *appError) {
+	var rules []BreakRule
+	for _, f := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		var rule BreakRule
+		parts := strings.Split(f, ":")
+		var err error
+		if len(parts) != 2 {
+			err = errors.New("invalid break rule: " + f)
+		} else if rule.AfterMinutes, err = strconv.Atoi(parts[0]); err == nil {
+			rule.DeductMinutes, err = strconv.Atoi(parts[1])
+		}
+		if err == nil && (rule.AfterMinutes < 1 || rule.AfterMinutes > int(maxSessionLength/time.Minute) ||
+			rule.DeductMinutes < 1 || rule.DeductMinutes >= rule.AfterMinutes) {
+			err = fmt.Errorf("break rule out of range: %s", f)
+		}
+		if err == nil && len(rules) > 0 && rule.AfterMinutes <= rules[len(rules)-1].AfterMinutes {
+			err = fmt.Errorf("break rule not after the previous one: %s", f)
+		}
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: `The "break_rules" parameter must list rules like 360:45, with increasing minutes from 1 to 1440`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) > maxBreakRules {
+		return nil, &appError{
+			Error:   fmt.Errorf("%d break rules", len(rules)),
+			Message: `The "%s" parameter must list at most %d rules`,
+			Args:    []interface{}{"break_rules", maxBreakRules},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return rules, nil
+}
+
+// formatBreakRules formats rules as parseBreakRules parses them.
+func formatBreakRules(rules []BreakRule, sep string) string {
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		parts[i] = strconv.Itoa(rule.AfterMinutes) + ":" + strconv.Itoa(rule.DeductMinutes)
+	}
+	return strings.Join(parts, sep)
+}
+
+// roundMinutes rounds minutes to a multiple of unit as mode, one of
+// roundModes, says.
+func roundMinutes(minutes, unit int, mode string) int {
+	if unit <= 1 {
+		return minutes
+	}
+	switch mode {
+	case "down":
+		return minutes / unit * unit
+	case "up":
+		return (minutes + unit - 1) / unit * unit
+	}
+	return (minutes + unit/2) / unit * unit
+}
+
+// checkRoundMode fails unless mode is one of roundModes.
+func checkRoundMode(mode string) *appError {
+	for _, m := range roundModes {
+		if m == mode {
+			return nil
+		}
+	}
+	return &appError{
+		Error:   fmt.Errorf("invalid round mode %q", mode),
+		Message: `The "round_mode" parameter must be "nearest", "down" or "up"`,
+		Code:    http.StatusBadRequest,
+	}
+}
+
+// parseAllowedDomains parses a list of email domains separated by commas
+// or spaces, each with or without a leading @.
+func parseAllowedDomains(value string) ([]string, *appError) {
+	var domains []string
+	for _, d := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		d = strings.ToLower(strings.TrimPrefix(d, "@"))
+		if !domainPattern.MatchString(d) {
+			return nil, &appError{
+				Error:   errors.New("invalid domain: " + d),
+				Message: `The "allowed_domains" parameter must list domains like example.co.jp`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		domains = append(domains, d)
+	}
+	return domains, nil
+}
+
+// checkAllowedDomains fails if the current user couldn't sign in with
+// policy any more.
+func checkAllowedDomains(c appengine.Context, policy *SignInPolicy) *appError {
+	if email := user.Current(c).Email; !user.IsAdmin(c) && !policy.allows(email) {
+		return &appError{
+			Error:   fmt.Errorf("%s would be locked out", email),
+			Message: "The allowed domains must include your own domain, %s",
+			Args:    []interface{}{emailDomain(email)},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+// checkRetentionDays fails unless days is a valid retention.
+func checkRetentionDays(name string, days int) *appError {
+	if days < 0 || days > maxRetentionDays {
+		return &appError{
+			Error:   errors.New("invalid retention"),
+			Message: `The "%s" parameter must be from 0 to %d`,
+			Args:    []interface{}{name, maxRetentionDays},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+type OrgSettingsJSON struct {
+	CompanyName     string      `json:"company_name"`
+	Timezone        string      `json:"timezone"`
+	Currency        string      `json:"currency"`
+	RoundMinutes    int         `json:"round_minutes"`
+	RoundMode       string      `json:"round_mode"`
+	AutoLeaveHour   int         `json:"auto_leave_hour"`
+	MaxSessionHours int         `json:"max_session_hours"`
+	RecentPunches   int         `json:"recent_punches"`
+	OvernightMode   string      `json:"overnight_mode"`
+	BreakRules      []BreakRule `json:"break_rules"`
+	AllowedDomains  []string    `json:"allowed_domains"`
+	RetentionDays   int         `json:"retention_days"`
+	// Updated is missing until the settings are first saved.
+	Updated *time.Time `json:"updated,omitempty"`
+}
+
+type OrgSettingsResponse struct {
+	Settings OrgSettingsJSON `json:"settings"`
+}
+
+type UpdateOrgSettingsRequest struct {
+	CompanyName string `form:"company_name"`
+	// Timezone is an IANA time zone name, like Asia/Tokyo.
+	Timezone string `form:"timezone"`
+	// Currency is an ISO 4217 code, like JPY.
+	Currency     string `form:"currency"`
+	RoundMinutes int    `form:"round_minutes"`
+	// RoundMode is nearest, down or up.
+	RoundMode string `form:"round_mode"`
+	// AutoLeaveHour is from 1 to 24, or 0 to leave sessions open.
+	AutoLeaveHour int `form:"auto_leave_hour"`
+	// MaxSessionHours is from 1 to 24.
+	MaxSessionHours int `form:"max_session_hours"`
+	// RecentPunches is from 1 to 100.
+	RecentPunches int `form:"recent_punches"`
+	// OvernightMode is start_day to count the time of a session crossing
+	// midnight for the day it started on, or split to split it at
+	// midnight.
+	OvernightMode string `form:"overnight_mode"`
+	// BreakRules is a list of rules like 360:45, deducting 45 minutes
+	// from the sessions longer than 360, separated by commas or spaces.
+	// An empty list deducts nothing.
+	BreakRules string `form:"break_rules"`
+	// AllowedDomains is separated by commas or spaces. An empty list
+	// lets every account in.
+	AllowedDomains string `form:"allowed_domains"`
+	// RetentionDays is the number of days punches are kept, or 0 to keep
+	// them forever.
+	RetentionDays int `form:"retention_days"`
+}
+
+func newOrgSettingsResponse(s *OrgSettings) OrgSettingsResponse {
+	domains := s.AllowedDomains
+	if domains == nil {
+		domains = []string{}
+	}
+	rules := s.BreakRules
+	if rules == nil {
+		rules = []BreakRule{}
+	}
+	res := OrgSettingsResponse{Settings: OrgSettingsJSON{
+		CompanyName:     s.CompanyName,
+		Timezone:        s.Timezone,
+		Currency:        s.Currency,
+		RoundMinutes:    s.RoundMinutes,
+		RoundMode:       s.RoundMode,
+		AutoLeaveHour:   s.AutoLeaveHour,
+		MaxSessionHours: s.MaxSessionHours,
+		RecentPunches:   s.RecentPunches,
+		OvernightMode:   s.OvernightMode,
+		BreakRules:      rules,
+		AllowedDomains:  domains,
+		RetentionDays:   s.RetentionDays,
+	}}
+	if !s.Updated.IsZero() {
+		updated := s.Updated
+		res.Settings.Updated = &updated
+	}
+	return res
+}
+
+// orgSettingsRequest returns the request that keeps the settings s.
+func orgSettingsRequest(s *OrgSettings) UpdateOrgSettingsRequest {
+	return UpdateOrgSettingsRequest{
+		CompanyName:     s.CompanyName,
+		Timezone:        s.Timezone,
+		Currency:        s.Currency,
+		RoundMinutes:    s.RoundMinutes,
+		RoundMode:       s.RoundMode,
+		AutoLeaveHour:   s.AutoLeaveHour,
+		MaxSessionHours: s.MaxSessionHours,
+		RecentPunches:   s.RecentPunches,
+		OvernightMode:   s.OvernightMode,
+		BreakRules:      formatBreakRules(s.BreakRules, ","),
+		AllowedDomains:  strings.Join(s.AllowedDomains, ","),
+		RetentionDays:   s.RetentionDays,
+	}
+}
+
+// updateOrgSettings stores the settings of the request fill makes from
+// the one keeping the stored settings, once they are checked.
+func updateOrgSettings(c appengine.Context, fill func(req *UpdateOrgSettingsRequest) *appError) (*OrgSettings, *appError) {
+	var appErr *appError
+	s, err := changeOrgSettings(c, func(s *OrgSettings) error {
+		req := orgSettingsRequest(s)
+		if appErr = fill(&req); appErr != nil {
+			return appErr.Error
+		}
+		var checked *OrgSettings
+		if checked, appErr = checkOrgSettings(c, &req); appErr != nil {
+			return appErr.Error
+		}
+		*s = *checked
+		return nil
+	})
+	if appErr != nil {
+		return nil, appErr
+	} else if err != nil {
+		return nil, orgSettingsPutError(err)
+	}
+	return s, nil
+}
+
+// checkOrgSettings checks req and returns the settings it asks for.
+func checkOrgSettings(c appengine.Context, req *UpdateOrgSettingsRequest) (*OrgSettings, *appError) {
+	s := &OrgSettings{
+		CompanyName:     strings.TrimSpace(req.CompanyName),
+		Timezone:        req.Timezone,
+		Currency:        strings.ToUpper(req.Currency),
+		RoundMinutes:    req.RoundMinutes,
+		RoundMode:       req.RoundMode,
+		AutoLeaveHour:   req.AutoLeaveHour,
+		MaxSessionHours: req.MaxSessionHours,
+		RecentPunches:   req.RecentPunches,
+		OvernightMode:   req.OvernightMode,
+		RetentionDays:   req.RetentionDays,
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil || s.Timezone == "" {
+		return nil, formValueError(fmt.Errorf("invalid time zone %q", s.Timezone), "timezone", `The "%s" parameter must be a time zone like Asia/Tokyo`)
+	}
+	if !currencyPattern.MatchString(s.Currency) {
+		return nil, formValueError(fmt.Errorf("invalid currency %q", s.Currency), "currency", `The "%s" parameter must be a currency code like JPY`)
+	}
+	if s.RoundMinutes < 1 || s.RoundMinutes > 60 {
+		return nil, &appError{
+			Error:   fmt.Errorf("invalid round minutes %d", s.RoundMinutes),
+			Message: `The "%s" parameter must be from 1 to %d`,
+			Args:    []interface{}{"round_minutes", 60},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if appErr := checkRoundMode(s.RoundMode); appErr != nil {
+		return nil, appErr
+	}
+	if s.AutoLeaveHour < 0 || s.AutoLeaveHour > maxAutoLeaveHour {
+		return nil, &appError{
+			Error:   fmt.Errorf("invalid auto leave hour %d", s.AutoLeaveHour),
+			Message: `The "%s" parameter must be from 0 to %d`,
+			Args:    []interface{}{"auto_leave_hour", maxAutoLeaveHour},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if max := int(maxSessionLength / time.Hour); s.MaxSessionHours < 1 || s.MaxSessionHours > max {
+		return nil, &appError{
+			Error:   fmt.Errorf("invalid max session hours %d", s.MaxSessionHours),
+			Message: `The "%s" parameter must be from 1 to %d`,
+			Args:    []interface{}{"max_session_hours", max},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if s.RecentPunches < 1 || s.RecentPunches > maxRecentPunches {
+		return nil, &appError{
+			Error:   fmt.Errorf("invalid recent punches %d", s.RecentPunches),
+			Message: `The "%s" parameter must be from 1 to %d`,
+			Args:    []interface{}{"recent_punches", maxRecentPunches},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if appErr := checkOvernightMode("overnight_mode", s.OvernightMode); appErr != nil {
+		return nil, appErr
+	}
+	rules, appErr := parseBreakRules(req.BreakRules)
+	if appErr != nil {
+		return nil, appErr
+	}
+	s.BreakRules = rules
+	domains, appErr := parseAllowedDomains(req.AllowedDomains)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if appErr := checkAllowedDomains(c, &SignInPolicy{AllowedDomains: domains}); appErr != nil {
+		return nil, appErr
+	}
+	s.AllowedDomains = domains
+	if appErr := checkRetentionDays("retention_days", s.RetentionDays); appErr != nil {
+		return nil, appErr
+	}
+	return s, nil
+}
+
+func apiAdminSettingsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	s, err := getOrgSettings(c)
+	if err != nil {
+		return nil, orgSettingsError(err)
+	}
+	switch r.Method {
+	case "GET":
+		return newOrgSettingsResponse(s), nil
+
+	case "PUT", "POST":
+		// Settings that aren't given keep their stored value. An empty
+		// company name or list of domains clears it.
+		s, appErr := updateOrgSettings(c, func(req *UpdateOrgSettingsRequest) *appError {
+			if appErr := decodeForm(r, req); appErr != nil {
+				return appErr
+			}
+			if _, ok := r.Form["company_name"]; ok {
+				req.CompanyName = r.FormValue("company_name")
+			}
+			if _, ok := r.Form["allowed_domains"]; ok {
+				req.AllowedDomains = r.FormValue("allowed_domains")
+			}
+			if _, ok := r.Form["break_rules"]; ok {
+				req.BreakRules = r.FormValue("break_rules")
+			}
+			return nil
+		})
+		if appErr != nil {
+			return nil, appErr
+		}
+		return newOrgSettingsResponse(s), nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// adminSettingsHandler is the org settings page. Its form sends every
+// setting.
+func adminSettingsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	s, err := getOrgSettings(c)
+	if err != nil {
+		return orgSettingsError(err)
+	}
+	if r.Method == "POST" {
+		req := UpdateOrgSettingsRequest{
+			CompanyName:    r.FormValue("company_name"),
+			Timezone:       r.FormValue("timezone"),
+			Currency:       r.FormValue("currency"),
+			RoundMode:      r.FormValue("round_mode"),
+			OvernightMode:  r.FormValue("overnight_mode"),
+			AllowedDomains: r.FormValue("allowed_domains"),
+			BreakRules:     r.FormValue("break_rules"),
+		}
+		for name, dst := range map[string]*int{
+			"round_minutes":     &req.RoundMinutes,
+			"auto_leave_hour":   &req.AutoLeaveHour,
+			"max_session_hours": &req.MaxSessionHours,
+			"recent_punches":    &req.RecentPunches,
+			"retention_days":    &req.RetentionDays,
+		} {
+			if v := r.FormValue(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return formValueError(err, name, `Failed to parse the "%s" parameter as an integer`)
+				}
+				*dst = n
+			}
+		}
+		fill := func(stored *UpdateOrgSettingsRequest) *appError {
+			*stored = req
+			return nil
+		}
+		if _, appErr := updateOrgSettings(c, fill); appErr != nil {
+			return appErr
+		}
+		redirect(w, "/admin/settings")
+		return nil
+	}
+
+	data := map[string]interface{}{
+		"Settings":       newOrgSettingsResponse(s).Settings,
+		"AllowedDomains": strings.Join(s.AllowedDomains, ", "),
+		"BreakRules":     formatBreakRules(s.BreakRules, ", "),
+		"RoundModes":     roundModes,
+	}
+	return renderTemplate(c, w, r, orgSettingsTemplate, data)
+}
+
+var orgSettingsTemplate = parsePage("org_settings")
@@ -0,0 +1,130 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// OvernightPolicy says which day the time of a session crossing midnight
+// counts for in the daily totals, as the overnight mode of the
+// OrgSettings. It was kept in a single OvernightPolicy entity before
+// OrgSettings, which is only read by getOrgSettings.
+type OvernightPolicy struct {
+	// Mode is overnightStartDay or overnightSplit.
+	Mode string
+}
+
+const (
+	// overnightStartDay counts the whole session for its arrival date.
+	overnightStartDay = "start_day"
+	// overnightSplit splits the session at midnight.
+	overnightSplit = "split"
+)
+
+func (p *OvernightPolicy) split() bool {
+	return p.Mode == overnightSplit
+}
+
+func overnightPolicyKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "OvernightPolicy", "default_overnight_policy", 0, nil)
+}
+
+func getOvernightPolicy(c appengine.Context) (*OvernightPolicy, error) {
+	s, err := getOrgSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	return &OvernightPolicy{Mode: s.OvernightMode}, nil
+}
+
+func putOvernightPolicy(c appengine.Context, policy *OvernightPolicy) error {
+	_, err := changeOrgSettings(c, func(s *OrgSettings) error {
+		s.OvernightMode = policy.Mode
+		return nil
+	})
+	return err
+}
+
+// legacyOvernightMode returns the mode of the OvernightPolicy entity.
+func legacyOvernightMode(c appengine.Context) (string, error) {
+	policy := OvernightPolicy{Mode: overnightStartDay}
+	err := datastore.Get(c, overnightPolicyKey(c), &policy)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return "", err
+	}
+	return policy.Mode, nil
+}
+
+// checkOvernightMode fails unless mode is overnightStartDay or
+// overnightSplit.
+func checkOvernightMode(name, mode string) *appError {
+	if mode != overnightStartDay && mode != overnightSplit {
+		return formValueError(errors.New("invalid overnight mode: "+mode), name, `The "%s" parameter must be "start_day" or "split"`)
+	}
+	return nil
+}
+
+// overnightPolicyError is the error of failing to get the policy.
+func overnightPolicyError(err error) *appError {
+	return &appError{
+		Error:   err,
+		Message: "Failed to fetch the overnight policy from the datastore",
+		Code:    http.StatusInternalServerError,
+	}
+}
+
+type OvernightPolicyJSON struct {
+	Mode string `json:"mode"`
+}
+
+type OvernightPolicyResponse struct {
+	OvernightPolicy OvernightPolicyJSON `json:"overnight_policy"`
+}
+
+type UpdateOvernightPolicyRequest struct {
+	Mode string `form:"mode"`
+}
+
+func newOvernightPolicyResponse(p *OvernightPolicy) OvernightPolicyResponse {
+	return OvernightPolicyResponse{OvernightPolicy: OvernightPolicyJSON{
+		Mode: p.Mode,
+	}}
+}
+
+func apiAdminOvernightPolicyHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	policy, err := getOvernightPolicy(c)
+	if err != nil {
+		return nil, overnightPolicyError(err)
+	}
+	if r.Method == "GET" {
+		return newOvernightPolicyResponse(policy), nil
+	} else if r.Method == "PUT" || r.Method == "POST" {
+		req := UpdateOvernightPolicyRequest{Mode: policy.Mode}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		if appErr := checkOvernightMode("mode", req.Mode); appErr != nil {
+			return nil, appErr
+		}
+
+		policy = &OvernightPolicy{Mode: req.Mode}
+		if err := putOvernightPolicy(c, policy); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the overnight policy to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newOvernightPolicyResponse(policy), nil
+	} else {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
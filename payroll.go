@@ -0,0 +1,369 @@
+package timecard
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Payroll pays the worked minutes of a month, the pay period, at the
+// hourly rate of each user. A day's minutes up to regularMinutesPerDay are
+// regular and the rest are overtime, paid at overtimePercent of the rate.
+// Every day is paid at the rate effective on it, so a rate changed in the
+// middle of a month splits the user's pay into a line per rate.
+
+const (
+	regularMinutesPerDay = 8 * 60
+	// overtimePercent is the 25% premium of the Labor Standards Act.
+	overtimePercent = 125
+)
+
+// PayRate is an hourly rate of a user from its Effective date on, until
+// the next rate's. Amounts are in the smallest unit of the currency.
+type PayRate struct {
+	Effective  string `datastore:",noindex"` // 2006-01-02
+	HourlyRate int64  `datastore:",noindex"`
+}
+
+// payRateOn returns the rate of rates, ordered by Effective, effective on
+// date, or 0 before the first one.
+func payRateOn(rates []PayRate, date string) int64 {
+	var rate int64
+	for _, r := range rates {
+		if r.Effective > date {
+			break
+		}
+		rate = r.HourlyRate
+	}
+	return rate
+}
+
+type PayRateJSON struct {
+	Effective  string `json:"effective"`
+	HourlyRate int64  `json:"hourly_rate"`
+}
+
+func newPayRatesJSON(rates []PayRate) []PayRateJSON {
+	res := make([]PayRateJSON, len(rates))
+	for i, r := range rates {
+		res[i] = PayRateJSON{Effective: r.Effective, HourlyRate: r.HourlyRate}
+	}
+	return res
+}
+
+func samePayRates(a, b []PayRate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type payRatesByDate []PayRate
+
+func (r payRatesByDate) Len() int           { return len(r) }
+func (r payRatesByDate) Less(i, j int) bool { return r[i].Effective < r[j].Effective }
+func (r payRatesByDate) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+type PayRateRequest struct {
+	ID      int64 `form:"id"`
+	Version int64 `form:"version"`
+	// Effective is the date the rate applies from. Setting a rate again
+	// for the same date replaces it.
+	Effective  string `form:"effective"`
+	HourlyRate int64  `form:"hourly_rate"`
+}
+
+// apiAdminPayRatesHandler sets (PUT) or removes (DELETE) a pay rate of a
+// user. Like other user updates, it fails with 409 unless the user is
+// still at the given version.
+func apiAdminPayRatesHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	var req PayRateRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	if r.FormValue("version") == "" {
+		return nil, &appError{
+			Error:   errors.New("missing version"),
+			Message: `The "version" parameter is required`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if _, err := time.Parse("2006-01-02", req.Effective); err != nil {
+		return nil, formValueError(err, "effective", `Failed to parse the "%s" parameter as a date (YYYY-MM-DD)`)
+	}
+	if req.HourlyRate < 0 {
+		return nil, formValueError(fmt.Errorf("negative hourly rate %d", req.HourlyRate), "hourly_rate", `The "%s" parameter can't be negative`)
+	}
+
+	key := datastore.NewKey(c, "User", "", req.ID, punchKey(c))
+	var u User
+	conflict := false
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := datastore.Get(tc, key, &u); err != nil {
+			return err
+		}
+		if u.Version != req.Version {
+			conflict = true
+			return nil
+		}
+		var rates []PayRate
+		for _, rate := range u.PayRates {
+			if rate.Effective != req.Effective {
+				rates = append(rates, rate)
+			}
+		}
+		if r.Method == "PUT" {
+			rates = append(rates, PayRate{Effective: req.Effective, HourlyRate: req.HourlyRate})
+			sort.Sort(payRatesByDate(rates))
+		}
+		u.PayRates = rates
+		u.Version++
+		u.Updated = time.Now()
+		_, err := datastore.Put(tc, key, &u)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, &appError{
+			Error:   err,
+			Message: "No such user",
+			Code:    http.StatusNotFound,
+		}
+	} else if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to put a user data to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if conflict {
+		return nil, &appError{
+			Error:   fmt.Errorf("user %d is at version %d, not %d", req.ID, u.Version, req.Version),
+			Message: "The user has been changed by someone else. Reload and try again",
+			Code:    http.StatusConflict,
+		}
+	}
+	return UserResponse{User: newUserJSON(key, &u)}, nil
+}
+
+type PayrollRequest struct {
+	// Month is the pay period, as 2006-01. It defaults to this month.
+	Month string `form:"month"`
+}
+
+// PayrollLineJSON is the pay of a user for the days of a pay period
+// with the same rate.
+type PayrollLineJSON struct {
+	From            string `json:"from"`
+	To              string `json:"to"`
+	HourlyRate      int64  `json:"hourly_rate"`
+	RegularMinutes  int    `json:"regular_minutes"`
+	OvertimeMinutes int    `json:"overtime_minutes"`
+	GrossPay        int64  `json:"gross_pay"`
+}
+
+type PayrollEntryJSON struct {
+	Puncher         string            `json:"puncher"`
+	Name            string            `json:"name"`
+	RegularMinutes  int               `json:"regular_minutes"`
+	OvertimeMinutes int               `json:"overtime_minutes"`
+	GrossPay        int64             `json:"gross_pay"`
+	Lines           []PayrollLineJSON `json:"lines"`
+}
+
+type PayrollResponse struct {
+	From    string             `json:"from"`
+	To      string             `json:"to"`
+	Entries []PayrollEntryJSON `json:"entries"`
+}
+
+// payrollEntry pays the daily summaries of one puncher, in date order.
+func payrollEntry(puncher, name string, rates []PayRate, summaries []DailySummary) PayrollEntryJSON {
+	e := PayrollEntryJSON{Puncher: puncher, Name: name, Lines: []PayrollLineJSON{}}
+	// The pay of a line is rounded once, from its minutes times the rate
+	// in percent.
+	var centiPay int64
+	finish := func() {
+		if len(e.Lines) == 0 {
+			return
+		}
+		l := &e.Lines[len(e.Lines)-1]
+		l.GrossPay = roundedDiv(centiPay, 60*100)
+		e.GrossPay += l.GrossPay
+		centiPay = 0
+	}
+	for _, s := range summaries {
+		rate := payRateOn(rates, s.Date)
+		if len(e.Lines) == 0 || e.Lines[len(e.Lines)-1].HourlyRate != rate {
+			finish()
+			e.Lines = append(e.Lines, PayrollLineJSON{From: s.Date, HourlyRate: rate})
+		}
+		l := &e.Lines[len(e.Lines)-1]
+		l.To = s.Date
+		regular := int(s.Worked / time.Minute)
+		overtime := 0
+		if regular > regularMinutesPerDay {
+			regular, overtime = regularMinutesPerDay, regular-regularMinutesPerDay
+		}
+		l.RegularMinutes += regular
+		l.OvertimeMinutes += overtime
+		e.RegularMinutes += regular
+		e.OvertimeMinutes += overtime
+		centiPay += int64(regular)*rate*100 + int64(overtime)*rate*overtimePercent
+	}
+	finish()
+	return e
+}
+
+// payrollNow returns the current time in the time zone of the org
+// settings. Pay periods and days are in it, so that a month pays the same
+// whoever asks.
+func payrollNow(c appengine.Context) (time.Time, *appError) {
+	settings, err := getOrgSettings(c)
+	if err != nil {
+		return time.Time{}, orgSettingsError(err)
+	}
+	return time.Now().In(settings.location()), nil
+}
+
+// buildPayroll pays everyone who worked in month, which is in the
+// location of now, ordered by email.
+func buildPayroll(c appengine.Context, month, now time.Time) (*PayrollResponse, *appError) {
+	end := month.AddDate(0, 1, 0)
+	sessions, err := findSessions(c, punchQuery{From: month, To: end, Fields: sessionFields})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	_, users, err := findUsers(c, userQuery{})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	byEmail := make(map[string]*User, len(users))
+	for i := range users {
+		byEmail[users[i].Email] = &users[i]
+	}
+
+	// summarizeDays keeps the date order of the sessions per puncher.
+	policy, err := getOvernightPolicy(c)
+	if err != nil {
+		return nil, overnightPolicyError(err)
+	}
+	days := make(map[string][]DailySummary)
+	for _, s := range summarizeDays(sessions, month, end, policy.split(), now) {
+		days[s.Puncher] = append(days[s.Puncher], s)
+	}
+	emails := make([]string, 0, len(days))
+	for email := range days {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	res := &PayrollResponse{
+		From:    month.Format("2006-01-02"),
+		To:      end.AddDate(0, 0, -1).Format("2006-01-02"),
+		Entries: make([]PayrollEntryJSON, 0, len(emails)),
+	}
+	for _, email := range emails {
+		var name string
+		var rates []PayRate
+		if u := byEmail[email]; u != nil {
+			name, rates = u.Name, u.PayRates
+		}
+		res.Entries = append(res.Entries, payrollEntry(email, name, rates, days[email]))
+	}
+	return res, nil
+}
+
+func apiAdminPayrollHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	var req PayrollRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	now, appErr := payrollNow(c)
+	if appErr != nil {
+		return nil, appErr
+	}
+	month, appErr := parseMonth(req.Month, now)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return buildPayroll(c, month, now)
+}
+
+// adminPayrollHandler shows the payroll of a month, or with format=csv
+// downloads it in the PayrollExportFormat, with a row per user and rate.
+func adminPayrollHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	var req PayrollRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return appErr
+	}
+	now, appErr := payrollNow(c)
+	if appErr != nil {
+		return appErr
+	}
+	month, appErr := parseMonth(req.Month, now)
+	if appErr != nil {
+		return appErr
+	}
+	payroll, appErr := buildPayroll(c, month, now)
+	if appErr != nil {
+		return appErr
+	}
+
+	if r.FormValue("format") == "csv" {
+		format, err := getPayrollExportFormat(c)
+		if err != nil {
+			return &appError{
+				Error:   err,
+				Message: "Failed to fetch the payroll export format from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		name := "timecard-payroll-" + month.Format("2006-01")
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		cw := csv.NewWriter(w)
+		cw.WriteAll(format.records(month, payroll))
+		if err := cw.Error(); err != nil {
+			c.Errorf("failed to write the payroll: %v", err)
+		}
+		return nil
+	}
+
+	query := url.Values{"month": {month.Format("2006-01")}, "format": {"csv"}}
+	data := map[string]interface{}{
+		"Month":   month,
+		"Payroll": payroll,
+		"CSVURL":  "/admin/payroll?" + query.Encode(),
+	}
+	return renderTemplate(c, w, r, payrollTemplate, data)
+}
+
+var payrollTemplate = parsePage("payroll")
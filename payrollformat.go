@@ -0,0 +1,301 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// PayrollExportFormat is the CSV layout of the payroll export, set by the
+// admins to what their payroll provider imports. There is a single
+// PayrollExportFormat entity; without one the export has the columns of
+// defaultPayrollExportFormat.
+type PayrollExportFormat struct {
+	// Fields are the keys of payrollFields of the columns, and Headers
+	// the names in the header row, in the same order.
+	Fields  []string `datastore:",noindex"`
+	Headers []string `datastore:",noindex"`
+	// Header is whether there is a header row.
+	Header bool `datastore:",noindex"`
+	// DateFormat writes dates with YYYY, MM and DD for the year, month and
+	// day, like YYYY/MM/DD.
+	DateFormat string `datastore:",noindex"`
+	// Hours and minutes are rounded to multiples of RoundMinutes, to the
+	// nearest one or down or up as RoundMode says, and hours are written
+	// with HourDecimals decimals. Gross pay is from the exact minutes.
+	RoundMinutes int    `datastore:",noindex"`
+	RoundMode    string `datastore:",noindex"`
+	HourDecimals int    `datastore:",noindex"`
+}
+
+var defaultPayrollExportFormat = PayrollExportFormat{
+	Fields:       []string{"from", "to", "email", "name", "hourly_rate", "regular_hours", "overtime_hours", "gross_pay"},
+	Headers:      []string{"from", "to", "email", "name", "hourly_rate", "regular_hours", "overtime_hours", "gross_pay"},
+	Header:       true,
+	DateFormat:   "YYYY-MM-DD",
+	RoundMinutes: 1,
+	RoundMode:    "nearest",
+	HourDecimals: 2,
+}
+
+var roundModes = []string{"nearest", "down", "up"}
+
+// payrollRow is a line of a payroll entry, which is what a row of the
+// export is about.
+type payrollRow struct {
+	format *PayrollExportFormat
+	month  time.Time
+	entry  *PayrollEntryJSON
+	line   *PayrollLineJSON
+}
+
+// payrollFields are the values the export can have columns for.
+var payrollFields = map[string]func(r *payrollRow) string{
+	"month":            func(r *payrollRow) string { return r.format.date(r.month) },
+	"from":             func(r *payrollRow) string { return r.format.dateValue(r.line.From) },
+	"to":               func(r *payrollRow) string { return r.format.dateValue(r.line.To) },
+	"email":            func(r *payrollRow) string { return r.entry.Puncher },
+	"name":             func(r *payrollRow) string { return r.entry.Name },
+	"hourly_rate":      func(r *payrollRow) string { return strconv.FormatInt(r.line.HourlyRate, 10) },
+	"regular_minutes":  func(r *payrollRow) string { return strconv.Itoa(r.format.round(r.line.RegularMinutes)) },
+	"overtime_minutes": func(r *payrollRow) string { return strconv.Itoa(r.format.round(r.line.OvertimeMinutes)) },
+	"total_minutes": func(r *payrollRow) string {
+		return strconv.Itoa(r.format.round(r.line.RegularMinutes + r.line.OvertimeMinutes))
+	},
+	"regular_hours":  func(r *payrollRow) string { return r.format.hours(r.line.RegularMinutes) },
+	"overtime_hours": func(r *payrollRow) string { return r.format.hours(r.line.OvertimeMinutes) },
+	"total_hours": func(r *payrollRow) string {
+		return r.format.hours(r.line.RegularMinutes + r.line.OvertimeMinutes)
+	},
+	"gross_pay": func(r *payrollRow) string { return strconv.FormatInt(r.line.GrossPay, 10) },
+}
+
+var dateFormatTokens = strings.NewReplacer("YYYY", "2006", "MM", "01", "DD", "02")
+
+func (f *PayrollExportFormat) date(t time.Time) string {
+	return t.Format(dateFormatTokens.Replace(f.DateFormat))
+}
+
+// dateValue reformats a date given as 2006-01-02.
+func (f *PayrollExportFormat) dateValue(value string) string {
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return value
+	}
+	return f.date(t)
+}
+
+func (f *PayrollExportFormat) round(minutes int) int {
+	return roundMinutes(minutes, f.RoundMinutes, f.RoundMode)
+}
+
+func (f *PayrollExportFormat) hours(minutes int) string {
+	return strconv.FormatFloat(float64(f.round(minutes))/60, 'f', f.HourDecimals, 64)
+}
+
+// records returns the CSV records of payroll for month.
+func (f *PayrollExportFormat) records(month time.Time, payroll *PayrollResponse) [][]string {
+	var records [][]string
+	if f.Header {
+		records = append(records, f.Headers)
+	}
+	for i := range payroll.Entries {
+		e := &payroll.Entries[i]
+		for j := range e.Lines {
+			row := &payrollRow{format: f, month: month, entry: e, line: &e.Lines[j]}
+			record := make([]string, len(f.Fields))
+			for k, field := range f.Fields {
+				record[k] = payrollFields[field](row)
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func payrollExportFormatKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "PayrollExportFormat", "default_payroll_export_format", 0, nil)
+}
+
+func getPayrollExportFormat(c appengine.Context) (*PayrollExportFormat, error) {
+	var format PayrollExportFormat
+	err := datastore.Get(c, payrollExportFormatKey(c), &format)
+	if err == datastore.ErrNoSuchEntity {
+		format = defaultPayrollExportFormat
+	} else if err != nil {
+		return nil, err
+	}
+	return &format, nil
+}
+
+type PayrollExportFormatJSON struct {
+	Fields       []string `json:"fields"`
+	Headers      []string `json:"headers"`
+	Header       bool     `json:"header"`
+	DateFormat   string   `json:"date_format"`
+	RoundMinutes int      `json:"round_minutes"`
+	RoundMode    string   `json:"round_mode"`
+	HourDecimals int      `json:"hour_decimals"`
+}
+
+type PayrollExportFormatResponse struct {
+	Format PayrollExportFormatJSON `json:"format"`
+}
+
+type UpdatePayrollExportFormatRequest struct {
+	// Fields and Headers are comma separated. Headers default to the
+	// field names.
+	Fields       string `form:"fields"`
+	Headers      string `form:"headers"`
+	Header       bool   `form:"header"`
+	DateFormat   string `form:"date_format"`
+	RoundMinutes int    `form:"round_minutes"`
+	RoundMode    string `form:"round_mode"`
+	HourDecimals int    `form:"hour_decimals"`
+}
+
+func newPayrollExportFormatResponse(f *PayrollExportFormat) PayrollExportFormatResponse {
+	return PayrollExportFormatResponse{Format: PayrollExportFormatJSON{
+		Fields:       f.Fields,
+		Headers:      f.Headers,
+		Header:       f.Header,
+		DateFormat:   f.DateFormat,
+		RoundMinutes: f.RoundMinutes,
+		RoundMode:    f.RoundMode,
+		HourDecimals: f.HourDecimals,
+	}}
+}
+
+// splitList splits a comma separated value, trimming the items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		items = append(items, strings.TrimSpace(item))
+	}
+	return items
+}
+
+// parsePayrollExportFormat validates req.
+func parsePayrollExportFormat(req *UpdatePayrollExportFormatRequest) (*PayrollExportFormat, *appError) {
+	f := &PayrollExportFormat{
+		Fields:       splitList(req.Fields),
+		Header:       req.Header,
+		DateFormat:   req.DateFormat,
+		RoundMinutes: req.RoundMinutes,
+		RoundMode:    req.RoundMode,
+		HourDecimals: req.HourDecimals,
+	}
+	for _, field := range f.Fields {
+		if payrollFields[field] == nil {
+			return nil, &appError{
+				Error:   fmt.Errorf("unknown payroll field %q", field),
+				Message: `Unknown field "%s" in the "fields" parameter`,
+				Args:    []interface{}{field},
+				Code:    http.StatusBadRequest,
+			}
+		}
+	}
+	if req.Headers == "" {
+		f.Headers = f.Fields
+	} else if f.Headers = splitList(req.Headers); len(f.Headers) != len(f.Fields) {
+		return nil, &appError{
+			Error:   fmt.Errorf("%d headers for %d fields", len(f.Headers), len(f.Fields)),
+			Message: `The "headers" parameter must have a header for each field`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if dateFormatTokens.Replace(f.DateFormat) == f.DateFormat {
+		return nil, formValueError(fmt.Errorf("no date in %q", f.DateFormat), "date_format", `The "%s" parameter must have YYYY, MM or DD`)
+	}
+	if f.RoundMinutes < 1 || f.RoundMinutes > 60 {
+		return nil, &appError{
+			Error:   fmt.Errorf("invalid round minutes %d", f.RoundMinutes),
+			Message: `The "%s" parameter must be from 1 to %d`,
+			Args:    []interface{}{"round_minutes", 60},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if appErr := checkRoundMode(f.RoundMode); appErr != nil {
+		return nil, appErr
+	}
+	if f.HourDecimals < 0 || f.HourDecimals > 4 {
+		return nil, &appError{
+			Error:   fmt.Errorf("invalid hour decimals %d", f.HourDecimals),
+			Message: `The "%s" parameter must be from 0 to %d`,
+			Args:    []interface{}{"hour_decimals", 4},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return f, nil
+}
+
+func apiAdminPayrollExportFormatHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	format, err := getPayrollExportFormat(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the payroll export format from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	switch r.Method {
+	case "GET":
+		return newPayrollExportFormatResponse(format), nil
+
+	case "PUT", "POST":
+		// Fields that aren't given keep their stored value.
+		req := UpdatePayrollExportFormatRequest{
+			Fields:       strings.Join(format.Fields, ","),
+			Headers:      strings.Join(format.Headers, ","),
+			Header:       format.Header,
+			DateFormat:   format.DateFormat,
+			RoundMinutes: format.RoundMinutes,
+			RoundMode:    format.RoundMode,
+			HourDecimals: format.HourDecimals,
+		}
+		// New fields without headers are their own headers.
+		if r.FormValue("fields") != "" && r.FormValue("headers") == "" {
+			req.Headers = ""
+		}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		format, appErr := parsePayrollExportFormat(&req)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if _, err := datastore.Put(c, payrollExportFormatKey(c), format); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the payroll export format to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newPayrollExportFormatResponse(format), nil
+
+	case "DELETE":
+		// Deleting the format goes back to the default one.
+		if err := datastore.Delete(c, payrollExportFormatKey(c)); err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to delete the payroll export format from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newPayrollExportFormatResponse(&defaultPayrollExportFormat), nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package timecard
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf16"
+)
+
+// pdfDocument writes a minimal PDF of A4 pages of text, lines and gray
+// boxes, which is enough for the printable timesheets. Text is set in
+// HeiseiKakuGo-W5, one of the Japanese fonts PDF readers provide without
+// it being embedded, so that both Latin and Japanese names print. ASCII
+// is half width and everything else full width, which is how text is
+// measured for alignment.
+type pdfDocument struct {
+	pages []*pdfPage
+}
+
+type pdfPage struct {
+	content bytes.Buffer
+}
+
+// The size of an A4 page in points. The origin is at the bottom left.
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+)
+
+func (d *pdfDocument) addPage() *pdfPage {
+	p := &pdfPage{}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+func pdfNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// pdfString encodes s as the hex string of its UTF-16 code units, which
+// is what the font's UCS-2 encoding maps to glyphs.
+func pdfString(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('<')
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&buf, "%04X", u)
+	}
+	buf.WriteByte('>')
+	return buf.String()
+}
+
+// pdfTextWidth returns the width of s set in size points.
+func pdfTextWidth(s string, size float64) float64 {
+	var em float64
+	for _, r := range s {
+		if r < 0x80 {
+			em += 0.5
+		} else {
+			em++
+		}
+	}
+	return em * size
+}
+
+// text sets s with its baseline starting at x, y.
+func (p *pdfPage) text(x, y, size float64, s string) {
+	fmt.Fprintf(&p.content, "BT /F1 %s Tf %s %s Td %s Tj ET\n", pdfNumber(size), pdfNumber(x), pdfNumber(y), pdfString(s))
+}
+
+// textRight sets s ending at x.
+func (p *pdfPage) textRight(x, y, size float64, s string) {
+	p.text(x-pdfTextWidth(s, size), y, size, s)
+}
+
+func (p *pdfPage) line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s m %s %s l S\n", pdfNumber(width), pdfNumber(x1), pdfNumber(y1), pdfNumber(x2), pdfNumber(y2))
+}
+
+// fillRect fills the box with its bottom left at x, y in gray, from 0
+// for black to 1 for white.
+func (p *pdfPage) fillRect(x, y, w, h, gray float64) {
+	fmt.Fprintf(&p.content, "q %s g %s %s %s %s re f Q\n", pdfNumber(gray), pdfNumber(x), pdfNumber(y), pdfNumber(w), pdfNumber(h))
+}
+
+// write writes the document. Objects 1 to 5 are the catalog, the page
+// tree and the font; each page is followed by its content.
+func (d *pdfDocument) write(w io.Writer) error {
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(format string, args ...interface{}) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n", len(offsets))
+		fmt.Fprintf(&buf, format, args...)
+		buf.WriteString("\nendobj\n")
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	var kids bytes.Buffer
+	for i := range d.pages {
+		fmt.Fprintf(&kids, "%d 0 R ", 6+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object("<< /Type /Pages /Kids [%s] /Count %d >>", kids.String(), len(d.pages))
+	object("<< /Type /Font /Subtype /Type0 /BaseFont /HeiseiKakuGo-W5 /Encoding /UniJIS-UCS2-HW-H /DescendantFonts [4 0 R] >>")
+	object("<< /Type /Font /Subtype /CIDFontType0 /BaseFont /HeiseiKakuGo-W5" +
+		" /CIDSystemInfo << /Registry (Adobe) /Ordering (Japan1) /Supplement 2 >>" +
+		" /FontDescriptor 5 0 R /DW 1000 /W [231 325 500] >>")
+	object("<< /Type /FontDescriptor /FontName /HeiseiKakuGo-W5 /Flags 4 /FontBBox [-92 -250 1010 922]" +
+		" /ItalicAngle 0 /Ascent 752 /Descent -221 /CapHeight 737 /StemV 114 >>")
+	for i, p := range d.pages {
+		object("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 7+2*i)
+		object("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.String())
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := buf.WriteTo(w)
+	return err
+}
@@ -0,0 +1,361 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Contractors work on projects of their clients. An arrival punch may
+// name the project the session it starts is spent on, and the billable
+// projects' sessions are invoiced to the client at the project's hourly
+// rate. Amounts are integers in the smallest unit of the client's
+// currency, such as yen or cents.
+
+type Client struct {
+	Name     string
+	Address  string `datastore:",noindex"`
+	Currency string
+	// TaxPercent is added to the invoices of the client.
+	TaxPercent int
+}
+
+type Project struct {
+	Name       string
+	ClientID   int64
+	Billable   bool
+	HourlyRate int64
+	// Archived projects can't be punched for any more.
+	Archived bool
+}
+
+const defaultCurrency = "JPY"
+
+func clientKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Client", "", id, punchKey(c))
+}
+
+func projectKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Project", "", id, punchKey(c))
+}
+
+func findClients(c appengine.Context) ([]*datastore.Key, []Client, error) {
+	var clients []Client
+	keys, err := datastore.NewQuery("Client").Ancestor(punchKey(c)).Order("Name").GetAll(c, &clients)
+	return keys, clients, err
+}
+
+func findProjects(c appengine.Context) ([]*datastore.Key, []Project, error) {
+	var projects []Project
+	keys, err := datastore.NewQuery("Project").Ancestor(punchKey(c)).Order("Name").GetAll(c, &projects)
+	return keys, projects, err
+}
+
+// findOpenProjects returns the projects that can be punched for, in name
+// order.
+func findOpenProjects(c appengine.Context) ([]ProjectJSON, *appError) {
+	keys, projects, err := findProjects(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the projects from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	open := make([]ProjectJSON, 0, len(projects))
+	for i := range projects {
+		if !projects[i].Archived {
+			open = append(open, newProjectJSON(keys[i], &projects[i]))
+		}
+	}
+	return open, nil
+}
+
+// checkPunchProject fails unless id is 0, for no project, or a project
+// that can be punched for.
+func checkPunchProject(c appengine.Context, id int64) *appError {
+	if id == 0 {
+		return nil
+	}
+	var p Project
+	err := datastore.Get(c, projectKey(c, id), &p)
+	if err == datastore.ErrNoSuchEntity || (err == nil && p.Archived) {
+		return &appError{
+			Error:   fmt.Errorf("no open project %d", id),
+			Message: `The "project" parameter must be the ID of a project that isn't archived`,
+			Code:    http.StatusBadRequest,
+		}
+	} else if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the projects from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return nil
+}
+
+// findProjectSessions returns the sessions of puncher, or everyone when
+// it's empty, that start from from up to end (exclusive), with their
+// projects. The projects aren't in sessionFields, so whole punches are
+// loaded. Sessions always count for the day they started on, so that
+// each is billed once.
+func findProjectSessions(c appengine.Context, puncher string, from, end time.Time) ([]WorkSession, *appError) {
+	all, err := findSessions(c, punchQuery{Puncher: puncher, From: from, To: end})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	var sessions []WorkSession
+	for _, s := range all {
+		if !s.Arrival.Before(from) {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+type ClientJSON struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Address    string `json:"address"`
+	Currency   string `json:"currency"`
+	TaxPercent int    `json:"tax_percent"`
+}
+
+func newClientJSON(key *datastore.Key, cl *Client) ClientJSON {
+	return ClientJSON{
+		ID:         key.IntID(),
+		Name:       cl.Name,
+		Address:    cl.Address,
+		Currency:   cl.Currency,
+		TaxPercent: cl.TaxPercent,
+	}
+}
+
+type ClientsResponse struct {
+	Clients []ClientJSON `json:"clients"`
+}
+
+type ClientResponse struct {
+	Client ClientJSON `json:"client"`
+}
+
+type PutClientRequest struct {
+	// ID is 0 to create a client.
+	ID         int64  `form:"id"`
+	Name       string `form:"name"`
+	Address    string `form:"address"`
+	Currency   string `form:"currency"`
+	TaxPercent int    `form:"tax_percent"`
+}
+
+type ProjectJSON struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	ClientID   int64  `json:"client_id"`
+	Billable   bool   `json:"billable"`
+	HourlyRate int64  `json:"hourly_rate"`
+	Archived   bool   `json:"archived"`
+}
+
+func newProjectJSON(key *datastore.Key, p *Project) ProjectJSON {
+	return ProjectJSON{
+		ID:         key.IntID(),
+		Name:       p.Name,
+		ClientID:   p.ClientID,
+		Billable:   p.Billable,
+		HourlyRate: p.HourlyRate,
+		Archived:   p.Archived,
+	}
+}
+
+type ProjectsResponse struct {
+	Projects []ProjectJSON `json:"projects"`
+}
+
+type ProjectResponse struct {
+	Project ProjectJSON `json:"project"`
+}
+
+type PutProjectRequest struct {
+	// ID is 0 to create a project.
+	ID   int64  `form:"id"`
+	Name string `form:"name"`
+	// ClientID is 0 for internal projects, which are never billed.
+	ClientID   int64 `form:"client_id"`
+	Billable   bool  `form:"billable"`
+	HourlyRate int64 `form:"hourly_rate"`
+	Archived   bool  `form:"archived"`
+}
+
+// getForUpdate loads the Client or Project with id into dst for a PUT
+// that creates one when id is 0, and returns its key.
+func getForUpdate(c appengine.Context, kind string, id int64, dst interface{}) (*datastore.Key, *appError) {
+	if id == 0 {
+		return datastore.NewIncompleteKey(c, kind, punchKey(c)), nil
+	}
+	messages := map[string][2]string{
+		"Client":  {"No such client", "Failed to fetch the clients from the datastore"},
+		"Project": {"No such project", "Failed to fetch the projects from the datastore"},
+	}[kind]
+	key := datastore.NewKey(c, kind, "", id, punchKey(c))
+	if err := datastore.Get(c, key, dst); err == datastore.ErrNoSuchEntity {
+		return nil, &appError{
+			Error:   err,
+			Message: messages[0],
+			Code:    http.StatusNotFound,
+		}
+	} else if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: messages[1],
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return key, nil
+}
+
+func apiAdminClientsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	switch r.Method {
+	case "GET":
+		keys, clients, err := findClients(c)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the clients from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		res := ClientsResponse{Clients: make([]ClientJSON, 0, len(clients))}
+		for i := range clients {
+			res.Clients = append(res.Clients, newClientJSON(keys[i], &clients[i]))
+		}
+		return res, nil
+
+	case "PUT", "POST":
+		var req PutClientRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		settings, err := getOrgSettings(c)
+		if err != nil {
+			return nil, orgSettingsError(err)
+		}
+		cl := Client{Currency: settings.Currency}
+		key, appErr := getForUpdate(c, "Client", req.ID, &cl)
+		if appErr != nil {
+			return nil, appErr
+		}
+		// Fields that aren't given keep their stored value.
+		req = PutClientRequest{Name: cl.Name, Address: cl.Address, Currency: cl.Currency, TaxPercent: cl.TaxPercent}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		if req.Name == "" {
+			return nil, &appError{
+				Error:   errors.New("missing client name"),
+				Message: `The "name" parameter is required`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		if req.TaxPercent < 0 || req.TaxPercent > 100 {
+			return nil, formValueError(fmt.Errorf("invalid tax percent %d", req.TaxPercent), "tax_percent", `The "%s" parameter must be from 0 to 100`)
+		}
+		cl = Client{Name: req.Name, Address: req.Address, Currency: strings.ToUpper(req.Currency), TaxPercent: req.TaxPercent}
+		key, err = datastore.Put(c, key, &cl)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the client to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return ClientResponse{Client: newClientJSON(key, &cl)}, nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+func apiAdminProjectsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	switch r.Method {
+	case "GET":
+		keys, projects, err := findProjects(c)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the projects from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		res := ProjectsResponse{Projects: make([]ProjectJSON, 0, len(projects))}
+		for i := range projects {
+			res.Projects = append(res.Projects, newProjectJSON(keys[i], &projects[i]))
+		}
+		return res, nil
+
+	case "PUT", "POST":
+		var req PutProjectRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		var p Project
+		key, appErr := getForUpdate(c, "Project", req.ID, &p)
+		if appErr != nil {
+			return nil, appErr
+		}
+		// Fields that aren't given keep their stored value.
+		req = PutProjectRequest{Name: p.Name, ClientID: p.ClientID, Billable: p.Billable, HourlyRate: p.HourlyRate, Archived: p.Archived}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		if req.Name == "" {
+			return nil, &appError{
+				Error:   errors.New("missing project name"),
+				Message: `The "name" parameter is required`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		if req.HourlyRate < 0 {
+			return nil, formValueError(fmt.Errorf("negative hourly rate %d", req.HourlyRate), "hourly_rate", `The "%s" parameter can't be negative`)
+		}
+		if req.ClientID != 0 {
+			var cl Client
+			if _, appErr := getForUpdate(c, "Client", req.ClientID, &cl); appErr != nil {
+				return nil, appErr
+			}
+		}
+		p = Project{Name: req.Name, ClientID: req.ClientID, Billable: req.Billable && req.ClientID != 0, HourlyRate: req.HourlyRate, Archived: req.Archived}
+		key, err := datastore.Put(c, key, &p)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the project to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return ProjectResponse{Project: newProjectJSON(key, &p)}, nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package timecard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// Every change of a punch is recorded as an immutable PunchEvent, a
+// child of the punch keyed by the punch's Revision after the change. The
+// Punch entity is the snapshot of its latest event, so reads never
+// replay the history; replaying it verifies the snapshot. Each event
+// holds the hash of the one before it, so that editing or removing an
+// event breaks the chain.
+
+const (
+	punchEventCreated  = "created"
+	punchEventDeleted  = "deleted"
+	punchEventRestored = "restored"
+	punchEventEdited   = "edited"
+	// punchEventAutoClosed creates the leave punched at the auto leave
+	// hour.
+	punchEventAutoClosed = "auto-closed"
+)
+
+// punchEventVersion is the Version of the events recorded now. Events
+// of version 0 were recorded before RecordedBy, Project, Note and Source
+// were kept and hashed, and verify without them.
+const punchEventVersion = 1
+
+type PunchEvent struct {
+	Type     string
+	Actor    string
+	Recorded time.Time
+
+	// The punch as it is after the event.
+	Puncher    string
+	PunchType  string
+	PunchTime  time.Time
+	DeletedAt  time.Time
+	DeletedBy  string
+	RecordedBy string
+	Project    int64  `datastore:",noindex"`
+	Note       string `datastore:",noindex"`
+	Source     string `datastore:",noindex"`
+
+	Version  int64  `datastore:",noindex"`
+	PrevHash string `datastore:",noindex"`
+	Hash     string `datastore:",noindex"`
+}
+
+func punchEventKey(c appengine.Context, punch *datastore.Key, revision int64) *datastore.Key {
+	return datastore.NewKey(c, "PunchEvent", "", revision, punch)
+}
+
+func (e *PunchEvent) digest(revision int64) string {
+	fields := []string{
+		e.PrevHash,
+		strconv.FormatInt(revision, 10),
+		e.Type,
+		e.Actor,
+		e.Recorded.UTC().Format(time.RFC3339Nano),
+		e.Puncher,
+		e.PunchType,
+		e.PunchTime.UTC().Format(time.RFC3339Nano),
+		e.DeletedAt.UTC().Format(time.RFC3339Nano),
+		e.DeletedBy,
+	}
+	if e.Version > 0 {
+		fields = append(fields,
+			strconv.FormatInt(e.Version, 10),
+			e.RecordedBy,
+			strconv.FormatInt(e.Project, 10),
+			e.Note,
+			e.Source,
+		)
+	}
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sealPunchEvents sets the hashes of the events of one punch, given in
+// revision order starting at revision first.
+func sealPunchEvents(events []PunchEvent, first int64, prevHash string) {
+	for i := range events {
+		events[i].PrevHash = prevHash
+		events[i].Hash = events[i].digest(first + int64(i))
+		prevHash = events[i].Hash
+	}
+}
+
+// recordPunchEvent appends an event to the history of p, which is
+// stored at key, and increments p.Revision. It must run in a
+// transaction, and the caller puts p afterwards.
+func recordPunchEvent(tc appengine.Context, key *datastore.Key, p *Punch, eventType, actor string) error {
+	prevHash := ""
+	if p.Revision > 0 {
+		var last PunchEvent
+		err := datastore.Get(tc, punchEventKey(tc, key, p.Revision), &last)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		prevHash = last.Hash
+	}
+	p.Revision++
+	e := PunchEvent{
+		Type:       eventType,
+		Actor:      actor,
+		Recorded:   time.Now(),
+		Puncher:    p.Puncher,
+		PunchType:  p.Type,
+		PunchTime:  p.Time,
+		DeletedAt:  p.DeletedAt,
+		DeletedBy:  p.DeletedBy,
+		RecordedBy: p.RecordedBy,
+		Project:    p.Project,
+		Note:       p.Note,
+		Source:     p.Source,
+		Version:    punchEventVersion,
+	}
+	e.PrevHash = prevHash
+	e.Hash = e.digest(p.Revision)
+	_, err := datastore.Put(tc, punchEventKey(tc, key, p.Revision), &e)
+	return err
+}
+
+// insertPunch stores the new punch p with its created event, or its
+// auto-closed event for a leave punched at the auto leave hour. It must
+// run in a transaction.
+func insertPunch(tc appengine.Context, p *Punch, actor string) (*datastore.Key, error) {
+	p.Revision = 0
+	key, err := datastore.Put(tc, datastore.NewIncompleteKey(tc, "Punch", punchKey(tc)), p)
+	if err != nil {
+		return nil, err
+	}
+	eventType := punchEventCreated
+	if p.Source == punchSourceAuto {
+		eventType = punchEventAutoClosed
+	}
+	if err := recordPunchEvent(tc, key, p, eventType, actor); err != nil {
+		return nil, err
+	}
+	_, err = datastore.Put(tc, key, p)
+	return key, err
+}
+
+// anonymizePunchEvents replaces email with alias in the history of the
+// punch and seals the chain again. This is the only change ever made to
+// recorded events. An empty alias clears the email.
+func anonymizePunchEvents(c appengine.Context, punch *datastore.Key, email, alias string) error {
+	keys, events, err := findPunchEvents(c, punch)
+	if err != nil || len(events) == 0 {
+		return err
+	}
+	for i := range events {
+		if events[i].Puncher == email {
+			events[i].Puncher = alias
+		}
+		if events[i].Actor == email {
+			events[i].Actor = alias
+		}
+		if events[i].DeletedBy == email {
+			events[i].DeletedBy = alias
+		}
+		if events[i].RecordedBy == email {
+			events[i].RecordedBy = alias
+		}
+	}
+	sealPunchEvents(events, keys[0].IntID(), "")
+	_, err = datastore.PutMulti(c, keys, events)
+	return err
+}
+
+func findPunchEvents(c appengine.Context, punch *datastore.Key) ([]*datastore.Key, []PunchEvent, error) {
+	var events []PunchEvent
+	keys, err := datastore.NewQuery("PunchEvent").Ancestor(punch).Order("__key__").GetAll(c, &events)
+	return keys, events, err
+}
+
+// verifyPunchHistory replays the events of the punch p and reports the
+// first inconsistency, or "" if the chain is intact and ends at p.
+func verifyPunchHistory(keys []*datastore.Key, events []PunchEvent, p *Punch) string {
+	prevHash := ""
+	for i, e := range events {
+		revision := keys[i].IntID()
+		if i > 0 && revision != keys[i-1].IntID()+1 {
+			return fmt.Sprintf("revision %d is missing", keys[i-1].IntID()+1)
+		}
+		if i > 0 && e.PrevHash != prevHash {
+			return fmt.Sprintf("revision %d doesn't follow revision %d", revision, revision-1)
+		}
+		if e.Hash != e.digest(revision) {
+			return fmt.Sprintf("revision %d has been altered", revision)
+		}
+		prevHash = e.Hash
+	}
+	if len(events) == 0 {
+		if p.Revision == 0 {
+			return ""
+		}
+		return "the history is missing"
+	}
+	// Without this check removing the first events would go unnoticed.
+	if keys[0].IntID() != 1 || events[0].PrevHash != "" {
+		return "revision 1 is missing"
+	}
+	last := events[len(events)-1]
+	if keys[len(keys)-1].IntID() != p.Revision || last.Puncher != p.Puncher || last.PunchType != p.Type ||
+		!last.PunchTime.Equal(p.Time) || !last.DeletedAt.Equal(p.DeletedAt) || last.DeletedBy != p.DeletedBy {
+		return "the punch doesn't match its latest revision"
+	}
+	if last.Version > 0 && (last.RecordedBy != p.RecordedBy || last.Project != p.Project ||
+		last.Note != p.Note || last.Source != p.Source) {
+		return "the punch doesn't match its latest revision"
+	}
+	return ""
+}
+
+type PunchEventJSON struct {
+	Revision  int64      `json:"revision"`
+	Type      string     `json:"type"`
+	Actor     string     `json:"actor"`
+	Recorded  time.Time  `json:"recorded"`
+	Puncher   string     `json:"puncher"`
+	PunchType string     `json:"punch_type"`
+	PunchTime time.Time  `json:"punch_time"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+	// RecordedBy, Project, Note and Source are kept from version 1.
+	RecordedBy string `json:"recorded_by,omitempty"`
+	Project    int64  `json:"project,omitempty"`
+	Note       string `json:"note,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Version    int64  `json:"version"`
+	PrevHash   string `json:"prev_hash"`
+	Hash       string `json:"hash"`
+	// Changes are the fields changed from the revision before, set by
+	// findPunchHistory.
+	Changes []PunchChangeJSON `json:"changes,omitempty"`
+}
+
+// PunchChangeJSON is a field of a punch changed by an event, with its
+// values before and after. Times are RFC 3339, and empty when unset.
+type PunchChangeJSON struct {
+	// Field is puncher, type, time, deleted or recorded_by.
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// punchChanges returns the fields e changed from prev.
+func punchChanges(prev, e *PunchEvent) []PunchChangeJSON {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	var changes []PunchChangeJSON
+	for _, f := range []struct {
+		field    string
+		from, to string
+	}{
+		{"puncher", prev.Puncher, e.Puncher},
+		{"type", prev.PunchType, e.PunchType},
+		{"time", formatTime(prev.PunchTime), formatTime(e.PunchTime)},
+		{"deleted", formatTime(prev.DeletedAt), formatTime(e.DeletedAt)},
+	} {
+		if f.from != f.to {
+			changes = append(changes, PunchChangeJSON{Field: f.field, From: f.from, To: f.to})
+		}
+	}
+	// Events of version 0 don't know who recorded the punch.
+	if prev.Version > 0 && prev.RecordedBy != e.RecordedBy {
+		changes = append(changes, PunchChangeJSON{Field: "recorded_by", From: prev.RecordedBy, To: e.RecordedBy})
+	}
+	return changes
+}
+
+func newPunchEventJSON(key *datastore.Key, e *PunchEvent) PunchEventJSON {
+	j := PunchEventJSON{
+		Revision:   key.IntID(),
+		Type:       e.Type,
+		Actor:      e.Actor,
+		Recorded:   e.Recorded,
+		Puncher:    e.Puncher,
+		PunchType:  e.PunchType,
+		PunchTime:  e.PunchTime,
+		DeletedBy:  e.DeletedBy,
+		RecordedBy: e.RecordedBy,
+		Project:    e.Project,
+		Note:       e.Note,
+		Source:     e.Source,
+		Version:    e.Version,
+		PrevHash:   e.PrevHash,
+		Hash:       e.Hash,
+	}
+	if !e.DeletedAt.IsZero() {
+		deletedAt := e.DeletedAt
+		j.DeletedAt = &deletedAt
+	}
+	return j
+}
+
+type PunchHistoryResponse struct {
+	Punch  PunchJSON        `json:"punch"`
+	Events []PunchEventJSON `json:"events"`
+	// Problem is empty when the history is intact.
+	Problem string `json:"problem,omitempty"`
+}
+
+func apiAdminPunchHistoryHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method != "GET" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	var req PunchIDRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	return findPunchHistory(c, req.ID)
+}
+
+// findPunchHistory returns the punch with id and its verified history.
+func findPunchHistory(c appengine.Context, id int64) (*PunchHistoryResponse, *appError) {
+	key := datastore.NewKey(c, "Punch", "", id, punchKey(c))
+	var p Punch
+	if err := datastore.Get(c, key, &p); err == datastore.ErrNoSuchEntity {
+		return nil, &appError{
+			Error:   err,
+			Message: "No such punch",
+			Code:    http.StatusNotFound,
+		}
+	} else if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	keys, events, err := findPunchEvents(c, key)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the punch history from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	res := &PunchHistoryResponse{
+		Punch:   newPunchJSON(key, &p),
+		Events:  make([]PunchEventJSON, 0, len(events)),
+		Problem: verifyPunchHistory(keys, events, &p),
+	}
+	for i := range events {
+		j := newPunchEventJSON(keys[i], &events[i])
+		if i > 0 {
+			j.Changes = punchChanges(&events[i-1], &events[i])
+		}
+		res.Events = append(res.Events, j)
+	}
+	return res, nil
+}
+
+// findMyPunchHistory is findPunchHistory for the punches of email, which
+// are the only ones it finds.
+func findMyPunchHistory(c appengine.Context, email string, id int64) (*PunchHistoryResponse, *appError) {
+	res, appErr := findPunchHistory(c, id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if res.Punch.Puncher != email {
+		return nil, &appError{
+			Error:   fmt.Errorf("punch %d is not one of %s", id, email),
+			Message: "No such punch",
+			Code:    http.StatusNotFound,
+		}
+	}
+	return res, nil
+}
+
+func apiMyPunchHistoryHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method != "GET" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	var req PunchIDRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	return findMyPunchHistory(c, user.Current(c).Email, req.ID)
+}
+
+// adminPunchHandler shows a punch with the client it was made from and
+// its history, for investigating disputed punches.
+func adminPunchHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return formValueError(err, "id", `Failed to parse the "%s" parameter as an integer`)
+	}
+	res, appErr := findPunchHistory(c, id)
+	if appErr != nil {
+		return appErr
+	}
+	return renderPunchPage(c, w, r, res, true)
+}
+
+// myPunchHandler shows one of my punches and its history.
+func myPunchHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return formValueError(err, "id", `Failed to parse the "%s" parameter as an integer`)
+	}
+	res, appErr := findMyPunchHistory(c, user.Current(c).Email, id)
+	if appErr != nil {
+		return appErr
+	}
+	return renderPunchPage(c, w, r, res, false)
+}
+
+func renderPunchPage(c appengine.Context, w http.ResponseWriter, r *http.Request, res *PunchHistoryResponse, admin bool) *appError {
+	data := map[string]interface{}{
+		"Punch":   res.Punch,
+		"Events":  res.Events,
+		"Problem": res.Problem,
+		"Admin":   admin,
+	}
+	return renderTemplate(c, w, r, punchTemplate, data)
+}
+
+var punchTemplate = parsePage("punch")
@@ -0,0 +1,369 @@
+package timecard
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+	"appengine/user"
+)
+
+// A PunchImport brings historical punches over from another system. The
+// admin uploads a CSV file with the columns email, type, timestamp and
+// the optional note, in any order after a header row. Every row is
+// validated first: a file with any invalid row imports nothing, so that
+// it can be fixed and uploaded again without duplicating punches. The
+// valid punches are stored in PunchImportBatch children of the import,
+// and a task inserts one batch per run, deleting the batch in the same
+// transaction, until none are left.
+//
+// Imported punches are recorded by the admin, like punches recorded for
+// an employee, but aren't announced to the live dashboard, the
+// integrations or the webhooks, being history. The BigQuery backfill
+// sends them to BigQuery.
+type PunchImport struct {
+	CreatedBy string
+	Created   time.Time
+	Status    string // "running" or "done"
+	Completed time.Time
+	Rows      int
+	Imported  int
+}
+
+// PunchImportBatch holds punches waiting to be imported. Their rows are
+// the CSV rows they came from.
+type PunchImportBatch struct {
+	Punches []Punch `datastore:",noindex"`
+	Rows    []int   `datastore:",noindex"`
+}
+
+const (
+	punchImportBatchSize = 100
+	maxPunchImportRows   = 20000
+	punchImportTaskPath  = "/tasks/punch-import"
+)
+
+// punchImportColumns are the columns a file must have.
+var punchImportColumns = []string{"email", "type", "timestamp"}
+
+type ImportPunchesRequest struct {
+	// DryRun only validates the file.
+	DryRun bool `form:"dry_run"`
+}
+
+type GetPunchImportRequest struct {
+	ID int64 `form:"id"`
+}
+
+type PunchImportJSON struct {
+	ID        int64      `json:"id"`
+	CreatedBy string     `json:"created_by"`
+	Created   time.Time  `json:"created"`
+	Status    string     `json:"status"`
+	Completed *time.Time `json:"completed,omitempty"`
+	Rows      int        `json:"rows"`
+	Imported  int        `json:"imported"`
+}
+
+type PunchImportResponse struct {
+	// Import is missing on a dry run or when a row is invalid.
+	Import *PunchImportJSON  `json:"import,omitempty"`
+	Rows   int               `json:"rows"`
+	Errors []CSVRowErrorJSON `json:"errors"`
+}
+
+func newPunchImportJSON(key *datastore.Key, pi *PunchImport) *PunchImportJSON {
+	j := &PunchImportJSON{
+		ID:        key.IntID(),
+		CreatedBy: pi.CreatedBy,
+		Created:   pi.Created,
+		Status:    pi.Status,
+		Rows:      pi.Rows,
+		Imported:  pi.Imported,
+	}
+	if !pi.Completed.IsZero() {
+		completed := pi.Completed
+		j.Completed = &completed
+	}
+	return j
+}
+
+func punchImportKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "PunchImport", "", id, punchKey(c))
+}
+
+func enqueuePunchImport(c appengine.Context, key *datastore.Key) error {
+	t := taskqueue.NewPOSTTask(punchImportTaskPath, url.Values{
+		"id": {strconv.FormatInt(key.IntID(), 10)},
+	})
+	return addTask(c, t, "")
+}
+
+// parsePunchImport reads the punches of a CSV file, recorded by actor,
+// and the errors of its invalid rows. rows are the row numbers of the
+// punches.
+func parsePunchImport(c appengine.Context, r *http.Request, f io.Reader, actor string) (punches []Punch, rows []int, rowErrors []CSVRowErrorJSON, appErr *appError) {
+	cr := csv.NewReader(f)
+	columns, appErr := readCSVHeader(cr, punchImportColumns, "The CSV file must have a header row with the columns email, type, timestamp and optionally note")
+	if appErr != nil {
+		return nil, nil, nil, appErr
+	}
+
+	_, users, err := findUsers(c, userQuery{})
+	if err != nil {
+		return nil, nil, nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	emails := make(map[string]string, len(users))
+	for _, u := range users {
+		emails[strings.ToLower(u.Email)] = u.Email
+	}
+
+	rowErrors = []CSVRowErrorJSON{}
+	rowError := func(row int, msg string) {
+		rowErrors = append(rowErrors, newCSVRowError(r, row, msg))
+	}
+	now := time.Now()
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// The rest of the file can't be trusted to line up.
+			rowError(row, "Failed to parse the row as CSV")
+			break
+		}
+		if len(punches)+len(rowErrors) >= maxPunchImportRows {
+			return nil, nil, nil, &appError{
+				Error:   errors.New("too many rows"),
+				Message: "The CSV file can have at most %d rows",
+				Args:    []interface{}{maxPunchImportRows},
+				Code:    http.StatusBadRequest,
+			}
+		}
+
+		p := Punch{Note: columns.get(record, "note"), Source: punchSourceImport}
+		if email, ok := emails[strings.ToLower(columns.get(record, "email"))]; ok {
+			p.Puncher = email
+		} else {
+			rowError(row, `The "email" column must be the email of a user`)
+			continue
+		}
+		p.Type = columns.get(record, "type")
+		if p.Type != "arrival" && p.Type != "leave" {
+			rowError(row, `The "type" column must be "arrival" or "leave"`)
+			continue
+		}
+		p.Time, err = time.Parse(time.RFC3339, columns.get(record, "timestamp"))
+		if err != nil {
+			rowError(row, `Failed to parse the "timestamp" column as an RFC 3339 time`)
+			continue
+		}
+		if p.Time.After(now.Add(maxPunchClockSkew)) {
+			rowError(row, "The punch time can't be in the future")
+			continue
+		}
+		if actor != p.Puncher {
+			p.RecordedBy = actor
+		}
+		punches = append(punches, p)
+		rows = append(rows, row)
+	}
+	return punches, rows, rowErrors, nil
+}
+
+func apiAdminPunchImportsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method == "GET" {
+		var req GetPunchImportRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		key := punchImportKey(c, req.ID)
+		var pi PunchImport
+		if err := datastore.Get(c, key, &pi); err == datastore.ErrNoSuchEntity {
+			return nil, &appError{
+				Error:   err,
+				Message: "No such punch import",
+				Code:    http.StatusNotFound,
+			}
+		} else if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the punch import from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return PunchImportResponse{Import: newPunchImportJSON(key, &pi), Rows: pi.Rows, Errors: []CSVRowErrorJSON{}}, nil
+	} else if r.Method != "POST" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	var req ImportPunchesRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	f, appErr := csvUpload(r)
+	if appErr != nil {
+		return nil, appErr
+	}
+	defer f.Close()
+
+	actor := user.Current(c).Email
+	punches, rows, rowErrors, appErr := parsePunchImport(c, r, f, actor)
+	if appErr != nil {
+		return nil, appErr
+	}
+	res := PunchImportResponse{Rows: len(punches) + len(rowErrors), Errors: rowErrors}
+	if req.DryRun || len(rowErrors) > 0 || len(punches) == 0 {
+		return res, nil
+	}
+
+	pi := PunchImport{
+		CreatedBy: actor,
+		Created:   time.Now(),
+		Status:    "running",
+		Rows:      len(punches),
+	}
+	key, err := putPunchImport(c, &pi, punches, rows)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to put the punch import to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if err := enqueuePunchImport(c, key); err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to start the punch import",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	c.Infof("%s started punch import %d of %d punches", actor, key.IntID(), pi.Rows)
+	res.Import = newPunchImportJSON(key, &pi)
+	return res, nil
+}
+
+// putPunchImport stores pi with the punches in batches. The batches are
+// put first, so that an import is never seen without its punches.
+func putPunchImport(c appengine.Context, pi *PunchImport, punches []Punch, rows []int) (*datastore.Key, error) {
+	low, _, err := datastore.AllocateIDs(c, "PunchImport", punchKey(c), 1)
+	if err != nil {
+		return nil, err
+	}
+	key := punchImportKey(c, low)
+	var batchKeys []*datastore.Key
+	var batches []PunchImportBatch
+	for start := 0; start < len(punches); start += punchImportBatchSize {
+		end := start + punchImportBatchSize
+		if end > len(punches) {
+			end = len(punches)
+		}
+		batchKeys = append(batchKeys, datastore.NewKey(c, "PunchImportBatch", "", int64(len(batchKeys)+1), key))
+		batches = append(batches, PunchImportBatch{Punches: punches[start:end], Rows: rows[start:end]})
+	}
+	if _, err := datastore.PutMulti(c, batchKeys, batches); err != nil {
+		return nil, err
+	}
+	_, err = datastore.Put(c, key, pi)
+	return key, err
+}
+
+// punchImportTaskHandler imports the first batch left of an import and
+// enqueues itself again until none are left.
+func punchImportTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		return formValueError(err, "id", `Failed to parse the "%s" parameter as an integer`)
+	}
+	key := punchImportKey(c, id)
+	var pi PunchImport
+	if err := datastore.Get(c, key, &pi); err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the punch import from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if pi.Status == "done" {
+		return nil
+	}
+
+	more, err := processPunchImportBatch(c, key)
+	if err == nil && more {
+		err = enqueuePunchImport(c, key)
+	}
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to process the punch import",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return nil
+}
+
+// processPunchImportBatch inserts the punches of the first batch left of
+// the import at key and deletes the batch in one transaction, so that a
+// retried task never imports a batch twice. It reports whether there may
+// be more batches, and completes the import when there are none.
+func processPunchImportBatch(c appengine.Context, key *datastore.Key) (more bool, err error) {
+	q := datastore.NewQuery("PunchImportBatch").Ancestor(key).Order("__key__").KeysOnly().Limit(1)
+	batchKeys, err := q.GetAll(c, nil)
+	if err != nil {
+		return false, err
+	}
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var pi PunchImport
+		if err := datastore.Get(tc, key, &pi); err != nil {
+			return err
+		}
+		if len(batchKeys) == 0 {
+			if pi.Status == "done" {
+				return nil
+			}
+			pi.Status = "done"
+			pi.Completed = time.Now()
+			c.Infof("punch import %d by %s completed: %d of %d punches imported", key.IntID(), pi.CreatedBy, pi.Imported, pi.Rows)
+			_, err := datastore.Put(tc, key, &pi)
+			return err
+		}
+
+		var batch PunchImportBatch
+		if err := datastore.Get(tc, batchKeys[0], &batch); err == datastore.ErrNoSuchEntity {
+			// Imported by a run whose result the query didn't see yet.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for i := range batch.Punches {
+			if _, err := insertPunch(tc, &batch.Punches[i], batch.Punches[i].recorder()); err != nil {
+				return fmt.Errorf("row %d: %v", batch.Rows[i], err)
+			}
+		}
+		if err := datastore.Delete(tc, batchKeys[0]); err != nil {
+			return err
+		}
+		pi.Imported += len(batch.Punches)
+		_, err := datastore.Put(tc, key, &pi)
+		return err
+	}, punchTransactionOptions)
+	return len(batchKeys) > 0, err
+}
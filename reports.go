@@ -0,0 +1,199 @@
+package timecard
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"appengine"
+)
+
+// The project report shows where the time of a period went: the worked
+// minutes of every project, grouped by client, and of every puncher on
+// it. Sessions without a project and projects without a client get
+// groups of their own. Open sessions count up to now, as in the stats.
+
+type ProjectReportRequest struct {
+	From string `form:"from"`
+	To   string `form:"to"`
+	// Puncher limits the report to one puncher.
+	Puncher string `form:"puncher"`
+}
+
+type PuncherMinutesJSON struct {
+	Puncher string `json:"puncher"`
+	Minutes int    `json:"minutes"`
+}
+
+type ProjectReportJSON struct {
+	// ProjectID is 0 for the sessions without a project.
+	ProjectID int64                `json:"project_id"`
+	Project   string               `json:"project"`
+	Billable  bool                 `json:"billable"`
+	Minutes   int                  `json:"minutes"`
+	Punchers  []PuncherMinutesJSON `json:"punchers"`
+}
+
+type ClientReportJSON struct {
+	// ClientID is 0 for the projects without a client.
+	ClientID int64               `json:"client_id"`
+	Client   string              `json:"client"`
+	Minutes  int                 `json:"minutes"`
+	Projects []ProjectReportJSON `json:"projects"`
+}
+
+type ProjectReportResponse struct {
+	From    string             `json:"from"`
+	To      string             `json:"to"`
+	Minutes int                `json:"minutes"`
+	Clients []ClientReportJSON `json:"clients"`
+}
+
+// table has a row per client, project and puncher.
+func (res *ProjectReportResponse) table() [][]string {
+	rows := [][]string{{"client", "project", "billable", "puncher", "minutes", "hours"}}
+	for _, g := range res.Clients {
+		for _, p := range g.Projects {
+			for _, m := range p.Punchers {
+				rows = append(rows, []string{g.Client, p.Project, strconv.FormatBool(p.Billable), m.Puncher,
+					strconv.Itoa(m.Minutes), fmt.Sprintf("%.2f", float64(m.Minutes)/60)})
+			}
+		}
+	}
+	return rows
+}
+
+// buildProjectReport reports the dates from and to of req, both
+// inclusive, in the location of now.
+func buildProjectReport(c appengine.Context, req *ProjectReportRequest, now time.Time) (*ProjectReportResponse, *appError) {
+	from, to, appErr := statsRange(req.From, req.To, now)
+	if appErr != nil {
+		return nil, appErr
+	}
+	clientKeys, clients, err := findClients(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the clients from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	projectKeys, projects, err := findProjects(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the projects from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	sessions, appErr := findProjectSessions(c, req.Puncher, from, to.AddDate(0, 0, 1))
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	worked := make(map[int64]map[string]time.Duration)
+	for _, s := range sessions {
+		if worked[s.Project] == nil {
+			worked[s.Project] = make(map[string]time.Duration)
+		}
+		worked[s.Project][s.Puncher] += s.Duration(now)
+	}
+	row := func(id int64, name string, billable bool) ProjectReportJSON {
+		r := ProjectReportJSON{ProjectID: id, Project: name, Billable: billable, Punchers: []PuncherMinutesJSON{}}
+		var punchers []string
+		for puncher := range worked[id] {
+			punchers = append(punchers, puncher)
+		}
+		sort.Strings(punchers)
+		for _, puncher := range punchers {
+			m := int(worked[id][puncher] / time.Minute)
+			r.Punchers = append(r.Punchers, PuncherMinutesJSON{Puncher: puncher, Minutes: m})
+			r.Minutes += m
+		}
+		delete(worked, id)
+		return r
+	}
+
+	// Clients and projects are listed by name, which the queries order by,
+	// and only when they have minutes.
+	groups := make([]ClientReportJSON, len(clients)+1)
+	index := make(map[int64]int)
+	for i := range clients {
+		groups[i] = ClientReportJSON{ClientID: clientKeys[i].IntID(), Client: clients[i].Name}
+		index[clientKeys[i].IntID()] = i
+	}
+	other := len(clients)
+	add := func(group int, r ProjectReportJSON) {
+		if r.Minutes > 0 {
+			groups[group].Projects = append(groups[group].Projects, r)
+			groups[group].Minutes += r.Minutes
+		}
+	}
+	for i, p := range projects {
+		group, ok := index[p.ClientID]
+		if !ok {
+			group = other
+		}
+		add(group, row(projectKeys[i].IntID(), p.Name, p.Billable))
+	}
+	add(other, row(0, "", false))
+
+	res := &ProjectReportResponse{
+		From:    from.Format("2006-01-02"),
+		To:      to.Format("2006-01-02"),
+		Clients: []ClientReportJSON{},
+	}
+	for _, g := range groups {
+		if g.Minutes > 0 {
+			res.Clients = append(res.Clients, g)
+			res.Minutes += g.Minutes
+		}
+	}
+	return res, nil
+}
+
+func apiAdminProjectReportHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	var req ProjectReportRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	return buildProjectReport(c, &req, requestViewer(r).Now())
+}
+
+// adminProjectReportHandler shows the project report of a period, or
+// with format=csv downloads it with a row per project and puncher.
+func adminProjectReportHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	var req ProjectReportRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return appErr
+	}
+	report, appErr := buildProjectReport(c, &req, requestViewer(r).Now())
+	if appErr != nil {
+		return appErr
+	}
+
+	if r.FormValue("format") == "csv" {
+		name := "timecard-projects-" + report.From + "-" + report.To
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		if err := writeTable(w, "csv", report); err != nil {
+			c.Errorf("failed to write the project report: %v", err)
+		}
+		return nil
+	}
+
+	query := url.Values{"from": {report.From}, "to": {report.To}, "format": {"csv"}}
+	if req.Puncher != "" {
+		query.Set("puncher", req.Puncher)
+	}
+	data := map[string]interface{}{
+		"Request": req,
+		"Report":  report,
+		"CSVURL":  "/admin/reports/projects?" + query.Encode(),
+	}
+	return renderTemplate(c, w, r, projectReportTemplate, data)
+}
+
+var projectReportTemplate = parsePage("project_report")
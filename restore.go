@@ -0,0 +1,772 @@
+package timecard
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/file"
+)
+
+// Restoring puts every entity of a backup back under its original ID.
+// Entities that aren't in the backup are left alone. With dry_run the
+// backup is only validated and compared with the datastore.
+
+const restoreBatchSize = 500
+
+type RestoreRequest struct {
+	// Object is the name of a backup in the default bucket. Without it the
+	// backup is read from the uploaded "archive" file.
+	Object string `form:"object"`
+	DryRun bool   `form:"dry_run"`
+}
+
+type RestoreCountsJSON struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+}
+
+type RestoreResponse struct {
+	DryRun             bool              `json:"dry_run"`
+	BackupCreated      time.Time         `json:"backup_created"`
+	Users              RestoreCountsJSON `json:"users"`
+	Punches            RestoreCountsJSON `json:"punches"`
+	PunchEvents        RestoreCountsJSON `json:"punch_events"`
+	IdempotencyKeys    RestoreCountsJSON `json:"idempotency_keys"`
+	Clients            RestoreCountsJSON `json:"clients"`
+	Projects           RestoreCountsJSON `json:"projects"`
+	Holidays           RestoreCountsJSON `json:"holidays"`
+	Workweeks          RestoreCountsJSON `json:"workweeks"`
+	Webhooks           RestoreCountsJSON `json:"webhooks"`
+	UserSettings       RestoreCountsJSON `json:"user_settings"`
+	ThemeChanged       bool              `json:"theme_changed"`
+	OrgSettingsChanged bool              `json:"org_settings_changed"`
+	// RetentionPolicyChanged is only set by version 1 backups, since
+	// later ones restore the retention with the org settings.
+	RetentionPolicyChanged     bool `json:"retention_policy_changed"`
+	PayrollExportFormatChanged bool `json:"payroll_export_format_changed"`
+	IntegrationsChanged        bool `json:"integrations_changed"`
+}
+
+func getStorageObject(c appengine.Context, bucket, name string) ([]byte, error) {
+	client, err := googleClient(c, storageScope)
+	if err != nil {
+		return nil, err
+	}
+	u := "https://www.googleapis.com/storage/v1/b/" + url.QueryEscape(bucket) +
+		"/o/" + strings.Replace(url.QueryEscape(name), "+", "%20", -1) + "?alt=media"
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, googleAPIError("cloud storage", resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func invalidBackupError(format string, args ...interface{}) *appError {
+	detail := fmt.Sprintf(format, args...)
+	return &appError{
+		Error:   errors.New("invalid backup: " + detail),
+		Message: "The backup is invalid: %s",
+		Args:    []interface{}{detail},
+		Code:    http.StatusBadRequest,
+	}
+}
+
+// readBackupArchive decodes and validates an archive written by
+// writeBackupArchive.
+func readBackupArchive(data []byte) (*BackupJSON, *appError) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, invalidBackupError("not a ZIP archive")
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var backup BackupJSON
+	var manifest BackupManifestJSON
+	for _, f := range []struct {
+		name string
+		dst  interface{}
+		// optional files are missing from backups taken before they
+		// were added.
+		optional bool
+		// since is the first backup version with the file.
+		since int
+	}{
+		{"manifest.json", &manifest, false, 1},
+		{"users.json", &backup.Users, false, 1},
+		{"punches.json", &backup.Punches, false, 1},
+		{"punch_events.json", &backup.PunchEvents, true, 1},
+		{"idempotency_keys.json", &backup.IdempotencyKeys, false, 1},
+		{"theme.json", &backup.Theme, false, 1},
+		{"retention_policy.json", &backup.RetentionPolicy, false, 1},
+		{"org_settings.json", &backup.OrgSettings, false, 2},
+		{"clients.json", &backup.Clients, false, 2},
+		{"projects.json", &backup.Projects, false, 2},
+		{"holidays.json", &backup.Holidays, false, 2},
+		{"workweeks.json", &backup.Workweeks, false, 2},
+		{"webhooks.json", &backup.Webhooks, false, 3},
+		{"payroll_export_format.json", &backup.PayrollExportFormat, false, 3},
+		{"user_settings.json", &backup.UserSettings, false, 3},
+		{"integrations.json", &backup.Integrations, false, 3},
+	} {
+		zf, ok := files[f.name]
+		if !ok && (f.optional || f.since > manifest.Version) {
+			continue
+		} else if !ok {
+			return nil, invalidBackupError("%s is missing", f.name)
+		}
+		rc, err := zf.Open()
+		if err == nil {
+			err = json.NewDecoder(rc).Decode(f.dst)
+			rc.Close()
+		}
+		if err != nil {
+			return nil, invalidBackupError("%s: %v", f.name, err)
+		}
+	}
+	if manifest.Version < 1 || manifest.Version > backupVersion {
+		return nil, invalidBackupError("unsupported version %d", manifest.Version)
+	}
+	backup.Version, backup.Created = manifest.Version, manifest.Created
+
+	userIDs := make(map[int64]bool)
+	for _, u := range backup.Users {
+		if u.ID <= 0 || userIDs[u.ID] {
+			return nil, invalidBackupError("bad or duplicate user id %d", u.ID)
+		}
+		if u.Email == "" {
+			return nil, invalidBackupError("user %d has no email", u.ID)
+		}
+		userIDs[u.ID] = true
+	}
+	punchIDs := make(map[int64]bool)
+	for _, p := range backup.Punches {
+		if p.ID <= 0 || punchIDs[p.ID] {
+			return nil, invalidBackupError("bad or duplicate punch id %d", p.ID)
+		}
+		if p.Puncher == "" || (p.Type != "arrival" && p.Type != "leave") || p.Time.IsZero() {
+			return nil, invalidBackupError("punch %d is incomplete", p.ID)
+		}
+		punchIDs[p.ID] = true
+	}
+	revisions := make(map[[2]int64]bool)
+	for _, e := range backup.PunchEvents {
+		k := [2]int64{e.PunchID, e.Revision}
+		if !punchIDs[e.PunchID] || e.Revision <= 0 || revisions[k] {
+			return nil, invalidBackupError("punch event %d of punch %d is bad, duplicate or refers to a missing punch", e.Revision, e.PunchID)
+		}
+		revisions[k] = true
+	}
+	for _, k := range backup.IdempotencyKeys {
+		if !strings.Contains(k.Name, "\n") || !punchIDs[k.PunchID] {
+			return nil, invalidBackupError("idempotency key %q is bad or refers to a missing punch", k.Name)
+		}
+	}
+	for _, color := range []string{backup.Theme.PrimaryColor, backup.Theme.BackgroundColor, backup.Theme.TextColor} {
+		if !colorPattern.MatchString(color) {
+			return nil, invalidBackupError("bad theme color %q", color)
+		}
+	}
+	if d := backup.RetentionPolicy.PunchDays; d < 0 || d > maxRetentionDays {
+		return nil, invalidBackupError("bad retention of %d days", d)
+	}
+	if backup.Version >= 2 {
+		if appErr := checkBackupV2(&backup); appErr != nil {
+			return nil, appErr
+		}
+	}
+	if backup.Version >= 3 {
+		if appErr := checkBackupV3(&backup); appErr != nil {
+			return nil, appErr
+		}
+	}
+	return &backup, nil
+}
+
+// checkBackupV2 validates the parts of a backup added in version 2.
+func checkBackupV2(backup *BackupJSON) *appError {
+	s := &backup.OrgSettings
+	if _, err := time.LoadLocation(s.Timezone); err != nil || s.Timezone == "" {
+		return invalidBackupError("bad time zone %q", s.Timezone)
+	}
+	if checkRoundMode(s.RoundMode) != nil || s.RoundMinutes < 1 {
+		return invalidBackupError("bad rounding to %d minutes %s", s.RoundMinutes, s.RoundMode)
+	}
+	if checkOvernightMode("overnight_mode", s.OvernightMode) != nil {
+		return invalidBackupError("bad overnight mode %q", s.OvernightMode)
+	}
+	if s.RetentionDays < 0 || s.RetentionDays > maxRetentionDays {
+		return invalidBackupError("bad retention of %d days", s.RetentionDays)
+	}
+
+	clientIDs := make(map[int64]bool)
+	for _, cl := range backup.Clients {
+		if cl.ID <= 0 || clientIDs[cl.ID] {
+			return invalidBackupError("bad or duplicate client id %d", cl.ID)
+		}
+		clientIDs[cl.ID] = true
+	}
+	projectIDs := make(map[int64]bool)
+	for _, p := range backup.Projects {
+		if p.ID <= 0 || projectIDs[p.ID] {
+			return invalidBackupError("bad or duplicate project id %d", p.ID)
+		}
+		if p.ClientID != 0 && !clientIDs[p.ClientID] {
+			return invalidBackupError("project %d refers to a missing client", p.ID)
+		}
+		projectIDs[p.ID] = true
+	}
+	for _, h := range backup.Holidays {
+		if _, err := time.Parse("2006-01-02", h.Date); err != nil {
+			return invalidBackupError("bad holiday date %q", h.Date)
+		}
+	}
+	emails := make(map[string]bool)
+	for _, w := range backup.Workweeks {
+		if _, appErr := parseWorkweek(strings.Join(w.Workdays, ","), w.ExpectedMinutes); appErr != nil || emails[w.Email] {
+			return invalidBackupError("bad or duplicate workweek %q", w.Email)
+		}
+		emails[w.Email] = true
+	}
+	return nil
+}
+
+// checkBackupV3 validates the parts of a backup added in version 3.
+func checkBackupV3(backup *BackupJSON) *appError {
+	webhookIDs := make(map[int64]bool)
+	for _, h := range backup.Webhooks {
+		if h.ID <= 0 || webhookIDs[h.ID] {
+			return invalidBackupError("bad or duplicate webhook id %d", h.ID)
+		}
+		u, err := url.Parse(h.URL)
+		if (h.Kind != webhookGoogleChat && h.Kind != webhookTeams) || err != nil || u.Scheme != "https" || u.Host == "" ||
+			(h.LateAfter != "" && !timeOfDayPattern.MatchString(h.LateAfter)) {
+			return invalidBackupError("webhook %d is bad", h.ID)
+		}
+		if _, err := time.LoadLocation(h.TimeZone); err != nil || h.TimeZone == "" {
+			return invalidBackupError("bad time zone %q", h.TimeZone)
+		}
+		webhookIDs[h.ID] = true
+	}
+	if backup.PayrollExportFormat != nil {
+		if _, appErr := payrollExportFormatFromJSON(backup.PayrollExportFormat); appErr != nil {
+			return invalidBackupError("bad payroll export format: %v", appErr.Error)
+		}
+	}
+	emails := make(map[string]bool)
+	for _, s := range backup.UserSettings {
+		if s.Email == "" || emails[s.Email] {
+			return invalidBackupError("bad or duplicate user settings %q", s.Email)
+		}
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return invalidBackupError("bad time zone %q", s.Timezone)
+		}
+		if _, ok := parseLocale(s.Locale); !ok && s.Locale != "" {
+			return invalidBackupError("bad locale %q", s.Locale)
+		}
+		emails[s.Email] = true
+	}
+	in := &backup.Integrations
+	if !bigQueryNamePattern.MatchString(in.BigQueryDataset) || !bigQueryNamePattern.MatchString(in.BigQueryTable) {
+		return invalidBackupError("bad BigQuery table %s.%s", in.BigQueryDataset, in.BigQueryTable)
+	}
+	return nil
+}
+
+// payrollExportFormatFromJSON validates and returns the format of a
+// backup.
+func payrollExportFormatFromJSON(j *PayrollExportFormatJSON) (*PayrollExportFormat, *appError) {
+	return parsePayrollExportFormat(&UpdatePayrollExportFormatRequest{
+		Fields:       strings.Join(j.Fields, ","),
+		Headers:      strings.Join(j.Headers, ","),
+		Header:       j.Header,
+		DateFormat:   j.DateFormat,
+		RoundMinutes: j.RoundMinutes,
+		RoundMode:    j.RoundMode,
+		HourDecimals: j.HourDecimals,
+	})
+}
+
+// diffEntities loads the stored entities for keys into current, a slice
+// as long as keys, and counts which of the restored entities would be
+// created, updated or left unchanged. same reports whether the restored
+// entity i equals current[i].
+func diffEntities(c appengine.Context, keys []*datastore.Key, current interface{}, same func(i int) bool) (RestoreCountsJSON, error) {
+	var counts RestoreCountsJSON
+	cv := reflect.ValueOf(current)
+	missing := make([]bool, len(keys))
+	for start := 0; start < len(keys); start += restoreBatchSize {
+		end := start + restoreBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err := datastore.GetMulti(c, keys[start:end], cv.Slice(start, end).Interface())
+		if me, ok := err.(appengine.MultiError); ok {
+			for i, err := range me {
+				if err == datastore.ErrNoSuchEntity {
+					missing[start+i] = true
+				} else if err != nil {
+					return counts, err
+				}
+			}
+		} else if err != nil {
+			return counts, err
+		}
+	}
+	for i := range keys {
+		if missing[i] {
+			counts.Created++
+		} else if same(i) {
+			counts.Unchanged++
+		} else {
+			counts.Updated++
+		}
+	}
+	return counts, nil
+}
+
+// putEntities stores src, a slice as long as keys, in batches.
+func putEntities(c appengine.Context, keys []*datastore.Key, src interface{}) error {
+	sv := reflect.ValueOf(src)
+	for start := 0; start < len(keys); start += restoreBatchSize {
+		end := start + restoreBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if _, err := datastore.PutMulti(c, keys[start:end], sv.Slice(start, end).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreBackup(c appengine.Context, backup *BackupJSON, dryRun bool) (*RestoreResponse, error) {
+	res := &RestoreResponse{DryRun: dryRun, BackupCreated: backup.Created}
+
+	userKeys := make([]*datastore.Key, len(backup.Users))
+	users := make([]User, len(backup.Users))
+	for i, u := range backup.Users {
+		userKeys[i] = datastore.NewKey(c, "User", "", u.ID, punchKey(c))
+		users[i] = User{Email: u.Email, Name: u.Name, Team: u.Team, Enabled: u.Enabled, Admin: u.Admin, Version: u.Version, Updated: u.Updated}
+		for _, r := range u.PayRates {
+			users[i].PayRates = append(users[i].PayRates, PayRate{Effective: r.Effective, HourlyRate: r.HourlyRate})
+		}
+	}
+	currentUsers := make([]User, len(users))
+	var err error
+	res.Users, err = diffEntities(c, userKeys, currentUsers, func(i int) bool {
+		cu, u := currentUsers[i], users[i]
+		return cu.Email == u.Email && cu.Name == u.Name && cu.Team == u.Team && cu.Enabled == u.Enabled && cu.Admin == u.Admin &&
+			samePayRates(cu.PayRates, u.PayRates) && cu.Version == u.Version && cu.Updated.Equal(u.Updated)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	punchKeys := make([]*datastore.Key, len(backup.Punches))
+	punches := make([]Punch, len(backup.Punches))
+	for i, p := range backup.Punches {
+		punchKeys[i] = datastore.NewKey(c, "Punch", "", p.ID, punchKey(c))
+		punches[i] = Punch{Puncher: p.Puncher, Type: p.Type, Time: p.Time, DeletedBy: p.DeletedBy, RecordedBy: p.RecordedBy, Project: p.Project, Note: p.Note, Revision: p.Revision,
+			Source: p.Source, UserAgent: p.UserAgent, ClientIP: p.ClientIP}
+		if p.DeletedAt != nil {
+			punches[i].DeletedAt = *p.DeletedAt
+		}
+	}
+	currentPunches := make([]Punch, len(punches))
+	res.Punches, err = diffEntities(c, punchKeys, currentPunches, func(i int) bool {
+		cp, p := currentPunches[i], punches[i]
+		return cp.Puncher == p.Puncher && cp.Type == p.Type && cp.Time.Equal(p.Time) &&
+			cp.DeletedAt.Equal(p.DeletedAt) && cp.DeletedBy == p.DeletedBy &&
+			cp.RecordedBy == p.RecordedBy && cp.Project == p.Project && cp.Note == p.Note && cp.Revision == p.Revision &&
+			cp.Source == p.Source && cp.UserAgent == p.UserAgent && cp.ClientIP == p.ClientIP
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	eventKeys := make([]*datastore.Key, len(backup.PunchEvents))
+	events := make([]PunchEvent, len(backup.PunchEvents))
+	for i, e := range backup.PunchEvents {
+		eventKeys[i] = punchEventKey(c, datastore.NewKey(c, "Punch", "", e.PunchID, punchKey(c)), e.Revision)
+		events[i] = PunchEvent{
+			Type:       e.Type,
+			Actor:      e.Actor,
+			Recorded:   e.Recorded,
+			Puncher:    e.Puncher,
+			PunchType:  e.PunchType,
+			PunchTime:  e.PunchTime,
+			DeletedBy:  e.DeletedBy,
+			RecordedBy: e.RecordedBy,
+			Project:    e.Project,
+			Note:       e.Note,
+			Source:     e.Source,
+			Version:    e.Version,
+			PrevHash:   e.PrevHash,
+			Hash:       e.Hash,
+		}
+		if e.DeletedAt != nil {
+			events[i].DeletedAt = *e.DeletedAt
+		}
+	}
+	currentEvents := make([]PunchEvent, len(events))
+	res.PunchEvents, err = diffEntities(c, eventKeys, currentEvents, func(i int) bool {
+		return currentEvents[i].Hash == events[i].Hash
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ikKeys := make([]*datastore.Key, len(backup.IdempotencyKeys))
+	iks := make([]IdempotencyKey, len(backup.IdempotencyKeys))
+	for i, k := range backup.IdempotencyKeys {
+		ikKeys[i] = datastore.NewKey(c, "IdempotencyKey", k.Name, 0, punchKey(c))
+		iks[i] = IdempotencyKey{Punch: datastore.NewKey(c, "Punch", "", k.PunchID, punchKey(c)), Created: k.Created}
+	}
+	currentIKs := make([]IdempotencyKey, len(iks))
+	res.IdempotencyKeys, err = diffEntities(c, ikKeys, currentIKs, func(i int) bool {
+		cik, ik := currentIKs[i], iks[i]
+		return cik.Punch != nil && cik.Punch.Equal(ik.Punch) && cik.Created.Equal(ik.Created)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	theme, err := getTheme(c)
+	if err != nil {
+		return nil, err
+	}
+	restoredTheme := Theme{
+		CompanyName:     backup.Theme.CompanyName,
+		LogoURL:         backup.Theme.LogoURL,
+		PrimaryColor:    backup.Theme.PrimaryColor,
+		BackgroundColor: backup.Theme.BackgroundColor,
+		TextColor:       backup.Theme.TextColor,
+	}
+	res.ThemeChanged = *theme != restoredTheme
+
+	var restoredPolicy RetentionPolicy
+	var restoredSettings *OrgSettings
+	if backup.Version < 2 {
+		policy, err := getRetentionPolicy(c)
+		if err != nil {
+			return nil, err
+		}
+		restoredPolicy = RetentionPolicy{PunchDays: backup.RetentionPolicy.PunchDays}
+		res.RetentionPolicyChanged = *policy != restoredPolicy
+	} else {
+		settings, err := getOrgSettings(c)
+		if err != nil {
+			return nil, err
+		}
+		restoredSettings = orgSettingsFromJSON(&backup.OrgSettings)
+		restoredSettings.Updated = settings.Updated
+		res.OrgSettingsChanged = !reflect.DeepEqual(normalizeOrgSettings(settings), normalizeOrgSettings(restoredSettings))
+	}
+
+	clientKeys := make([]*datastore.Key, len(backup.Clients))
+	clients := make([]Client, len(backup.Clients))
+	for i, cl := range backup.Clients {
+		clientKeys[i] = clientKey(c, cl.ID)
+		clients[i] = Client{Name: cl.Name, Address: cl.Address, Currency: cl.Currency, TaxPercent: cl.TaxPercent}
+	}
+	currentClients := make([]Client, len(clients))
+	res.Clients, err = diffEntities(c, clientKeys, currentClients, func(i int) bool {
+		return currentClients[i] == clients[i]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	projectKeys := make([]*datastore.Key, len(backup.Projects))
+	projects := make([]Project, len(backup.Projects))
+	for i, p := range backup.Projects {
+		projectKeys[i] = projectKey(c, p.ID)
+		projects[i] = Project{Name: p.Name, ClientID: p.ClientID, Billable: p.Billable, HourlyRate: p.HourlyRate, Archived: p.Archived}
+	}
+	currentProjects := make([]Project, len(projects))
+	res.Projects, err = diffEntities(c, projectKeys, currentProjects, func(i int) bool {
+		return currentProjects[i] == projects[i]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	holidayKeys := make([]*datastore.Key, len(backup.Holidays))
+	holidays := make([]Holiday, len(backup.Holidays))
+	for i, h := range backup.Holidays {
+		holidayKeys[i] = holidayKey(c, h.Date)
+		holidays[i] = Holiday{Name: h.Name}
+	}
+	currentHolidays := make([]Holiday, len(holidays))
+	res.Holidays, err = diffEntities(c, holidayKeys, currentHolidays, func(i int) bool {
+		return currentHolidays[i] == holidays[i]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	workweekKeys := make([]*datastore.Key, len(backup.Workweeks))
+	workweeks := make([]Workweek, len(backup.Workweeks))
+	for i, w := range backup.Workweeks {
+		workweekKeys[i] = workweekKey(c)
+		if w.Email != "" {
+			workweekKeys[i] = userWorkweekKey(c, w.Email)
+		}
+		// readBackupArchive has checked the workweeks.
+		week, _ := parseWorkweek(strings.Join(w.Workdays, ","), w.ExpectedMinutes)
+		workweeks[i] = *week
+	}
+	currentWorkweeks := make([]Workweek, len(workweeks))
+	res.Workweeks, err = diffEntities(c, workweekKeys, currentWorkweeks, func(i int) bool {
+		cw, w := currentWorkweeks[i], workweeks[i]
+		return joinWeekdays(cw.Workdays) == joinWeekdays(w.Workdays) && cw.ExpectedMinutes == w.ExpectedMinutes
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	webhookKeys := make([]*datastore.Key, len(backup.Webhooks))
+	webhooks := make([]Webhook, len(backup.Webhooks))
+	for i, h := range backup.Webhooks {
+		webhookKeys[i] = webhookKey(c, h.ID)
+		webhooks[i] = Webhook{Team: h.Team, Kind: h.Kind, URL: h.URL, LateAfter: h.LateAfter, TimeZone: h.TimeZone}
+		if len(h.Members) > 0 {
+			webhooks[i].Members = h.Members
+		}
+	}
+	currentWebhooks := make([]Webhook, len(webhooks))
+	res.Webhooks, err = diffEntities(c, webhookKeys, currentWebhooks, func(i int) bool {
+		ch, h := currentWebhooks[i], webhooks[i]
+		return ch.Team == h.Team && ch.Kind == h.Kind && ch.URL == h.URL && strings.Join(ch.Members, ",") == strings.Join(h.Members, ",") &&
+			ch.LateAfter == h.LateAfter && ch.TimeZone == h.TimeZone
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var restoredFormat *PayrollExportFormat
+	if backup.PayrollExportFormat != nil {
+		// readBackupArchive has checked the format.
+		restoredFormat, _ = payrollExportFormatFromJSON(backup.PayrollExportFormat)
+		var format PayrollExportFormat
+		err := datastore.Get(c, payrollExportFormatKey(c), &format)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		res.PayrollExportFormatChanged = err != nil || !reflect.DeepEqual(format, *restoredFormat)
+	}
+
+	userSettingsKeys := make([]*datastore.Key, len(backup.UserSettings))
+	userSettings := make([]UserSettings, len(backup.UserSettings))
+	for i, s := range backup.UserSettings {
+		userSettingsKeys[i] = userSettingsKey(c, s.Email)
+		userSettings[i] = UserSettings{
+			Timezone:         s.Timezone,
+			Locale:           s.Locale,
+			AccountEmailsOff: !s.AccountEmails,
+			PunchEmailsOff:   !s.PunchEmails,
+			DefaultProject:   s.DefaultProject,
+			Updated:          s.Updated,
+		}
+	}
+	currentUserSettings := make([]UserSettings, len(userSettings))
+	res.UserSettings, err = diffEntities(c, userSettingsKeys, currentUserSettings, func(i int) bool {
+		cs, s := currentUserSettings[i], userSettings[i]
+		return cs.Timezone == s.Timezone && cs.Locale == s.Locale && cs.AccountEmailsOff == s.AccountEmailsOff &&
+			cs.PunchEmailsOff == s.PunchEmailsOff && cs.DefaultProject == s.DefaultProject && cs.Updated.Equal(s.Updated)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var restoredIntegrations Integrations
+	if backup.Version >= 3 {
+		in, err := getIntegrations(c)
+		if err != nil {
+			return nil, err
+		}
+		// The keys aren't in the backup, so the stored ones are kept.
+		restoredIntegrations = *in
+		j := &backup.Integrations
+		restoredIntegrations.BigQueryProject = j.BigQueryProject
+		restoredIntegrations.BigQueryDataset = j.BigQueryDataset
+		restoredIntegrations.BigQueryTable = j.BigQueryTable
+		restoredIntegrations.SheetsSpreadsheetID = j.SheetsSpreadsheetID
+		restoredIntegrations.DirectoryAdminEmail = j.DirectoryAdminEmail
+		restoredIntegrations.DirectoryDomain = j.DirectoryDomain
+		res.IntegrationsChanged = restoredIntegrations != *in
+	}
+
+	if dryRun {
+		return res, nil
+	}
+	if err := putEntities(c, userKeys, users); err != nil {
+		return nil, err
+	}
+	if err := putEntities(c, punchKeys, punches); err != nil {
+		return nil, err
+	}
+	if err := putEntities(c, eventKeys, events); err != nil {
+		return nil, err
+	}
+	if err := putEntities(c, ikKeys, iks); err != nil {
+		return nil, err
+	}
+	if res.ThemeChanged {
+		if err := putTheme(c, &restoredTheme); err != nil {
+			return nil, err
+		}
+	}
+	if res.RetentionPolicyChanged {
+		if err := putRetentionPolicy(c, &restoredPolicy); err != nil {
+			return nil, err
+		}
+	}
+	// After the theme, whose company name is one of the settings.
+	if res.OrgSettingsChanged {
+		if err := putOrgSettings(c, restoredSettings); err != nil {
+			return nil, err
+		}
+	}
+	if err := putEntities(c, clientKeys, clients); err != nil {
+		return nil, err
+	}
+	if err := putEntities(c, projectKeys, projects); err != nil {
+		return nil, err
+	}
+	if err := putEntities(c, holidayKeys, holidays); err != nil {
+		return nil, err
+	}
+	if err := putEntities(c, workweekKeys, workweeks); err != nil {
+		return nil, err
+	}
+	if err := putEntities(c, webhookKeys, webhooks); err != nil {
+		return nil, err
+	}
+	if res.PayrollExportFormatChanged {
+		if _, err := datastore.Put(c, payrollExportFormatKey(c), restoredFormat); err != nil {
+			return nil, err
+		}
+	}
+	if err := putEntities(c, userSettingsKeys, userSettings); err != nil {
+		return nil, err
+	}
+	if res.IntegrationsChanged {
+		if _, err := datastore.Put(c, integrationsKey(c), &restoredIntegrations); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// orgSettingsFromJSON returns the settings of a backup.
+func orgSettingsFromJSON(j *OrgSettingsJSON) *OrgSettings {
+	return &OrgSettings{
+		CompanyName:     j.CompanyName,
+		Timezone:        j.Timezone,
+		Currency:        j.Currency,
+		RoundMinutes:    j.RoundMinutes,
+		RoundMode:       j.RoundMode,
+		AutoLeaveHour:   j.AutoLeaveHour,
+		MaxSessionHours: j.MaxSessionHours,
+		RecentPunches:   j.RecentPunches,
+		OvernightMode:   j.OvernightMode,
+		BreakRules:      j.BreakRules,
+		AllowedDomains:  j.AllowedDomains,
+		RetentionDays:   j.RetentionDays,
+	}
+}
+
+// normalizeOrgSettings returns a copy of s with empty lists nil, so that
+// settings decoded from JSON and loaded from the datastore compare
+// equal.
+func normalizeOrgSettings(s *OrgSettings) OrgSettings {
+	n := *s
+	if len(n.BreakRules) == 0 {
+		n.BreakRules = nil
+	}
+	if len(n.AllowedDomains) == 0 {
+		n.AllowedDomains = nil
+	}
+	return n
+}
+
+func apiAdminRestoreHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method != "POST" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	var req RestoreRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+
+	var data []byte
+	var err error
+	if req.Object != "" {
+		var bucket string
+		bucket, err = file.DefaultBucketName(c)
+		if err == nil {
+			data, err = getStorageObject(c, bucket, req.Object)
+		}
+	} else {
+		f, _, ferr := r.FormFile("archive")
+		if ferr == http.ErrMissingFile || ferr == http.ErrNotMultipart {
+			return nil, &appError{
+				Error:   ferr,
+				Message: `The "object" parameter or an "archive" file is required`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		err = ferr
+		if err == nil {
+			data, err = ioutil.ReadAll(f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to read the backup",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	backup, appErr := readBackupArchive(data)
+	if appErr != nil {
+		return nil, appErr
+	}
+	res, err := restoreBackup(c, backup, req.DryRun)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to restore the backup",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	c.Infof("restore (dry run: %v) of a backup from %v: %+v", req.DryRun, res.BackupCreated, *res)
+	return res, nil
+}
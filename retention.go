@@ -0,0 +1,204 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// RetentionPolicy says how long punches are kept, as the retention days
+// of the OrgSettings. It was kept in a single RetentionPolicy entity
+// before OrgSettings, which is only read by getOrgSettings.
+type RetentionPolicy struct {
+	// PunchDays is the number of days punches are kept, or 0 to keep
+	// them forever.
+	PunchDays int
+}
+
+const (
+	maxRetentionDays = 100 * 366
+
+	purgeBatchSize = 500
+	// punchPurgeBatchSize is smaller since the events of each punch are
+	// queried one punch at a time.
+	punchPurgeBatchSize = 50
+	// purgeBatchesPerTask keeps each step of a purge job well within the
+	// deadline.
+	purgeBatchesPerTask = 20
+	purgeTaskPath       = "/tasks/purge"
+)
+
+func retentionPolicyKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "RetentionPolicy", "default_retention_policy", 0, nil)
+}
+
+func getRetentionPolicy(c appengine.Context) (*RetentionPolicy, error) {
+	s, err := getOrgSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	return &RetentionPolicy{PunchDays: s.RetentionDays}, nil
+}
+
+func putRetentionPolicy(c appengine.Context, policy *RetentionPolicy) error {
+	_, err := changeOrgSettings(c, func(s *OrgSettings) error {
+		s.RetentionDays = policy.PunchDays
+		return nil
+	})
+	return err
+}
+
+type RetentionPolicyJSON struct {
+	PunchDays int `json:"punch_days"`
+}
+
+type RetentionPolicyResponse struct {
+	RetentionPolicy RetentionPolicyJSON `json:"retention_policy"`
+}
+
+type UpdateRetentionPolicyRequest struct {
+	PunchDays int `form:"punch_days"`
+}
+
+func newRetentionPolicyResponse(p *RetentionPolicy) RetentionPolicyResponse {
+	return RetentionPolicyResponse{RetentionPolicy: RetentionPolicyJSON{
+		PunchDays: p.PunchDays,
+	}}
+}
+
+func apiAdminRetentionHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	policy, err := getRetentionPolicy(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the retention policy from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if r.Method == "GET" {
+		return newRetentionPolicyResponse(policy), nil
+	} else if r.Method == "PUT" || r.Method == "POST" {
+		req := UpdateRetentionPolicyRequest{PunchDays: policy.PunchDays}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		if appErr := checkRetentionDays("punch_days", req.PunchDays); appErr != nil {
+			return nil, appErr
+		}
+
+		policy = &RetentionPolicy{PunchDays: req.PunchDays}
+		if err := putRetentionPolicy(c, policy); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the retention policy to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newRetentionPolicyResponse(policy), nil
+	} else {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// purgeTaskHandler starts a purge job deleting the punches older than
+// the retention policy allows, together with their events and
+// idempotency keys. It is run daily by cron.
+func purgeTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	policy, err := getRetentionPolicy(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the retention policy from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if policy.PunchDays == 0 {
+		return nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -policy.PunchDays)
+	params := url.Values{"cutoff": {cutoff.Format(time.RFC3339Nano)}}
+	if _, _, err := startJob(c, jobKindPurge, params, "cron"); err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to purge expired data",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return nil
+}
+
+// purgeBefore deletes up to purgeBatchesPerTask batches of entities of
+// kind in the punches' entity group matching the filter, and returns how
+// many were deleted and whether any may be left.
+func purgeBefore(c appengine.Context, kind, filter string, cutoff time.Time) (int, bool, error) {
+	q := datastore.NewQuery(kind).Ancestor(punchKey(c)).Filter(filter, cutoff).KeysOnly().Limit(purgeBatchSize)
+	deleted := 0
+	for i := 0; i < purgeBatchesPerTask; i++ {
+		keys, err := q.GetAll(c, nil)
+		if err != nil {
+			return deleted, false, err
+		}
+		if len(keys) == 0 {
+			return deleted, false, nil
+		}
+		if err := datastore.DeleteMulti(c, keys); err != nil {
+			return deleted, false, err
+		}
+		deleted += len(keys)
+	}
+	return deleted, true, nil
+}
+
+// purgePunchesBefore deletes up to purgeBatchesPerTask batches of the
+// punches older than cutoff together with their events, which are the
+// children of each punch. Events are selected by their punch rather than
+// by the time they recorded, which may be that of an earlier revision.
+// It returns how many punches were deleted and whether any may be left.
+func purgePunchesBefore(c appengine.Context, cutoff time.Time) (int, bool, error) {
+	q := datastore.NewQuery("Punch").Ancestor(punchKey(c)).Filter("Time <", cutoff).KeysOnly().Limit(punchPurgeBatchSize)
+	deleted := 0
+	for i := 0; i < purgeBatchesPerTask; i++ {
+		keys, err := q.GetAll(c, nil)
+		if err != nil {
+			return deleted, false, err
+		}
+		if len(keys) == 0 {
+			return deleted, false, nil
+		}
+		var eventKeys []*datastore.Key
+		for _, key := range keys {
+			ks, err := datastore.NewQuery("PunchEvent").Ancestor(key).KeysOnly().GetAll(c, nil)
+			if err != nil {
+				return deleted, false, err
+			}
+			eventKeys = append(eventKeys, ks...)
+		}
+		// The events go first so that a failed step leaves no events
+		// of a deleted punch behind; the punches are found again by the
+		// next try.
+		for len(eventKeys) > 0 {
+			n := len(eventKeys)
+			if n > purgeBatchSize {
+				n = purgeBatchSize
+			}
+			if err := datastore.DeleteMulti(c, eventKeys[:n]); err != nil {
+				return deleted, false, err
+			}
+			eventKeys = eventKeys[n:]
+		}
+		if err := datastore.DeleteMulti(c, keys); err != nil {
+			return deleted, false, err
+		}
+		deleted += len(keys)
+	}
+	return deleted, true, nil
+}
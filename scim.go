@@ -0,0 +1,641 @@
+package timecard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// The identity provider provisions users through a SCIM 2.0 endpoint
+// (RFC 7643 and 7644) under /scim/v2. It authenticates with a bearer
+// token that an admin creates on /api/v1/admin/scim/token, and which
+// also tells the tenant. Only the stored hash of the token is kept.
+//
+// A SCIM user is a User entity: userName is the email, and active is
+// Enabled. The email can't be changed since punches refer to it, and
+// DELETE disables the user rather than deleting them, so that their
+// punches are kept; the admins delete users on the users page.
+// Attributes the app doesn't store are accepted and ignored.
+
+const (
+	scimUsersPath   = "/scim/v2/Users"
+	scimContentType = "application/scim+json"
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	maxSCIMBodySize = 1 << 20
+)
+
+// SCIMToken is keyed by the hash of its token and lives in the default
+// namespace, with the namespace of the tenant it provisions.
+type SCIMToken struct {
+	Namespace string
+	CreatedBy string
+	Created   time.Time
+}
+
+func scimTokenKey(c appengine.Context, token string) *datastore.Key {
+	sum := sha256.Sum256([]byte(token))
+	return datastore.NewKey(c, "SCIMToken", hex.EncodeToString(sum[:]), 0, nil)
+}
+
+// scimHandler serves SCIM requests, which come from the identity
+// provider rather than a signed-in user. It returns the HTTP status and
+// the resource to send, or nil for no content.
+type scimHandler func(appengine.Context, http.ResponseWriter, *http.Request) (int, interface{}, *appError)
+
+func (fn scimHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	l := startRequestLog(c, w, r)
+	defer l.finish()
+	c, appErr := scimContext(c, r)
+	if appErr != nil {
+		if appErr.Code == http.StatusUnauthorized {
+			l.Header().Set("WWW-Authenticate", `Bearer realm="timecard"`)
+		}
+		handleSCIMError(c, l, r, appErr)
+		return
+	}
+
+	code, resource, appErr := fn(c, l, r)
+	if appErr != nil {
+		handleSCIMError(c, l, r, appErr)
+		return
+	}
+	if resource == nil {
+		l.WriteHeader(code)
+		return
+	}
+	l.Header().Set("Content-Type", scimContentType)
+	l.WriteHeader(code)
+	if err := json.NewEncoder(l).Encode(resource); err != nil {
+		l.fail(err)
+	}
+}
+
+// scimContext returns c in the namespace of the bearer token of r.
+func scimContext(c appengine.Context, r *http.Request) (appengine.Context, *appError) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		err := errors.New("A bearer token is required")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusUnauthorized,
+		}
+	}
+	var t SCIMToken
+	err := datastore.Get(c, scimTokenKey(c, strings.TrimPrefix(auth, "Bearer ")), &t)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, &appError{
+			Error:   errors.New("unknown SCIM token"),
+			Message: "The bearer token is invalid or has been revoked",
+			Code:    http.StatusUnauthorized,
+		}
+	} else if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the SCIM token from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if t.Namespace != "" {
+		if c, err = appengine.Namespace(c, t.Namespace); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the tenants from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+	}
+	return c, nil
+}
+
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	SCIMType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+// handleSCIMError sends e as a SCIM error. w must come from
+// startRequestLog.
+func handleSCIMError(c appengine.Context, w http.ResponseWriter, r *http.Request, e *appError) {
+	if l, ok := w.(*requestLogger); ok {
+		l.fail(e.Error)
+	}
+	res := SCIMError{
+		Schemas: []string{scimErrorSchema},
+		Status:  strconv.Itoa(e.Code),
+		Detail:  e.localMessage(r) + " (" + requestLocale(r).T("Request ID: %s", responseRequestID(w)) + ")",
+	}
+	if e.Code == http.StatusConflict {
+		res.SCIMType = "uniqueness"
+	}
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(e.Code)
+	json.NewEncoder(w).Encode(res)
+}
+
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type SCIMMeta struct {
+	ResourceType string    `json:"resourceType"`
+	LastModified time.Time `json:"lastModified"`
+	Version      string    `json:"version"`
+	Location     string    `json:"location"`
+}
+
+type SCIMUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	UserName    string      `json:"userName"`
+	Name        *SCIMName   `json:"name,omitempty"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []SCIMEmail `json:"emails,omitempty"`
+	// Active is nil in requests that leave it out, which create active
+	// users.
+	Active *bool     `json:"active,omitempty"`
+	Meta   *SCIMMeta `json:"meta,omitempty"`
+}
+
+func newSCIMUser(r *http.Request, key *datastore.Key, u *User) SCIMUser {
+	id := strconv.FormatInt(key.IntID(), 10)
+	active := u.Enabled
+	return SCIMUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          id,
+		UserName:    u.Email,
+		Name:        &SCIMName{Formatted: u.Name},
+		DisplayName: u.Name,
+		Emails:      []SCIMEmail{{Value: u.Email, Primary: true}},
+		Active:      &active,
+		Meta: &SCIMMeta{
+			ResourceType: "User",
+			LastModified: u.Updated,
+			Version:      fmt.Sprintf(`W/"%d"`, u.Version),
+			Location:     "https://" + r.Host + scimUsersPath + "/" + id,
+		},
+	}
+}
+
+// email returns the email of the user the resource describes.
+func (su *SCIMUser) email() string {
+	if strings.Contains(su.UserName, "@") {
+		return su.UserName
+	}
+	for _, e := range su.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	return su.UserName
+}
+
+// name returns the name of the user the resource describes, or "" if it
+// has none.
+func (su *SCIMUser) name() string {
+	if su.DisplayName != "" {
+		return su.DisplayName
+	}
+	if su.Name == nil {
+		return ""
+	}
+	if su.Name.Formatted != "" {
+		return su.Name.Formatted
+	}
+	return strings.TrimSpace(su.Name.GivenName + " " + su.Name.FamilyName)
+}
+
+type SCIMListResponse struct {
+	Schemas      []string   `json:"schemas"`
+	TotalResults int        `json:"totalResults"`
+	StartIndex   int        `json:"startIndex"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []SCIMUser `json:"Resources"`
+}
+
+type SCIMPatchRequest struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// scimUserNameFilter is the only filter supported, which is the one
+// identity providers use to find out whether a user exists.
+var scimUserNameFilter = regexp.MustCompile(`(?i)^\s*userName\s+eq\s+"([^"]*)"\s*$`)
+
+func decodeSCIMBody(r *http.Request, v interface{}) *appError {
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSCIMBodySize)).Decode(v); err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to parse the request body as JSON",
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+func scimUsersHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (int, interface{}, *appError) {
+	if r.URL.Path == scimUsersPath {
+		switch r.Method {
+		case "GET":
+			return listSCIMUsers(c, r)
+		case "POST":
+			return createSCIMUser(c, r)
+		}
+	} else {
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, scimUsersPath+"/"), 10, 64)
+		if err != nil || id <= 0 {
+			return 0, nil, &appError{
+				Error:   fmt.Errorf("bad SCIM user path %s", r.URL.Path),
+				Message: "No such user",
+				Code:    http.StatusNotFound,
+			}
+		}
+		key := datastore.NewKey(c, "User", "", id, punchKey(c))
+		switch r.Method {
+		case "GET":
+			var u User
+			if err := datastore.Get(c, key, &u); err == datastore.ErrNoSuchEntity {
+				return 0, nil, &appError{
+					Error:   err,
+					Message: "No such user",
+					Code:    http.StatusNotFound,
+				}
+			} else if err != nil {
+				return 0, nil, &appError{
+					Error:   err,
+					Message: "Failed to fetch users data from the datastore",
+					Code:    http.StatusInternalServerError,
+				}
+			}
+			return http.StatusOK, newSCIMUser(r, key, &u), nil
+		case "PUT":
+			var su SCIMUser
+			if appErr := decodeSCIMBody(r, &su); appErr != nil {
+				return 0, nil, appErr
+			}
+			return updateSCIMUser(c, r, key, func(u *User) *appError {
+				if !strings.EqualFold(su.email(), u.Email) {
+					return &appError{
+						Error:   fmt.Errorf("SCIM tried to change the email of %s to %s", u.Email, su.email()),
+						Message: "The email of a user can't be changed",
+						Code:    http.StatusBadRequest,
+					}
+				}
+				if name := su.name(); name != "" {
+					u.Name = name
+				}
+				u.Enabled = su.Active == nil || *su.Active
+				return nil
+			})
+		case "PATCH":
+			var req SCIMPatchRequest
+			if appErr := decodeSCIMBody(r, &req); appErr != nil {
+				return 0, nil, appErr
+			}
+			return updateSCIMUser(c, r, key, func(u *User) *appError {
+				for _, op := range req.Operations {
+					if appErr := patchSCIMUser(u, strings.ToLower(op.Op), op.Path, op.Value); appErr != nil {
+						return appErr
+					}
+				}
+				return nil
+			})
+		case "DELETE":
+			_, _, appErr := updateSCIMUser(c, r, key, func(u *User) *appError {
+				u.Enabled = false
+				return nil
+			})
+			return http.StatusNoContent, nil, appErr
+		}
+	}
+	err := errors.New("Unsupported http method")
+	return 0, nil, &appError{
+		Error:   err,
+		Message: err.Error(),
+		Code:    http.StatusBadRequest,
+	}
+}
+
+func listSCIMUsers(c appengine.Context, r *http.Request) (int, interface{}, *appError) {
+	startIndex, count := 1, defaultUsersLimit
+	for name, n := range map[string]*int{"startIndex": &startIndex, "count": &count} {
+		if s := r.FormValue(name); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil {
+				return 0, nil, formValueError(err, name, `Failed to parse the "%s" parameter as an integer`)
+			}
+			*n = v
+		}
+	}
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	if count < 0 {
+		count = 0
+	} else if count > maxUsersLimit {
+		count = maxUsersLimit
+	}
+	filterEmail := ""
+	if filter := r.FormValue("filter"); filter != "" {
+		m := scimUserNameFilter.FindStringSubmatch(filter)
+		if m == nil {
+			return 0, nil, &appError{
+				Error:   errors.New("unsupported SCIM filter: " + filter),
+				Message: `The "filter" parameter only supports userName eq "..."`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		filterEmail = m[1]
+	}
+
+	keys, users, err := findUsers(c, userQuery{Sort: "email"})
+	if err != nil {
+		return 0, nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	res := SCIMListResponse{
+		Schemas:    []string{scimListSchema},
+		StartIndex: startIndex,
+		Resources:  []SCIMUser{},
+	}
+	for i := range users {
+		if filterEmail != "" && !strings.EqualFold(users[i].Email, filterEmail) {
+			continue
+		}
+		res.TotalResults++
+		if res.TotalResults >= startIndex && len(res.Resources) < count {
+			res.Resources = append(res.Resources, newSCIMUser(r, keys[i], &users[i]))
+		}
+	}
+	res.ItemsPerPage = len(res.Resources)
+	return http.StatusOK, res, nil
+}
+
+func createSCIMUser(c appengine.Context, r *http.Request) (int, interface{}, *appError) {
+	var su SCIMUser
+	if appErr := decodeSCIMBody(r, &su); appErr != nil {
+		return 0, nil, appErr
+	}
+	email := strings.TrimSpace(su.email())
+	if !strings.Contains(email, "@") {
+		return 0, nil, &appError{
+			Error:   errors.New("invalid SCIM userName: " + email),
+			Message: "The userName must be an email address",
+			Code:    http.StatusBadRequest,
+		}
+	}
+	policy, err := getSignInPolicy(c)
+	if err != nil {
+		return 0, nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the sign-in policy from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if !policy.allows(email) {
+		return 0, nil, &appError{
+			Error:   errors.New("SCIM user outside the allowed domains: " + email),
+			Message: "Accounts of %s aren't allowed to sign in",
+			Args:    []interface{}{emailDomain(email)},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	name := su.name()
+	if name == "" {
+		name = strings.SplitN(email, "@", 2)[0]
+	}
+
+	var key *datastore.Key
+	u := User{
+		Email:   email,
+		Name:    name,
+		Enabled: su.Active == nil || *su.Active,
+		Version: 1,
+		Updated: time.Now(),
+	}
+	exists := false
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		_, existing, err := findUserByEmail(tc, email)
+		if exists = existing != nil; err != nil || exists {
+			return err
+		}
+		key, err = datastore.Put(tc, datastore.NewIncompleteKey(tc, "User", punchKey(tc)), &u)
+		return err
+	}, nil)
+	if err != nil {
+		return 0, nil, &appError{
+			Error:   err,
+			Message: "Failed to put a user data to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if exists {
+		return 0, nil, &appError{
+			Error:   errors.New("SCIM user already exists: " + email),
+			Message: "A user with the email %s already exists",
+			Args:    []interface{}{email},
+			Code:    http.StatusConflict,
+		}
+	}
+	c.Infof("SCIM created the user %s", email)
+	notifyAccount(c, email, notificationAccountCreated)
+	return http.StatusCreated, newSCIMUser(r, key, &u), nil
+}
+
+// updateSCIMUser applies update to the user of key in a transaction.
+func updateSCIMUser(c appengine.Context, r *http.Request, key *datastore.Key, update func(*User) *appError) (int, interface{}, *appError) {
+	var u User
+	var appErr *appError
+	disabled := false
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := datastore.Get(tc, key, &u); err != nil {
+			return err
+		}
+		wasEnabled := u.Enabled
+		if appErr = update(&u); appErr != nil {
+			return nil
+		}
+		disabled = wasEnabled && !u.Enabled
+		u.Version++
+		u.Updated = time.Now()
+		_, err := datastore.Put(tc, key, &u)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return 0, nil, &appError{
+			Error:   err,
+			Message: "No such user",
+			Code:    http.StatusNotFound,
+		}
+	} else if err != nil {
+		return 0, nil, &appError{
+			Error:   err,
+			Message: "Failed to put a user data to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if appErr != nil {
+		return 0, nil, appErr
+	}
+	if disabled {
+		notifyAccount(c, u.Email, notificationAccountDisabled)
+	}
+	return http.StatusOK, newSCIMUser(r, key, &u), nil
+}
+
+// patchSCIMUser applies one PATCH operation. Operations without a path
+// set the attributes of their value.
+func patchSCIMUser(u *User, op, path string, value json.RawMessage) *appError {
+	if op != "add" && op != "replace" {
+		return nil
+	}
+	if path == "" {
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(value, &attrs); err != nil {
+			return &appError{
+				Error:   err,
+				Message: "Failed to parse the request body as JSON",
+				Code:    http.StatusBadRequest,
+			}
+		}
+		for name, v := range attrs {
+			if appErr := patchSCIMUser(u, op, name, v); appErr != nil {
+				return appErr
+			}
+		}
+		return nil
+	}
+
+	switch strings.ToLower(path) {
+	case "active":
+		// Some identity providers send the boolean as a string.
+		var s interface{}
+		json.Unmarshal(value, &s)
+		active, err := strconv.ParseBool(fmt.Sprint(s))
+		if err != nil {
+			return &appError{
+				Error:   err,
+				Message: "The active attribute must be a boolean",
+				Code:    http.StatusBadRequest,
+			}
+		}
+		u.Enabled = active
+	case "displayname", "name.formatted":
+		var name string
+		if err := json.Unmarshal(value, &name); err == nil && name != "" {
+			u.Name = name
+		}
+	}
+	return nil
+}
+
+type SCIMTokenJSON struct {
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+}
+
+type SCIMTokenResponse struct {
+	// Token is nil when no token has been created.
+	Token *SCIMTokenJSON `json:"token"`
+	// BaseURL is what the identity provider is configured with.
+	BaseURL string `json:"base_url"`
+	// Secret is only sent when the token is created, since only its hash
+	// is stored.
+	Secret string `json:"secret,omitempty"`
+}
+
+// findSCIMTokens returns the keys of the tokens of the namespace. c must
+// be in the default namespace.
+func findSCIMTokens(c appengine.Context, namespace string, tokens *[]SCIMToken) ([]*datastore.Key, error) {
+	return datastore.NewQuery("SCIMToken").Filter("Namespace =", namespace).GetAll(c, tokens)
+}
+
+// apiAdminSCIMTokenHandler shows, replaces and revokes the SCIM token of
+// the tenant. Each tenant has at most one token.
+func apiAdminSCIMTokenHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	ns := contextNamespace(c)
+	// Tokens are kept in the default namespace.
+	dc := appengine.NewContext(r)
+	res := SCIMTokenResponse{BaseURL: "https://" + r.Host + "/scim/v2"}
+
+	var tokens []SCIMToken
+	keys, err := findSCIMTokens(dc, ns, &tokens)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the SCIM token from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+		if len(tokens) > 0 {
+			res.Token = &SCIMTokenJSON{CreatedBy: tokens[0].CreatedBy, Created: tokens[0].Created}
+		}
+		return res, nil
+
+	case "POST", "DELETE":
+		if err := datastore.DeleteMulti(dc, keys); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the SCIM token to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		if r.Method == "DELETE" {
+			c.Infof("%s revoked the SCIM token", user.Current(c).Email)
+			return res, nil
+		}
+		secret := randomHex(32)
+		t := SCIMToken{Namespace: ns, CreatedBy: user.Current(c).Email, Created: time.Now()}
+		if _, err := datastore.Put(dc, scimTokenKey(dc, secret), &t); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the SCIM token to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		c.Infof("%s created a SCIM token", t.CreatedBy)
+		res.Token = &SCIMTokenJSON{CreatedBy: t.CreatedBy, Created: t.Created}
+		res.Secret = secret
+		return res, nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package timecard
+
+import (
+	"sort"
+	"time"
+
+	"appengine"
+)
+
+// WorkSession is the span between an arrival punch and the following
+// leave punch of the same puncher. An arrival without a leave yet makes
+// an open session whose Leave is zero. An arrival followed by another
+// arrival makes a session with a MissingLeave, whose Leave is zero too
+// and whose worked time is unknown.
+type WorkSession struct {
+	Puncher      string
+	Arrival      time.Time
+	Leave        time.Time
+	MissingLeave bool
+	// Project is the project of the arrival, which is only known when the
+	// punches weren't projected to sessionFields.
+	Project int64
+	// rounding deducts the breaks from the worked time of the session
+	// and rounds it once it is closed, when it was found by findSessions.
+	rounding *OrgSettings
+}
+
+func (s *WorkSession) Open() bool {
+	return s.Leave.IsZero() && !s.MissingLeave
+}
+
+// Duration returns the worked time of the session, less the break the
+// org settings deduct and rounded as they say. Open sessions count up to
+// now, without either, and sessions with a missing leave count nothing.
+func (s *WorkSession) Duration(now time.Time) time.Duration {
+	if s.MissingLeave {
+		return 0
+	}
+	if s.Open() {
+		return now.Sub(s.Arrival)
+	}
+	if s.rounding != nil {
+		return s.rounding.roundWorked(s.Leave.Sub(s.Arrival) - s.BreakDeducted())
+	}
+	return s.Leave.Sub(s.Arrival)
+}
+
+// BreakDeducted returns the break deducted from the worked time of the
+// session by the break rules of the org settings.
+func (s *WorkSession) BreakDeducted() time.Duration {
+	if s.Open() || s.MissingLeave || s.rounding == nil {
+		return 0
+	}
+	return s.rounding.breakDeduction(s.Leave.Sub(s.Arrival))
+}
+
+type punchesByTime []Punch
+
+func (p punchesByTime) Len() int           { return len(p) }
+func (p punchesByTime) Less(i, j int) bool { return p[i].Time.Before(p[j].Time) }
+func (p punchesByTime) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// pairSessions builds the sessions of the given punches. Punches of
+// several punchers may be mixed. A leave without a preceding arrival is
+// ignored, and a second arrival while a session is open ends that
+// session with a MissingLeave, like a forgotten leave. Otherwise it
+// would be closed by the leave of the second one, maybe a day later.
+func pairSessions(punches []Punch) []WorkSession {
+	sorted := make([]Punch, len(punches))
+	copy(sorted, punches)
+	sort.Stable(punchesByTime(sorted))
+
+	var sessions []WorkSession
+	open := make(map[string]int)
+	for _, p := range sorted {
+		i, isOpen := open[p.Puncher]
+		switch p.Type {
+		case "arrival":
+			if isOpen {
+				sessions[i].MissingLeave = true
+			}
+			open[p.Puncher] = len(sessions)
+			sessions = append(sessions, WorkSession{Puncher: p.Puncher, Arrival: p.Time, Project: p.Project})
+		case "leave":
+			if isOpen {
+				sessions[i].Leave = p.Time
+				delete(open, p.Puncher)
+			}
+		}
+	}
+	return sessions
+}
+
+// DailySummary is the worked time of a puncher on one date.
+type DailySummary struct {
+	Puncher string
+	Date    string // 2006-01-02
+	Worked  time.Duration
+}
+
+// summarizeDays totals the sessions per puncher and date, in date order.
+// Dates are those in the location of now, and only those from from up to
+// end (exclusive) are summarized; a zero from or end leaves that side
+// open. A session crossing midnight counts for the date it started on,
+// or with split for each date by the time worked on it.
+func summarizeDays(sessions []WorkSession, from, end time.Time, split bool, now time.Time) []DailySummary {
+	var summaries []DailySummary
+	index := make(map[string]int)
+	add := func(puncher string, day time.Time, worked time.Duration) {
+		if (!from.IsZero() && day.Before(from)) || (!end.IsZero() && !day.Before(end)) {
+			return
+		}
+		date := day.Format("2006-01-02")
+		k := puncher + " " + date
+		j, ok := index[k]
+		if !ok {
+			j = len(summaries)
+			index[k] = j
+			summaries = append(summaries, DailySummary{Puncher: puncher, Date: date})
+		}
+		summaries[j].Worked += worked
+	}
+	for i := range sessions {
+		s := &sessions[i]
+		start := s.Arrival.In(now.Location())
+		worked := s.Duration(now)
+		if !split || s.MissingLeave {
+			add(s.Puncher, startOfDay(start), worked)
+			continue
+		}
+		// The span punched is split at midnight, and the worked time
+		// shared by the days in proportion, so that the break deducted and
+		// the rounding are spread over them too.
+		stop := s.Leave
+		if s.Open() {
+			stop = now
+		}
+		span := stop.Sub(start)
+		for start.Before(stop) {
+			day := startOfDay(start)
+			next := day.AddDate(0, 0, 1)
+			if !next.Before(stop) {
+				add(s.Puncher, day, worked)
+				break
+			}
+			part := time.Duration(float64(worked)*float64(next.Sub(start))/float64(span)/float64(time.Minute)+0.5) * time.Minute
+			add(s.Puncher, day, part)
+			worked -= part
+			start = next
+		}
+	}
+	return summaries
+}
+
+// startOfDay returns the midnight starting the day of t in its location.
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// maxSessionLength is how far before and after a range punches are
+// loaded to pair the sessions crossing its ends, like night shifts
+// arriving before midnight and leaving after.
+const maxSessionLength = 24 * time.Hour
+
+// findSessions returns the sessions of the punches pq matches that
+// overlap its range, which may be open at either end, with their worked
+// time less the breaks and rounded as the org settings say. pq.Fields should be
+// sessionFields unless the projects are needed.
+func findSessions(c appengine.Context, pq punchQuery) ([]WorkSession, error) {
+	from, to := pq.From, pq.To
+	if !from.IsZero() {
+		pq.From = from.Add(-maxSessionLength)
+	}
+	if !to.IsZero() {
+		pq.To = to.Add(maxSessionLength)
+	}
+	_, punches, err := findPunches(c, pq)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := getOrgSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []WorkSession
+	for _, s := range pairSessions(punches) {
+		s.rounding = settings
+		if !to.IsZero() && !s.Arrival.Before(to) {
+			continue
+		}
+		if !from.IsZero() && s.MissingLeave && s.Arrival.Before(from) {
+			continue
+		}
+		if !from.IsZero() && !s.Open() && !s.MissingLeave && !s.Leave.After(from) {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
@@ -0,0 +1,303 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// UserSettings is the configuration of one user: the time zone and the
+// language pages are shown in, which notifications are emailed, and the
+// project arrivals are on unless another is chosen. It is keyed by email
+// under punchKey. The time zone and the language follow the browser when
+// they are empty.
+type UserSettings struct {
+	// Timezone is an IANA time zone name, like Asia/Tokyo.
+	Timezone string `datastore:",noindex"`
+	Locale   string `datastore:",noindex"`
+	// The zero value sends every email.
+	AccountEmailsOff bool `datastore:",noindex"`
+	PunchEmailsOff   bool `datastore:",noindex"`
+	// DefaultProject is the ID of a Project, or 0.
+	DefaultProject int64 `datastore:",noindex"`
+	Updated        time.Time
+}
+
+func userSettingsKey(c appengine.Context, email string) *datastore.Key {
+	return datastore.NewKey(c, "UserSettings", email, 0, punchKey(c))
+}
+
+// getUserSettings returns the settings of email. Until they are first
+// saved, the email preferences are read from the NotificationPreferences
+// they were kept in before.
+func getUserSettings(c appengine.Context, email string) (*UserSettings, error) {
+	var s UserSettings
+	err := datastore.Get(c, userSettingsKey(c, email), &s)
+	if err == datastore.ErrNoSuchEntity {
+		var prefs NotificationPreferences
+		err = datastore.Get(c, notificationPreferencesKey(c, email), &prefs)
+		if err == datastore.ErrNoSuchEntity {
+			err = nil
+		}
+		s.AccountEmailsOff, s.PunchEmailsOff = prefs.AccountEmailsOff, prefs.PunchEmailsOff
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func putUserSettings(c appengine.Context, email string, s *UserSettings) *appError {
+	s.Updated = time.Now()
+	if _, err := datastore.Put(c, userSettingsKey(c, email), s); err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to put the settings to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return nil
+}
+
+func userSettingsError(err error) *appError {
+	return &appError{
+		Error:   err,
+		Message: "Failed to fetch the settings from the datastore",
+		Code:    http.StatusInternalServerError,
+	}
+}
+
+// emails reports whether notifications of notificationType are emailed.
+func (s *UserSettings) emails(notificationType string) bool {
+	switch notificationType {
+	case notificationAccountCreated, notificationAccountDisabled:
+		return !s.AccountEmailsOff
+	default:
+		return !s.PunchEmailsOff
+	}
+}
+
+// locale returns the language chosen, or the default one.
+func (s *UserSettings) locale() locale {
+	if l, ok := parseLocale(s.Locale); ok {
+		return l
+	}
+	return defaultLocale
+}
+
+// The settings of the signed-in user are loaded once per request by the
+// handlers, so that requestViewer and requestLocale can apply them
+// without a context.
+var requestSettings = struct {
+	sync.Mutex
+	m map[*http.Request]*UserSettings
+}{m: make(map[*http.Request]*UserSettings)}
+
+// loadRequestSettings applies the settings of email to the rest of r.
+// The returned function forgets them, and must be deferred. Failing to
+// load them only leaves r with the browser's time zone and language.
+func loadRequestSettings(c appengine.Context, r *http.Request, email string) func() {
+	s, err := getUserSettings(c, email)
+	if err != nil {
+		c.Errorf("failed to get the settings of %s: %v", email, err)
+		return func() {}
+	}
+	requestSettings.Lock()
+	requestSettings.m[r] = s
+	requestSettings.Unlock()
+	return func() {
+		requestSettings.Lock()
+		delete(requestSettings.m, r)
+		requestSettings.Unlock()
+	}
+}
+
+// requestUserSettings returns the settings loaded for r, or nil.
+func requestUserSettings(r *http.Request) *UserSettings {
+	requestSettings.Lock()
+	defer requestSettings.Unlock()
+	return requestSettings.m[r]
+}
+
+type UserSettingsJSON struct {
+	Timezone       string `json:"timezone"`
+	Locale         string `json:"locale"`
+	AccountEmails  bool   `json:"account_emails"`
+	PunchEmails    bool   `json:"punch_emails"`
+	DefaultProject int64  `json:"default_project"`
+}
+
+type UserSettingsResponse struct {
+	Settings UserSettingsJSON `json:"settings"`
+}
+
+type UpdateUserSettingsRequest struct {
+	// Timezone is an IANA time zone name, or empty to use the browser's.
+	Timezone string `form:"timezone"`
+	// Locale is en or ja, or empty to follow the browser.
+	Locale        string `form:"locale"`
+	AccountEmails bool   `form:"account_emails"`
+	PunchEmails   bool   `form:"punch_emails"`
+	// DefaultProject is the ID of the project arrivals are on, or 0.
+	DefaultProject int64 `form:"default_project"`
+}
+
+func newUserSettingsResponse(s *UserSettings) UserSettingsResponse {
+	return UserSettingsResponse{Settings: UserSettingsJSON{
+		Timezone:       s.Timezone,
+		Locale:         s.Locale,
+		AccountEmails:  !s.AccountEmailsOff,
+		PunchEmails:    !s.PunchEmailsOff,
+		DefaultProject: s.DefaultProject,
+	}}
+}
+
+// updateUserSettings checks req and stores it as the settings of email,
+// which were current. A default project that has been archived since it
+// was chosen is kept unless req changes it.
+func updateUserSettings(c appengine.Context, email string, current *UserSettings, req *UpdateUserSettingsRequest) (*UserSettings, *appError) {
+	s := &UserSettings{
+		Timezone:         req.Timezone,
+		AccountEmailsOff: !req.AccountEmails,
+		PunchEmailsOff:   !req.PunchEmails,
+		DefaultProject:   req.DefaultProject,
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return nil, formValueError(err, "timezone", `The "%s" parameter must be a time zone like Asia/Tokyo`)
+		}
+	}
+	if req.Locale != "" {
+		l, ok := parseLocale(req.Locale)
+		if !ok {
+			return nil, &appError{
+				Error:   errors.New("invalid locale: " + req.Locale),
+				Message: `The "locale" parameter must be en, ja or empty`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		s.Locale = string(l)
+	}
+	if s.DefaultProject != current.DefaultProject {
+		if appErr := checkPunchProject(c, s.DefaultProject); appErr != nil {
+			return nil, appErr
+		}
+	}
+	if appErr := putUserSettings(c, email, s); appErr != nil {
+		return nil, appErr
+	}
+	return s, nil
+}
+
+// defaultPunchProject returns the default project of the settings loaded
+// for r, or 0 when there is none or it has been archived or deleted since
+// it was chosen.
+func defaultPunchProject(c appengine.Context, r *http.Request) int64 {
+	s := requestUserSettings(r)
+	if s == nil || s.DefaultProject == 0 {
+		return 0
+	}
+	if appErr := checkPunchProject(c, s.DefaultProject); appErr != nil {
+		c.Infof("ignoring the default project: %v", appErr.Error)
+		return 0
+	}
+	return s.DefaultProject
+}
+
+func apiMySettingsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	email := user.Current(c).Email
+	s, err := getUserSettings(c, email)
+	if err != nil {
+		return nil, userSettingsError(err)
+	}
+	switch r.Method {
+	case "GET":
+		return newUserSettingsResponse(s), nil
+
+	case "PUT", "POST":
+		// Settings that aren't given keep their value. An empty timezone
+		// or locale goes back to following the browser.
+		current := newUserSettingsResponse(s).Settings
+		req := UpdateUserSettingsRequest{
+			Timezone:       current.Timezone,
+			Locale:         current.Locale,
+			AccountEmails:  current.AccountEmails,
+			PunchEmails:    current.PunchEmails,
+			DefaultProject: current.DefaultProject,
+		}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		if _, ok := r.Form["timezone"]; ok {
+			req.Timezone = r.FormValue("timezone")
+		}
+		if _, ok := r.Form["locale"]; ok {
+			req.Locale = r.FormValue("locale")
+		}
+		s, appErr := updateUserSettings(c, email, s, &req)
+		if appErr != nil {
+			return nil, appErr
+		}
+		return newUserSettingsResponse(s), nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// mySettingsHandler is the settings page. Its form sends every setting.
+func mySettingsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	email := user.Current(c).Email
+	s, err := getUserSettings(c, email)
+	if err != nil {
+		return userSettingsError(err)
+	}
+	if r.Method == "POST" {
+		req := UpdateUserSettingsRequest{
+			Timezone:      r.FormValue("timezone"),
+			Locale:        r.FormValue("locale"),
+			AccountEmails: r.FormValue("account_emails") != "",
+			PunchEmails:   r.FormValue("punch_emails") != "",
+		}
+		if v := r.FormValue("default_project"); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return formValueError(err, "default_project", `Failed to parse the "%s" parameter as an integer`)
+			}
+			req.DefaultProject = id
+		}
+		if _, appErr := updateUserSettings(c, email, s, &req); appErr != nil {
+			return appErr
+		}
+		redirect(w, "/my/settings")
+		return nil
+	}
+
+	open, appErr := findOpenProjects(c)
+	if appErr != nil {
+		return appErr
+	}
+	browserTimezone := ""
+	if cookie, err := r.Cookie(timezoneCookieName); err == nil {
+		browserTimezone = cookie.Value
+	}
+	data := map[string]interface{}{
+		"Settings":        newUserSettingsResponse(s).Settings,
+		"Projects":        open,
+		"BrowserTimezone": browserTimezone,
+	}
+	return renderTemplate(c, w, r, settingsTemplate, data)
+}
+
+var settingsTemplate = parsePage("settings")
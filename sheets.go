@@ -0,0 +1,168 @@
+package timecard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"appengine"
+)
+
+// Hour totals are appended to the first sheet of the configured
+// spreadsheet, one row per puncher with the columns
+//
+//	from, to, email, name, hours
+//
+// so that every export adds to the same table.
+
+const sheetsScope = "https://www.googleapis.com/auth/spreadsheets"
+
+type SheetsExportRequest struct {
+	From string `form:"from"`
+	To   string `form:"to"`
+}
+
+type SheetsExportResponse struct {
+	From         string `json:"from"`
+	To           string `json:"to"`
+	Rows         int    `json:"rows"`
+	UpdatedRange string `json:"updated_range"`
+}
+
+// sheetsRows returns the rows of the hour totals of summaries, ordered
+// by email.
+func sheetsRows(from, to string, summaries []DailySummary, names map[string]string) [][]interface{} {
+	totals := make(map[string]time.Duration)
+	for _, s := range summaries {
+		totals[s.Puncher] += s.Worked
+	}
+	emails := make([]string, 0, len(totals))
+	for email := range totals {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	rows := make([][]interface{}, 0, len(emails))
+	for _, email := range emails {
+		hours := float64(totals[email]/time.Minute) / 60
+		rows = append(rows, []interface{}{from, to, email, names[email], fmt.Sprintf("%.2f", hours)})
+	}
+	return rows
+}
+
+func appendSheetRows(c appengine.Context, in *Integrations, rows [][]interface{}) (updatedRange string, err error) {
+	var client *http.Client
+	if in.SheetsCredentials != "" {
+		client, err = serviceAccountClient(c, in.SheetsCredentials, sheetsScope, "")
+	} else {
+		client, err = googleClient(c, sheetsScope)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"values": rows})
+	if err != nil {
+		return "", err
+	}
+	u := "https://sheets.googleapis.com/v4/spreadsheets/" + url.QueryEscape(in.SheetsSpreadsheetID) +
+		"/values/A1:append?valueInputOption=USER_ENTERED&insertDataOption=INSERT_ROWS"
+	resp, err := client.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", googleAPIError("sheets", resp)
+	}
+	var res struct {
+		Updates struct {
+			UpdatedRange string `json:"updatedRange"`
+		} `json:"updates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	return res.Updates.UpdatedRange, nil
+}
+
+func apiAdminSheetsExportHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method != "POST" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	var req SheetsExportRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	in, err := getIntegrations(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the integrations from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if in.SheetsSpreadsheetID == "" {
+		err := errors.New("Google Sheets is not configured")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	now := requestViewer(r).Now()
+	from, to, appErr := statsRange(req.From, req.To, now)
+	if appErr != nil {
+		return nil, appErr
+	}
+	end := to.AddDate(0, 0, 1)
+	sessions, err := findSessions(c, punchQuery{From: from, To: end, Fields: sessionFields})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	policy, err := getOvernightPolicy(c)
+	if err != nil {
+		return nil, overnightPolicyError(err)
+	}
+	_, users, err := findUsers(c, userQuery{})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	names := make(map[string]string, len(users))
+	for _, u := range users {
+		names[u.Email] = u.Name
+	}
+
+	res := SheetsExportResponse{From: from.Format("2006-01-02"), To: to.Format("2006-01-02")}
+	rows := sheetsRows(res.From, res.To, summarizeDays(sessions, from, end, policy.split(), now), names)
+	res.Rows = len(rows)
+	if len(rows) > 0 {
+		if res.UpdatedRange, err = appendSheetRows(c, in, rows); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to export to Google Sheets",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,183 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// SignInPolicy restricts the app to accounts of the allowed email
+// domains of the OrgSettings; without domains, every account may sign
+// in. Project admins are always let in so that they can't lock
+// themselves out. The domains were kept in a single SignInPolicy entity
+// before OrgSettings, which is only read by getOrgSettings.
+type SignInPolicy struct {
+	AllowedDomains []string
+}
+
+var domainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+
+func signInPolicyKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "SignInPolicy", "default_sign_in_policy", 0, nil)
+}
+
+func getSignInPolicy(c appengine.Context) (*SignInPolicy, error) {
+	s, err := getOrgSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	return &SignInPolicy{AllowedDomains: s.AllowedDomains}, nil
+}
+
+func putSignInPolicy(c appengine.Context, policy *SignInPolicy) error {
+	_, err := changeOrgSettings(c, func(s *OrgSettings) error {
+		s.AllowedDomains = policy.AllowedDomains
+		return nil
+	})
+	return err
+}
+
+func emailDomain(email string) string {
+	return strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+}
+
+func (p *SignInPolicy) allows(email string) bool {
+	if len(p.AllowedDomains) == 0 {
+		return true
+	}
+	domain := emailDomain(email)
+	for _, d := range p.AllowedDomains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignIn fails requests from accounts outside the allowed domains.
+func checkSignIn(c appengine.Context) *appError {
+	if user.IsAdmin(c) {
+		return nil
+	}
+	policy, err := getSignInPolicy(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the sign-in policy from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if email := user.Current(c).Email; !policy.allows(email) {
+		return &appError{
+			Error:   fmt.Errorf("%s is outside the allowed domains", email),
+			Message: "The account %s can't use this timecard. Sign in with your work account, or contact your admin",
+			Args:    []interface{}{email},
+			Code:    http.StatusForbidden,
+		}
+	}
+	return nil
+}
+
+// handleSignInError sends the error of checkSignIn, as a page with a link
+// to sign in with another account to browsers. w must come from
+// startRequestLog.
+func handleSignInError(c appengine.Context, w http.ResponseWriter, r *http.Request, e *appError) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") || e.Code != http.StatusForbidden {
+		handleAppError(c, w, r, e)
+		return
+	}
+	if l, ok := w.(*requestLogger); ok {
+		l.fail(e.Error)
+	}
+	logoutURL, err := user.LogoutURL(c, r.URL.String())
+	if err != nil {
+		c.Errorf("failed to make the logout URL: %v", err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(e.Code)
+	data := map[string]interface{}{
+		"Message":   e.localMessage(r),
+		"LogoutURL": logoutURL,
+	}
+	if appErr := renderTemplate(c, w, r, signInDeniedTemplate, data); appErr != nil {
+		c.Errorf("failed to render the sign-in denied page: %v", appErr.Error)
+	}
+}
+
+var signInDeniedTemplate = parsePage("signin-denied")
+
+type SignInPolicyJSON struct {
+	AllowedDomains []string `json:"allowed_domains"`
+}
+
+type SignInPolicyResponse struct {
+	SignInPolicy SignInPolicyJSON `json:"sign_in_policy"`
+}
+
+type UpdateSignInPolicyRequest struct {
+	// AllowedDomains is separated by commas or spaces. An empty list
+	// lets every account in.
+	AllowedDomains string `form:"allowed_domains"`
+}
+
+func newSignInPolicyResponse(p *SignInPolicy) SignInPolicyResponse {
+	domains := p.AllowedDomains
+	if domains == nil {
+		domains = []string{}
+	}
+	return SignInPolicyResponse{SignInPolicy: SignInPolicyJSON{AllowedDomains: domains}}
+}
+
+func apiAdminSignInPolicyHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	policy, err := getSignInPolicy(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the sign-in policy from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if r.Method == "GET" {
+		return newSignInPolicyResponse(policy), nil
+	} else if r.Method == "PUT" || r.Method == "POST" {
+		req := UpdateSignInPolicyRequest{AllowedDomains: strings.Join(policy.AllowedDomains, ",")}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		// decodeForm skips empty values, but an empty list is how every
+		// account is let in again.
+		if _, ok := r.Form["allowed_domains"]; ok {
+			req.AllowedDomains = r.FormValue("allowed_domains")
+		}
+		domains, appErr := parseAllowedDomains(req.AllowedDomains)
+		if appErr != nil {
+			return nil, appErr
+		}
+		policy = &SignInPolicy{AllowedDomains: domains}
+		if appErr := checkAllowedDomains(c, policy); appErr != nil {
+			return nil, appErr
+		}
+
+		if err := putSignInPolicy(c, policy); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the sign-in policy to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newSignInPolicyResponse(policy), nil
+	} else {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Service worker of the timecard. It is served from /sw.js so that its
+// scope covers the whole app.
+//
+// Pages are fetched from the network first and fall back to the last
+// cached copy when offline; shared assets are served from the cache.
+// Punches made while offline are queued by timecard.js, not here.
+
+var CACHE = 'timecard-v1';
+var ASSETS = [
+  '/',
+  '/static/css/timecard.css',
+  '/static/js/timecard.js',
+  '/static/manifest.json'
+];
+
+self.addEventListener('install', function(event) {
+  event.waitUntil(caches.open(CACHE).then(function(cache) {
+    return cache.addAll(ASSETS);
+  }));
+});
+
+self.addEventListener('activate', function(event) {
+  event.waitUntil(caches.keys().then(function(keys) {
+    return Promise.all(keys.filter(function(key) {
+      return key !== CACHE;
+    }).map(function(key) {
+      return caches.delete(key);
+    }));
+  }));
+});
+
+self.addEventListener('fetch', function(event) {
+  var request = event.request;
+  if (request.method !== 'GET' || new URL(request.url).origin !== location.origin) {
+    return;
+  }
+  if (request.url.indexOf('/static/') >= 0) {
+    event.respondWith(caches.match(request).then(function(cached) {
+      return cached || fetch(request);
+    }));
+    return;
+  }
+  if (request.mode === 'navigate') {
+    event.respondWith(fetch(request).then(function(response) {
+      if (response.ok) {
+        var copy = response.clone();
+        caches.open(CACHE).then(function(cache) {
+          cache.put(request, copy);
+        });
+      }
+      return response;
+    }).catch(function() {
+      return caches.match(request).then(function(cached) {
+        return cached || caches.match('/');
+      });
+    }));
+  }
+});
@@ -0,0 +1,165 @@
+// Scripts shared by all pages.
+(function() {
+  // Report the browser time zone so that the server renders times and
+  // groups days in it.
+  if (window.Intl && document.cookie.indexOf('timezone=') < 0) {
+    document.cookie = 'timezone=' + Intl.DateTimeFormat().resolvedOptions().timeZone + '; path=/; max-age=31536000';
+  }
+
+  if ('serviceWorker' in navigator) {
+    navigator.serviceWorker.register('/sw.js');
+  }
+
+  // Punch forms marked with data-punch-type are sent through the API
+  // with the time of the click and an idempotency key. Punches
+  // that can't be sent are queued in localStorage and retried when the
+  // browser is back online; the key makes a retry of a punch that did
+  // reach the server harmless.
+  var QUEUE = 'timecard.punchQueue';
+
+  function loadQueue() {
+    try {
+      return JSON.parse(localStorage.getItem(QUEUE)) || [];
+    } catch (e) {
+      return [];
+    }
+  }
+
+  function saveQueue(queue) {
+    localStorage.setItem(QUEUE, JSON.stringify(queue));
+    var status = document.getElementById('punch-queue');
+    if (status) {
+      status.hidden = queue.length === 0;
+      status.querySelector('.count').textContent = queue.length;
+    }
+  }
+
+  function newKey() {
+    var bytes = new Uint8Array(16);
+    crypto.getRandomValues(bytes);
+    return Array.prototype.map.call(bytes, function(b) {
+      return ('0' + b.toString(16)).slice(-2);
+    }).join('');
+  }
+
+  function send(punch) {
+    var body = 'type=' + encodeURIComponent(punch.type) +
+      '&time=' + encodeURIComponent(punch.time) +
+      '&idempotency_key=' + encodeURIComponent(punch.key);
+    if (punch.project) {
+      body += '&project=' + encodeURIComponent(punch.project);
+    }
+    return fetch('/api/v1/my/punches', {
+      method: 'POST',
+      credentials: 'same-origin',
+      headers: {'Content-Type': 'application/x-www-form-urlencoded'},
+      body: body
+    }).then(function(response) {
+      // A 4xx answer won't get better by retrying, so drop the punch.
+      if (response.status >= 500) {
+        throw new Error(response.statusText);
+      }
+      return response;
+    });
+  }
+
+  var flushing = false;
+
+  function flush() {
+    var queue = loadQueue();
+    if (flushing || queue.length === 0 || !navigator.onLine) {
+      return Promise.resolve(false);
+    }
+    flushing = true;
+    return send(queue[0]).then(function() {
+      saveQueue(loadQueue().slice(1));
+      flushing = false;
+      return flush().then(function() {
+        return true;
+      });
+    }, function() {
+      flushing = false;
+      return false;
+    });
+  }
+
+  // The Arrive and Leave buttons allow the punch that follows the last
+  // one known: one made on this page, else the last queued one, else
+  // the status rendered by the server. A page served from the cache
+  // while offline may render an old status, so then it isn't trusted.
+  var lastType = null;
+
+  function updateButtons() {
+    var buttons = document.querySelector('.punch-buttons');
+    if (!buttons) {
+      return;
+    }
+    var queue = loadQueue();
+    var type = lastType;
+    if (!type && queue.length > 0) {
+      type = queue[queue.length - 1].type;
+    }
+    if (!type && navigator.onLine) {
+      type = buttons.getAttribute('data-status') === 'in' ? 'arrival' : 'leave';
+    }
+    var forms = buttons.querySelectorAll('form[data-punch-type]');
+    Array.prototype.forEach.call(forms, function(form) {
+      form.querySelector('button').disabled = type !== null && form.getAttribute('data-punch-type') === type;
+    });
+  }
+
+  document.addEventListener('submit', function(e) {
+    var form = e.target;
+    var type = form.getAttribute('data-punch-type');
+    if (!type || !window.fetch || !window.localStorage || !window.crypto) {
+      return;
+    }
+    e.preventDefault();
+    // The key rendered into the form is only for posts made without
+    // this script: the page isn't reloaded while offline, so every punch
+    // queued here needs a key of its own. The button is disabled until
+    // the next punch, so a double click still makes one punch.
+    var project = form.elements.project;
+    var queue = loadQueue();
+    queue.push({
+      type: type,
+      time: new Date().toISOString(),
+      key: newKey(),
+      project: project ? project.value : ''
+    });
+    saveQueue(queue);
+    lastType = type;
+    updateButtons();
+    flush().then(function(sent) {
+      if (sent) {
+        location.reload();
+      }
+    });
+  });
+
+  // The bell in the header shows the number of unread notifications.
+  function showUnread() {
+    var count = document.querySelector('header .notifications .count');
+    if (!count || !window.fetch) {
+      return;
+    }
+    fetch('/api/v1/my/notifications?limit=0', {credentials: 'same-origin'}).then(function(response) {
+      return response.ok ? response.json() : {unread: 0};
+    }).then(function(res) {
+      count.hidden = res.unread === 0;
+      count.textContent = res.unread;
+    }, function() {});
+  }
+
+  window.addEventListener('online', function() {
+    updateButtons();
+    flush();
+  });
+  window.addEventListener('offline', updateButtons);
+  document.addEventListener('DOMContentLoaded', function() {
+    saveQueue(loadQueue());
+    updateButtons();
+    flush();
+    showUnread();
+  });
+})();
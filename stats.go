@@ -0,0 +1,207 @@
+package timecard
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/user"
+)
+
+const (
+	defaultStatsDays = 28
+	maxStatsDays     = 366
+)
+
+type StatsRequest struct {
+	From string `form:"from"`
+	To   string `form:"to"`
+}
+
+type AdminStatsRequest struct {
+	From    string `form:"from"`
+	To      string `form:"to"`
+	Puncher string `form:"puncher"`
+}
+
+// StatsSeriesJSON is a chart series: Labels[i] is the date (the Monday
+// for weeks) of Minutes[i] and Expected[i], the minutes expected by the
+// workweeks.
+type StatsSeriesJSON struct {
+	Labels   []string `json:"labels"`
+	Minutes  []int    `json:"minutes"`
+	Expected []int    `json:"expected"`
+}
+
+type StatsResponse struct {
+	From  string          `json:"from"`
+	To    string          `json:"to"`
+	Days  StatsSeriesJSON `json:"days"`
+	Weeks StatsSeriesJSON `json:"weeks"`
+	// BalanceMinutes is the flex balance: the minutes worked less those
+	// expected, over the days of the range before today.
+	BalanceMinutes int `json:"balance_minutes"`
+}
+
+// table has a row per day.
+func (res *StatsResponse) table() [][]string {
+	rows := [][]string{{"date", "minutes", "expected_minutes"}}
+	for i, label := range res.Days.Labels {
+		rows = append(rows, []string{label, strconv.Itoa(res.Days.Minutes[i]), strconv.Itoa(res.Days.Expected[i])})
+	}
+	return rows
+}
+
+// statsRange returns the dates from and to (both inclusive) of a stats
+// request, defaulting to the last four weeks.
+func statsRange(fromValue, toValue string, now time.Time) (from, to time.Time, appErr *appError) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if to, appErr = parseTimeParam("to", toValue, now.Location()); appErr != nil {
+		return
+	}
+	if to.IsZero() {
+		to = today
+	}
+	if from, appErr = parseTimeParam("from", fromValue, now.Location()); appErr != nil {
+		return
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, 1-defaultStatsDays)
+	}
+	if to.Before(from) || to.Sub(from) >= maxStatsDays*24*time.Hour {
+		appErr = &appError{
+			Error:   fmt.Errorf("invalid stats range %v - %v", from, to),
+			Message: "The range must be from 1 to %d days",
+			Args:    []interface{}{maxStatsDays},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return
+}
+
+// buildStats totals the summaries of all punchers per day and per week,
+// with a zero entry for every day and week of the range. expected
+// returns the time expected of the punchers on a day.
+func buildStats(from, to time.Time, summaries []DailySummary, expected func(day time.Time) time.Duration, now time.Time) *StatsResponse {
+	byDate := make(map[string]time.Duration)
+	for _, s := range summaries {
+		byDate[s.Date] += s.Worked
+	}
+
+	res := &StatsResponse{
+		From:  from.Format("2006-01-02"),
+		To:    to.Format("2006-01-02"),
+		Days:  StatsSeriesJSON{Labels: []string{}, Minutes: []int{}, Expected: []int{}},
+		Weeks: StatsSeriesJSON{Labels: []string{}, Minutes: []int{}, Expected: []int{}},
+	}
+	today := startOfDay(now)
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		label := d.Format("2006-01-02")
+		minutes := int(byDate[label] / time.Minute)
+		expectedMinutes := int(expected(d) / time.Minute)
+		res.Days.Labels = append(res.Days.Labels, label)
+		res.Days.Minutes = append(res.Days.Minutes, minutes)
+		res.Days.Expected = append(res.Days.Expected, expectedMinutes)
+		if d.Before(today) {
+			res.BalanceMinutes += minutes - expectedMinutes
+		}
+
+		week := weekStart(d).Format("2006-01-02")
+		if n := len(res.Weeks.Labels); n == 0 || res.Weeks.Labels[n-1] != week {
+			res.Weeks.Labels = append(res.Weeks.Labels, week)
+			res.Weeks.Minutes = append(res.Weeks.Minutes, 0)
+			res.Weeks.Expected = append(res.Weeks.Expected, 0)
+		}
+		res.Weeks.Minutes[len(res.Weeks.Minutes)-1] += minutes
+		res.Weeks.Expected[len(res.Weeks.Expected)-1] += expectedMinutes
+	}
+	return res
+}
+
+// expectedFunc returns a function giving the time expected of puncher
+// on a day, or of all enabled users when puncher is empty.
+func expectedFunc(c appengine.Context, puncher string) (func(day time.Time) time.Duration, *appError) {
+	ww, err := findWorkweeks(c)
+	if err != nil {
+		return nil, workweekError(err)
+	}
+	holidays, err := findHolidays(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the holidays from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	punchers := []string{puncher}
+	if puncher == "" {
+		enabled := true
+		_, users, err := findUsers(c, userQuery{Enabled: &enabled})
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch users data from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		punchers = punchers[:0]
+		for _, u := range users {
+			punchers = append(punchers, u.Email)
+		}
+	}
+	return func(day time.Time) time.Duration {
+		var d time.Duration
+		for _, p := range punchers {
+			d += ww.of(p).expected(day, holidays)
+		}
+		return d
+	}, nil
+}
+
+func findStats(c appengine.Context, now time.Time, puncher, fromValue, toValue string) (*StatsResponse, *appError) {
+	from, to, appErr := statsRange(fromValue, toValue, now)
+	if appErr != nil {
+		return nil, appErr
+	}
+	end := to.AddDate(0, 0, 1)
+	sessions, err := findSessions(c, punchQuery{
+		Puncher: puncher,
+		From:    from,
+		To:      end,
+		Fields:  sessionFields,
+	})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	policy, err := getOvernightPolicy(c)
+	if err != nil {
+		return nil, overnightPolicyError(err)
+	}
+	expected, appErr := expectedFunc(c, puncher)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return buildStats(from, to, summarizeDays(sessions, from, end, policy.split(), now), expected, now), nil
+}
+
+func apiMyStatsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	var req StatsRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	return findStats(c, requestViewer(r).Now(), user.Current(c).Email, req.From, req.To)
+}
+
+func apiAdminStatsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	var req AdminStatsRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	return findStats(c, requestViewer(r).Now(), req.Puncher, req.From, req.To)
+}
@@ -0,0 +1,44 @@
+package timecard
+
+import (
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/user"
+)
+
+// A puncher is in when their latest punch is an arrival, since the time
+// of that arrival, and out otherwise.
+
+type StatusResponse struct {
+	Puncher string `json:"puncher"`
+	In      bool   `json:"in"`
+	// Since is the time of the latest punch, which is absent when the
+	// puncher has never punched.
+	Since     *time.Time `json:"since,omitempty"`
+	LastPunch *PunchJSON `json:"last_punch,omitempty"`
+}
+
+func findStatus(c appengine.Context, puncher string) (*StatusResponse, *appError) {
+	keys, punches, err := findPunches(c, punchQuery{Puncher: puncher, Newest: true, Limit: 1})
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	res := &StatusResponse{Puncher: puncher}
+	if len(punches) > 0 {
+		p := newPunchJSON(keys[0], &punches[0])
+		res.In = p.Type == "arrival"
+		res.Since = &p.Time
+		res.LastPunch = &p
+	}
+	return res, nil
+}
+
+func apiMyStatusHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	return findStatus(c, user.Current(c).Email)
+}
@@ -0,0 +1,330 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// punchQuery selects punches. Zero-valued fields don't restrict the
+// result.
+type punchQuery struct {
+	Puncher string
+	Type    string
+	From    time.Time // inclusive
+	To      time.Time // exclusive
+	Limit   int
+	// Newest returns the latest punches first.
+	Newest bool
+	// Cursor continues a query where a previous page ended. Used by
+	// findPunchPage, which needs a positive Limit.
+	Cursor string
+	// IncludeDeleted returns punches in the trash too.
+	IncludeDeleted bool
+	// Fields makes findPunches load only these properties, which is
+	// cheaper than loading whole entities. The other fields of the
+	// returned punches are zero, except Puncher and Type which are set
+	// from the filters above.
+	Fields []string
+}
+
+// sessionFields are the properties needed to pair punches into sessions.
+// Project isn't one of them since projecting it would leave out the
+// punches stored before projects existed.
+var sessionFields = []string{"Puncher", "Type", "Time"}
+
+func (pq punchQuery) query(c appengine.Context) *datastore.Query {
+	q := datastore.NewQuery("Punch").Ancestor(punchKey(c))
+	if pq.Puncher != "" {
+		q = q.Filter("Puncher =", pq.Puncher)
+	}
+	if pq.Type != "" {
+		q = q.Filter("Type =", pq.Type)
+	}
+	if !pq.From.IsZero() {
+		q = q.Filter("Time >=", pq.From)
+	}
+	if !pq.To.IsZero() {
+		q = q.Filter("Time <", pq.To)
+	}
+	if pq.Newest {
+		q = q.Order("-Time")
+	} else {
+		q = q.Order("Time")
+	}
+	// Punches stored before the trash existed have no DeletedAt to filter
+	// on, so deleted punches are skipped while iterating and the limit
+	// can only be left to the datastore when they are included.
+	if pq.Limit > 0 && pq.IncludeDeleted {
+		q = q.Limit(pq.Limit)
+	}
+	if len(pq.Fields) > 0 {
+		// The datastore doesn't project properties filtered by equality.
+		var fields []string
+		for _, f := range pq.Fields {
+			if (f == "Puncher" && pq.Puncher != "") || (f == "Type" && pq.Type != "") {
+				continue
+			}
+			fields = append(fields, f)
+		}
+		if len(fields) > 0 {
+			q = q.Project(fields...)
+		} else {
+			q = q.KeysOnly()
+		}
+	}
+	return q
+}
+
+// deletedPunchIDs returns the IDs of the punches in the trash. Projected
+// punches have no DeletedAt to check, and projecting it would leave out
+// the punches stored before the trash existed, so they are checked
+// against this keys-only query instead.
+func deletedPunchIDs(c appengine.Context) (map[int64]bool, error) {
+	q := datastore.NewQuery("Punch").Ancestor(punchKey(c)).Filter("DeletedAt >", time.Time{}).KeysOnly()
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int64]bool, len(keys))
+	for _, k := range keys {
+		ids[k.IntID()] = true
+	}
+	return ids, nil
+}
+
+// startQuerySpan starts the trace span of a datastore query.
+func startQuerySpan(c appengine.Context, name string, query interface{}) *span {
+	s := startSpan(c, name)
+	s.set("db.system", "datastore")
+	s.set("db.statement", fmt.Sprintf("%+v", query))
+	return s
+}
+
+func findPunches(c appengine.Context, pq punchQuery) (_ []*datastore.Key, _ []Punch, err error) {
+	s := startQuerySpan(c, "findPunches", pq)
+	defer func() { s.finish(err) }()
+	projected := len(pq.Fields) > 0
+	var deleted map[int64]bool
+	if projected && !pq.IncludeDeleted {
+		if deleted, err = deletedPunchIDs(c); err != nil {
+			return nil, nil, err
+		}
+	}
+	var keys []*datastore.Key
+	var punches []Punch
+	for t := pq.query(c).Run(c); pq.Limit == 0 || len(punches) < pq.Limit; {
+		var p Punch
+		key, err := t.Next(&p)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if (p.Deleted() || deleted[key.IntID()]) && !pq.IncludeDeleted {
+			continue
+		}
+		if projected {
+			if pq.Puncher != "" {
+				p.Puncher = pq.Puncher
+			}
+			if pq.Type != "" {
+				p.Type = pq.Type
+			}
+		}
+		keys = append(keys, key)
+		punches = append(punches, p)
+	}
+	return keys, punches, nil
+}
+
+// findPunchPage returns up to pq.Limit punches starting at pq.Cursor and
+// the cursor of the next page, which is empty on the last page.
+func findPunchPage(c appengine.Context, pq punchQuery) (_ []*datastore.Key, _ []Punch, _ string, err error) {
+	s := startQuerySpan(c, "findPunchPage", pq)
+	defer func() { s.finish(err) }()
+	limit := pq.Limit
+	pq.Limit++
+	q := pq.query(c)
+	if pq.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(pq.Cursor)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		q = q.Start(cursor)
+	}
+
+	var keys []*datastore.Key
+	var punches []Punch
+	var next string
+	for t := q.Run(c); ; {
+		if len(punches) == limit {
+			cursor, err := t.Cursor()
+			if err != nil {
+				return nil, nil, "", err
+			}
+			// Look past deleted punches for one more to show, so that the
+			// last page isn't followed by an empty one.
+			for {
+				var p Punch
+				if _, err := t.Next(&p); err == datastore.Done {
+					break
+				} else if err != nil {
+					return nil, nil, "", err
+				}
+				if !p.Deleted() || pq.IncludeDeleted {
+					next = cursor.String()
+					break
+				}
+			}
+			break
+		}
+		var p Punch
+		key, err := t.Next(&p)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, nil, "", err
+		}
+		if p.Deleted() && !pq.IncludeDeleted {
+			continue
+		}
+		keys = append(keys, key)
+		punches = append(punches, p)
+	}
+	return keys, punches, next, nil
+}
+
+// userQuery selects users. Zero-valued fields don't restrict the result.
+// Users are few enough to be filtered and sorted in memory, which is also
+// the only way to match a prefix of either the name or the email.
+type userQuery struct {
+	// Prefix matches the start of the name or the email, ignoring case.
+	Prefix string
+	// Enabled selects only enabled or only disabled users.
+	Enabled *bool
+	// Sort is a key of userSorts, prefixed with "-" for descending
+	// order. Users are sorted by name by default.
+	Sort string
+	// Cursor continues after the user a previous page ended with. Used
+	// by findUserPage, which needs a positive Limit.
+	Cursor string
+	Limit  int
+}
+
+var userSorts = map[string]func(a, b *User) bool{
+	"name":    func(a, b *User) bool { return a.Name < b.Name },
+	"email":   func(a, b *User) bool { return a.Email < b.Email },
+	"updated": func(a, b *User) bool { return a.Updated.Before(b.Updated) },
+}
+
+func validUserSort(s string) bool {
+	_, ok := userSorts[strings.TrimPrefix(s, "-")]
+	return s == "" || ok
+}
+
+type usersBy struct {
+	keys  []*datastore.Key
+	users []User
+	less  func(a, b *User) bool
+}
+
+func (u usersBy) Len() int           { return len(u.users) }
+func (u usersBy) Less(i, j int) bool { return u.less(&u.users[i], &u.users[j]) }
+func (u usersBy) Swap(i, j int) {
+	u.keys[i], u.keys[j] = u.keys[j], u.keys[i]
+	u.users[i], u.users[j] = u.users[j], u.users[i]
+}
+
+func (uq userQuery) match(u *User) bool {
+	if uq.Enabled != nil && u.Enabled != *uq.Enabled {
+		return false
+	}
+	prefix := strings.ToLower(uq.Prefix)
+	return strings.HasPrefix(strings.ToLower(u.Name), prefix) ||
+		strings.HasPrefix(strings.ToLower(u.Email), prefix)
+}
+
+func findUsers(c appengine.Context, uq userQuery) (_ []*datastore.Key, _ []User, err error) {
+	s := startQuerySpan(c, "findUsers", uq)
+	defer func() { s.finish(err) }()
+	q := datastore.NewQuery("User").Ancestor(punchKey(c)).Order("Name")
+	var all []User
+	allKeys, err := q.GetAll(c, &all)
+	if err != nil {
+		return nil, nil, err
+	}
+	var keys []*datastore.Key
+	var users []User
+	for i := range all {
+		if uq.match(&all[i]) {
+			keys = append(keys, allKeys[i])
+			users = append(users, all[i])
+		}
+	}
+	if uq.Sort != "" && uq.Sort != "name" {
+		less := userSorts[strings.TrimPrefix(uq.Sort, "-")]
+		if strings.HasPrefix(uq.Sort, "-") {
+			asc := less
+			less = func(a, b *User) bool { return asc(b, a) }
+		}
+		sort.Stable(usersBy{keys, users, less})
+	}
+	return keys, users, nil
+}
+
+var errBadUserCursor = errors.New("bad user cursor")
+
+// findUserPage returns up to uq.Limit users after uq.Cursor, the cursor
+// of the next page, which is empty on the last page, and the number of
+// users matching uq on all pages. The cursor is the ID of the last user
+// of a page, which stays valid as long as that user exists and matches,
+// while users are added or removed around it.
+func findUserPage(c appengine.Context, uq userQuery) (_ []*datastore.Key, _ []User, next string, total int, err error) {
+	keys, users, err := findUsers(c, uq)
+	if err != nil {
+		return nil, nil, "", 0, err
+	}
+	total = len(users)
+	start := 0
+	if uq.Cursor != "" {
+		id, err := strconv.ParseInt(uq.Cursor, 10, 64)
+		start = -1
+		for i, key := range keys {
+			if err == nil && key.IntID() == id {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return nil, nil, "", 0, errBadUserCursor
+		}
+	}
+	end := start + uq.Limit
+	if end < total {
+		next = strconv.FormatInt(keys[end-1].IntID(), 10)
+	} else {
+		end = total
+	}
+	return keys[start:end], users[start:end], next, total, nil
+}
+
+// findUserByEmail returns the User entity with the given email, or nil
+// if there is none.
+func findUserByEmail(c appengine.Context, email string) (_ *datastore.Key, _ *User, err error) {
+	s := startQuerySpan(c, "findUserByEmail", email)
+	defer func() { s.finish(err) }()
+	q := datastore.NewQuery("User").Ancestor(punchKey(c)).Filter("Email =", email).Limit(1)
+	var users []User
+	keys, err := q.GetAll(c, &users)
+	if err != nil || len(users) == 0 {
+		return nil, nil, err
+	}
+	return keys[0], &users[0], nil
+}
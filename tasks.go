@@ -0,0 +1,55 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+
+	"appengine"
+)
+
+// taskHandler serves requests from the task queue and cron. Returning an
+// error makes the task queue retry the task. Tasks run in the namespace
+// they were added in by addTask, and cron requests run in the default
+// namespace after being passed on to every tenant.
+type taskHandler func(appengine.Context, http.ResponseWriter, *http.Request) *appError
+
+func (fn taskHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	l := startRequestLog(c, w, r)
+	l.slow = slowTaskThreshold
+	defer l.finish()
+	// App Engine removes these headers from external requests.
+	if r.Header.Get("X-AppEngine-QueueName") == "" && r.Header.Get("X-AppEngine-Cron") != "true" {
+		err := errors.New("not a task queue or cron request")
+		handleAppError(c, l, r, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusForbidden,
+		})
+		return
+	}
+	if ns := r.Header.Get(tenantHeader); ns != "" {
+		var err error
+		if c, err = appengine.Namespace(c, ns); err != nil {
+			handleAppError(c, l, r, &appError{
+				Error:   err,
+				Message: "Failed to fetch the tenants from the datastore",
+				Code:    http.StatusInternalServerError,
+			})
+			return
+		}
+	} else if r.Header.Get("X-AppEngine-Cron") == "true" {
+		if err := fanOutCron(c, r); err != nil {
+			handleAppError(c, l, r, &appError{
+				Error:   err,
+				Message: "Failed to fetch the tenants from the datastore",
+				Code:    http.StatusInternalServerError,
+			})
+			return
+		}
+	}
+
+	if e := fn(c, l, r); e != nil {
+		handleAppError(c, l, r, e)
+	}
+}
@@ -0,0 +1,45 @@
+package timecard
+
+import (
+	"html/template"
+	"net/http"
+	"path/filepath"
+
+	"appengine"
+)
+
+// Pages are the files under templates/ with the same name, each parsed
+// together with the layout defining the "layout" template. Pages define
+// the blocks of the layout: "title", "head" and "content".
+
+const templateDir = "templates"
+
+func parsePage(name string) *template.Template {
+	return template.Must(template.New(name).Funcs(templateFuncs).ParseFiles(
+		filepath.Join(templateDir, "layout.html"),
+		filepath.Join(templateDir, name+".html"),
+	))
+}
+
+// renderTemplate executes the layout of a copy of t whose functions
+// format for the viewer of r and show the current theme. t itself is
+// never executed so that it can be cloned.
+func renderTemplate(c appengine.Context, w http.ResponseWriter, r *http.Request, t *template.Template, data interface{}) *appError {
+	theme := currentTheme(c)
+	funcs := requestViewer(r).funcs()
+	funcs["theme"] = func() *Theme { return theme }
+
+	clone, err := t.Clone()
+	if err == nil {
+		err = clone.Funcs(funcs).ExecuteTemplate(w, "layout", data)
+	}
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to execute the %s template",
+			Args:    []interface{}{t.Name()},
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/taskqueue"
+	"appengine/user"
+)
+
+// One deployment can serve several companies, each a Tenant with its own
+// datastore and memcache namespace. A request belongs to the tenant
+// listing the domain of the signed-in account, and to the default
+// namespace, the original company, when no tenant does. Everything under
+// a tenant, including its admins and its settings, is separate from the
+// other tenants. Project admins look into any tenant by choosing it on
+// /admin/tenant.
+//
+// Tenant entities live in the default namespace. Tasks carry the
+// namespace they were added in, and cron requests are fanned out to every
+// tenant.
+
+type Tenant struct {
+	Name    string
+	Domains []string
+}
+
+const (
+	tenantsCacheKey    = "tenants"
+	tenantCookieName   = "tenant"
+	tenantHeader       = "X-Timecard-Namespace"
+	tenantSwitchPath   = "/admin/tenant"
+	maxNamespaceLength = 100
+)
+
+var namespacePattern = regexp.MustCompile(`^[0-9A-Za-z._-]+$`)
+
+// tenantKey needs c in the default namespace, where tenants are kept.
+func tenantKey(c appengine.Context, namespace string) *datastore.Key {
+	return datastore.NewKey(c, "Tenant", namespace, 0, nil)
+}
+
+// contextNamespace returns the namespace c is in.
+func contextNamespace(c appengine.Context) string {
+	return punchKey(c).Namespace()
+}
+
+// getTenants returns every tenant by namespace. c must be in the default
+// namespace.
+func getTenants(c appengine.Context) (map[string]Tenant, error) {
+	tenants := make(map[string]Tenant)
+	if _, err := memcache.Gob.Get(c, tenantsCacheKey, &tenants); err == nil {
+		return tenants, nil
+	} else if err != memcache.ErrCacheMiss {
+		c.Warningf("failed to get the tenants from memcache: %v", err)
+	}
+
+	var list []Tenant
+	keys, err := datastore.NewQuery("Tenant").GetAll(c, &list)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		tenants[keys[i].StringID()] = list[i]
+	}
+	if err := memcache.Gob.Set(c, &memcache.Item{Key: tenantsCacheKey, Object: tenants}); err != nil {
+		c.Warningf("failed to set the tenants to memcache: %v", err)
+	}
+	return tenants, nil
+}
+
+// requestNamespace returns the namespace of the tenant r belongs to.
+func requestNamespace(c appengine.Context, r *http.Request) (string, error) {
+	tenants, err := getTenants(c)
+	if err != nil || len(tenants) == 0 {
+		return "", err
+	}
+	if user.IsAdmin(c) {
+		if cookie, err := r.Cookie(tenantCookieName); err == nil {
+			if _, ok := tenants[cookie.Value]; ok {
+				return cookie.Value, nil
+			}
+		}
+	}
+	domain := emailDomain(user.Current(c).Email)
+	for ns, t := range tenants {
+		for _, d := range t.Domains {
+			if d == domain {
+				return ns, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// tenantContext returns c in the namespace of the tenant of r.
+func tenantContext(c appengine.Context, r *http.Request) (appengine.Context, *appError) {
+	ns, err := requestNamespace(c, r)
+	if err == nil && ns != "" {
+		c, err = appengine.Namespace(c, ns)
+	}
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the tenants from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return c, nil
+}
+
+// addTask adds t to queue so that it runs in c's namespace.
+func addTask(c appengine.Context, t *taskqueue.Task, queue string) error {
+	if ns := contextNamespace(c); ns != "" {
+		if t.Header == nil {
+			t.Header = make(http.Header)
+		}
+		t.Header.Set(tenantHeader, ns)
+	}
+	_, err := taskqueue.Add(c, t, queue)
+	return err
+}
+
+// fanOutCron runs the cron request r again as a task in every tenant's
+// namespace. c must be in the default namespace.
+func fanOutCron(c appengine.Context, r *http.Request) error {
+	tenants, err := getTenants(c)
+	if err != nil {
+		return err
+	}
+	for ns := range tenants {
+		t := taskqueue.NewPOSTTask(r.URL.Path, nil)
+		t.Header.Set(tenantHeader, ns)
+		if _, err := taskqueue.Add(c, t, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type TenantJSON struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Domains   []string `json:"domains"`
+}
+
+type TenantsResponse struct {
+	Tenants []TenantJSON `json:"tenants"`
+}
+
+type TenantResponse struct {
+	Tenant TenantJSON `json:"tenant"`
+}
+
+type PutTenantRequest struct {
+	Namespace string `form:"namespace"`
+	Name      string `form:"name"`
+	// Domains is separated by commas or spaces.
+	Domains string `form:"domains"`
+}
+
+// apiAdminTenantsHandler lists and saves tenants. Only project admins can
+// use it, since tenant admins only administer their own tenant.
+func apiAdminTenantsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if !user.IsAdmin(c) {
+		err := errors.New("Only project admins can manage tenants")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusForbidden,
+		}
+	}
+	// Tenants are kept in the default namespace.
+	c = appengine.NewContext(r)
+
+	switch r.Method {
+	case "GET":
+		tenants, err := getTenants(c)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the tenants from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		res := TenantsResponse{Tenants: make([]TenantJSON, 0, len(tenants))}
+		for ns, t := range tenants {
+			res.Tenants = append(res.Tenants, TenantJSON{Namespace: ns, Name: t.Name, Domains: t.Domains})
+		}
+		return res, nil
+
+	case "PUT", "POST":
+		var req PutTenantRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		if !namespacePattern.MatchString(req.Namespace) || len(req.Namespace) > maxNamespaceLength {
+			return nil, &appError{
+				Error:   fmt.Errorf("invalid namespace %q", req.Namespace),
+				Message: `The "namespace" parameter may only contain letters, digits, ".", "-" and "_", up to %d characters`,
+				Args:    []interface{}{maxNamespaceLength},
+				Code:    http.StatusBadRequest,
+			}
+		}
+		t := Tenant{Name: req.Name}
+		for _, d := range strings.FieldsFunc(req.Domains, func(r rune) bool { return r == ',' || r == ' ' }) {
+			d = strings.ToLower(strings.TrimPrefix(d, "@"))
+			if !domainPattern.MatchString(d) {
+				return nil, &appError{
+					Error:   errors.New("invalid domain: " + d),
+					Message: `The "domains" parameter must list domains like example.co.jp`,
+					Code:    http.StatusBadRequest,
+				}
+			}
+			t.Domains = append(t.Domains, d)
+		}
+		if t.Domains == nil {
+			t.Domains = []string{}
+		}
+		if _, err := datastore.Put(c, tenantKey(c, req.Namespace), &t); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the tenant to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		if err := memcache.Delete(c, tenantsCacheKey); err != nil && err != memcache.ErrCacheMiss {
+			c.Warningf("failed to delete the tenants from memcache: %v", err)
+		}
+		return TenantResponse{Tenant: TenantJSON{Namespace: req.Namespace, Name: t.Name, Domains: t.Domains}}, nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// adminTenantHandler shows the tenants to project admins and sets the one
+// they look into. An empty or unknown tenant is the default namespace.
+func adminTenantHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	if !user.IsAdmin(c) {
+		err := errors.New("Only project admins can manage tenants")
+		return &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusForbidden,
+		}
+	}
+	if r.Method == "POST" {
+		http.SetCookie(w, &http.Cookie{
+			Name:    tenantCookieName,
+			Value:   r.FormValue("tenant"),
+			Path:    "/",
+			Expires: time.Now().AddDate(0, 0, 1),
+			Secure:  true,
+		})
+		redirect(w, "/")
+		return nil
+	}
+
+	tenants, err := getTenants(appengine.NewContext(r))
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the tenants from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	data := map[string]interface{}{
+		"Tenants": tenants,
+		"Current": contextNamespace(c),
+	}
+	return renderTemplate(c, w, r, tenantTemplate, data)
+}
+
+var tenantTemplate = parsePage("tenant")
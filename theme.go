@@ -0,0 +1,185 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+// Theme is the company branding shown by the page layout. There is a
+// single Theme entity, edited by admins. The company name is the one of
+// the OrgSettings, and is only read from the entity by getOrgSettings.
+type Theme struct {
+	CompanyName     string
+	LogoURL         string
+	PrimaryColor    string
+	BackgroundColor string
+	TextColor       string
+}
+
+var defaultTheme = Theme{
+	PrimaryColor:    "#3367d6",
+	BackgroundColor: "#ffffff",
+	TextColor:       "#222222",
+}
+
+const themeCacheKey = "theme"
+
+func themeKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Theme", "default_theme", 0, nil)
+}
+
+func getTheme(c appengine.Context) (*Theme, error) {
+	s, err := getOrgSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	var theme Theme
+	if _, err := memcache.Gob.Get(c, themeCacheKey, &theme); err == nil {
+		theme.CompanyName = s.CompanyName
+		return &theme, nil
+	} else if err != memcache.ErrCacheMiss {
+		c.Warningf("failed to get the theme from memcache: %v", err)
+	}
+
+	err = datastore.Get(c, themeKey(c), &theme)
+	if err == datastore.ErrNoSuchEntity {
+		theme = defaultTheme
+	} else if err != nil {
+		return nil, err
+	}
+	if err := memcache.Gob.Set(c, &memcache.Item{Key: themeCacheKey, Object: theme}); err != nil {
+		c.Warningf("failed to set the theme to memcache: %v", err)
+	}
+	theme.CompanyName = s.CompanyName
+	return &theme, nil
+}
+
+// currentTheme returns the theme for rendering a page, falling back to
+// the default so that pages still render when the theme can't be read.
+func currentTheme(c appengine.Context) *Theme {
+	theme, err := getTheme(c)
+	if err != nil {
+		c.Errorf("failed to get the theme: %v", err)
+		return &defaultTheme
+	}
+	return theme
+}
+
+func putTheme(c appengine.Context, theme *Theme) error {
+	_, err := changeOrgSettings(c, func(s *OrgSettings) error {
+		s.CompanyName = theme.CompanyName
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	stored := *theme
+	stored.CompanyName = ""
+	if _, err := datastore.Put(c, themeKey(c), &stored); err != nil {
+		return err
+	}
+	if err := memcache.Delete(c, themeCacheKey); err != nil && err != memcache.ErrCacheMiss {
+		c.Warningf("failed to delete the theme from memcache: %v", err)
+	}
+	return nil
+}
+
+type ThemeJSON struct {
+	CompanyName     string `json:"company_name"`
+	LogoURL         string `json:"logo_url"`
+	PrimaryColor    string `json:"primary_color"`
+	BackgroundColor string `json:"background_color"`
+	TextColor       string `json:"text_color"`
+}
+
+type ThemeResponse struct {
+	Theme ThemeJSON `json:"theme"`
+}
+
+type UpdateThemeRequest struct {
+	CompanyName     string `form:"company_name"`
+	LogoURL         string `form:"logo_url"`
+	PrimaryColor    string `form:"primary_color"`
+	BackgroundColor string `form:"background_color"`
+	TextColor       string `form:"text_color"`
+}
+
+func newThemeResponse(t *Theme) ThemeResponse {
+	return ThemeResponse{Theme: ThemeJSON{
+		CompanyName:     t.CompanyName,
+		LogoURL:         t.LogoURL,
+		PrimaryColor:    t.PrimaryColor,
+		BackgroundColor: t.BackgroundColor,
+		TextColor:       t.TextColor,
+	}}
+}
+
+var colorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+func apiAdminThemeHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	theme, err := getTheme(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the theme from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if r.Method == "GET" {
+		return newThemeResponse(theme), nil
+	} else if r.Method == "PUT" || r.Method == "POST" {
+		req := UpdateThemeRequest{
+			CompanyName:     theme.CompanyName,
+			LogoURL:         theme.LogoURL,
+			PrimaryColor:    theme.PrimaryColor,
+			BackgroundColor: theme.BackgroundColor,
+			TextColor:       theme.TextColor,
+		}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		for name, color := range map[string]string{
+			"primary_color":    req.PrimaryColor,
+			"background_color": req.BackgroundColor,
+			"text_color":       req.TextColor,
+		} {
+			if !colorPattern.MatchString(color) {
+				return nil, formValueError(errors.New("invalid color: "+color), name, `The "%s" parameter must be a color like #336699`)
+			}
+		}
+		if req.LogoURL != "" {
+			if u, err := url.Parse(req.LogoURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+				return nil, formValueError(errors.New("invalid logo URL: "+req.LogoURL), "logo_url", `The "%s" parameter must be an http or https URL`)
+			}
+		}
+
+		theme = &Theme{
+			CompanyName:     req.CompanyName,
+			LogoURL:         req.LogoURL,
+			PrimaryColor:    req.PrimaryColor,
+			BackgroundColor: req.BackgroundColor,
+			TextColor:       req.TextColor,
+		}
+		if err := putTheme(c, theme); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the theme to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newThemeResponse(theme), nil
+	} else {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
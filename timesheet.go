@@ -0,0 +1,153 @@
+package timecard
+
+import (
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/user"
+)
+
+type timesheetDay struct {
+	Date    time.Time
+	Arrival time.Time
+	Leave   time.Time
+	Breaks  time.Duration
+	Worked  time.Duration
+	Open    bool
+	// Expected is the time the workweek expects on the day.
+	Expected time.Duration
+}
+
+// timesheet covers the days of a week or a month.
+type timesheet struct {
+	Start    time.Time
+	Days     []timesheetDay
+	Breaks   time.Duration
+	Total    time.Duration
+	Expected time.Duration
+}
+
+// weekStart returns the Monday starting the week of t.
+func weekStart(t time.Time) time.Time {
+	d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return d.AddDate(0, 0, -(int(d.Weekday())+6)%7)
+}
+
+// buildTimesheet makes one row per day from start to end. The arrival is
+// the first of the day and the leave the last; the gaps between the
+// sessions of a day and the breaks deducted from them are its breaks.
+func buildTimesheet(start, end time.Time, sessions []WorkSession, week *Workweek, holidays map[string]string, now time.Time) *timesheet {
+	ts := &timesheet{Start: start}
+	index := make(map[string]int)
+	for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+		index[day.Format("2006-01-02")] = len(ts.Days)
+		ts.Days = append(ts.Days, timesheetDay{Date: day, Expected: week.expected(day, holidays)})
+		ts.Expected += week.expected(day, holidays)
+	}
+	for i := range sessions {
+		s := &sessions[i]
+		n, ok := index[s.Arrival.In(start.Location()).Format("2006-01-02")]
+		if !ok {
+			continue
+		}
+		d := &ts.Days[n]
+		if d.Arrival.IsZero() {
+			d.Arrival = s.Arrival
+		} else if !d.Leave.IsZero() {
+			d.Breaks += s.Arrival.Sub(d.Leave)
+			ts.Breaks += s.Arrival.Sub(d.Leave)
+		}
+		d.Breaks += s.BreakDeducted()
+		ts.Breaks += s.BreakDeducted()
+		d.Leave = s.Leave
+		d.Open = s.Open()
+		d.Worked += s.Duration(now)
+		ts.Total += s.Duration(now)
+	}
+	return ts
+}
+
+// myTimesheetHandler shows a week of my timesheet, or with format=pdf
+// downloads the month to print and sign.
+func myTimesheetHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	if r.FormValue("format") == "pdf" {
+		return myTimesheetPDF(c, w, r)
+	}
+	now := requestViewer(r).Now()
+	start := weekStart(now)
+	if v := r.FormValue("week"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, now.Location())
+		if err != nil {
+			return formValueError(err, "week", `Failed to parse the "%s" parameter as a date (YYYY-MM-DD)`)
+		}
+		start = weekStart(t)
+	}
+
+	email := user.Current(c).Email
+	sessions, err := findSessions(c, punchQuery{
+		Puncher: email,
+		From:    start,
+		To:      start.AddDate(0, 0, 7),
+		Fields:  sessionFields,
+	})
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	ww, err := findWorkweeks(c)
+	if err != nil {
+		return workweekError(err)
+	}
+	holidays, err := findHolidays(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the holidays from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+
+	data := map[string]interface{}{
+		"Timesheet": buildTimesheet(start, start.AddDate(0, 0, 7), sessions, ww.of(email), holidays, now),
+		"Prev":      start.AddDate(0, 0, -7).Format("2006-01-02"),
+		"Next":      start.AddDate(0, 0, 7).Format("2006-01-02"),
+		"Month":     start.Format("2006-01"),
+	}
+	return renderTemplate(c, w, r, timesheetTemplate, data)
+}
+
+// myTimesheetPDF downloads my timesheet of the month parameter, which
+// defaults to this month.
+func myTimesheetPDF(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	v := requestViewer(r)
+	now := v.Now()
+	month, appErr := parseMonth(r.FormValue("month"), now)
+	if appErr != nil {
+		return appErr
+	}
+	email := user.Current(c).Email
+	_, u, err := findUserByEmail(c, email)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if u == nil {
+		u = &User{Email: email}
+	}
+	ts := &timesheets{Period: "month", Start: month, End: month.AddDate(0, 1, 0)}
+	if appErr := ts.addUsers(c, []User{*u}, email, now); appErr != nil {
+		return appErr
+	}
+	writeTimesheetsPDF(c, w, v, ts, "timecard-timesheet-"+month.Format("2006-01"))
+	return nil
+}
+
+var timesheetTemplate = parsePage("timesheet")
@@ -0,0 +1,133 @@
+package timecard
+
+import (
+	"net/http"
+	"time"
+
+	"appengine"
+)
+
+// Labor regulations ask for timesheets printed and signed every month.
+// The PDF has a page per user with the grid of the timesheet page, the
+// totals and lines for the signatures of the employee and the approver.
+
+// The columns of the grid, by their left edges and widths in points.
+var timesheetPDFColumns = []struct {
+	label string
+	x, w  float64
+	right bool
+}{
+	{"Date", 50, 95, false},
+	{"Arrival", 145, 75, false},
+	{"Leave", 220, 75, false},
+	{"Breaks", 295, 80, true},
+	{"Total", 375, 85, true},
+	{"Expected", 460, 85, true},
+}
+
+const (
+	timesheetPDFTop       = 740
+	timesheetPDFRowHeight = 16
+	timesheetPDFFontSize  = 9
+)
+
+// timesheetsPDF lays out a page per user of ts, printed at now.
+func timesheetsPDF(v *viewer, ts *timesheets, now time.Time) *pdfDocument {
+	l := v.Locale
+	period := ts.Start.Format("2006-01")
+	if ts.Period == "week" {
+		period = l.T("Week of %s", ts.Start.Format("2006-01-02"))
+	}
+	doc := &pdfDocument{}
+	for _, u := range ts.Users {
+		p := doc.addPage()
+		p.text(50, 790, 16, l.T("Timesheet")+"  "+period)
+		name := u.Puncher
+		if u.Name != "" {
+			name = u.Name + " <" + u.Puncher + ">"
+		}
+		p.text(50, 765, 11, name)
+
+		first, last := timesheetPDFColumns[0], timesheetPDFColumns[len(timesheetPDFColumns)-1]
+		left, right := first.x, last.x+last.w
+		y := float64(timesheetPDFTop)
+		row := func(cells []string, fill float64) {
+			if fill < 1 {
+				p.fillRect(left, y-timesheetPDFRowHeight, right-left, timesheetPDFRowHeight, fill)
+			}
+			for i, col := range timesheetPDFColumns {
+				if cells[i] == "" {
+					continue
+				}
+				baseline := y - timesheetPDFRowHeight + 5
+				if col.right {
+					p.textRight(col.x+col.w-4, baseline, timesheetPDFFontSize, cells[i])
+				} else {
+					p.text(col.x+4, baseline, timesheetPDFFontSize, cells[i])
+				}
+			}
+			y -= timesheetPDFRowHeight
+			p.line(left, y, right, y, 0.5)
+		}
+
+		p.line(left, y, right, y, 0.5)
+		header := make([]string, len(timesheetPDFColumns))
+		for i, col := range timesheetPDFColumns {
+			header[i] = l.T(col.label)
+		}
+		row(header, 0.85)
+		for _, d := range u.Timesheet.Days {
+			cells := []string{v.formatWeekday(d.Date) + " " + d.Date.Format("01/02"), "", "", "", "", ""}
+			if !d.Arrival.IsZero() {
+				cells[1] = v.formatTime(d.Arrival)
+			}
+			if d.Open {
+				cells[2] = l.T("(in)")
+			} else if !d.Leave.IsZero() {
+				cells[2] = v.formatTime(d.Leave)
+			}
+			if d.Breaks > 0 {
+				cells[3] = v.formatDuration(d.Breaks)
+			}
+			if d.Worked > 0 {
+				cells[4] = v.formatDuration(d.Worked)
+			}
+			if d.Expected > 0 {
+				cells[5] = v.formatDuration(d.Expected)
+			}
+			row(cells, 1)
+		}
+		row([]string{l.T("Total"), "", "",
+			v.formatDuration(u.Timesheet.Breaks), v.formatDuration(u.Timesheet.Total), v.formatDuration(u.Timesheet.Expected)}, 0.93)
+		for _, col := range timesheetPDFColumns {
+			p.line(col.x, timesheetPDFTop, col.x, y, 0.5)
+		}
+		p.line(right, timesheetPDFTop, right, y, 0.5)
+
+		// Lines to sign and date, for the employee and the approver.
+		y -= 60
+		for _, signer := range []struct {
+			label string
+			x     float64
+		}{{"Employee signature", 50}, {"Approver signature", 320}} {
+			p.line(signer.x, y, signer.x+225, y, 0.5)
+			p.text(signer.x, y-12, timesheetPDFFontSize, l.T(signer.label))
+			p.line(signer.x, y-40, signer.x+225, y-40, 0.5)
+			p.text(signer.x, y-52, timesheetPDFFontSize, l.T("Date"))
+		}
+		p.text(50, 40, 8, l.T("Printed %s", v.formatDateTime(now)))
+	}
+	if len(doc.pages) == 0 {
+		doc.addPage().text(50, 790, 11, l.T("No users"))
+	}
+	return doc
+}
+
+// writeTimesheetsPDF downloads the PDF of ts as name.pdf.
+func writeTimesheetsPDF(c appengine.Context, w http.ResponseWriter, v *viewer, ts *timesheets, name string) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.pdf"`)
+	if err := timesheetsPDF(v, ts, time.Now()).write(w); err != nil {
+		c.Errorf("failed to write the timesheets: %v", err)
+	}
+}
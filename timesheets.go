@@ -0,0 +1,276 @@
+package timecard
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"appengine"
+)
+
+// Admins see the timesheets of everyone for a week or a month, and
+// download them as CSV with a row per user and day, or for HR as an Excel
+// workbook with a sheet per user whose totals are formulas.
+
+type TimesheetsRequest struct {
+	// Period is "week" or "month". It defaults to week.
+	Period string `form:"period"`
+	// Date is a day of the period, as 2006-01-02. It defaults to today.
+	Date string `form:"date"`
+	// Puncher limits the timesheets to one user.
+	Puncher string `form:"puncher"`
+}
+
+type userTimesheet struct {
+	Puncher   string
+	Name      string
+	Timesheet *timesheet
+}
+
+type timesheets struct {
+	Period string
+	Start  time.Time
+	// End is the day after the period.
+	End   time.Time
+	Users []userTimesheet
+}
+
+// newTimesheets returns the empty timesheets of the week or the month of
+// date, which defaults to today.
+func newTimesheets(period, date string, now time.Time) (*timesheets, *appError) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if date != "" {
+		t, err := time.ParseInLocation("2006-01-02", date, now.Location())
+		if err != nil {
+			return nil, formValueError(err, "date", `Failed to parse the "%s" parameter as a date (YYYY-MM-DD)`)
+		}
+		day = t
+	}
+	ts := &timesheets{Period: period}
+	switch period {
+	case "", "week":
+		ts.Period = "week"
+		ts.Start = weekStart(day)
+		ts.End = ts.Start.AddDate(0, 0, 7)
+	case "month":
+		ts.Start = time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, day.Location())
+		ts.End = ts.Start.AddDate(0, 1, 0)
+	default:
+		return nil, &appError{
+			Error:   errors.New("invalid timesheet period: " + period),
+			Message: `The "period" parameter must be "week" or "month"`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return ts, nil
+}
+
+// buildTimesheets makes the timesheets of the enabled users, or of
+// req.Puncher, in name order.
+func buildTimesheets(c appengine.Context, req *TimesheetsRequest, now time.Time) (*timesheets, *appError) {
+	ts, appErr := newTimesheets(req.Period, req.Date, now)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	var users []User
+	if req.Puncher != "" {
+		_, u, err := findUserByEmail(c, req.Puncher)
+		if err == nil && u == nil {
+			return nil, &appError{
+				Error:   errors.New("no user for puncher " + req.Puncher),
+				Message: `The "puncher" parameter must be the email of a user`,
+				Code:    http.StatusBadRequest,
+			}
+		} else if err == nil {
+			users = []User{*u}
+		} else {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch users data from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+	} else {
+		enabled := true
+		var err error
+		_, users, err = findUsers(c, userQuery{Enabled: &enabled})
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch users data from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+	}
+	if appErr := ts.addUsers(c, users, req.Puncher, now); appErr != nil {
+		return nil, appErr
+	}
+	return ts, nil
+}
+
+// addUsers adds the timesheets of users. puncher is the email of the only
+// user, or empty.
+func (ts *timesheets) addUsers(c appengine.Context, users []User, puncher string, now time.Time) *appError {
+	sessions, err := findSessions(c, punchQuery{Puncher: puncher, From: ts.Start, To: ts.End, Fields: sessionFields})
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	byPuncher := make(map[string][]WorkSession)
+	for _, s := range sessions {
+		byPuncher[s.Puncher] = append(byPuncher[s.Puncher], s)
+	}
+	ww, err := findWorkweeks(c)
+	if err != nil {
+		return workweekError(err)
+	}
+	holidays, err := findHolidays(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the holidays from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	for _, u := range users {
+		ts.Users = append(ts.Users, userTimesheet{
+			Puncher:   u.Email,
+			Name:      u.Name,
+			Timesheet: buildTimesheet(ts.Start, ts.End, byPuncher[u.Email], ww.of(u.Email), holidays, now),
+		})
+	}
+	return nil
+}
+
+// timesheetsWorkbook lays out a sheet per user: a header row, a row per
+// day and a row of totals summing the days.
+func timesheetsWorkbook(l locale, ts *timesheets) *xlsxWorkbook {
+	wb := &xlsxWorkbook{}
+	for _, u := range ts.Users {
+		name := u.Name
+		if name == "" {
+			name = u.Puncher
+		}
+		sheet := wb.addSheet(name, 12, 10, 10, 10, 10, 10)
+		header := func(s string) xlsxCell { return xlsxCell{Value: l.T(s), Style: xlsxHeader} }
+		sheet.addRow(header("Date"), header("Arrival"), header("Leave"), header("Breaks"), header("Total"), header("Expected"))
+		loc := ts.Start.Location()
+		for _, d := range u.Timesheet.Days {
+			row := []xlsxCell{{Value: d.Date, Style: xlsxDate}, {}, {}}
+			if !d.Arrival.IsZero() {
+				row[1] = xlsxCell{Value: d.Arrival.In(loc), Style: xlsxTime}
+			}
+			if !d.Open && !d.Leave.IsZero() {
+				row[2] = xlsxCell{Value: d.Leave.In(loc), Style: xlsxTime}
+			}
+			row = append(row,
+				xlsxCell{Value: d.Breaks, Style: xlsxDuration},
+				xlsxCell{Value: d.Worked, Style: xlsxDuration},
+				xlsxCell{Value: d.Expected, Style: xlsxDuration})
+			sheet.addRow(row...)
+		}
+		last := len(u.Timesheet.Days) + 1
+		sum := func(col int, v time.Duration) xlsxCell {
+			return xlsxCell{
+				Value:   v,
+				Formula: fmt.Sprintf("SUM(%s:%s)", xlsxRef(col, 2), xlsxRef(col, last)),
+				Style:   xlsxTotalDuration,
+			}
+		}
+		sheet.addRow(xlsxCell{Value: l.T("Total"), Style: xlsxTotalLabel}, xlsxCell{Style: xlsxTotalLabel}, xlsxCell{Style: xlsxTotalLabel},
+			sum(3, u.Timesheet.Breaks), sum(4, u.Timesheet.Total), sum(5, u.Timesheet.Expected))
+	}
+	if len(wb.sheets) == 0 {
+		// A workbook needs a sheet.
+		wb.addSheet(l.T("Timesheets"))
+	}
+	return wb
+}
+
+func minutesString(d time.Duration) string {
+	return strconv.Itoa(int(d / time.Minute))
+}
+
+// adminTimesheetsHandler shows the timesheets of a period, or downloads
+// them with format=csv, format=xlsx or format=pdf.
+func adminTimesheetsHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	var req TimesheetsRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return appErr
+	}
+	v := requestViewer(r)
+	ts, appErr := buildTimesheets(c, &req, v.Now())
+	if appErr != nil {
+		return appErr
+	}
+
+	name := "timecard-timesheets-" + ts.Start.Format("2006-01-02")
+	if ts.Period == "month" {
+		name = "timecard-timesheets-" + ts.Start.Format("2006-01")
+	}
+	switch r.FormValue("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"email", "name", "date", "arrival", "leave", "break_minutes", "worked_minutes", "expected_minutes"})
+		for _, u := range ts.Users {
+			for _, d := range u.Timesheet.Days {
+				arrival, leave := "", ""
+				if !d.Arrival.IsZero() {
+					arrival = v.formatTime(d.Arrival)
+				}
+				if !d.Open && !d.Leave.IsZero() {
+					leave = v.formatTime(d.Leave)
+				}
+				cw.Write([]string{u.Puncher, u.Name, d.Date.Format("2006-01-02"), arrival, leave,
+					minutesString(d.Breaks), minutesString(d.Worked), minutesString(d.Expected)})
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			c.Errorf("failed to write the timesheets: %v", err)
+		}
+		return nil
+
+	case "xlsx":
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.xlsx"`)
+		if err := timesheetsWorkbook(v.Locale, ts).write(w); err != nil {
+			c.Errorf("failed to write the timesheets: %v", err)
+		}
+		return nil
+
+	case "pdf":
+		writeTimesheetsPDF(c, w, v, ts, name)
+		return nil
+	}
+
+	query := url.Values{"period": {ts.Period}, "date": {ts.Start.Format("2006-01-02")}}
+	if req.Puncher != "" {
+		query.Set("puncher", req.Puncher)
+	}
+	query.Set("format", "csv")
+	csvURL := "/admin/timesheets?" + query.Encode()
+	query.Set("format", "xlsx")
+	xlsxURL := "/admin/timesheets?" + query.Encode()
+	query.Set("format", "pdf")
+	data := map[string]interface{}{
+		"Timesheets": ts,
+		"Date":       ts.Start.Format("2006-01-02"),
+		"CSVURL":     csvURL,
+		"XLSXURL":    xlsxURL,
+		"PDFURL":     "/admin/timesheets?" + query.Encode(),
+	}
+	return renderTemplate(c, w, r, timesheetsTemplate, data)
+}
+
+var timesheetsTemplate = parsePage("timesheets")
@@ -0,0 +1,249 @@
+package timecard
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/urlfetch"
+)
+
+// Requests are traced with a span for the request and one for each
+// storage call, and the spans are exported with OTLP over HTTP/JSON to
+// the collector in the OTEL_EXPORTER_OTLP_ENDPOINT environment variable
+// (set in app.yaml). Without it nothing is recorded. A W3C traceparent
+// header on the request continues the caller's trace.
+//
+// The spans of a request are found through its *http.Request, since
+// appengine.Context can't carry values.
+
+const (
+	otlpEndpointEnv = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otlpDeadline    = 2 * time.Second
+)
+
+type trace struct {
+	id    string
+	mu    sync.Mutex
+	spans []*span
+}
+
+type span struct {
+	trace    *trace
+	id       string
+	parentID string
+	name     string
+	kind     int // 1 internal, 2 server
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	failed   bool
+}
+
+var traces = struct {
+	sync.Mutex
+	m map[*http.Request]*trace
+}{m: make(map[*http.Request]*trace)}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func contextRequest(c appengine.Context) *http.Request {
+	r, _ := c.Request().(*http.Request)
+	return r
+}
+
+// startTrace starts the server span of r, or returns nil when tracing is
+// off.
+func startTrace(r *http.Request) *span {
+	if os.Getenv(otlpEndpointEnv) == "" {
+		return nil
+	}
+	t := &trace{id: randomHex(16)}
+	parentID := ""
+	// traceparent: version-traceid-parentid-flags
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		t.id, parentID = parts[1], parts[2]
+	}
+	traces.Lock()
+	traces.m[r] = t
+	traces.Unlock()
+
+	s := t.newSpan(r.Method+" "+r.URL.Path, parentID)
+	s.kind = 2
+	return s
+}
+
+func (t *trace) newSpan(name, parentID string) *span {
+	s := &span{
+		trace:    t,
+		id:       randomHex(8),
+		parentID: parentID,
+		name:     name,
+		kind:     1,
+		start:    time.Now(),
+		attrs:    make(map[string]string),
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return s
+}
+
+// startSpan starts a span under the request span of the request c
+// serves. It returns nil, on which all span methods do nothing, when the
+// request isn't traced.
+func startSpan(c appengine.Context, name string) *span {
+	r := contextRequest(c)
+	if r == nil {
+		return nil
+	}
+	traces.Lock()
+	t := traces.m[r]
+	traces.Unlock()
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	parentID := t.spans[0].id
+	t.mu.Unlock()
+	return t.newSpan(name, parentID)
+}
+
+func (s *span) set(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// finish ends s, marking it failed when err isn't nil.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.failed = true
+		s.attrs["error"] = err.Error()
+	}
+}
+
+// finishTrace ends the request span s and exports the trace.
+func finishTrace(c appengine.Context, r *http.Request, s *span, status int, err error) {
+	if s == nil {
+		return
+	}
+	traces.Lock()
+	delete(traces.m, r)
+	traces.Unlock()
+
+	s.set("http.method", r.Method)
+	s.set("http.target", r.URL.Path)
+	s.set("http.status_code", strconv.Itoa(status))
+	s.finish(err)
+	if status >= 500 {
+		s.failed = true
+	}
+	if err := exportTrace(c, s.trace); err != nil {
+		c.Warningf("failed to export a trace: %v", err)
+	}
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttributes(m map[string]string) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(m))
+	for k, v := range m {
+		a := otlpAttribute{Key: k}
+		a.Value.StringValue = v
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+func exportTrace(c appengine.Context, t *trace) error {
+	type otlpStatus struct {
+		Code int `json:"code"` // 1 ok, 2 error
+	}
+	type otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes"`
+		Status            otlpStatus      `json:"status"`
+	}
+
+	t.mu.Lock()
+	spans := make([]otlpSpan, 0, len(t.spans))
+	for _, s := range t.spans {
+		if s.end.IsZero() {
+			s.end = time.Now()
+		}
+		status := otlpStatus{Code: 1}
+		if s.failed {
+			status.Code = 2
+		}
+		spans = append(spans, otlpSpan{
+			TraceID:           t.id,
+			SpanID:            s.id,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+			Status:            status,
+		})
+	}
+	t.mu.Unlock()
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{
+					"service.name":    "timecard",
+					"service.version": appengine.VersionID(c),
+				}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "timecard"},
+				"spans": spans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: &urlfetch.Transport{Context: c, Deadline: otlpDeadline}}
+	endpoint := strings.TrimRight(os.Getenv(otlpEndpointEnv), "/") + "/v1/traces"
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return googleAPIError("otlp", resp)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package timecard
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// Admins delete punches by moving them to the trash, which keeps them
+// with the time and the admin of the deletion so that they can be
+// restored. Deleted punches are left out of queries unless asked for.
+
+const trashPageSize = 100
+
+// The errors of changing a punch that is not in the state the change
+// starts from.
+var (
+	errPunchInTrash    = errors.New("the punch is in the trash")
+	errPunchNotInTrash = errors.New("the punch is not in the trash")
+)
+
+type PunchIDRequest struct {
+	ID int64 `form:"id"`
+}
+
+// setPunchDeleted moves the punch with id to the trash, or restores it
+// when deleted is false, and records the change as done by actor. It
+// fails with errPunchInTrash or errPunchNotInTrash when the punch already
+// is where it would be moved.
+func setPunchDeleted(c appengine.Context, id int64, actor string, deleted bool) (*datastore.Key, *Punch, error) {
+	key := datastore.NewKey(c, "Punch", "", id, punchKey(c))
+	var p Punch
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := datastore.Get(tc, key, &p); err != nil {
+			return err
+		}
+		if inTrash := !p.DeletedAt.IsZero(); inTrash == deleted {
+			if inTrash {
+				return errPunchInTrash
+			}
+			return errPunchNotInTrash
+		}
+		event := punchEventDeleted
+		if deleted {
+			p.DeletedAt, p.DeletedBy = time.Now(), actor
+		} else {
+			p.DeletedAt, p.DeletedBy = time.Time{}, ""
+			event = punchEventRestored
+		}
+		if err := recordPunchEvent(tc, key, &p, event, actor); err != nil {
+			return err
+		}
+		_, err := datastore.Put(tc, key, &p)
+		return err
+	}, punchTransactionOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, &p, nil
+}
+
+// punchChangeError reports a failure to change an existing punch.
+func punchChangeError(err error) *appError {
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return &appError{
+			Error:   err,
+			Message: "No such punch",
+			Code:    http.StatusNotFound,
+		}
+	case errPunchInTrash:
+		return &appError{
+			Error:   err,
+			Message: "The punch is in the trash",
+			Code:    http.StatusConflict,
+		}
+	case errPunchNotInTrash:
+		return &appError{
+			Error:   err,
+			Message: "The punch is not in the trash",
+			Code:    http.StatusConflict,
+		}
+	}
+	return punchWriteError(err)
+}
+
+func apiAdminPunchesHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	switch r.Method {
+	case "POST":
+		return recordPunchFor(c, r)
+	case "PUT":
+		return correctPunch(c, r)
+	case "DELETE":
+		return trashPunch(c, r)
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+func trashPunch(c appengine.Context, r *http.Request) (interface{}, *appError) {
+	var req PunchIDRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	key, p, err := setPunchDeleted(c, req.ID, user.Current(c).Email, true)
+	if err != nil {
+		return nil, punchChangeError(err)
+	}
+	res := PunchResponse{Punch: newPunchJSON(key, p)}
+	streamPunch(c, res.Punch, "delete")
+	notifyPunchChanged(c, p, p.DeletedBy, notificationPunchDeleted)
+	return res, nil
+}
+
+func apiAdminPunchesRestoreHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	if r.Method != "POST" {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+	var req PunchIDRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	actor := user.Current(c).Email
+	key, p, err := setPunchDeleted(c, req.ID, actor, false)
+	if err != nil {
+		return nil, punchChangeError(err)
+	}
+	res := PunchResponse{Punch: newPunchJSON(key, p)}
+	streamPunch(c, res.Punch, "restore")
+	notifyPunchChanged(c, p, actor, notificationPunchRestored)
+	return res, nil
+}
+
+// adminTrashHandler shows the most recently deleted punches, and
+// restores the one posted.
+func adminTrashHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method == "POST" {
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return formValueError(err, "id", `Failed to parse the "%s" parameter as an integer`)
+		}
+		actor := user.Current(c).Email
+		key, p, err := setPunchDeleted(c, id, actor, false)
+		if err != nil {
+			return punchChangeError(err)
+		}
+		streamPunch(c, newPunchJSON(key, p), "restore")
+		notifyPunchChanged(c, p, actor, notificationPunchRestored)
+		redirect(w, "/admin/trash")
+		return nil
+	}
+
+	q := datastore.NewQuery("Punch").Ancestor(punchKey(c)).
+		Filter("DeletedAt >", time.Time{}).Order("-DeletedAt").Limit(trashPageSize)
+	var punches []Punch
+	keys, err := q.GetAll(c, &punches)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch punches data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	items := make([]PunchJSON, 0, len(punches))
+	for i := range punches {
+		items = append(items, newPunchJSON(keys[i], &punches[i]))
+	}
+	return renderTemplate(c, w, r, trashTemplate, map[string]interface{}{
+		"Punches": items,
+	})
+}
+
+var trashTemplate = parsePage("trash")
@@ -0,0 +1,226 @@
+package timecard
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// HR onboards many employees at once by posting a CSV file to the users
+// API with mode=import. The file has the columns email and name, and
+// optionally team, role ("admin" or "employee") and enabled. A row for an
+// existing email updates that user, where empty cells keep the stored
+// value; other rows create users, who are employees and enabled unless
+// the row says otherwise. All the rows are stored in one transaction, so
+// a file with any invalid row changes nothing.
+
+const maxUserImportRows = 500
+
+var userImportColumns = []string{"email", "name"}
+
+type ImportUsersResponse struct {
+	DryRun    bool `json:"dry_run"`
+	Rows      int  `json:"rows"`
+	Created   int  `json:"created"`
+	Updated   int  `json:"updated"`
+	Unchanged int  `json:"unchanged"`
+	// Users are the created and updated users, once stored.
+	Users  []UserJSON        `json:"users"`
+	Errors []CSVRowErrorJSON `json:"errors"`
+}
+
+// userImportRow is a valid row of a file. Fields that are nil weren't
+// given.
+type userImportRow struct {
+	email   string
+	name    string
+	team    string
+	admin   *bool
+	enabled *bool
+}
+
+func (ir *userImportRow) apply(u *User) {
+	if ir.name != "" {
+		u.Name = ir.name
+	}
+	if ir.team != "" {
+		u.Team = ir.team
+	}
+	if ir.admin != nil {
+		u.Admin = *ir.admin
+	}
+	if ir.enabled != nil {
+		u.Enabled = *ir.enabled
+	}
+}
+
+func parseUserImport(r *http.Request, cr *csv.Reader, policy *SignInPolicy) ([]userImportRow, []CSVRowErrorJSON, *appError) {
+	columns, appErr := readCSVHeader(cr, userImportColumns, "The CSV file must have a header row with the columns email, name and optionally team, role and enabled")
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+	var rows []userImportRow
+	rowErrors := []CSVRowErrorJSON{}
+	seen := make(map[string]int)
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// The rest of the file can't be trusted to line up.
+			rowErrors = append(rowErrors, newCSVRowError(r, row, "Failed to parse the row as CSV"))
+			break
+		}
+		if len(rows)+len(rowErrors) >= maxUserImportRows {
+			return nil, nil, &appError{
+				Error:   errors.New("too many rows"),
+				Message: "The CSV file can have at most %d rows",
+				Args:    []interface{}{maxUserImportRows},
+				Code:    http.StatusBadRequest,
+			}
+		}
+
+		ir := userImportRow{
+			email: columns.get(record, "email"),
+			name:  columns.get(record, "name"),
+			team:  columns.get(record, "team"),
+		}
+		if !strings.Contains(ir.email, "@") {
+			rowErrors = append(rowErrors, newCSVRowError(r, row, `The "email" column must be an email address`))
+			continue
+		}
+		if !policy.allows(ir.email) {
+			rowErrors = append(rowErrors, newCSVRowError(r, row, "Accounts of %s aren't allowed to sign in", emailDomain(ir.email)))
+			continue
+		}
+		if first, ok := seen[strings.ToLower(ir.email)]; ok {
+			rowErrors = append(rowErrors, newCSVRowError(r, row, "The email is already in row %d", first))
+			continue
+		}
+		seen[strings.ToLower(ir.email)] = row
+		switch role := strings.ToLower(columns.get(record, "role")); role {
+		case "":
+		case "admin", "employee":
+			admin := role == "admin"
+			ir.admin = &admin
+		default:
+			rowErrors = append(rowErrors, newCSVRowError(r, row, `The "role" column must be "admin", "employee" or empty`))
+			continue
+		}
+		if s := columns.get(record, "enabled"); s != "" {
+			enabled, err := strconv.ParseBool(s)
+			if err != nil {
+				rowErrors = append(rowErrors, newCSVRowError(r, row, `The "enabled" column must be true, false or empty`))
+				continue
+			}
+			ir.enabled = &enabled
+		}
+		rows = append(rows, ir)
+	}
+	return rows, rowErrors, nil
+}
+
+// importUsers creates and updates the users of the CSV "file" of r, or
+// with dryRun only reports what it would do.
+func importUsers(c appengine.Context, r *http.Request, dryRun bool) (interface{}, *appError) {
+	f, appErr := csvUpload(r)
+	if appErr != nil {
+		return nil, appErr
+	}
+	defer f.Close()
+	policy, err := getSignInPolicy(c)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to fetch the sign-in policy from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	rows, rowErrors, appErr := parseUserImport(r, csv.NewReader(f), policy)
+	if appErr != nil {
+		return nil, appErr
+	}
+	res := ImportUsersResponse{DryRun: dryRun, Rows: len(rows) + len(rowErrors), Users: []UserJSON{}, Errors: rowErrors}
+	if len(rowErrors) > 0 {
+		return res, nil
+	}
+
+	var keys []*datastore.Key
+	var users []User
+	var created, disabled []string
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		keys, users, created, disabled = nil, nil, nil, nil
+		res.Created, res.Updated, res.Unchanged = 0, 0, 0
+		var all []User
+		allKeys, err := datastore.NewQuery("User").Ancestor(punchKey(tc)).GetAll(tc, &all)
+		if err != nil {
+			return err
+		}
+		byEmail := make(map[string]int, len(all))
+		for i := range all {
+			byEmail[strings.ToLower(all[i].Email)] = i
+		}
+		now := time.Now()
+		for i := range rows {
+			ir := &rows[i]
+			j, ok := byEmail[strings.ToLower(ir.email)]
+			if !ok {
+				u := User{Email: ir.email, Enabled: true, Version: 1, Updated: now}
+				ir.apply(&u)
+				keys = append(keys, datastore.NewIncompleteKey(tc, "User", punchKey(tc)))
+				users = append(users, u)
+				created = append(created, u.Email)
+				res.Created++
+				continue
+			}
+			u := all[j]
+			ir.apply(&u)
+			if u.Name == all[j].Name && u.Team == all[j].Team && u.Admin == all[j].Admin && u.Enabled == all[j].Enabled {
+				res.Unchanged++
+				continue
+			}
+			if all[j].Enabled && !u.Enabled {
+				disabled = append(disabled, u.Email)
+			}
+			u.Version++
+			u.Updated = now
+			keys = append(keys, allKeys[j])
+			users = append(users, u)
+			res.Updated++
+		}
+		if dryRun || len(keys) == 0 {
+			return nil
+		}
+		keys, err = datastore.PutMulti(tc, keys, users)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to put a user data to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	if dryRun {
+		return res, nil
+	}
+
+	for i := range users {
+		res.Users = append(res.Users, newUserJSON(keys[i], &users[i]))
+	}
+	for _, email := range created {
+		notifyAccount(c, email, notificationAccountCreated)
+	}
+	for _, email := range disabled {
+		notifyAccount(c, email, notificationAccountDisabled)
+	}
+	c.Infof("imported users: %d created, %d updated, %d unchanged", res.Created, res.Updated, res.Unchanged)
+	return res, nil
+}
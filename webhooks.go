@@ -0,0 +1,546 @@
+package timecard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+	"appengine/urlfetch"
+)
+
+// Teams that live in Google Chat or Microsoft Teams get cards about their
+// members posted to an incoming webhook of their space or channel. Each
+// Webhook names its team and members, or has no members to cover
+// everyone. It posts a card when a member arrives after LateAfter, the
+// first arrival of their day only, and every morning it posts the
+// members who didn't punch out the day before.
+//
+// The cards are in the default locale. There are no approvals in the
+// app yet, so nothing is posted about pending ones.
+
+type Webhook struct {
+	Team string
+	Kind string
+	URL  string `datastore:",noindex"`
+	// Members are emails; empty means everyone.
+	Members []string
+	// LateAfter is a time of day like "09:30" in TimeZone, or empty not
+	// to post late arrivals.
+	LateAfter string
+	TimeZone  string
+}
+
+const (
+	webhookGoogleChat = "google_chat"
+	webhookTeams      = "teams"
+
+	webhookLatePath  = "/tasks/webhooks/late"
+	webhookDailyPath = "/tasks/webhooks/daily"
+)
+
+var timeOfDayPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+func webhookKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, "Webhook", "", id, punchKey(c))
+}
+
+func findWebhooks(c appengine.Context) ([]*datastore.Key, []Webhook, error) {
+	var hooks []Webhook
+	keys, err := datastore.NewQuery("Webhook").Ancestor(punchKey(c)).Order("Team").GetAll(c, &hooks)
+	return keys, hooks, err
+}
+
+func (h *Webhook) covers(email string) bool {
+	if len(h.Members) == 0 {
+		return true
+	}
+	for _, m := range h.Members {
+		if strings.EqualFold(m, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Webhook) location() *time.Location {
+	if loc, err := time.LoadLocation(h.TimeZone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+type webhookFact struct {
+	Name  string
+	Value string
+}
+
+// webhookCard is a card before it is formatted for the kind of webhook.
+type webhookCard struct {
+	Title    string
+	Subtitle string
+	Facts    []webhookFact
+}
+
+// payload returns the JSON body posting card to the webhook: a Chat card
+// or a Teams Adaptive Card.
+func (h *Webhook) payload(card *webhookCard) interface{} {
+	type m map[string]interface{}
+	if h.Kind == webhookTeams {
+		body := []interface{}{
+			m{"type": "TextBlock", "size": "Medium", "weight": "Bolder", "text": card.Title},
+		}
+		if card.Subtitle != "" {
+			body = append(body, m{"type": "TextBlock", "isSubtle": true, "wrap": true, "text": card.Subtitle})
+		}
+		facts := make([]interface{}, len(card.Facts))
+		for i, f := range card.Facts {
+			facts[i] = m{"title": f.Name, "value": f.Value}
+		}
+		body = append(body, m{"type": "FactSet", "facts": facts})
+		return m{
+			"type": "message",
+			"attachments": []interface{}{m{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": m{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body":    body,
+				},
+			}},
+		}
+	}
+
+	widgets := make([]interface{}, len(card.Facts))
+	for i, f := range card.Facts {
+		widgets[i] = m{"decoratedText": m{"topLabel": f.Name, "text": f.Value}}
+	}
+	return m{
+		"text": card.Title,
+		"cardsV2": []interface{}{m{
+			"cardId": "timecard",
+			"card": m{
+				"header":   m{"title": card.Title, "subtitle": card.Subtitle},
+				"sections": []interface{}{m{"widgets": widgets}},
+			},
+		}},
+	}
+}
+
+func postWebhook(c appengine.Context, h *Webhook, card *webhookCard) error {
+	b, err := json.Marshal(h.payload(card))
+	if err != nil {
+		return err
+	}
+	resp, err := urlfetch.Client(c).Post(h.URL, "application/json; charset=utf-8", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return googleAPIError(h.Kind+" webhook", resp)
+	}
+	return nil
+}
+
+// userNames returns the names of the users by email.
+func userNames(c appengine.Context) (map[string]string, error) {
+	_, users, err := findUsers(c, userQuery{})
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(users))
+	for _, u := range users {
+		names[u.Email] = u.Name
+	}
+	return names, nil
+}
+
+func displayName(names map[string]string, email string) string {
+	if name := names[email]; name != "" {
+		return name + " <" + email + ">"
+	}
+	return email
+}
+
+// queueLateArrival has the arrival p checked against the webhooks that
+// post late arrivals. Failures are only logged since the punch itself
+// has been stored.
+func queueLateArrival(c appengine.Context, p PunchJSON) {
+	if p.Type != "arrival" {
+		return
+	}
+	_, hooks, err := findWebhooks(c)
+	if err != nil {
+		c.Errorf("failed to get the webhooks: %v", err)
+		return
+	}
+	for i := range hooks {
+		if hooks[i].LateAfter != "" && hooks[i].covers(p.Puncher) {
+			b, _ := json.Marshal(p)
+			if err := addTask(c, taskqueue.NewPOSTTask(webhookLatePath, url.Values{"punch": {string(b)}}), ""); err != nil {
+				c.Errorf("failed to queue the late arrival check: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func webhookLateTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	var p PunchJSON
+	if err := json.Unmarshal([]byte(r.FormValue("punch")), &p); err != nil {
+		// Retrying won't fix a bad task.
+		c.Errorf("dropping a bad late arrival task: %v", err)
+		return nil
+	}
+	_, hooks, err := findWebhooks(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch the webhooks from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	names, err := userNames(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	settings, err := getOrgSettings(c)
+	if err != nil {
+		return orgSettingsError(err)
+	}
+	maxSession := time.Duration(settings.MaxSessionHours) * time.Hour
+
+	l := defaultLocale
+	for i := range hooks {
+		h := &hooks[i]
+		if h.LateAfter == "" || !h.covers(p.Puncher) {
+			continue
+		}
+		local := p.Time.In(h.location())
+		if local.Format("15:04") <= h.LateAfter {
+			continue
+		}
+		dayStart := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+		earlier, _, err := findPunches(c, punchQuery{Puncher: p.Puncher, Type: "arrival", From: dayStart, To: p.Time, Limit: 1, Fields: sessionFields})
+		if err != nil {
+			return &appError{
+				Error:   err,
+				Message: "Failed to fetch punches data from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		if len(earlier) > 0 {
+			continue
+		}
+		card := webhookCard{
+			Title:    l.T("Late arrival"),
+			Subtitle: h.Team,
+			Facts: []webhookFact{
+				{Name: l.T("Employee"), Value: displayName(names, p.Puncher)},
+				{Name: l.T("Arrived"), Value: local.Format("2006-01-02 15:04")},
+				{Name: l.T("Expected by"), Value: h.LateAfter},
+			},
+		}
+		if err := postWebhook(c, h, &card); err != nil {
+			c.Errorf("failed to post the late arrival of %s to %s: %v", p.Puncher, h.Team, err)
+		}
+	}
+	return nil
+}
+
+// webhookDailyTaskHandler posts, to each webhook, the members whose last
+// punch of yesterday in its time zone is an arrival they haven't left.
+// A leave after midnight within maxSessionLength of the arrival closes
+// it, like that of a night shift. A session still open when the task
+// runs is only missing its leave once it is longer than MaxSessionHours
+// of the org settings.
+func webhookDailyTaskHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) *appError {
+	_, hooks, err := findWebhooks(c)
+	if err != nil || len(hooks) == 0 {
+		if err != nil {
+			return &appError{
+				Error:   err,
+				Message: "Failed to fetch the webhooks from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return nil
+	}
+	names, err := userNames(c)
+	if err != nil {
+		return &appError{
+			Error:   err,
+			Message: "Failed to fetch users data from the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	settings, err := getOrgSettings(c)
+	if err != nil {
+		return orgSettingsError(err)
+	}
+	maxSession := time.Duration(settings.MaxSessionHours) * time.Hour
+
+	l := defaultLocale
+	for i := range hooks {
+		h := &hooks[i]
+		now := time.Now().In(h.location())
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		yesterday := today.AddDate(0, 0, -1)
+		_, punches, err := findPunches(c, punchQuery{From: yesterday, To: today.Add(maxSessionLength), Fields: sessionFields})
+		if err != nil {
+			return &appError{
+				Error:   err,
+				Message: "Failed to fetch punches data from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		// open has the time of the arrival each member hasn't left, and
+		// next whether they punched after midnight.
+		open := make(map[string]time.Time)
+		next := make(map[string]bool)
+		seen := make(map[string]bool)
+		var order []string
+		for _, p := range punches {
+			if !h.covers(p.Puncher) {
+				continue
+			}
+			if p.Time.Before(today) {
+				if !seen[p.Puncher] {
+					seen[p.Puncher] = true
+					order = append(order, p.Puncher)
+				}
+				if p.Type == "arrival" {
+					open[p.Puncher] = p.Time
+				} else {
+					delete(open, p.Puncher)
+				}
+				continue
+			}
+			if arrival, ok := open[p.Puncher]; ok && !next[p.Puncher] {
+				next[p.Puncher] = true
+				if p.Type == "leave" && p.Time.Sub(arrival) <= maxSessionLength {
+					delete(open, p.Puncher)
+				}
+			}
+		}
+		var missing []string
+		for _, email := range order {
+			if arrival, ok := open[email]; ok && (next[email] || now.Sub(arrival) > maxSession) {
+				missing = append(missing, displayName(names, email))
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		card := webhookCard{
+			Title:    l.T("Missing punches on %s", yesterday.Format("2006-01-02")),
+			Subtitle: h.Team,
+			Facts:    []webhookFact{{Name: l.T("Didn't punch out"), Value: strings.Join(missing, "\n")}},
+		}
+		if err := postWebhook(c, h, &card); err != nil {
+			c.Errorf("failed to post the missing punches to %s: %v", h.Team, err)
+		}
+	}
+	return nil
+}
+
+type WebhookJSON struct {
+	ID        int64    `json:"id"`
+	Team      string   `json:"team"`
+	Kind      string   `json:"kind"`
+	URL       string   `json:"url"`
+	Members   []string `json:"members"`
+	LateAfter string   `json:"late_after"`
+	TimeZone  string   `json:"time_zone"`
+}
+
+func newWebhookJSON(key *datastore.Key, h *Webhook) WebhookJSON {
+	members := h.Members
+	if members == nil {
+		members = []string{}
+	}
+	return WebhookJSON{
+		ID:        key.IntID(),
+		Team:      h.Team,
+		Kind:      h.Kind,
+		URL:       h.URL,
+		Members:   members,
+		LateAfter: h.LateAfter,
+		TimeZone:  h.TimeZone,
+	}
+}
+
+type WebhooksResponse struct {
+	Webhooks []WebhookJSON `json:"webhooks"`
+}
+
+type WebhookResponse struct {
+	Webhook WebhookJSON `json:"webhook"`
+}
+
+type PutWebhookRequest struct {
+	// ID is 0 to create a webhook.
+	ID   int64  `form:"id"`
+	Team string `form:"team"`
+	// Kind is google_chat or teams.
+	Kind string `form:"kind"`
+	URL  string `form:"url"`
+	// Members is separated by commas or spaces. Empty covers everyone.
+	Members   string `form:"members"`
+	LateAfter string `form:"late_after"`
+	TimeZone  string `form:"time_zone"`
+}
+
+type WebhookIDRequest struct {
+	ID int64 `form:"id"`
+}
+
+func apiAdminWebhooksHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	switch r.Method {
+	case "GET":
+		keys, hooks, err := findWebhooks(c)
+		if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the webhooks from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		res := WebhooksResponse{Webhooks: make([]WebhookJSON, 0, len(hooks))}
+		for i := range hooks {
+			res.Webhooks = append(res.Webhooks, newWebhookJSON(keys[i], &hooks[i]))
+		}
+		return res, nil
+
+	case "POST", "PUT":
+		return putWebhook(c, r)
+
+	case "DELETE":
+		var req WebhookIDRequest
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		key := webhookKey(c, req.ID)
+		var h Webhook
+		err := datastore.Get(c, key, &h)
+		if err == nil {
+			err = datastore.Delete(c, key)
+		}
+		if err == datastore.ErrNoSuchEntity {
+			return nil, &appError{
+				Error:   err,
+				Message: "No such webhook",
+				Code:    http.StatusNotFound,
+			}
+		} else if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the webhook to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return WebhookResponse{Webhook: newWebhookJSON(key, &h)}, nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// putWebhook creates a webhook, or updates the one with the ID, whose
+// fields that aren't given keep their stored value.
+func putWebhook(c appengine.Context, r *http.Request) (interface{}, *appError) {
+	var req PutWebhookRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	key := datastore.NewIncompleteKey(c, "Webhook", punchKey(c))
+	settings, err := getOrgSettings(c)
+	if err != nil {
+		return nil, orgSettingsError(err)
+	}
+	h := Webhook{Kind: webhookGoogleChat, TimeZone: settings.Timezone}
+	if req.ID != 0 {
+		key = webhookKey(c, req.ID)
+		if err := datastore.Get(c, key, &h); err == datastore.ErrNoSuchEntity {
+			return nil, &appError{
+				Error:   err,
+				Message: "No such webhook",
+				Code:    http.StatusNotFound,
+			}
+		} else if err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to fetch the webhooks from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+	}
+	req = PutWebhookRequest{
+		Team:      h.Team,
+		Kind:      h.Kind,
+		URL:       h.URL,
+		Members:   strings.Join(h.Members, ","),
+		LateAfter: h.LateAfter,
+		TimeZone:  h.TimeZone,
+	}
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+
+	if req.Kind != webhookGoogleChat && req.Kind != webhookTeams {
+		return nil, &appError{
+			Error:   errors.New("invalid webhook kind: " + req.Kind),
+			Message: `The "kind" parameter must be "google_chat" or "teams"`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if u, err := url.Parse(req.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, &appError{
+			Error:   fmt.Errorf("invalid webhook URL %q", req.URL),
+			Message: `The "url" parameter must be an https URL`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	if req.LateAfter != "" && !timeOfDayPattern.MatchString(req.LateAfter) {
+		return nil, formValueError(errors.New("invalid time of day: "+req.LateAfter), "late_after", `The "%s" parameter must be a time of day like 09:30`)
+	}
+	if _, err := time.LoadLocation(req.TimeZone); err != nil || req.TimeZone == "" {
+		return nil, formValueError(fmt.Errorf("invalid time zone %q", req.TimeZone), "time_zone", `The "%s" parameter must be a time zone like Asia/Tokyo`)
+	}
+	h = Webhook{
+		Team:      req.Team,
+		Kind:      req.Kind,
+		URL:       req.URL,
+		Members:   strings.FieldsFunc(req.Members, func(r rune) bool { return r == ',' || r == ' ' }),
+		LateAfter: req.LateAfter,
+		TimeZone:  req.TimeZone,
+	}
+	key, err = datastore.Put(c, key, &h)
+	if err != nil {
+		return nil, &appError{
+			Error:   err,
+			Message: "Failed to put the webhook to the datastore",
+			Code:    http.StatusInternalServerError,
+		}
+	}
+	return WebhookResponse{Webhook: newWebhookJSON(key, &h)}, nil
+}
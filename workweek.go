@@ -0,0 +1,292 @@
+package timecard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Workweek says which days of the week are workdays and how long a
+// workday is expected to be. There is a single Workweek entity for the
+// organization, edited by admins, and a user may have a UserWorkweek of
+// their own, like a part-timer working three days a week. Without one
+// the workdays are Monday to Friday, 8 hours each. Holidays are never
+// workdays.
+type Workweek struct {
+	Workdays        []int `datastore:",noindex"` // time.Weekday values
+	ExpectedMinutes int   `datastore:",noindex"`
+}
+
+var defaultWorkweek = Workweek{
+	Workdays:        []int{1, 2, 3, 4, 5},
+	ExpectedMinutes: 8 * 60,
+}
+
+// weekdayNames are the names of the workdays in the API, by
+// time.Weekday.
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (w *Workweek) isWorkday(day time.Time, holidays map[string]string) bool {
+	if _, holiday := holidays[day.Format("2006-01-02")]; holiday {
+		return false
+	}
+	for _, d := range w.Workdays {
+		if time.Weekday(d) == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// expected returns the time expected to be worked on day.
+func (w *Workweek) expected(day time.Time, holidays map[string]string) time.Duration {
+	if !w.isWorkday(day, holidays) {
+		return 0
+	}
+	return time.Duration(w.ExpectedMinutes) * time.Minute
+}
+
+func workweekKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "Workweek", "default_workweek", 0, nil)
+}
+
+func userWorkweekKey(c appengine.Context, email string) *datastore.Key {
+	return datastore.NewKey(c, "UserWorkweek", email, 0, punchKey(c))
+}
+
+// getWorkweek loads the workweek at key into a new Workweek, or returns
+// nil if there is none.
+func getWorkweek(c appengine.Context, key *datastore.Key) (*Workweek, error) {
+	var w Workweek
+	if err := datastore.Get(c, key, &w); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// workweeks are the organization's workweek and the users' own.
+type workweeks struct {
+	org   Workweek
+	users map[string]Workweek
+}
+
+func findWorkweeks(c appengine.Context) (*workweeks, error) {
+	ww := &workweeks{org: defaultWorkweek, users: make(map[string]Workweek)}
+	org, err := getWorkweek(c, workweekKey(c))
+	if err != nil {
+		return nil, err
+	} else if org != nil {
+		ww.org = *org
+	}
+	var users []Workweek
+	keys, err := datastore.NewQuery("UserWorkweek").Ancestor(punchKey(c)).GetAll(c, &users)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		ww.users[key.StringID()] = users[i]
+	}
+	return ww, nil
+}
+
+// of returns the workweek of the user with email.
+func (ww *workweeks) of(email string) *Workweek {
+	if w, ok := ww.users[email]; ok {
+		return &w
+	}
+	return &ww.org
+}
+
+// workweekError is the error of failing to find the workweeks.
+func workweekError(err error) *appError {
+	return &appError{
+		Error:   err,
+		Message: "Failed to fetch the workweek from the datastore",
+		Code:    http.StatusInternalServerError,
+	}
+}
+
+type WorkweekJSON struct {
+	// Email is set for the workweek of a user.
+	Email           string   `json:"email,omitempty"`
+	Workdays        []string `json:"workdays"`
+	ExpectedMinutes int      `json:"expected_minutes"`
+	// Default is true when the organization's workweek applies.
+	Default bool `json:"default"`
+}
+
+type WorkweekResponse struct {
+	Workweek WorkweekJSON `json:"workweek"`
+}
+
+func newWorkweekResponse(email string, w *Workweek, isDefault bool) WorkweekResponse {
+	res := WorkweekResponse{Workweek: WorkweekJSON{
+		Email:           email,
+		Workdays:        []string{},
+		ExpectedMinutes: w.ExpectedMinutes,
+		Default:         isDefault,
+	}}
+	for _, d := range w.Workdays {
+		res.Workweek.Workdays = append(res.Workweek.Workdays, weekdayNames[d])
+	}
+	return res
+}
+
+type UpdateWorkweekRequest struct {
+	// Workdays are comma separated names like mon,tue,wed.
+	Workdays        string `form:"workdays"`
+	ExpectedMinutes int    `form:"expected_minutes"`
+}
+
+type UserWorkweekRequest struct {
+	Email           string `form:"email"`
+	Workdays        string `form:"workdays"`
+	ExpectedMinutes int    `form:"expected_minutes"`
+}
+
+// parseWorkweek validates the workdays and expected minutes of a request.
+func parseWorkweek(workdays string, expectedMinutes int) (*Workweek, *appError) {
+	w := &Workweek{Workdays: []int{}, ExpectedMinutes: expectedMinutes}
+	seen := make(map[int]bool)
+	for _, name := range splitList(strings.ToLower(workdays)) {
+		d := -1
+		for i, n := range weekdayNames {
+			if n == name {
+				d = i
+			}
+		}
+		if d < 0 && name != "" {
+			return nil, &appError{
+				Error:   fmt.Errorf("unknown weekday %q", name),
+				Message: `The "workdays" parameter must be days like mon,tue,wed,thu,fri`,
+				Code:    http.StatusBadRequest,
+			}
+		}
+		if d >= 0 && !seen[d] {
+			seen[d] = true
+			w.Workdays = append(w.Workdays, d)
+		}
+	}
+	if expectedMinutes < 0 || expectedMinutes > 24*60 {
+		return nil, &appError{
+			Error:   fmt.Errorf("invalid expected minutes %d", expectedMinutes),
+			Message: `The "%s" parameter must be from 0 to %d`,
+			Args:    []interface{}{"expected_minutes", 24 * 60},
+			Code:    http.StatusBadRequest,
+		}
+	}
+	return w, nil
+}
+
+func joinWeekdays(days []int) string {
+	names := make([]string, len(days))
+	for i, d := range days {
+		names[i] = weekdayNames[d]
+	}
+	return strings.Join(names, ",")
+}
+
+func apiAdminWorkweekHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	ww, err := findWorkweeks(c)
+	if err != nil {
+		return nil, workweekError(err)
+	}
+	if r.Method == "GET" {
+		return newWorkweekResponse("", &ww.org, false), nil
+	} else if r.Method == "PUT" || r.Method == "POST" {
+		req := UpdateWorkweekRequest{Workdays: joinWeekdays(ww.org.Workdays), ExpectedMinutes: ww.org.ExpectedMinutes}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		week, appErr := parseWorkweek(req.Workdays, req.ExpectedMinutes)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if _, err := datastore.Put(c, workweekKey(c), week); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the workweek to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newWorkweekResponse("", week, false), nil
+	} else {
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
+
+// apiAdminUserWorkweekHandler gets, sets or removes (DELETE) the
+// workweek of a user, which without one is the organization's.
+func apiAdminUserWorkweekHandler(c appengine.Context, w http.ResponseWriter, r *http.Request) (interface{}, *appError) {
+	var req UserWorkweekRequest
+	if appErr := decodeForm(r, &req); appErr != nil {
+		return nil, appErr
+	}
+	if req.Email == "" {
+		return nil, &appError{
+			Error:   errors.New("missing email"),
+			Message: `The "email" parameter is required`,
+			Code:    http.StatusBadRequest,
+		}
+	}
+	ww, err := findWorkweeks(c)
+	if err != nil {
+		return nil, workweekError(err)
+	}
+	key := userWorkweekKey(c, req.Email)
+	_, isUsers := ww.users[req.Email]
+	switch r.Method {
+	case "GET":
+		return newWorkweekResponse(req.Email, ww.of(req.Email), !isUsers), nil
+
+	case "PUT", "POST":
+		// Fields that aren't given keep their current value.
+		current := ww.of(req.Email)
+		req = UserWorkweekRequest{Email: req.Email, Workdays: joinWeekdays(current.Workdays), ExpectedMinutes: current.ExpectedMinutes}
+		if appErr := decodeForm(r, &req); appErr != nil {
+			return nil, appErr
+		}
+		week, appErr := parseWorkweek(req.Workdays, req.ExpectedMinutes)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if _, err := datastore.Put(c, key, week); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to put the workweek to the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newWorkweekResponse(req.Email, week, false), nil
+
+	case "DELETE":
+		if err := datastore.Delete(c, key); err != nil {
+			return nil, &appError{
+				Error:   err,
+				Message: "Failed to delete the workweek from the datastore",
+				Code:    http.StatusInternalServerError,
+			}
+		}
+		return newWorkweekResponse(req.Email, &ww.org, true), nil
+
+	default:
+		err := errors.New("Unsupported http method")
+		return nil, &appError{
+			Error:   err,
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package timecard
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xlsxWorkbook writes a minimal Office Open XML spreadsheet, which is
+// enough for the exports HR opens in Excel: sheets of strings, numbers,
+// dates, times and durations in a few styles, and formulas. Strings are
+// written inline, without a shared string table, and Excel recalculates
+// the formulas when it opens the file.
+type xlsxWorkbook struct {
+	sheets []*xlsxSheet
+}
+
+type xlsxSheet struct {
+	name   string
+	widths []float64
+	rows   [][]xlsxCell
+}
+
+// xlsxCell is a string, an int, a float64, a time.Time, a time.Duration
+// or nil. A cell with a Formula shows Value until it is recalculated.
+type xlsxCell struct {
+	Value   interface{}
+	Formula string
+	Style   xlsxStyle
+}
+
+// xlsxStyle is an index of cellXfs in xlsxStyles.
+type xlsxStyle int
+
+const (
+	xlsxDefault xlsxStyle = iota
+	xlsxHeader
+	xlsxDate
+	xlsxTime
+	xlsxDuration
+	xlsxTotalLabel
+	xlsxTotalDuration
+)
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="3"><numFmt numFmtId="164" formatCode="yyyy-mm-dd"/><numFmt numFmtId="165" formatCode="hh:mm"/><numFmt numFmtId="166" formatCode="[h]:mm"/></numFmts>
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="3"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill><fill><patternFill patternType="solid"><fgColor rgb="FFD9D9D9"/><bgColor indexed="64"/></patternFill></fill></fills>
+<borders count="3"><border><left/><right/><top/><bottom/><diagonal/></border><border><left/><right/><top/><bottom style="thin"/><diagonal/></border><border><left/><right/><top style="thin"/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="7">
+<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>
+<xf numFmtId="0" fontId="1" fillId="2" borderId="1" xfId="0" applyFont="1" applyFill="1" applyBorder="1"/>
+<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="166" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>
+<xf numFmtId="0" fontId="1" fillId="0" borderId="2" xfId="0" applyFont="1" applyBorder="1"/>
+<xf numFmtId="166" fontId="1" fillId="0" borderId="2" xfId="0" applyNumberFormat="1" applyFont="1" applyBorder="1"/>
+</cellXfs>
+</styleSheet>
+`
+
+// xlsxEpoch is day 0 of the dates of a workbook.
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// addSheet adds a sheet with the column widths in characters. The name
+// is made valid and unique in the workbook.
+func (wb *xlsxWorkbook) addSheet(name string, widths ...float64) *xlsxSheet {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return ' '
+		}
+		return r
+	}, name))
+	if name == "" {
+		name = "Sheet"
+	}
+	base := []rune(name)
+	for n := 1; ; n++ {
+		suffix := ""
+		if n > 1 {
+			suffix = fmt.Sprintf(" (%d)", n)
+		}
+		r := base
+		if max := 31 - len(suffix); len(r) > max {
+			r = r[:max]
+		}
+		name = string(r) + suffix
+		if !wb.hasSheet(name) {
+			break
+		}
+	}
+	s := &xlsxSheet{name: name, widths: widths}
+	wb.sheets = append(wb.sheets, s)
+	return s
+}
+
+func (wb *xlsxWorkbook) hasSheet(name string) bool {
+	for _, s := range wb.sheets {
+		if strings.EqualFold(s.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// addRow appends a row and returns its number, the first being 1.
+func (s *xlsxSheet) addRow(cells ...xlsxCell) int {
+	s.rows = append(s.rows, cells)
+	return len(s.rows)
+}
+
+// xlsxColumn returns the name of the column at index i, like A or AB.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// xlsxRef returns the reference of the cell at column index col of row.
+func xlsxRef(col, row int) string {
+	return xlsxColumn(col) + strconv.Itoa(row)
+}
+
+func xlsxEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// xlsxNumber returns the number stored for v, or false for a string or
+// an empty cell.
+func xlsxNumber(v interface{}) (string, bool) {
+	var f float64
+	switch v := v.(type) {
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		f = v
+	case time.Time:
+		if v.IsZero() {
+			return "", false
+		}
+		wall := time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second(), v.Nanosecond(), time.UTC)
+		f = wall.Sub(xlsxEpoch).Hours() / 24
+	case time.Duration:
+		f = v.Hours() / 24
+	default:
+		return "", false
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), true
+}
+
+func (s *xlsxSheet) write(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	buf.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	// The header row stays in view.
+	buf.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	if len(s.widths) > 0 {
+		buf.WriteString("<cols>")
+		for i, width := range s.widths {
+			fmt.Fprintf(&buf, `<col min="%d" max="%d" width="%g" customWidth="1"/>`, i+1, i+1, width)
+		}
+		buf.WriteString("</cols>")
+	}
+	buf.WriteString("<sheetData>")
+	for i, cells := range s.rows {
+		fmt.Fprintf(&buf, `<row r="%d">`, i+1)
+		for j, cell := range cells {
+			ref := xlsxRef(j, i+1)
+			if str, ok := cell.Value.(string); ok && cell.Formula == "" {
+				fmt.Fprintf(&buf, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, cell.Style, xlsxEscape(str))
+				continue
+			}
+			fmt.Fprintf(&buf, `<c r="%s" s="%d">`, ref, cell.Style)
+			if cell.Formula != "" {
+				fmt.Fprintf(&buf, "<f>%s</f>", xlsxEscape(cell.Formula))
+			}
+			if v, ok := xlsxNumber(cell.Value); ok {
+				fmt.Fprintf(&buf, "<v>%s</v>", v)
+			}
+			buf.WriteString("</c>")
+		}
+		buf.WriteString("</row>")
+	}
+	buf.WriteString("</sheetData></worksheet>")
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// write writes the workbook as an .xlsx file.
+func (wb *xlsxWorkbook) write(w io.Writer) error {
+	var contentTypes, sheets, rels bytes.Buffer
+	for i, s := range wb.sheets {
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+		fmt.Fprintf(&sheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xlsxEscape(s.name), i+1, i+1)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, len(wb.sheets)+1)
+
+	const header = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
+	parts := []struct {
+		name, content string
+	}{
+		{"[Content_Types].xml", header +
+			`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			contentTypes.String() + `</Types>`},
+		{"_rels/.rels", header +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", header +
+			`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets>` + sheets.String() + `</sheets><calcPr fullCalcOnLoad="1"/></workbook>`},
+		{"xl/_rels/workbook.xml.rels", header +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			rels.String() + `</Relationships>`},
+		{"xl/styles.xml", xlsxStyles},
+	}
+
+	zw := zip.NewWriter(w)
+	for _, part := range parts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return err
+		}
+	}
+	for i, s := range wb.sheets {
+		f, err := zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return err
+		}
+		if err := s.write(f); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}